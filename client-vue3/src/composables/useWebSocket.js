@@ -109,16 +109,18 @@ export function useWebSocket() {
         wsUrl.protocol = location.protocol === 'https:' ? 'wss:' : 'ws:'
         wsUrl.port = location.port
         if (response.data.auth) {
-          if (authCode.value) {
-            wsUrl.searchParams.set('auth', authCode.value)
-          } else {
+          if (!authCode.value) {
             authCodeDialog.value = true
             return
           }
         }
         wsUrl.searchParams.set('room', room.value)
         const ws = new WebSocket(wsUrl)
-        ws.onopen = () => resolve(ws)
+        ws.onopen = () => {
+          // 通过第一帧发送认证令牌，避免令牌出现在 URL 中
+          if (response.data.auth) ws.send(JSON.stringify({ type: 'auth', token: authCode.value }))
+          resolve(ws)
+        }
         ws.onerror = reject
       })
     }).then((ws) => {
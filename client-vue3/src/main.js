@@ -34,6 +34,7 @@ const globalState = reactive({
     websocketConnecting: false,
     authCode: localStorage.getItem('auth') || '',
     authCodeDialog: false,
+    csrfToken: '', // 单点登录会话的 CSRF 令牌
     room: '',
     roomInput: '',
     roomDialog: false,
@@ -55,6 +56,8 @@ app.provide('globalState', globalState)
 axios.interceptors.request.use(config => {
     if (globalState.authCode) {
         config.headers.Authorization = `Bearer ${globalState.authCode}`
+    } else if (globalState.csrfToken) {
+        config.headers['X-CSRF-Token'] = globalState.csrfToken
     }
     return config
 })
@@ -36,6 +36,7 @@ const globalState = reactive({
     connected: false, // PWA: 连接状态
     authCode: localStorage.getItem('auth') || '',
     authCodeDialog: false,
+    csrfToken: '', // 单点登录会话的 CSRF 令牌
     room: '',
     roomInput: '',
     roomDialog: false,
@@ -57,6 +58,8 @@ app.provide('globalState', globalState)
 axios.interceptors.request.use(config => {
     if (globalState.authCode) {
         config.headers.Authorization = `Bearer ${globalState.authCode}`
+    } else if (globalState.csrfToken) {
+        config.headers['X-CSRF-Token'] = globalState.csrfToken
     }
     return config
 })
@@ -0,0 +1,211 @@
+package lib
+
+/**
+*** FILE: access.go
+***   handle IP allow/deny lists, private-networks-only mode and per-room overrides
+**/
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// accessPolicy 由 AccessRule 解析得到的访问策略
+type accessPolicy struct {
+	allow       []*net.IPNet
+	deny        []*net.IPNet
+	privateOnly bool
+}
+
+func newAccessPolicy(rule AccessRule) (*accessPolicy, error) {
+	allow, err := parseCIDRList(rule.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRList(rule.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &accessPolicy{allow: allow, deny: deny, privateOnly: rule.PrivateOnly}, nil
+}
+
+// isPrivateIP 判断是否为私有、回环或链路本地地址
+func isPrivateIP(ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	return ip != nil && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast())
+}
+
+// permits 判断 IP 是否被允许：拒绝列表优先；配置了允许列表或仅限私有网络时，只允许命中其一的地址
+func (p *accessPolicy) permits(ip string) bool {
+	if ipInNets(ip, p.deny) {
+		return false
+	}
+	if len(p.allow) == 0 && !p.privateOnly {
+		return true
+	}
+	return ipInNets(ip, p.allow) || (p.privateOnly && isPrivateIP(ip))
+}
+
+// accessControl 全局策略及各房间的覆盖策略
+type accessControl struct {
+	global *accessPolicy
+	rooms  map[string]*accessPolicy
+}
+
+func newAccessControl(cfg AccessConfig) (*accessControl, error) {
+	global, err := newAccessPolicy(cfg.AccessRule)
+	if err != nil {
+		return nil, err
+	}
+	ac := &accessControl{global: global, rooms: make(map[string]*accessPolicy)}
+	for room, rule := range cfg.Rooms {
+		policy, err := newAccessPolicy(rule)
+		if err != nil {
+			return nil, fmt.Errorf("房间 '%s': %w", room, err)
+		}
+		ac.rooms[normalizeRoomName(room)] = policy
+	}
+	return ac, nil
+}
+
+// permitsRoom 按房间的覆盖策略 (没有则按全局策略) 判断
+func (ac *accessControl) permitsRoom(ip string, room string) bool {
+	if policy, ok := ac.rooms[normalizeRoomName(room)]; ok {
+		return policy.permits(ip)
+	}
+	return ac.global.permits(ip)
+}
+
+// ipPermitsRoom 判断客户端 IP 是否被房间的访问策略允许
+func (s *ClipboardServer) ipPermitsRoom(r *http.Request, room string) bool {
+	return s.access == nil || s.access.permitsRoom(get_remote_ip(r), room)
+}
+
+// permitsAny 不属于任何房间的请求 (静态文件、/server、/login 等)：全局策略或任一房间的覆盖策略允许即可
+func (ac *accessControl) permitsAny(ip string) bool {
+	if ac.global.permits(ip) {
+		return true
+	}
+	for _, policy := range ac.rooms {
+		if policy.permits(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// roomScopedPaths 这些路径的请求属于某个房间 (未指定时为默认房间)
+var roomScopedPaths = []string{"/push", "/text", "/upload", "/revoke/", "/content/", "/file/", "/folder/", "/bundle", "/expire/", "/share/"}
+
+// resourceRoom 返回请求路径所指资源 (文件、文件夹、上传会话或消息) 实际所属的房间
+// found 为 false 表示路径不指向具体资源或资源不存在
+func (s *ClipboardServer) resourceRoom(path string) (room string, found bool) {
+	key := func(prefix string) string {
+		if !strings.HasPrefix(path, prefix) {
+			return ""
+		}
+		return strings.SplitN(strings.TrimPrefix(path, prefix), "/", 2)[0]
+	}
+	fileRoom := func(uuid string) (string, bool) {
+		s.runMutex.Lock()
+		defer s.runMutex.Unlock()
+		fileInfo, ok := s.uploadFileMap[uuid]
+		return fileInfo.Room, ok
+	}
+	for _, prefix := range []string{"/file/", "/upload/chunk/", "/upload/finish/", "/upload/tus/"} {
+		if uuid := key(prefix); uuid != "" {
+			return fileRoom(uuid)
+		}
+	}
+	if uuid := key("/upload/cancel/"); uuid != "" {
+		if task, ok := s.fetchTasks.Load(uuid); ok {
+			return task.(*fetchTask).room, true
+		}
+		if upload, ok := s.lookupFolderUpload(uuid); ok {
+			return upload.Room, true
+		}
+		return fileRoom(uuid)
+	}
+	if uuid := key("/upload/folder/"); uuid != "" {
+		if upload, ok := s.lookupFolderUpload(uuid); ok {
+			return upload.Room, true
+		}
+		return "", false
+	}
+	if uuid := key("/folder/"); uuid != "" {
+		if folder, ok := s.lookupFolder(uuid); ok {
+			return folder.Room, true
+		}
+		return "", false
+	}
+	for _, prefix := range []string{"/content/", "/revoke/", "/expire/", "/share/"} {
+		if idStr := key(prefix); idStr != "" {
+			id, err := strconv.Atoi(strings.TrimSuffix(idStr, ".json"))
+			if err != nil {
+				return "", false
+			}
+			// 消息 ID 全局唯一
+			s.messageQueue.Lock()
+			defer s.messageQueue.Unlock()
+			for _, msg := range s.messageQueue.List {
+				if msg.Data.ID() == id {
+					return msg.Data.Room(), true
+				}
+			}
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// requestRoom 返回请求所属的房间；scoped 为 false 表示请求不属于任何房间
+// 指向具体资源的请求按资源实际所属的房间判断，不采用查询参数中的 room
+func (s *ClipboardServer) requestRoom(r *http.Request) (room string, scoped bool) {
+	path := strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix)
+	for _, p := range roomScopedPaths {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			scoped = true
+			break
+		}
+	}
+	if !scoped {
+		return "", false
+	}
+	if room, found := s.resourceRoom(path); found {
+		return room, true
+	}
+	// 创建类请求及资源不存在的请求 (处理函数会返回 404)；
+	// 涉及多个房间的请求 (如 /bundle、/content/latest) 由处理函数对每条消息调用 canAccessRoom
+	if room = r.URL.Query().Get("room"); room != "" {
+		return room, true
+	}
+	return "default", true
+}
+
+// accessMiddleware 在所有处理函数 (包括静态文件和 /push) 之前按客户端 IP 检查访问策略
+func (s *ClipboardServer) accessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := get_remote_ip(r)
+		room, scoped := s.requestRoom(r)
+		var permitted bool
+		switch {
+		case scoped:
+			permitted = s.access.permitsRoom(ip, room)
+		case strings.HasPrefix(r.URL.Path, s.config.Server.Prefix+"/admin/"):
+			// 管理接口不受房间覆盖策略影响
+			permitted = s.access.global.permits(ip)
+		default:
+			permitted = s.access.permitsAny(ip)
+		}
+		if !permitted {
+			s.logf(logHTTP, slog.LevelInfo, "访问被拒绝: IP %s 不在允许的网络范围内, 房间: '%s', 路径: %s", ip, room, r.URL.Path)
+			writeJSONError(w, http.StatusForbidden, "Forbidden", "该地址不允许访问")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
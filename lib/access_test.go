@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAccessPolicyPermits(t *testing.T) {
+	tests := []struct {
+		name string
+		rule AccessRule
+		ip   string
+		want bool
+	}{
+		{"no rules", AccessRule{}, "203.0.113.5", true},
+		{"allow list hit", AccessRule{Allow: []string{"203.0.113.0/24"}}, "203.0.113.5", true},
+		{"allow list miss", AccessRule{Allow: []string{"203.0.113.0/24"}}, "198.51.100.1", false},
+		{"single address", AccessRule{Allow: []string{"203.0.113.5"}}, "203.0.113.5", true},
+		{"deny over allow", AccessRule{Allow: []string{"203.0.113.0/24"}, Deny: []string{"203.0.113.5"}}, "203.0.113.5", false},
+		{"deny only", AccessRule{Deny: []string{"203.0.113.0/24"}}, "198.51.100.1", true},
+		{"deny over private only", AccessRule{PrivateOnly: true, Deny: []string{"192.168.1.0/24"}}, "192.168.1.10", false},
+		{"private only private", AccessRule{PrivateOnly: true}, "192.168.1.10", true},
+		{"private only loopback", AccessRule{PrivateOnly: true}, "::1", true},
+		{"private only link local", AccessRule{PrivateOnly: true}, "fe80::1", true},
+		{"private only public", AccessRule{PrivateOnly: true}, "203.0.113.5", false},
+		{"private only or allow list", AccessRule{PrivateOnly: true, Allow: []string{"203.0.113.5"}}, "203.0.113.5", true},
+		{"invalid address", AccessRule{PrivateOnly: true}, "not-an-ip", false},
+	}
+	for _, tt := range tests {
+		p, err := newAccessPolicy(tt.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := p.permits(tt.ip); got != tt.want {
+			t.Errorf("%s: permits(%s) = %v, want %v", tt.name, tt.ip, got, tt.want)
+		}
+	}
+	if _, err := newAccessPolicy(AccessRule{Allow: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+}
+
+// 房间的覆盖策略完全取代全局策略，不属于房间的请求只要全局或任一房间允许即可
+func TestAccessControlRoomOverrides(t *testing.T) {
+	ac, err := newAccessControl(AccessConfig{
+		AccessRule: AccessRule{PrivateOnly: true},
+		Rooms: map[string]AccessRule{
+			"public": {},
+			"":       {Allow: []string{"198.51.100.0/24"}}, // 默认房间
+			"lab":    {Deny: []string{"192.168.1.0/24"}, PrivateOnly: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		room string
+		ip   string
+		want bool
+	}{
+		{"public", "203.0.113.5", true},
+		{"default", "198.51.100.7", true},
+		{"default", "192.168.1.10", false},
+		{"lab", "192.168.1.10", false},
+		{"lab", "10.0.0.1", true},
+		{"other", "10.0.0.1", true}, // 没有覆盖策略的房间使用全局策略
+		{"other", "203.0.113.5", false},
+	}
+	for _, tt := range tests {
+		if got := ac.permitsRoom(tt.ip, tt.room); got != tt.want {
+			t.Errorf("permitsRoom(%s, %q) = %v, want %v", tt.ip, tt.room, got, tt.want)
+		}
+	}
+	if !ac.permitsAny("203.0.113.5") {
+		t.Error("permitsAny: address allowed by a room override was rejected")
+	}
+
+	strict, _ := newAccessControl(AccessConfig{AccessRule: AccessRule{PrivateOnly: true}, Rooms: map[string]AccessRule{"lab": {Allow: []string{"198.51.100.0/24"}}}})
+	if strict.permitsAny("203.0.113.5") {
+		t.Error("permitsAny: address allowed by no policy was accepted")
+	}
+}
+
+// 指向具体资源的请求按资源所属的房间检查，不能通过 ?room= 借用其他房间的策略
+func TestAccessMiddlewareResourceRoom(t *testing.T) {
+	s, ts := newTestServer(t, func(cfg *Config) {
+		cfg.Access = AccessConfig{
+			AccessRule: AccessRule{Deny: []string{"192.0.2.1"}},
+			Rooms:      map[string]AccessRule{"lab": {Allow: []string{"198.51.100.0/24"}}},
+		}
+	})
+	// 测试服务器的地址是默认的受信任代理，X-Forwarded-For 即客户端地址
+	lab := []string{"X-Forwarded-For", "198.51.100.7"}
+	outside := []string{"X-Forwarded-For", "203.0.113.5"}
+	denied := []string{"X-Forwarded-For", "192.0.2.1"}
+
+	id := uploadFile(t, ts, "?room=lab", "lab.txt", []byte("lab data"), lab...)
+	uuid := messageFile(s, id)
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers []string
+		want    int
+	}{
+		{"lab file from lab network", http.MethodGet, "/file/" + uuid, lab, http.StatusOK},
+		{"lab file from outside", http.MethodGet, "/file/" + uuid, outside, http.StatusForbidden},
+		{"lab file with other room parameter", http.MethodGet, "/file/" + uuid + "?room=default", outside, http.StatusForbidden},
+		{"lab message with other room parameter", http.MethodGet, "/content/" + id + "?room=default", outside, http.StatusForbidden},
+		{"lab message from lab network", http.MethodGet, "/content/" + id + "?room=lab", lab, http.StatusOK},
+		{"upload to lab from outside", http.MethodPost, "/upload?room=lab", outside, http.StatusForbidden},
+		{"default room from outside", http.MethodPost, "/text", outside, http.StatusOK},
+		{"unscoped path from outside", http.MethodGet, "/server", outside, http.StatusOK},
+		{"denied address", http.MethodGet, "/server", denied, http.StatusForbidden},
+		{"denied address in default room", http.MethodPost, "/text", denied, http.StatusForbidden},
+		{"admin from lab network", http.MethodGet, "/admin/lockouts", lab, http.StatusOK},
+		{"admin from denied address", http.MethodGet, "/admin/lockouts", denied, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if resp, data := doRequest(t, tt.method, ts.URL+tt.path, strings.NewReader("hi"), tt.headers...); resp.StatusCode != tt.want {
+			t.Errorf("%s: %s %s, want %d", tt.name, resp.Status, data, tt.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package lib
+
+/**
+*** FILE: archive.go
+***   handle zip and tar.gz archives written directly to the response, entry by entry
+**/
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"time"
+)
+
+// archiveContentTypes 支持的归档格式及其 Content-Type
+var archiveContentTypes = map[string]string{
+	"zip":    "application/zip",
+	"tar.gz": "application/gzip",
+}
+
+// archiveWriter 逐个写入归档条目，写完后必须调用 Close
+type archiveWriter interface {
+	add(name string, size int64, modified time.Time, r io.Reader) error
+	Close() error
+}
+
+// newArchiveWriter 创建写入 w 的归档，format 为 zip 或 tar.gz
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case "zip":
+		return &zipArchive{zw: zip.NewWriter(w)}, nil
+	case "tar.gz":
+		gz := gzip.NewWriter(w)
+		return &tarGzArchive{gz: gz, tw: tar.NewWriter(gz)}, nil
+	}
+	return nil, fmt.Errorf("不支持的归档格式 '%s'，可选 zip 或 tar.gz", format)
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) add(name string, size int64, modified time.Time, r io.Reader) error {
+	fw, err := a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(fw, r, size)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarGzArchive) add(name string, size int64, modified time.Time, r io.Reader) error {
+	header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: size, ModTime: modified}
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.CopyN(a.tw, r, size)
+	return err
+}
+
+func (a *tarGzArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
@@ -0,0 +1,198 @@
+package lib
+
+/**
+*** FILE: audit.go
+***   handle the append-only JSONL audit log and its query endpoint
+**/
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 审计动作
+const (
+	auditSend        = "send"
+	auditUpdate      = "update"
+	auditRevoke      = "revoke"
+	auditClear       = "clear"
+	auditUpload      = "upload"
+	auditDownload    = "download"
+	auditDeleteFile  = "delete_file"
+	auditExpire      = "expire"
+	auditQuarantine  = "quarantine"
+	auditAuthFailure = "auth_failure"
+)
+
+// AuditEntry 审计日志中的一条记录
+type AuditEntry struct {
+	Time      int64             `json:"ts"`
+	Action    string            `json:"action"`
+	IP        string            `json:"ip"`
+	Device    map[string]string `json:"device,omitempty"`
+	Actor     string            `json:"actor"` // 认证方式: none, password, token, session, share
+	TokenID   string            `json:"tokenId,omitempty"`
+	User      string            `json:"user,omitempty"` // 单点登录用户或令牌名称
+	Room      string            `json:"room,omitempty"`
+	MessageID int               `json:"messageId,omitempty"`
+	File      string            `json:"file,omitempty"` // 文件 UUID
+	Detail    string            `json:"detail,omitempty"`
+}
+
+// initAuditLog 打开审计日志文件，未启用时不做任何事
+func (s *ClipboardServer) initAuditLog() error {
+	cfg := s.config.Audit
+	if !cfg.Enabled {
+		return nil
+	}
+	path := cfg.File
+	if path == "" {
+		path = s.storagePath("audit.jsonl")
+	}
+	writer, err := newRotatingWriter(path, cfg.MaxSize, cfg.MaxFiles)
+	if err != nil {
+		return err
+	}
+	s.auditLog = writer
+	s.logf(logServer, slog.LevelInfo, "审计日志: %s", path)
+	return nil
+}
+
+// audit 记录一条审计日志，身份信息取自请求上下文
+func (s *ClipboardServer) audit(r *http.Request, action string, room string, messageID int, file string, detail string) {
+	if s.auditLog == nil {
+		return
+	}
+	entry := AuditEntry{
+		Time:      time.Now().Unix(),
+		Action:    action,
+		IP:        get_remote_ip(r),
+		Device:    s.parse_user_agent(r.UserAgent()),
+		Actor:     "anonymous",
+		Room:      room,
+		MessageID: messageID,
+		File:      file,
+		Detail:    detail,
+	}
+	if info := authFromRequest(r); info != nil {
+		entry.Actor = info.Method
+		entry.TokenID = info.TokenID
+		entry.User = info.Name
+		if info.User != "" {
+			entry.User = info.User
+		}
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if _, err := s.auditLog.Write(append(data, '\n')); err != nil {
+		s.logf(logServer, slog.LevelError, "写入审计日志时出错: %v", err)
+	}
+}
+
+// auditFilter 审计日志查询条件
+type auditFilter struct {
+	action, room, ip, actor, file string
+	messageID                     int
+	since, until                  int64
+}
+
+func (f auditFilter) match(e *AuditEntry) bool {
+	switch {
+	case f.action != "" && e.Action != f.action,
+		f.room != "" && normalizeRoomName(e.Room) != normalizeRoomName(f.room),
+		f.ip != "" && e.IP != f.ip,
+		f.actor != "" && e.Actor != f.actor && e.User != f.actor && e.TokenID != f.actor,
+		f.file != "" && e.File != f.file,
+		f.messageID != 0 && e.MessageID != f.messageID,
+		f.since > 0 && e.Time < f.since,
+		f.until > 0 && e.Time > f.until:
+		return false
+	}
+	return true
+}
+
+// handleAudit 查询审计日志 (GET /admin/audit?action=&room=&ip=&actor=&id=&file=&since=&until=&limit=)，需要 admin 权限
+// 结果按时间从新到旧排列
+func (s *ClipboardServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "仅允许 GET 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.auditLog == nil {
+		writeJSONError(w, http.StatusNotFound, "NotFound", "审计日志未启用")
+		return
+	}
+
+	q := r.URL.Query()
+	filter := auditFilter{
+		action: q.Get("action"),
+		room:   q.Get("room"),
+		ip:     q.Get("ip"),
+		actor:  q.Get("actor"),
+		file:   q.Get("file"),
+	}
+	filter.messageID, _ = strconv.Atoi(q.Get("id"))
+	filter.since, _ = strconv.ParseInt(q.Get("since"), 10, 64)
+	filter.until, _ = strconv.ParseInt(q.Get("until"), 10, 64)
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+
+	entries := make([]AuditEntry, 0)
+	for _, path := range s.auditLog.files() {
+		matched, err := readAuditFile(path, filter)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				s.logf(logServer, slog.LevelWarn, "读取审计日志 %s 时出错: %v", path, err)
+			}
+			continue
+		}
+		// 单个文件内按从新到旧追加
+		for i := len(matched) - 1; i >= 0 && len(entries) < limit; i-- {
+			entries = append(entries, matched[i])
+		}
+		if len(entries) >= limit {
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": entries,
+		"count":   len(entries),
+	})
+}
+
+// readAuditFile 读取单个审计日志文件中匹配的记录，按写入顺序返回
+func readAuditFile(path string, filter auditFilter) ([]AuditEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var matched []AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if filter.match(&entry) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched, scanner.Err()
+}
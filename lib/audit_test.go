@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditFilterMatch(t *testing.T) {
+	entry := &AuditEntry{Time: 1000, Action: auditDownload, IP: "192.0.2.1", Actor: "token", TokenID: "t1", User: "ci",
+		Room: "", MessageID: 7, File: "uuid-1"}
+	tests := []struct {
+		name   string
+		filter auditFilter
+		want   bool
+	}{
+		{"empty", auditFilter{}, true},
+		{"action", auditFilter{action: auditDownload}, true},
+		{"other action", auditFilter{action: auditUpload}, false},
+		{"default room", auditFilter{room: "default"}, true},
+		{"other room", auditFilter{room: "a"}, false},
+		{"ip", auditFilter{ip: "192.0.2.1"}, true},
+		{"other ip", auditFilter{ip: "192.0.2.2"}, false},
+		{"actor method", auditFilter{actor: "token"}, true},
+		{"actor token id", auditFilter{actor: "t1"}, true},
+		{"actor user", auditFilter{actor: "ci"}, true},
+		{"other actor", auditFilter{actor: "password"}, false},
+		{"file", auditFilter{file: "uuid-1"}, true},
+		{"other file", auditFilter{file: "uuid-2"}, false},
+		{"message id", auditFilter{messageID: 7}, true},
+		{"other message id", auditFilter{messageID: 8}, false},
+		{"since inclusive", auditFilter{since: 1000}, true},
+		{"after since", auditFilter{since: 1001}, false},
+		{"until inclusive", auditFilter{until: 1000}, true},
+		{"before until", auditFilter{until: 999}, false},
+		{"all conditions", auditFilter{action: auditDownload, room: "default", ip: "192.0.2.1", actor: "ci", file: "uuid-1", messageID: 7, since: 900, until: 1100}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.match(entry); got != tt.want {
+			t.Errorf("%s: match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// 损坏的行被跳过，不影响其他记录
+func TestReadAuditFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	lines := []string{
+		`{"ts":1,"action":"send","room":"a"}`,
+		`{"ts":2,"action":`,
+		`not json`,
+		`{"ts":3,"action":"upload","room":"a"}`,
+		`{"ts":4,"action":"send","room":"b"}`,
+	}
+	os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	entries, err := readAuditFile(path, auditFilter{room: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Time != 1 || entries[1].Time != 3 {
+		t.Errorf("entries = %+v", entries)
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	_, ts := newTestServer(t, func(cfg *Config) { cfg.Audit.Enabled = true })
+	for _, room := range []string{"a", "a", "b"} {
+		if resp, data := doRequest(t, http.MethodPost, ts.URL+"/text?room="+room, strings.NewReader("hi")); resp.StatusCode != http.StatusOK {
+			t.Fatalf("post: %s %s", resp.Status, data)
+		}
+	}
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"action=send", 3},
+		{"action=send&room=a", 2},
+		{"action=send&limit=1", 1},
+		{"action=send&ip=192.0.2.1", 0},
+	}
+	for _, tt := range tests {
+		resp, data := doRequest(t, http.MethodGet, ts.URL+"/admin/audit?"+tt.query, nil)
+		var result struct {
+			Entries []AuditEntry `json:"entries"`
+			Count   int          `json:"count"`
+		}
+		json.Unmarshal(data, &result)
+		if resp.StatusCode != http.StatusOK || result.Count != tt.want || len(result.Entries) != tt.want {
+			t.Errorf("%s: %s count %d, want %d", tt.query, resp.Status, result.Count, tt.want)
+		}
+		// 结果按时间从新到旧排列
+		for i := 1; i < len(result.Entries); i++ {
+			if result.Entries[i].Time > result.Entries[i-1].Time {
+				t.Errorf("%s: entries not newest first", tt.query)
+			}
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package lib
+
+/**
+*** FILE: auth.go
+***   handle request identity and permission scopes
+**/
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 权限范围
+const (
+	scopeRead   = "read"
+	scopeWrite  = "write"
+	scopeDelete = "delete"
+	scopeAdmin  = "admin" // admin 包含所有权限
+)
+
+var validScopes = map[string]bool{
+	scopeRead:   true,
+	scopeWrite:  true,
+	scopeDelete: true,
+	scopeAdmin:  true,
+}
+
+// authInfo 描述一个请求的认证身份，由认证中间件写入请求上下文
+type authInfo struct {
+	Method    string   // "none"(未启用认证), "password", "token", "session", "share", "cert"，创建会话时还可以是 "oidc"
+	TokenID   string   // API 令牌 ID
+	Name      string   // 令牌名称
+	Scopes    []string // 拥有的权限范围
+	Room      string   // 房间限制，空字符串表示不限制
+	SessionID string   // 登录会话 ID (哈希)
+	User      string   // 单点登录用户 (邮箱或 subject)
+}
+
+func (a *authInfo) hasScope(scope string) bool {
+	if a.Method == "none" || a.Method == "password" {
+		return true
+	}
+	for _, sc := range a.Scopes {
+		if sc == scope || sc == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+type authContextKey struct{}
+
+func withAuthInfo(r *http.Request, info *authInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), authContextKey{}, info))
+}
+
+// authFromRequest 获取请求的认证身份，未经过认证中间件时返回 nil
+func authFromRequest(r *http.Request) *authInfo {
+	info, _ := r.Context().Value(authContextKey{}).(*authInfo)
+	return info
+}
+
+// scopeForMethod 根据请求方法推断所需的权限范围
+func scopeForMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return scopeRead
+	case http.MethodDelete:
+		return scopeDelete
+	default:
+		return scopeWrite
+	}
+}
+
+// authPassword 返回配置的访问密码，以及是否需要认证
+// 启用 OIDC 时总是需要认证，共享密码只有在 oidc.allowPassword 为 true 时才可用
+func (s *ClipboardServer) authPassword() (string, bool) {
+	if s.config.OIDC.Enabled {
+		if !s.config.OIDC.AllowPassword {
+			return "", true
+		}
+		if password, ok := s.configuredPassword(); ok {
+			return password, true
+		}
+		return "", true
+	}
+	return s.configuredPassword()
+}
+
+// configuredPassword 返回 server.auth 中配置的密码
+func (s *ClipboardServer) configuredPassword() (string, bool) {
+	// 处理所有可能的类型：string、bool、int、float64
+	switch auth := s.config.Server.Auth.(type) {
+	case string:
+		if auth != "" {
+			return auth, true
+		}
+	case bool:
+		// bool true 的情况已在 NewClipboardServer 中处理为随机密码
+		if auth {
+			return "", true
+		}
+	case int:
+		return strconv.Itoa(auth), true
+	case float64:
+		return strconv.FormatFloat(auth, 'f', 0, 64), true
+	}
+	return "", false
+}
+
+// tokenFromRequest 获取认证令牌 - 先检查 Authorization 头，再检查查询参数
+func tokenFromRequest(r *http.Request) string {
+	token := ""
+	authHeader := r.Header.Get("Authorization")
+	if authHeader != "" {
+		parts := strings.Split(authHeader, " ")
+		if len(parts) == 2 && strings.ToLower(parts[0]) == "bearer" {
+			token = parts[1]
+		} else {
+			// 尝试将整个头部作为令牌（向后兼容）
+			token = authHeader
+		}
+	}
+	if token == "" {
+		token = r.URL.Query().Get("auth")
+	}
+	return token
+}
+
+// credentialFromRequest 获取请求携带的凭据：先检查 Authorization 头和 auth 查询参数，再检查会话 Cookie
+// viaCookie 表示凭据来自 Cookie，此时修改类请求需要通过 CSRF 校验
+func credentialFromRequest(r *http.Request) (token string, viaCookie bool) {
+	if token = tokenFromRequest(r); token != "" {
+		return token, false
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// verifyCredential 校验会话令牌、API 令牌或访问密码，并检查权限范围和房间限制
+// 校验通过时 status 为 0；否则返回对应的 HTTP 状态码和错误信息，失败已记录日志
+func (s *ClipboardServer) verifyCredential(r *http.Request, token string, requiredScope string) (info *authInfo, status int, message string) {
+	clientIP := get_remote_ip(r)
+	certInfo := s.clientCertAuth(r)
+	if token == "" && certInfo == nil {
+		s.logf(logAuth, slog.LevelInfo, "认证失败: 未提供令牌。来自 IP: %s, 路径: %s", clientIP, r.URL.Path)
+		return nil, http.StatusUnauthorized, "需要认证令牌"
+	}
+
+	switch {
+	case token == "":
+		// 已通过校验的客户端证书无需密码
+		info = certInfo
+	case strings.HasPrefix(token, sessionTokenPrefix):
+		sess, forged := s.lookupSession(token)
+		if sess == nil {
+			s.logf(logAuth, slog.LevelInfo, "认证失败: 会话无效或已过期。来自 IP: %s, 路径: %s", clientIP, r.URL.Path)
+			if forged {
+				s.authFailed(r)
+			}
+			return nil, http.StatusUnauthorized, "会话无效或已过期"
+		}
+		info = sess.authInfo()
+	default:
+		var found, expired bool
+		if info, found, expired = s.lookupAPIToken(token); found && expired {
+			s.logf(logAuth, slog.LevelInfo, "认证失败: API 令牌已过期。来自 IP: %s, 路径: %s", clientIP, r.URL.Path)
+			return nil, http.StatusUnauthorized, "认证令牌已过期"
+		}
+		if !found {
+			expectedPassword, _ := s.authPassword()
+			if expectedPassword == "" && s.oidc != nil {
+				// 启用 OIDC 后不再接受共享密码
+				s.logf(logAuth, slog.LevelInfo, "认证失败: 无效令牌 (已启用 OIDC，共享密码不可用)。来自 IP: %s, 路径: %s", clientIP, r.URL.Path)
+				s.authFailed(r)
+				return nil, http.StatusUnauthorized, "无效的认证令牌"
+			}
+			if expectedPassword == "" {
+				s.logf(logAuth, slog.LevelInfo, "认证失败: 服务器认证配置错误。来自 IP: %s", clientIP)
+				return nil, http.StatusInternalServerError, "服务器认证配置错误"
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(expectedPassword)) != 1 {
+				// 不记录提供的令牌和期望的密码
+				s.logf(logAuth, slog.LevelInfo, "认证失败: 无效令牌。来自 IP: %s, 路径: %s", clientIP, r.URL.Path)
+				s.authFailed(r)
+				return nil, http.StatusUnauthorized, "无效的认证令牌"
+			}
+			info = &authInfo{Method: "password"}
+		}
+	}
+
+	if !info.hasScope(requiredScope) {
+		s.logf(logAuth, slog.LevelInfo, "认证失败: %s 缺少权限 %s。来自 IP: %s, 路径: %s", info.describe(), requiredScope, clientIP, r.URL.Path)
+		return nil, http.StatusForbidden, "令牌权限不足"
+	}
+	if room := r.URL.Query().Get("room"); info.Room != "" && room != "" && normalizeRoomName(room) != info.Room {
+		s.logf(logAuth, slog.LevelInfo, "认证失败: %s 无权访问房间 '%s'。来自 IP: %s", info.describe(), room, clientIP)
+		return nil, http.StatusForbidden, "令牌无权访问该房间"
+	}
+	s.logf(logAuth, slog.LevelDebug, "认证成功: %s, IP: %s, 路径: %s", info.describe(), clientIP, r.URL.Path)
+	s.authSucceeded(r)
+	return info, 0, ""
+}
+
+// describe 返回用于日志的身份描述，不包含任何凭据
+func (a *authInfo) describe() string {
+	switch {
+	case a.SessionID != "" && a.User != "":
+		return fmt.Sprintf("会话 %s (用户 %s)", a.SessionID[:8], a.User)
+	case a.SessionID != "" && a.TokenID != "":
+		return fmt.Sprintf("会话 %s (API 令牌 %s)", a.SessionID[:8], a.Name)
+	case a.SessionID != "":
+		return fmt.Sprintf("会话 %s", a.SessionID[:8])
+	case a.TokenID != "":
+		return fmt.Sprintf("API 令牌 %s (ID: %s)", a.Name, a.TokenID)
+	case a.Method == "cert":
+		return fmt.Sprintf("客户端证书 %s", a.Name)
+	}
+	return "密码"
+}
+
+// writeCredentialError 按 verifyCredential 返回的状态码写入 JSON 错误响应
+func writeCredentialError(w http.ResponseWriter, status int, message string) {
+	code := "Unauthorized"
+	switch status {
+	case http.StatusForbidden:
+		code = "Forbidden"
+	case http.StatusInternalServerError:
+		code = "ServerError"
+	}
+	writeJSONError(w, status, code, message)
+}
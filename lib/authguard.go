@@ -0,0 +1,231 @@
+package lib
+
+/**
+*** FILE: authguard.go
+***   handle brute-force protection: failed attempts, lockout and ban list
+**/
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authFailure 单个 IP 的认证失败记录
+type authFailure struct {
+	IP          string `json:"ip"`
+	Failures    int    `json:"failures"`    // 当前连续失败次数
+	Lockouts    int    `json:"lockouts"`    // 已触发的锁定次数，用于计算指数退避
+	LockedUntil int64  `json:"lockedUntil"` // 锁定截止时间 (Unix 时间戳)，0 表示未锁定
+	LastFailure int64  `json:"lastFailure"`
+}
+
+// authGuard 跟踪每个 IP 的认证失败次数
+type authGuard struct {
+	mu         sync.Mutex
+	cfg        AuthGuardConfig
+	bannedNets []*net.IPNet
+	failures   map[string]*authFailure
+	lastPrune  time.Time
+}
+
+func newAuthGuard(cfg AuthGuardConfig) (*authGuard, error) {
+	banned, err := parseCIDRList(cfg.BanList)
+	if err != nil {
+		return nil, err
+	}
+	return &authGuard{
+		cfg:        cfg,
+		bannedNets: banned,
+		failures:   make(map[string]*authFailure),
+		lastPrune:  time.Now(),
+	}, nil
+}
+
+const (
+	defaultLockoutMax = 24 * 3600 // 未设置 lockoutMax 时的锁定上限（秒）
+	maxLockoutShift   = 30        // 指数退避的最大翻倍次数，避免移位溢出
+)
+
+// lockoutMax 返回锁定时长上限（秒），未设置时使用一天
+func (g *authGuard) lockoutMax() int64 {
+	if g.cfg.LockoutMax > 0 {
+		return int64(g.cfg.LockoutMax)
+	}
+	return defaultLockoutMax
+}
+
+// resetAfter 返回多久没有失败后重置失败记录：锁定上限的两倍
+func (g *authGuard) resetAfter() int64 {
+	return g.lockoutMax() * 2
+}
+
+// pruneLocked 每分钟清理一次未锁定且长时间没有失败的记录，必须在 mu 锁定时调用
+func (g *authGuard) pruneLocked(now time.Time) {
+	if now.Sub(g.lastPrune) < time.Minute {
+		return
+	}
+	g.lastPrune = now
+	for ip, f := range g.failures {
+		if f.LockedUntil <= now.Unix() && now.Unix()-f.LastFailure > g.resetAfter() {
+			delete(g.failures, ip)
+		}
+	}
+}
+
+func (g *authGuard) banned(ip string) bool {
+	return ipInNets(ip, g.bannedNets)
+}
+
+// lockedFor 返回 IP 剩余的锁定时长，未锁定时返回 0
+func (g *authGuard) lockedFor(ip string, now time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.failures[ip]
+	if !ok || f.LockedUntil <= now.Unix() {
+		return 0
+	}
+	return time.Duration(f.LockedUntil-now.Unix()) * time.Second
+}
+
+// recordFailure 记录一次失败，达到阈值时按指数退避锁定，返回本次触发的锁定时长 (未触发为 0)
+func (g *authGuard) recordFailure(ip string, now time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pruneLocked(now)
+
+	f, ok := g.failures[ip]
+	if !ok {
+		f = &authFailure{IP: ip}
+		g.failures[ip] = f
+	}
+	// 长时间没有失败则重置退避
+	if f.LockedUntil <= now.Unix() && now.Unix()-f.LastFailure > g.resetAfter() {
+		f.Lockouts = 0
+		f.Failures = 0
+	}
+	f.Failures++
+	f.LastFailure = now.Unix()
+
+	if g.cfg.MaxFailures <= 0 || f.Failures < g.cfg.MaxFailures {
+		return 0
+	}
+
+	// 以秒计算并限制翻倍次数，锁定次数再多也不会溢出成负数
+	shift := f.Lockouts
+	if shift > maxLockoutShift {
+		shift = maxLockoutShift
+	}
+	seconds := int64(g.cfg.LockoutBase) << uint(shift)
+	if maxSeconds := g.lockoutMax(); seconds > maxSeconds || seconds < 0 {
+		seconds = maxSeconds
+	}
+	lockout := time.Duration(seconds) * time.Second
+	f.Lockouts++
+	f.Failures = 0
+	f.LockedUntil = now.Add(lockout).Unix()
+	return lockout
+}
+
+// recordSuccess 认证成功后清除失败次数 (保留退避级别直到长时间无失败)
+func (g *authGuard) recordSuccess(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.failures[ip]; ok {
+		f.Failures = 0
+		if f.Lockouts == 0 {
+			delete(g.failures, ip)
+		}
+	}
+}
+
+func (g *authGuard) unlock(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.failures[ip]
+	delete(g.failures, ip)
+	return ok
+}
+
+func (g *authGuard) snapshot() []authFailure {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	list := make([]authFailure, 0, len(g.failures))
+	for _, f := range g.failures {
+		list = append(list, *f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastFailure > list[j].LastFailure })
+	return list
+}
+
+// checkAuthGuard 在校验凭据之前检查 IP 是否被封禁或锁定，被拒绝时写入响应并返回 false
+func (s *ClipboardServer) checkAuthGuard(w http.ResponseWriter, r *http.Request) bool {
+	ip := get_remote_ip(r)
+	if s.authGuard.banned(ip) {
+		s.logf(logAuth, slog.LevelInfo, "认证拒绝: IP %s 在封禁列表中, 路径: %s", ip, r.URL.Path)
+		writeJSONError(w, http.StatusForbidden, "Forbidden", "该地址已被禁止访问")
+		return false
+	}
+	if remaining := s.authGuard.lockedFor(ip, time.Now()); remaining > 0 {
+		s.logf(logAuth, slog.LevelInfo, "认证拒绝: IP %s 处于锁定状态，剩余 %v, 路径: %s", ip, remaining, r.URL.Path)
+		w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds())))
+		writeJSONError(w, http.StatusTooManyRequests, "TooManyRequests", "认证失败次数过多，请稍后重试")
+		return false
+	}
+	return true
+}
+
+// authFailed 记录一次认证失败，必要时输出锁定事件
+func (s *ClipboardServer) authFailed(r *http.Request) {
+	ip := get_remote_ip(r)
+	s.audit(r, auditAuthFailure, r.URL.Query().Get("room"), 0, "", r.URL.Path)
+	if lockout := s.authGuard.recordFailure(ip, time.Now()); lockout > 0 {
+		s.logf(logAuth, slog.LevelInfo, "认证锁定: IP %s 连续认证失败 %d 次，锁定 %v", ip, s.config.AuthGuard.MaxFailures, lockout)
+	}
+}
+
+// authSucceeded 认证成功后清除失败记录
+func (s *ClipboardServer) authSucceeded(r *http.Request) {
+	s.authGuard.recordSuccess(get_remote_ip(r))
+}
+
+// handleLockouts 查看 (GET /admin/lockouts) 或解除 (DELETE /admin/lockouts/{ip}) 认证锁定，需要 admin 权限
+func (s *ClipboardServer) handleLockouts(w http.ResponseWriter, r *http.Request) {
+	ip := strings.Trim(strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/admin/lockouts"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && ip == "":
+		now := time.Now().Unix()
+		entries := s.authGuard.snapshot()
+		locked := 0
+		for _, e := range entries {
+			if e.LockedUntil > now {
+				locked++
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"entries": entries,
+			"locked":  locked,
+			"banList": s.config.AuthGuard.BanList,
+		})
+
+	case r.Method == http.MethodDelete && ip != "":
+		if !s.authGuard.unlock(ip) {
+			http.Error(w, "没有该 IP 的锁定记录", http.StatusNotFound)
+			return
+		}
+		s.logf(logAuth, slog.LevelInfo, "已解除 IP %s 的认证锁定, 操作来自: %s", ip, get_remote_ip(r))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "已解除锁定", "ip": ip})
+
+	default:
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+	}
+}
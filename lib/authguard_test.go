@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 每次锁定时长翻倍，不超过 lockoutMax
+func TestAuthGuardLockoutBackoff(t *testing.T) {
+	g, _ := newAuthGuard(AuthGuardConfig{MaxFailures: 3, LockoutBase: 60, LockoutMax: 200})
+	now := time.Now()
+	for _, want := range []time.Duration{60 * time.Second, 120 * time.Second, 200 * time.Second, 200 * time.Second} {
+		for i := 1; i < 3; i++ {
+			if lockout := g.recordFailure("192.0.2.1", now); lockout != 0 {
+				t.Fatalf("locked after %d failures", i)
+			}
+		}
+		if lockout := g.recordFailure("192.0.2.1", now); lockout != want {
+			t.Fatalf("lockout = %v, want %v", lockout, want)
+		}
+		if remaining := g.lockedFor("192.0.2.1", now); remaining != want {
+			t.Errorf("lockedFor = %v, want %v", remaining, want)
+		}
+		if remaining := g.lockedFor("192.0.2.2", now); remaining != 0 {
+			t.Errorf("other IP locked for %v", remaining)
+		}
+		now = now.Add(want)
+	}
+	if remaining := g.lockedFor("192.0.2.1", now); remaining != 0 {
+		t.Errorf("still locked after lockout: %v", remaining)
+	}
+}
+
+// 长时间没有失败后重置退避级别；认证成功只清除失败次数
+func TestAuthGuardReset(t *testing.T) {
+	g, _ := newAuthGuard(AuthGuardConfig{MaxFailures: 2, LockoutBase: 60, LockoutMax: 600})
+	now := time.Now()
+	g.recordFailure("192.0.2.1", now)
+	g.recordFailure("192.0.2.1", now)
+
+	g.recordSuccess("192.0.2.1")
+	if entries := g.snapshot(); len(entries) != 1 || entries[0].Lockouts != 1 {
+		t.Fatalf("success cleared backoff level: %+v", entries)
+	}
+	now = now.Add(1201 * time.Second)
+	g.recordFailure("192.0.2.1", now)
+	if lockout := g.recordFailure("192.0.2.1", now); lockout != 60*time.Second {
+		t.Errorf("lockout after quiet period = %v, want 60s", lockout)
+	}
+
+	g.recordFailure("192.0.2.3", now)
+	g.recordSuccess("192.0.2.3")
+	if entries := g.snapshot(); len(entries) != 1 {
+		t.Errorf("success kept failure record: %+v", entries)
+	}
+}
+
+// 未锁定且长时间没有失败的记录被清理，锁定中的记录保留
+func TestAuthGuardPrune(t *testing.T) {
+	g, _ := newAuthGuard(AuthGuardConfig{MaxFailures: 2, LockoutBase: 60})
+	now := time.Now()
+	g.recordFailure("192.0.2.1", now)
+	g.recordFailure("192.0.2.2", now)
+	g.recordFailure("192.0.2.2", now)
+	g.failures["192.0.2.2"].LockedUntil = now.Add(72 * time.Hour).Unix()
+
+	// 未设置上限时按一天的默认上限，两天没有失败后清理
+	g.recordFailure("192.0.2.3", now.Add(49*time.Hour))
+	if _, ok := g.failures["192.0.2.1"]; ok {
+		t.Error("idle record not pruned")
+	}
+	if _, ok := g.failures["192.0.2.2"]; !ok {
+		t.Error("locked record was pruned")
+	}
+	if _, ok := g.failures["192.0.2.3"]; !ok {
+		t.Error("new record missing")
+	}
+}
+
+// 锁定次数很多时锁定时长仍然为正且不超过上限，未设置上限时使用默认上限
+func TestAuthGuardLockoutClamped(t *testing.T) {
+	for _, cfg := range []AuthGuardConfig{
+		{MaxFailures: 1, LockoutBase: 60},
+		{MaxFailures: 1, LockoutBase: 60, LockoutMax: -1},
+		{MaxFailures: 1, LockoutBase: 60, LockoutMax: 3600},
+	} {
+		g, _ := newAuthGuard(cfg)
+		max := time.Duration(g.lockoutMax()) * time.Second
+		now := time.Now()
+		for i := 0; i < 100; i++ {
+			lockout := g.recordFailure("192.0.2.1", now)
+			if lockout <= 0 || lockout > max {
+				t.Fatalf("lockoutMax %d: lockout %d = %v, want (0, %v]", cfg.LockoutMax, i, lockout, max)
+			}
+			if i >= 20 && lockout != max {
+				t.Fatalf("lockoutMax %d: lockout %d = %v, want cap %v", cfg.LockoutMax, i, lockout, max)
+			}
+			now = now.Add(lockout)
+		}
+	}
+}
+
+// 错误的房间密钥计入认证失败，锁定后即使密钥正确也被拒绝
+func TestRoomKeyLockout(t *testing.T) {
+	_, ts := newTestServer(t, func(cfg *Config) {
+		cfg.AuthGuard = AuthGuardConfig{MaxFailures: 3, LockoutBase: 60, LockoutMax: 60}
+		cfg.Server.RoomList = true
+	})
+	resp, data := doRequest(t, http.MethodPost, ts.URL+"/rooms", strings.NewReader(`{"name":"secret","key":"room-key"}`))
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create room: %s %s", resp.Status, data)
+	}
+	// 没有携带密钥的请求不计入失败
+	for i := 0; i < 3; i++ {
+		if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/text?room=secret", strings.NewReader("hi")); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("request without key: %s", resp.Status)
+		}
+	}
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/rooms", nil, "X-Room-Key", "guess-1"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("room list with wrong key: %s", resp.Status)
+	}
+	for i := 2; i <= 3; i++ {
+		resp, _ := doRequest(t, http.MethodPost, ts.URL+"/text?room=secret", strings.NewReader("hi"), "X-Room-Key", "guess-"+strconv.Itoa(i))
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("wrong key %d: %s", i, resp.Status)
+		}
+	}
+	resp, _ = doRequest(t, http.MethodPost, ts.URL+"/text?room=secret", strings.NewReader("hi"), "X-Room-Key", "room-key")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("right key while locked: %s", resp.Status)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/rooms", nil, "X-Room-Key", "room-key"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("room list while locked: %s", resp.Status)
+	}
+}
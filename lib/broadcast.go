@@ -1,16 +1,37 @@
 package lib
 
 import (
+	"log/slog"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// wsWriteLockLocked 返回连接的写入锁，不存在时创建 (调用者需持有 runMutex)
+func (s *ClipboardServer) wsWriteLockLocked(conn *websocket.Conn) *sync.Mutex {
+	mu, ok := s.wsWriteLocks[conn]
+	if !ok {
+		mu = &sync.Mutex{}
+		s.wsWriteLocks[conn] = mu
+	}
+	return mu
+}
+
+// writeWebSocketJSON 在连接的写入锁内写入一条 JSON 消息
+// 处理函数、广播以及后台的服务器下载和上传进度可能同时写入同一连接，所有写入 (WriteControl 除外) 都必须经过这里
+func writeWebSocketJSON(conn *websocket.Conn, mu *sync.Mutex, v interface{}) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return conn.WriteJSON(v)
+}
+
 // broadcastMessageToRoomExcept 将消息广播到房间中的所有客户端，除了一个特定的连接。
 func (s *ClipboardServer) broadcastMessageToRoomExcept(message PostEvent, room string, exceptConn *websocket.Conn) {
-	// 第一步：在锁内收集需要发送的连接
+	// 第一步：在锁内收集需要发送的连接及其写入锁
 	var targetConnections []*websocket.Conn
+	var writeLocks []*sync.Mutex
 	s.runMutex.Lock()
 	for client, clientRoom := range s.room_ws {
 		if client == exceptConn {
@@ -18,15 +39,16 @@ func (s *ClipboardServer) broadcastMessageToRoomExcept(message PostEvent, room s
 		}
 		if room == "" || clientRoom == room {
 			targetConnections = append(targetConnections, client)
+			writeLocks = append(writeLocks, s.wsWriteLockLocked(client))
 		}
 	}
 	s.runMutex.Unlock()
 
 	// 第二步：在锁外进行网络操作
 	var failedConnections []*websocket.Conn
-	for _, client := range targetConnections {
-		if err := client.WriteJSON(message); err != nil {
-			s.logger.Printf("错误: 写入消息到 WebSocket 客户端 %s 失败: %v。计划移除客户端。", client.RemoteAddr(), err)
+	for i, client := range targetConnections {
+		if err := writeWebSocketJSON(client, writeLocks[i], message); err != nil {
+			s.logf(logWS, slog.LevelError, "错误: 写入消息到 WebSocket 客户端 %s 失败: %v。计划移除客户端。", client.RemoteAddr(), err)
 			failedConnections = append(failedConnections, client)
 		}
 	}
@@ -38,6 +60,7 @@ func (s *ClipboardServer) broadcastMessageToRoomExcept(message PostEvent, room s
 			client.Close()
 			delete(s.websockets, client)
 			delete(s.room_ws, client)
+			delete(s.wsWriteLocks, client)
 			if deviceID, ok := s.connDeviceIDMap[client]; ok {
 				delete(s.connDeviceIDMap, client)
 				delete(s.deviceConnected, deviceID)
@@ -50,23 +73,25 @@ func (s *ClipboardServer) broadcastMessageToRoomExcept(message PostEvent, room s
 // broadcastMessage 向所有连接的 WebSocket 客户端（可选地，特定房间）广播消息。
 // 这个方法需要是线程安全的，因为它会被多个 goroutine 调用。
 func (s *ClipboardServer) broadcastMessage(message PostEvent, room string) {
-	s.logger.Printf("广播消息 (ID: %d, 类型: %s) 到房间 '%s'", message.Data.ID(), message.Event, room)
+	s.logf(logWS, slog.LevelDebug, "广播消息 (ID: %d, 类型: %s) 到房间 '%s'", message.Data.ID(), message.Event, room)
 
-	// 第一步：在锁内收集需要发送的连接
+	// 第一步：在锁内收集需要发送的连接及其写入锁
 	var targetConnections []*websocket.Conn
+	var writeLocks []*sync.Mutex
 	s.runMutex.Lock()
 	for client, clientRoom := range s.room_ws {
 		if room == "" || clientRoom == room {
 			targetConnections = append(targetConnections, client)
+			writeLocks = append(writeLocks, s.wsWriteLockLocked(client))
 		}
 	}
 	s.runMutex.Unlock()
 
 	// 第二步：在锁外进行网络操作
 	var failedConnections []*websocket.Conn
-	for _, client := range targetConnections {
-		if err := client.WriteJSON(message); err != nil {
-			s.logger.Printf("错误: 写入消息到 WebSocket 客户端 %s 失败: %v。移除客户端。", client.RemoteAddr(), err)
+	for i, client := range targetConnections {
+		if err := writeWebSocketJSON(client, writeLocks[i], message); err != nil {
+			s.logf(logWS, slog.LevelError, "错误: 写入消息到 WebSocket 客户端 %s 失败: %v。移除客户端。", client.RemoteAddr(), err)
 			failedConnections = append(failedConnections, client)
 		}
 	}
@@ -78,6 +103,7 @@ func (s *ClipboardServer) broadcastMessage(message PostEvent, room string) {
 			client.Close()
 			delete(s.websockets, client)
 			delete(s.room_ws, client)
+			delete(s.wsWriteLocks, client)
 			if deviceID, ok := s.connDeviceIDMap[client]; ok {
 				delete(s.connDeviceIDMap, client)
 				delete(s.deviceConnected, deviceID)
@@ -102,6 +128,9 @@ func (s *ClipboardServer) addMessageToQueueAndBroadcast(dataType string, data in
 		SenderIP:     ip,
 		SenderDevice: ua,
 	}
+	if info := authFromRequest(r); info != nil {
+		receiveBase.SenderUser = info.User
+	}
 
 	// Create ReceiveHolder
 	var rh ReceiveHolder
@@ -111,7 +140,7 @@ func (s *ClipboardServer) addMessageToQueueAndBroadcast(dataType string, data in
 			ReceiveBase: receiveBase,
 			Content:     data.(string),
 		}
-	case "file":
+	case "file", "folder":
 		fileRec := data.(*FileReceive)
 		// Ensure FileReceive's own ReceiveBase is also populated if it's not already
 		// For now, assuming data.(*FileReceive) might already have its ReceiveBase fields set,
@@ -121,7 +150,7 @@ func (s *ClipboardServer) addMessageToQueueAndBroadcast(dataType string, data in
 		rh.FileReceive = fileRec
 	default:
 		// Handle unknown dataType if necessary, though current calls are "text" or "file"
-		s.logger.Printf("警告: addMessageToQueueAndBroadcast 收到未知数据类型: %s", dataType)
+		s.logf(logWS, slog.LevelWarn, "警告: addMessageToQueueAndBroadcast 收到未知数据类型: %s", dataType)
 		// Return an empty or error PostEvent
 		return PostEvent{}
 	}
@@ -156,23 +185,25 @@ func (s *ClipboardServer) addMessageToQueueAndBroadcast(dataType string, data in
 
 // broadcastWebSocketMessage 向所有连接的 WebSocket 客户端（可选地，特定房间）广播 WebSocketMessage。
 func (s *ClipboardServer) broadcastWebSocketMessage(message WebSocketMessage, room string) {
-	s.logger.Printf("广播 WebSocket 消消息 (类型: %s) 到房间 '%s'", message.Event, room)
+	s.logf(logWS, slog.LevelDebug, "广播 WebSocket 消消息 (类型: %s) 到房间 '%s'", message.Event, room)
 
-	// 第一步：在锁内收集需要发送的连接
+	// 第一步：在锁内收集需要发送的连接及其写入锁
 	var targetConnections []*websocket.Conn
+	var writeLocks []*sync.Mutex
 	s.runMutex.Lock()
 	for client, clientRoom := range s.room_ws {
 		if room == "" || clientRoom == room {
 			targetConnections = append(targetConnections, client)
+			writeLocks = append(writeLocks, s.wsWriteLockLocked(client))
 		}
 	}
 	s.runMutex.Unlock()
 
 	// 第二步：在锁外进行网络操作
 	var failedConnections []*websocket.Conn
-	for _, client := range targetConnections {
-		if err := client.WriteJSON(message); err != nil {
-			s.logger.Printf("错误: 写入 WebSocketMessage 到客户端 %s 失败: %v。计划移除客户端。", client.RemoteAddr(), err)
+	for i, client := range targetConnections {
+		if err := writeWebSocketJSON(client, writeLocks[i], message); err != nil {
+			s.logf(logWS, slog.LevelError, "错误: 写入 WebSocketMessage 到客户端 %s 失败: %v。计划移除客户端。", client.RemoteAddr(), err)
 			failedConnections = append(failedConnections, client)
 		}
 	}
@@ -184,6 +215,7 @@ func (s *ClipboardServer) broadcastWebSocketMessage(message WebSocketMessage, ro
 			client.Close()
 			delete(s.websockets, client)
 			delete(s.room_ws, client)
+			delete(s.wsWriteLocks, client)
 			// 从 connDeviceIDMap 中查找并删除对应的设备ID
 			if deviceID, ok := s.connDeviceIDMap[client]; ok {
 				delete(s.connDeviceIDMap, client)
@@ -196,8 +228,9 @@ func (s *ClipboardServer) broadcastWebSocketMessage(message WebSocketMessage, ro
 
 // broadcastWebSocketMessageToRoomExcept 将 WebSocketMessage 广播到房间中的所有客户端，除了一个特定的连接。
 func (s *ClipboardServer) broadcastWebSocketMessageToRoomExcept(message WebSocketMessage, room string, exceptConn *websocket.Conn) {
-	// 第一步：在锁内收集需要发送的连接
+	// 第一步：在锁内收集需要发送的连接及其写入锁
 	var targetConnections []*websocket.Conn
+	var writeLocks []*sync.Mutex
 	s.runMutex.Lock()
 	for client, clientRoom := range s.room_ws {
 		if client == exceptConn {
@@ -205,15 +238,16 @@ func (s *ClipboardServer) broadcastWebSocketMessageToRoomExcept(message WebSocke
 		}
 		if room == "" || clientRoom == room {
 			targetConnections = append(targetConnections, client)
+			writeLocks = append(writeLocks, s.wsWriteLockLocked(client))
 		}
 	}
 	s.runMutex.Unlock()
 
 	// 第二步：在锁外进行网络操作
 	var failedConnections []*websocket.Conn
-	for _, client := range targetConnections {
-		if err := client.WriteJSON(message); err != nil {
-			s.logger.Printf("错误: 写入 WebSocketMessage (except) 到客户端 %s 失败: %v。", client.RemoteAddr(), err)
+	for i, client := range targetConnections {
+		if err := writeWebSocketJSON(client, writeLocks[i], message); err != nil {
+			s.logf(logWS, slog.LevelError, "错误: 写入 WebSocketMessage (except) 到客户端 %s 失败: %v。", client.RemoteAddr(), err)
 			failedConnections = append(failedConnections, client)
 		}
 	}
@@ -225,6 +259,7 @@ func (s *ClipboardServer) broadcastWebSocketMessageToRoomExcept(message WebSocke
 			client.Close()
 			delete(s.websockets, client)
 			delete(s.room_ws, client)
+			delete(s.wsWriteLocks, client)
 			if deviceID, ok := s.connDeviceIDMap[client]; ok {
 				delete(s.connDeviceIDMap, client)
 				delete(s.deviceConnected, deviceID)
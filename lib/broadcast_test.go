@@ -0,0 +1,33 @@
+package lib
+
+import (
+	"sync"
+	"testing"
+)
+
+// 后台任务 (服务器下载、上传进度) 与处理函数同时广播时，同一连接的写入必须串行
+func TestConcurrentBroadcastToSameConnection(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	conn := dialPush(t, ts, "")
+
+	const writers, perWriter = 16, 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				s.broadcastWebSocketMessage(WebSocketMessage{Event: "upload_progress", Data: j}, "default")
+			}
+		}()
+	}
+	received := 0
+	for received < writers*perWriter {
+		var msg WebSocketMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("after %d messages: %v", received, err)
+		}
+		received++
+	}
+	wg.Wait()
+}
@@ -0,0 +1,200 @@
+package lib
+
+/**
+*** FILE: bundle.go
+***   handle bundle downloads: several messages of a room streamed as one zip or tar.gz archive
+**/
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bundleEntry 打包下载中的一个条目：存储目录中的文件或文本消息
+type bundleEntry struct {
+	name     string
+	file     File   // 文件条目
+	text     string // 文本条目
+	isText   bool
+	modified time.Time // 文本条目的发送时间，文件条目使用文件的修改时间
+}
+
+// uniqueArchiveName 同名的条目依次命名为 a.txt、a (1).txt、a (2).txt
+func uniqueArchiveName(name string, used map[string]bool) string {
+	unique := name
+	ext := path.Ext(name)
+	if strings.HasSuffix(name, ".tar.gz") {
+		ext = ".tar.gz"
+	}
+	for i := 1; used[unique]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	used[unique] = true
+	return unique
+}
+
+// archiveBaseName 文件名中的 / 和 \ 会被归档当作目录，替换掉
+func archiveBaseName(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// handleBundle 将选中的消息打包下载 (GET /bundle?ids=1,5,9&room=&format=zip|tar.gz)
+// 文件使用原文件名，文本消息保存为 text-{id}.txt，文件夹中的文件放在以文件夹命名的目录下；同名时加序号
+// 任何一条消息不存在、无权访问或文件已过期时返回 404 和这些消息的 ID
+func (s *ClipboardServer) handleBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "仅允许 GET 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	room := q.Get("room")
+	format := q.Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	contentType, ok := archiveContentTypes[format]
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "BadRequest", "不支持的格式，可选 zip 或 tar.gz")
+		return
+	}
+
+	var ids []int
+	requested := make(map[int]bool)
+	for _, field := range strings.Split(q.Get("ids"), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "BadRequest", fmt.Sprintf("无效的消息 ID '%s'", field))
+			return
+		}
+		if !requested[id] {
+			requested[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "BadRequest", "缺少 ids 参数")
+		return
+	}
+	if room != "" && !s.checkRoomAccess(w, r, room) {
+		return
+	}
+
+	// 按请求的顺序收集消息，房间规则与 /content/{id} 相同
+	found := make(map[int]ReceiveHolder, len(ids))
+	s.messageQueue.Lock()
+	for _, msg := range s.messageQueue.List {
+		id := msg.Data.ID()
+		if requested[id] && (room == "" || msg.Data.Room() == "" || msg.Data.Room() == room) {
+			found[id] = msg.Data
+		}
+	}
+	s.messageQueue.Unlock()
+	roomAccess := make(map[string]bool) // 缓存房间密钥校验结果
+	for id, msg := range found {
+		allowed, checked := roomAccess[msg.Room()]
+		if !checked {
+			allowed = s.canAccessRoom(r, msg.Room())
+			roomAccess[msg.Room()] = allowed
+		}
+		if !allowed {
+			delete(found, id)
+		}
+	}
+
+	now := time.Now().Unix()
+	used := make(map[string]bool)
+	var entries []bundleEntry
+	var missing []int
+	s.runMutex.Lock()
+	for _, id := range ids {
+		msg, ok := found[id]
+		switch {
+		case !ok:
+			missing = append(missing, id)
+		case msg.TextReceive != nil:
+			entries = append(entries, bundleEntry{
+				name:     uniqueArchiveName(fmt.Sprintf("text-%d.txt", id), used),
+				text:     msg.TextReceive.Content,
+				isText:   true,
+				modified: time.Unix(msg.TextReceive.Timestamp, 0),
+			})
+		case msg.FileReceive.Type == "folder":
+			dir := uniqueArchiveName(archiveBaseName(msg.FileReceive.Name), used)
+			count := 0
+			for _, e := range msg.FileReceive.Entries {
+				if fileInfo, ok := s.uploadFileMap[e.UUID]; ok && !isExpired(fileInfo.ExpireTime, now) {
+					// 条目的路径通常已经以文件夹名开头 (浏览器的 webkitRelativePath)
+					name := dir + "/" + strings.TrimPrefix(e.Path, msg.FileReceive.Name+"/")
+					entries = append(entries, bundleEntry{name: name, file: fileInfo})
+					count++
+				}
+			}
+			if count == 0 {
+				missing = append(missing, id)
+			}
+		default:
+			fileInfo, ok := s.uploadFileMap[msg.FileReceive.Cache]
+			if !ok || isExpired(fileInfo.ExpireTime, now) {
+				missing = append(missing, id)
+				continue
+			}
+			entries = append(entries, bundleEntry{name: uniqueArchiveName(archiveBaseName(msg.FileReceive.Name), used), file: fileInfo})
+		}
+	}
+	s.runMutex.Unlock()
+
+	if len(missing) > 0 {
+		s.logf(logHTTP, slog.LevelInfo, "打包下载失败: 消息 %v 不存在、无权访问或已过期 (房间: '%s')", missing, room)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "NotFound",
+			"message": "部分消息不存在、无权访问或已过期",
+			"missing": missing,
+		})
+		return
+	}
+
+	bundleName := "bundle"
+	if room != "" {
+		bundleName += "-" + archiveBaseName(room)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", bundleName+"."+format))
+	if r.Method == http.MethodHead {
+		return
+	}
+	s.audit(r, auditDownload, normalizeRoomName(room), 0, "", fmt.Sprintf("打包下载 %d 条消息", len(ids)))
+	s.logf(logHTTP, slog.LevelInfo, "提供打包下载: %d 条消息, %d 个文件, 格式: %s, 房间: '%s'", len(ids), len(entries), format, room)
+
+	archive, _ := newArchiveWriter(w, format)
+	for _, e := range entries {
+		var err error
+		if e.isText {
+			err = archive.add(e.name, int64(len(e.text)), e.modified, strings.NewReader(e.text))
+		} else {
+			err = s.addArchiveFile(archive, e.name, e.file)
+		}
+		if err != nil {
+			// 响应头已经发出，只能中断响应
+			s.logf(logHTTP, slog.LevelWarn, "警告: 打包下载中断: %v", err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		s.logf(logHTTP, slog.LevelWarn, "警告: 打包下载中断: %v", err)
+	}
+}
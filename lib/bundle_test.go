@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestUniqueArchiveName(t *testing.T) {
+	used := make(map[string]bool)
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a.txt", "a.txt"},
+		{"a.txt", "a (1).txt"},
+		{"a.txt", "a (2).txt"},
+		{"a (1).txt", "a (1) (1).txt"},
+		{"backup.tar.gz", "backup.tar.gz"},
+		{"backup.tar.gz", "backup (1).tar.gz"},
+		{"README", "README"},
+		{"README", "README (1)"},
+		{".env", ".env"},
+		{".env", " (1).env"},
+	}
+	for _, tt := range tests {
+		if got := uniqueArchiveName(tt.name, used); got != tt.want {
+			t.Errorf("uniqueArchiveName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestArchiveBaseName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{"../../etc/passwd", ".._.._etc_passwd"},
+		{`C:\Users\a.txt`, "C:_Users_a.txt"},
+		{"", "file"},
+		{".", "file"},
+		{"..", "file"},
+	}
+	for _, tt := range tests {
+		if got := archiveBaseName(tt.name); got != tt.want {
+			t.Errorf("archiveBaseName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// bundleEntries 解压打包下载的结果，返回文件名到内容的映射
+func bundleEntries(t *testing.T, format string, data []byte) map[string]string {
+	t.Helper()
+	entries := map[string]string{}
+	switch format {
+	case "zip":
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			rc, _ := f.Open()
+			content, _ := io.ReadAll(rc)
+			rc.Close()
+			entries[f.Name] = string(content)
+		}
+	case "tar.gz":
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gz)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := io.ReadAll(tr)
+			entries[h.Name] = string(content)
+		}
+	}
+	return entries
+}
+
+func TestBundleDownload(t *testing.T) {
+	_, ts := newTestServer(t, nil)
+	first := uploadFile(t, ts, "", "a.txt", []byte("first"))
+	second := uploadFile(t, ts, "", "a.txt", []byte("second"))
+	resp, data := doRequest(t, http.MethodPost, ts.URL+"/text", strings.NewReader("note"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("text: %s %s", resp.Status, data)
+	}
+	var text struct{ ID string }
+	json.Unmarshal(data, &text)
+
+	ids := strings.Join([]string{first, second, text.ID}, ",")
+	want := map[string]string{"a.txt": "first", "a (1).txt": "second", "text-" + text.ID + ".txt": "note"}
+	for _, format := range []string{"zip", "tar.gz"} {
+		resp, data := doRequest(t, http.MethodGet, ts.URL+"/bundle?format="+format+"&ids="+ids, nil)
+		if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Disposition"), `"bundle.`+format+`"`) {
+			t.Fatalf("%s: %s %s", format, resp.Status, resp.Header.Get("Content-Disposition"))
+		}
+		got := bundleEntries(t, format, data)
+		if len(got) != len(want) {
+			t.Errorf("%s entries = %v", format, got)
+		}
+		for name, content := range want {
+			if got[name] != content {
+				t.Errorf("%s: %s = %q, want %q", format, name, got[name], content)
+			}
+		}
+	}
+}
+
+func TestBundleErrors(t *testing.T) {
+	_, ts := newTestServer(t, nil)
+	id := uploadFile(t, ts, "", "a.txt", []byte("a"))
+	tests := []struct {
+		query       string
+		want        int
+		wantMissing []int
+	}{
+		{"ids=", http.StatusBadRequest, nil},
+		{"ids=" + id + ",x", http.StatusBadRequest, nil},
+		{"ids=" + id + "&format=rar", http.StatusBadRequest, nil},
+		{"ids=" + id + ",9999,9998", http.StatusNotFound, []int{9998, 9999}},
+	}
+	for _, tt := range tests {
+		resp, data := doRequest(t, http.MethodGet, ts.URL+"/bundle?"+tt.query, nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: %s %s", tt.query, resp.Status, data)
+			continue
+		}
+		if tt.wantMissing != nil {
+			var result struct{ Missing []int }
+			json.Unmarshal(data, &result)
+			sort.Ints(result.Missing)
+			if len(result.Missing) != len(tt.wantMissing) || result.Missing[0] != tt.wantMissing[0] || result.Missing[1] != tt.wantMissing[1] {
+				t.Errorf("%s: missing = %v", tt.query, result.Missing)
+			}
+		}
+	}
+}
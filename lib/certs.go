@@ -0,0 +1,393 @@
+package lib
+
+/**
+*** FILE: certs.go
+***   handle self-signed certificate generation and hot reloading of cert/key files
+**/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	autoCAValidity     = 10 * 365 * 24 * time.Hour
+	autoCertValidity   = 825 * 24 * time.Hour // 部分客户端 (如 Apple) 不接受更长的有效期
+	autoCertRenewAhead = 30 * 24 * time.Hour  // 到期前 30 天重新签发
+)
+
+// certFingerprint 返回证书 DER 的 SHA-256 指纹 (冒号分隔的十六进制)
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hexStr := strings.ToUpper(hex.EncodeToString(sum[:]))
+	parts := make([]string, 0, len(sum))
+	for i := 0; i < len(hexStr); i += 2 {
+		parts = append(parts, hexStr[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+// localCertNames 返回服务器证书需要覆盖的 IP 和主机名：所有本机网卡地址、主机名以及额外配置的名称
+func localCertNames(extra []string) (ips []net.IP, dnsNames []string) {
+	seenIP := map[string]bool{}
+	addIP := func(ip net.IP) {
+		if ip != nil && !seenIP[ip.String()] {
+			seenIP[ip.String()] = true
+			ips = append(ips, ip)
+		}
+	}
+	seenName := map[string]bool{}
+	addName := func(name string) {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" && !seenName[name] {
+			seenName[name] = true
+			dnsNames = append(dnsNames, name)
+		}
+	}
+
+	addIP(net.IPv4(127, 0, 0, 1))
+	addIP(net.IPv6loopback)
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				addIP(ipNet.IP)
+			}
+		}
+	}
+	addName("localhost")
+	if hostname, err := os.Hostname(); err == nil {
+		addName(hostname)
+		if !strings.Contains(hostname, ".") {
+			addName(hostname + ".local")
+		}
+	}
+	for _, name := range extra {
+		if ip := net.ParseIP(name); ip != nil {
+			addIP(ip)
+		} else {
+			addName(name)
+		}
+	}
+	return ips, dnsNames
+}
+
+func writePEM(path string, blockType string, der []byte, perm os.FileMode) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
+
+func writeECKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "EC PRIVATE KEY", der, 0600)
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// loadOrCreateCA 读取存储目录中的自签名 CA，不存在或已过期时重新生成
+func loadOrCreateCA(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	if pair, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		if cert, err := x509.ParseCertificate(pair.Certificate[0]); err == nil && time.Now().Before(cert.NotAfter) {
+			if key, ok := pair.PrivateKey.(*ecdsa.PrivateKey); ok {
+				return cert, key, nil
+			}
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Cloud Clipboard Local CA", Organization: []string{"Cloud Clipboard"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(autoCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeECKey(keyPath, key); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+// certCoversNames 判断证书是否覆盖所有需要的 IP 和主机名
+func certCoversNames(cert *x509.Certificate, ips []net.IP, dnsNames []string) bool {
+	for _, ip := range ips {
+		if cert.VerifyHostname(ip.String()) != nil {
+			return false
+		}
+	}
+	for _, name := range dnsNames {
+		if cert.VerifyHostname(name) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ensureAutoCert 确保存储目录中存在由本地 CA 签发、覆盖本机所有地址且未临近过期的服务器证书
+// 返回服务器证书、私钥和 CA 证书的路径
+func (s *ClipboardServer) ensureAutoCert() (certPath, keyPath, caPath string, err error) {
+	dir := s.storagePath("tls")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", "", err
+	}
+	caPath = filepath.Join(dir, "ca.pem")
+	certPath = filepath.Join(dir, "server.pem")
+	keyPath = filepath.Join(dir, "server.key")
+
+	ips, dnsNames := localCertNames(s.config.TLS.Hosts)
+	if pair, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err == nil && time.Until(cert.NotAfter) > autoCertRenewAhead && certCoversNames(cert, ips, dnsNames) && pathExists(caPath) {
+			return certPath, keyPath, caPath, nil
+		}
+	}
+
+	caCert, caKey, err := loadOrCreateCA(caPath, filepath.Join(dir, "ca.key"))
+	if err != nil {
+		return "", "", "", fmt.Errorf("无法生成本地 CA: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", "", err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return "", "", "", err
+	}
+	now := time.Now()
+	commonName := "localhost"
+	if len(dnsNames) > 1 {
+		commonName = dnsNames[1]
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Cloud Clipboard"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(autoCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  ips,
+		DNSNames:     dnsNames,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return "", "", "", fmt.Errorf("无法签发服务器证书: %w", err)
+	}
+	// 先写私钥再写证书，证书文件的变化会触发重新加载
+	if err := writeECKey(keyPath, key); err != nil {
+		return "", "", "", err
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})...)
+	if err := os.WriteFile(certPath, chain, 0644); err != nil {
+		return "", "", "", err
+	}
+
+	names := make([]string, 0, len(ips)+len(dnsNames))
+	for _, ip := range ips {
+		names = append(names, ip.String())
+	}
+	names = append(names, dnsNames...)
+	sort.Strings(names)
+	s.logf(logTLS, slog.LevelInfo, "已签发自签名服务器证书，有效期至 %s，覆盖: %s", template.NotAfter.Format("2006-01-02"), strings.Join(names, ", "))
+	return certPath, keyPath, caPath, nil
+}
+
+// certReloader 监视证书和私钥文件，变化后重新加载，通过 GetCertificate 提供给新的 TLS 握手
+type certReloader struct {
+	certPath, keyPath string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	cr := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// latestModTime 返回证书和私钥文件中较新的修改时间
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{cr.certPath, cr.keyPath} {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if stat.ModTime().After(latest) {
+			latest = stat.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) reload() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return err
+	}
+	pair, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return err
+	}
+	if pair.Leaf == nil {
+		if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	cr.mu.Lock()
+	cr.cert = &pair
+	cr.modTime = modTime
+	cr.mu.Unlock()
+	return nil
+}
+
+// changed 判断文件是否在上次加载之后被修改
+func (cr *certReloader) changed() bool {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return false
+	}
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return !modTime.Equal(cr.modTime)
+}
+
+func (cr *certReloader) leaf() *x509.Certificate {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert.Leaf
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	if cr.cert == nil {
+		return nil, errors.New("没有可用的服务器证书")
+	}
+	return cr.cert, nil
+}
+
+// initTLS 准备服务器证书：自动模式下生成自签名证书，并创建证书重新加载器
+func (s *ClipboardServer) initTLS() error {
+	certPath, keyPath := s.config.Server.Cert, s.config.Server.Key
+	if s.config.TLS.Auto && (certPath == "" || keyPath == "") {
+		var caPath string
+		var err error
+		if certPath, keyPath, caPath, err = s.ensureAutoCert(); err != nil {
+			return err
+		}
+		s.autoCert = true
+		if data, err := os.ReadFile(caPath); err == nil {
+			if block, _ := pem.Decode(data); block != nil {
+				s.logf(logTLS, slog.LevelInfo, "本地 CA 证书: %s (SHA-256 指纹: %s)，可将其导入客户端信任列表", caPath, certFingerprint(block.Bytes))
+			}
+		}
+	}
+	if certPath == "" || keyPath == "" {
+		return nil
+	}
+	reloader, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		return fmt.Errorf("无法加载证书 %s: %w", certPath, err)
+	}
+	s.certReloader = reloader
+	s.logf(logTLS, slog.LevelInfo, "服务器证书: %s (SHA-256 指纹: %s)", certPath, certFingerprint(reloader.leaf().Raw))
+	return nil
+}
+
+// startCertWatcher 在服务器启动时开始监视证书，调用方需持有 runMutex
+func (s *ClipboardServer) startCertWatcher() {
+	if s.certReloader == nil || s.certWatchStop != nil {
+		return
+	}
+	s.certWatchStop = make(chan struct{})
+	go s.watchCertificates(s.certWatchStop)
+}
+
+// stopCertWatcher 在服务器停止时结束证书监视任务，调用方需持有 runMutex
+func (s *ClipboardServer) stopCertWatcher() {
+	if s.certWatchStop != nil {
+		close(s.certWatchStop)
+		s.certWatchStop = nil
+	}
+}
+
+// watchCertificates 定期检查证书文件，变化后重新加载；自动模式下在临近过期或本机地址变化时重新签发
+// stop 关闭后返回
+func (s *ClipboardServer) watchCertificates(stop <-chan struct{}) {
+	interval := time.Duration(s.config.TLS.ReloadInterval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastAutoCheck := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if s.autoCert && time.Since(lastAutoCheck) > time.Hour {
+			lastAutoCheck = time.Now()
+			if _, _, _, err := s.ensureAutoCert(); err != nil {
+				s.logf(logTLS, slog.LevelWarn, "警告: 检查自签名证书失败: %v", err)
+			}
+		}
+		if !s.certReloader.changed() {
+			continue
+		}
+		if err := s.certReloader.reload(); err != nil {
+			// 文件可能正在写入，保留当前证书，下次再试
+			s.logf(logTLS, slog.LevelWarn, "警告: 重新加载证书失败，继续使用当前证书: %v", err)
+			continue
+		}
+		s.logf(logTLS, slog.LevelInfo, "已重新加载服务器证书 (SHA-256 指纹: %s，有效期至 %s)",
+			certFingerprint(s.certReloader.leaf().Raw), s.certReloader.leaf().NotAfter.Format("2006-01-02"))
+	}
+}
@@ -0,0 +1,219 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertFingerprint(t *testing.T) {
+	// SHA-256("abc")
+	want := "BA:78:16:BF:8F:01:CF:EA:41:41:40:DE:5D:AE:22:23:B0:03:61:A3:96:17:7A:9C:B4:10:FF:61:F2:00:15:AD"
+	if got := certFingerprint([]byte("abc")); got != want {
+		t.Errorf("certFingerprint = %s", got)
+	}
+}
+
+func TestLocalCertNames(t *testing.T) {
+	ips, dnsNames := localCertNames([]string{" Clip.Example.com ", "clip.example.com", "192.0.2.10", "127.0.0.1", ""})
+	hasIP := func(want string) bool {
+		for _, ip := range ips {
+			if ip.Equal(net.ParseIP(want)) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, want := range []string{"127.0.0.1", "::1", "192.0.2.10"} {
+		if !hasIP(want) {
+			t.Errorf("ips %v missing %s", ips, want)
+		}
+	}
+	count := map[string]int{}
+	for _, ip := range ips {
+		count[ip.String()]++
+	}
+	for _, name := range dnsNames {
+		count[name]++
+		if name != strings.ToLower(name) || name == "" {
+			t.Errorf("name not normalized: %q", name)
+		}
+	}
+	for name, n := range count {
+		if n > 1 {
+			t.Errorf("%s listed %d times", name, n)
+		}
+	}
+	if count["localhost"] != 1 || count["clip.example.com"] != 1 {
+		t.Errorf("dnsNames = %v", dnsNames)
+	}
+}
+
+func TestCertCoversNames(t *testing.T) {
+	cert := &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("192.0.2.10")}, DNSNames: []string{"clip.lan", "*.example.com"}}
+	tests := []struct {
+		name     string
+		ips      []string
+		dnsNames []string
+		want     bool
+	}{
+		{"all covered", []string{"192.0.2.10"}, []string{"clip.lan", "a.example.com"}, true},
+		{"new ip", []string{"192.0.2.11"}, nil, false},
+		{"new name", nil, []string{"nas.lan"}, false},
+		{"nothing required", nil, nil, true},
+	}
+	for _, tt := range tests {
+		var ips []net.IP
+		for _, ip := range tt.ips {
+			ips = append(ips, net.ParseIP(ip))
+		}
+		if got := certCoversNames(cert, ips, tt.dnsNames); got != tt.want {
+			t.Errorf("%s: certCoversNames = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadOrCreateCA(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	first, _, err := loadOrCreateCA(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.IsCA || first.Subject.CommonName == "" {
+		t.Errorf("CA certificate: %+v", first.Subject)
+	}
+	if stat, err := os.Stat(keyPath); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("CA key permissions: %v %v", stat.Mode(), err)
+	}
+	again, _, err := loadOrCreateCA(certPath, keyPath)
+	if err != nil || again.SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Errorf("existing CA was not reused: %v", err)
+	}
+	os.WriteFile(certPath, []byte("corrupt"), 0644)
+	regenerated, _, err := loadOrCreateCA(certPath, keyPath)
+	if err != nil || regenerated.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Errorf("corrupt CA was not regenerated: %v", err)
+	}
+}
+
+// 自动证书由本地 CA 签发并覆盖配置的主机；名称不变时复用，新增主机时重新签发
+func TestEnsureAutoCert(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *Config) { cfg.TLS.Hosts = []string{"clip.example.com", "192.0.2.10"} })
+	certPath, keyPath, caPath, err := s.ensureAutoCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := func() *x509.Certificate {
+		pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := x509.ParseCertificate(pair.Certificate[0])
+		return cert
+	}
+	cert := leaf()
+	caPEM, _ := os.ReadFile(caPath)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	for _, name := range []string{"clip.example.com", "192.0.2.10", "localhost", "127.0.0.1"} {
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: name}); err != nil {
+			t.Errorf("verify %s: %v", name, err)
+		}
+	}
+	if validity := cert.NotAfter.Sub(cert.NotBefore); validity > autoCertValidity+2*time.Hour {
+		t.Errorf("validity %v exceeds %v", validity, autoCertValidity)
+	}
+
+	if _, _, _, err := s.ensureAutoCert(); err != nil || leaf().SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Errorf("certificate re-issued without changes: %v", err)
+	}
+	s.config.TLS.Hosts = append(s.config.TLS.Hosts, "nas.lan")
+	if _, _, _, err := s.ensureAutoCert(); err != nil || leaf().VerifyHostname("nas.lan") != nil {
+		t.Errorf("certificate not re-issued for new host: %v", err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "cert.key")
+	first, _, err := loadOrCreateCA(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.changed() || cr.leaf().SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Fatal("unexpected state after load")
+	}
+
+	// 替换证书和私钥
+	os.Remove(certPath)
+	second, _, err := loadOrCreateCA(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	if !cr.changed() {
+		t.Fatal("change not detected")
+	}
+	if err := cr.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cert, _ := cr.GetCertificate(nil); cert.Leaf.SerialNumber.Cmp(second.SerialNumber) != 0 || cr.changed() {
+		t.Error("reloaded certificate not served")
+	}
+
+	// 写入一半的文件无法加载时保留当前证书
+	os.WriteFile(certPath, []byte("partial"), 0644)
+	if err := cr.reload(); err == nil {
+		t.Error("invalid certificate loaded")
+	}
+	if cr.leaf().SerialNumber.Cmp(second.SerialNumber) != 0 {
+		t.Error("current certificate replaced by invalid file")
+	}
+}
+
+// 证书监视任务只在服务器运行时存在，停止后退出
+func TestCertWatcherStops(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.TLS.Auto = true
+		cfg.TLS.ReloadInterval = 1
+	})
+	if s.certReloader == nil || s.certWatchStop != nil {
+		t.Fatal("certificate watcher started before Start")
+	}
+	s.runMutex.Lock()
+	s.startCertWatcher()
+	stop := s.certWatchStop
+	s.startCertWatcher() // 重复启动不会创建第二个任务
+	if s.certWatchStop != stop {
+		t.Error("second watcher started")
+	}
+	s.stopCertWatcher()
+	s.runMutex.Unlock()
+	if s.certWatchStop != nil {
+		t.Error("watcher still registered after stop")
+	}
+
+	done := make(chan struct{})
+	stop = make(chan struct{})
+	go func() {
+		s.watchCertificates(stop)
+		close(done)
+	}()
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchCertificates did not return after stop")
+	}
+}
@@ -0,0 +1,206 @@
+package lib
+
+/**
+*** FILE: chunk.go
+***   handle offset-addressed chunk upload sessions: received ranges, missing chunks and status
+**/
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// byteRange 已接收的字节区间 [Start, End)
+type byteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// addRange 将区间并入有序且互不重叠的区间列表，相邻或重叠的区间会被合并
+func addRange(ranges []byteRange, r byteRange) []byteRange {
+	if r.End <= r.Start {
+		return ranges
+	}
+	ranges = append(ranges, r)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	merged := ranges[:1]
+	for _, cur := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if cur.Start <= last.End {
+			if cur.End > last.End {
+				last.End = cur.End
+			}
+			continue
+		}
+		merged = append(merged, cur)
+	}
+	return merged
+}
+
+// missingRanges 返回 [0, size) 中尚未接收的区间
+func missingRanges(ranges []byteRange, size int64) []byteRange {
+	missing := make([]byteRange, 0)
+	var pos int64
+	for _, r := range ranges {
+		if r.Start >= size {
+			break
+		}
+		if r.Start > pos {
+			missing = append(missing, byteRange{pos, r.Start})
+		}
+		if r.End > pos {
+			pos = r.End
+		}
+	}
+	if pos < size {
+		missing = append(missing, byteRange{pos, size})
+	}
+	return missing
+}
+
+// coveredBytes 返回区间列表覆盖的字节数
+func coveredBytes(ranges []byteRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		total += r.End - r.Start
+	}
+	return total
+}
+
+// chunkUpload 进行中的分块上传会话，/upload/finish 成功后移除
+type chunkUpload struct {
+	sync.Mutex
+	Size      int64         // 初始化时声明的总大小，-1 表示未声明
+	ChunkSize int64         // 初始化时声明的分块大小，0 表示未声明 (此时只能使用 offset)
+	Received  []byteRange   // 已完整写入的区间
+	Hasher    *uploadHasher // 已计入连续接收的前 Hasher.Size 字节
+	Rewritten bool          // 有分块改写了已计入摘要的数据，需要从头重新计算摘要
+	Progress  *progressReporter
+}
+
+// end 返回已接收数据的末尾位置，不带 offset 和 index 的分块追加在这里
+func (c *chunkUpload) end() int64 {
+	if len(c.Received) == 0 {
+		return 0
+	}
+	return c.Received[len(c.Received)-1].End
+}
+
+// finalSize 返回完成上传时的文件大小：声明了大小时为声明值，否则为连续接收的数据长度
+// 数据不完整时返回缺失的区间
+func (c *chunkUpload) finalSize() (int64, []byteRange) {
+	size := c.Size
+	if size < 0 {
+		size = c.end()
+	}
+	return size, missingRanges(c.Received, size)
+}
+
+// noteWrite 在分块写入结束后 (无论成功与否) 调用，写入覆盖了已计入摘要的数据时标记需要重新计算，调用方需持有锁
+func (c *chunkUpload) noteWrite(offset, written int64) {
+	if written > 0 && offset < c.Hasher.Size {
+		c.Rewritten = true
+	}
+}
+
+// advanceHash 将从头开始连续接收的数据计入摘要，乱序到达的分块在前面的空缺补齐后计入，调用方需持有锁
+// 已计入的数据被改写过时从头重新计算，保证摘要与磁盘上的文件一致
+func (c *chunkUpload) advanceHash(filePath string) error {
+	if c.Rewritten {
+		c.Hasher = newUploadHasher(c.Hasher.expected)
+		c.Rewritten = false
+	}
+	if len(c.Received) == 0 || c.Received[0].Start != 0 || c.Received[0].End <= c.Hasher.Size {
+		return nil
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(c.Hasher, io.NewSectionReader(file, c.Hasher.Size, c.Received[0].End-c.Hasher.Size))
+	return err
+}
+
+// chunkStatus GET /upload/chunk/{uuid} 的响应
+type chunkStatus struct {
+	UUID          string      `json:"uuid"`
+	Name          string      `json:"name"`
+	Size          int64       `json:"size"`
+	ChunkSize     int64       `json:"chunkSize,omitempty"`
+	Received      []byteRange `json:"received"`
+	ReceivedBytes int64       `json:"receivedBytes"`
+	Missing       []byteRange `json:"missing,omitempty"`       // 仅在声明了大小时给出
+	MissingChunks []int64     `json:"missingChunks,omitempty"` // 仅在声明了大小和分块大小时给出
+	Complete      bool        `json:"complete"`
+}
+
+// status 返回会话当前的接收情况，调用方需持有锁
+func (c *chunkUpload) status(fileInfo File) chunkStatus {
+	st := chunkStatus{
+		UUID:          fileInfo.UUID,
+		Name:          fileInfo.Name,
+		Size:          c.Size,
+		ChunkSize:     c.ChunkSize,
+		Received:      append([]byteRange{}, c.Received...),
+		ReceivedBytes: coveredBytes(c.Received),
+	}
+	if c.Size < 0 {
+		st.Complete = len(c.Received) <= 1 && (len(c.Received) == 0 || c.Received[0].Start == 0)
+		return st
+	}
+	st.Missing = missingRanges(c.Received, c.Size)
+	st.Complete = len(st.Missing) == 0
+	if c.ChunkSize > 0 {
+		for _, m := range st.Missing {
+			for index := m.Start / c.ChunkSize; index*c.ChunkSize < m.End; index++ {
+				if len(st.MissingChunks) == 0 || st.MissingChunks[len(st.MissingChunks)-1] != index {
+					st.MissingChunks = append(st.MissingChunks, index)
+				}
+			}
+		}
+	}
+	return st
+}
+
+// lookupChunkUpload 返回进行中的分块上传及其文件信息；文件已过期或被删除时清除会话
+func (s *ClipboardServer) lookupChunkUpload(uuid string) (*chunkUpload, File, bool) {
+	s.runMutex.Lock()
+	fileInfo, exists := s.uploadFileMap[uuid]
+	s.runMutex.Unlock()
+
+	s.chunkMutex.Lock()
+	upload, ok := s.chunkUploads[uuid]
+	if ok && !exists {
+		delete(s.chunkUploads, uuid)
+	}
+	s.chunkMutex.Unlock()
+	if ok && !exists {
+		upload.Progress.abort("上传已过期")
+		return nil, File{}, false
+	}
+	return upload, fileInfo, ok
+}
+
+// handleChunkStatus 查询分块上传的接收情况 (GET /upload/chunk/{uuid})，客户端据此重传缺失的分块
+func (s *ClipboardServer) handleChunkStatus(w http.ResponseWriter, r *http.Request) {
+	uuid := strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/upload/chunk/")
+	upload, fileInfo, ok := s.lookupChunkUpload(uuid)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "NotFound", "上传会话不存在、已完成或已过期")
+		return
+	}
+	if !s.checkRoomAccess(w, r, fileInfo.Room) {
+		return
+	}
+	upload.Lock()
+	st := upload.status(fileInfo)
+	upload.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,230 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAddRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []byteRange
+		add    byteRange
+		want   []byteRange
+	}{
+		{"first", nil, byteRange{0, 10}, []byteRange{{0, 10}}},
+		{"empty range ignored", []byteRange{{0, 10}}, byteRange{5, 5}, []byteRange{{0, 10}}},
+		{"disjoint out of order", []byteRange{{20, 30}}, byteRange{0, 10}, []byteRange{{0, 10}, {20, 30}}},
+		{"adjacent merged", []byteRange{{0, 10}}, byteRange{10, 20}, []byteRange{{0, 20}}},
+		{"overlap merged", []byteRange{{0, 10}, {20, 30}}, byteRange{5, 25}, []byteRange{{0, 30}}},
+		{"duplicate", []byteRange{{0, 10}}, byteRange{2, 8}, []byteRange{{0, 10}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addRange(tt.ranges, tt.add); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("addRange = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMissingRanges(t *testing.T) {
+	tests := []struct {
+		ranges []byteRange
+		size   int64
+		want   []byteRange
+	}{
+		{nil, 10, []byteRange{{0, 10}}},
+		{[]byteRange{{0, 10}}, 10, []byteRange{}},
+		{[]byteRange{{2, 4}, {6, 8}}, 10, []byteRange{{0, 2}, {4, 6}, {8, 10}}},
+		{[]byteRange{{0, 4}, {12, 20}}, 10, []byteRange{{4, 10}}},
+	}
+	for _, tt := range tests {
+		if got := missingRanges(tt.ranges, tt.size); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("missingRanges(%v, %d) = %v, want %v", tt.ranges, tt.size, got, tt.want)
+		}
+	}
+	if got := coveredBytes([]byteRange{{0, 4}, {6, 8}}); got != 6 {
+		t.Errorf("coveredBytes = %d, want 6", got)
+	}
+}
+
+func TestChunkStatusMissingChunks(t *testing.T) {
+	c := &chunkUpload{Size: 25, ChunkSize: 10, Received: []byteRange{{10, 20}}}
+	st := c.status(File{UUID: "u", Name: "a"})
+	if !reflect.DeepEqual(st.MissingChunks, []int64{0, 2}) || st.Complete || st.ReceivedBytes != 10 {
+		t.Errorf("status = %+v", st)
+	}
+}
+
+// 隐藏长度的请求体，客户端使用 chunked 编码发送，服务器无法预先检查 Content-Length
+type unsizedReader struct{ io.Reader }
+
+func TestChunkUploadLimitsToDeclaredSize(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	resp, data := doRequest(t, http.MethodPost, ts.URL+"/upload/chunk", strings.NewReader(`{"name":"a.txt","size":10,"chunkSize":5}`), "Content-Type", "application/json")
+	var init struct {
+		Result struct{ UUID string } `json:"result"`
+	}
+	if err := json.Unmarshal(data, &init); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("init: %s %s", resp.Status, data)
+	}
+	uuid := init.Result.UUID
+	chunkURL := func(query string) string { return fmt.Sprintf("%s/upload/chunk/%s?%s", ts.URL, uuid, query) }
+	filePath := filepath.Join(s.storageFolder, uuid)
+
+	// 超出声明大小一个字节：不能写入磁盘，也不能记录为已接收
+	resp, _ = doRequest(t, http.MethodPost, chunkURL("index=1"), unsizedReader{strings.NewReader("567890")})
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized chunk: %s", resp.Status)
+	}
+	if st, err := os.Stat(filePath); err != nil || st.Size() > 10 {
+		t.Fatalf("file size after oversized chunk: %v %v", st, err)
+	}
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/upload/finish/"+uuid, nil); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("finish with missing chunks: %s", resp.Status)
+	}
+
+	for i, part := range []string{"56789", "01234"} {
+		resp, data := doRequest(t, http.MethodPost, chunkURL(fmt.Sprintf("index=%d", 1-i)), unsizedReader{strings.NewReader(part)})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("chunk %d: %s %s", 1-i, resp.Status, data)
+		}
+	}
+	resp, data = doRequest(t, http.MethodPost, ts.URL+"/upload/finish/"+uuid, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("finish: %s %s", resp.Status, data)
+	}
+	content, _ := os.ReadFile(filePath)
+	if !bytes.Equal(content, []byte("0123456789")) {
+		t.Errorf("content = %q", content)
+	}
+}
+
+// 中断的写入留在文件末尾之后的数据在完成时被截断
+func TestChunkFinishTruncatesToFinalSize(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	_, data := doRequest(t, http.MethodPost, ts.URL+"/upload/chunk", strings.NewReader(`{"name":"b.txt","size":4}`), "Content-Type", "application/json")
+	var init struct {
+		Result struct{ UUID string } `json:"result"`
+	}
+	json.Unmarshal(data, &init)
+	uuid := init.Result.UUID
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/upload/chunk/"+uuid+"?offset=0", strings.NewReader("abcd")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("chunk: %s", resp.Status)
+	}
+	// 模拟作废的分块留下的数据
+	f, _ := os.OpenFile(filepath.Join(s.storageFolder, uuid), os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("garbage")
+	f.Close()
+
+	if resp, data := doRequest(t, http.MethodPost, ts.URL+"/upload/finish/"+uuid, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("finish: %s %s", resp.Status, data)
+	}
+	if content, _ := os.ReadFile(filepath.Join(s.storageFolder, uuid)); string(content) != "abcd" {
+		t.Errorf("content = %q", content)
+	}
+}
+
+// 改写已计入摘要的数据后，完成时的摘要和校验以磁盘上的最终文件为准
+func TestChunkRewriteRehashes(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	original := sha256.Sum256([]byte("aaaaabbbbb"))
+	rewritten := sha256.Sum256([]byte("cccccbbbbb"))
+	tests := []struct {
+		name     string
+		digest   []byte
+		rewrite  string
+		want     int
+		wantHash [32]byte
+	}{
+		{"retransmitted chunk", original[:], "aaaaa", http.StatusOK, original},
+		{"changed chunk with original digest", original[:], "ccccc", http.StatusUnprocessableEntity, original},
+		{"changed chunk with new digest", rewritten[:], "ccccc", http.StatusOK, rewritten},
+		{"changed chunk without digest", nil, "ccccc", http.StatusOK, rewritten},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"name":"a.txt","size":10}`
+			if tt.digest != nil {
+				body = fmt.Sprintf(`{"name":"a.txt","size":10,"digest":"sha-256=%s"}`, base64.StdEncoding.EncodeToString(tt.digest))
+			}
+			_, data := doRequest(t, http.MethodPost, ts.URL+"/upload/chunk", strings.NewReader(body), "Content-Type", "application/json")
+			var init struct {
+				Result struct{ UUID string } `json:"result"`
+			}
+			json.Unmarshal(data, &init)
+			uuid := init.Result.UUID
+			for _, chunk := range []struct{ offset, data string }{{"0", "aaaaa"}, {"5", "bbbbb"}, {"0", tt.rewrite}} {
+				if resp, data := doRequest(t, http.MethodPost, ts.URL+"/upload/chunk/"+uuid+"?offset="+chunk.offset, strings.NewReader(chunk.data)); resp.StatusCode != http.StatusOK {
+					t.Fatalf("chunk at %s: %s %s", chunk.offset, resp.Status, data)
+				}
+			}
+			resp, data := doRequest(t, http.MethodPost, ts.URL+"/upload/finish/"+uuid, nil)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("finish: %s %s", resp.Status, data)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			s.runMutex.Lock()
+			digest := s.uploadFileMap[uuid].Digest
+			s.runMutex.Unlock()
+			if digest != fileDigestPrefix+hex.EncodeToString(tt.wantHash[:]) {
+				t.Errorf("stored digest = %s", digest)
+			}
+		})
+	}
+}
+
+// 没有声明大小也没有文件大小限制时，分块不能跳过未接收的数据
+func TestChunkOffsetBoundedWithoutSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		init  string
+		query string
+		want  int
+	}{
+		{"huge offset", 0, `{"name":"a.txt"}`, "offset=4611686018427387904", http.StatusBadRequest},
+		{"gap", 0, `{"name":"a.txt"}`, "offset=6", http.StatusBadRequest},
+		{"append at end", 0, `{"name":"a.txt"}`, "offset=5", http.StatusOK},
+		{"rewrite received data", 0, `{"name":"a.txt"}`, "offset=0", http.StatusOK},
+		{"index past end", 0, `{"name":"a.txt","chunkSize":5}`, "index=3", http.StatusBadRequest},
+		{"declared size allows gaps", 0, `{"name":"a.txt","size":20}`, "offset=15", http.StatusOK},
+		{"file limit allows gaps", 20, `{"name":"a.txt"}`, "offset=15", http.StatusOK},
+		{"file limit bounds offset", 20, `{"name":"a.txt"}`, "offset=4611686018427387904", http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t, func(cfg *Config) { cfg.File.Limit = tt.limit })
+			_, data := doRequest(t, http.MethodPost, ts.URL+"/upload/chunk", strings.NewReader(tt.init), "Content-Type", "application/json")
+			var init struct {
+				Result struct{ UUID string } `json:"result"`
+			}
+			json.Unmarshal(data, &init)
+			uuid := init.Result.UUID
+			if resp, data := doRequest(t, http.MethodPost, ts.URL+"/upload/chunk/"+uuid, strings.NewReader("01234")); resp.StatusCode != http.StatusOK {
+				t.Fatalf("first chunk: %s %s", resp.Status, data)
+			}
+			resp, data := doRequest(t, http.MethodPost, ts.URL+"/upload/chunk/"+uuid+"?"+tt.query, strings.NewReader("56789"))
+			if resp.StatusCode != tt.want {
+				t.Fatalf("chunk: %s %s, want %d", resp.Status, data, tt.want)
+			}
+			if st, err := os.Stat(filepath.Join(s.storageFolder, uuid)); err != nil || st.Size() > 20 {
+				t.Errorf("file size = %v %v", st, err)
+			}
+		})
+	}
+}
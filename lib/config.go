@@ -27,15 +27,178 @@ type Config struct {
 		// 添加房间相关配置
 		RoomList    bool `json:"roomList"`    // 是否启用房间列表功能
 		RoomCleanup int  `json:"roomCleanup"` // 房间清理间隔（秒）
+
+		TrustedProxies  []string `json:"trustedProxies"`  // 受信任的反向代理 IP/CIDR，只有来自这些地址的转发头才会被采用
+		ForwardedHeader string   `json:"forwardedHeader"` // 采用的转发头: x-forwarded-for (默认)、forwarded 或 x-real-ip
 	} `json:"server"`
 	Text struct {
 		Limit int `json:"limit"` //done
 	} `json:"text"`
 	File struct {
-		Expire int `json:"expire"` //done
-		Chunk  int `json:"chunk"`  //done, but no limit
-		Limit  int `json:"limit"`  //done
+		Expire    int `json:"expire"`    //done
+		Chunk     int `json:"chunk"`     //done, but no limit
+		Limit     int `json:"limit"`     //done
+		MinExpire int `json:"minExpire"` // 上传时可以指定的最短有效期（秒），0 表示不限制
+		MaxExpire int `json:"maxExpire"` // 上传时可以指定的最长有效期（秒），0 表示不限制
 	} `json:"file"`
+	Share     ShareConfig     `json:"share"`
+	RateLimit RateLimitConfig `json:"rateLimit"`
+	AuthGuard AuthGuardConfig `json:"authGuard"`
+	CORS      CORSConfig      `json:"cors"`
+	Session   SessionConfig   `json:"session"`
+	Audit     AuditConfig     `json:"audit"`
+	Access    AccessConfig    `json:"access"`
+	OIDC      OIDCConfig      `json:"oidc"`
+	MTLS      MTLSConfig      `json:"mtls"`
+	TLS       TLSConfig       `json:"tls"`
+	Log       LogConfig       `json:"log"`
+	Scan      ScanConfig      `json:"scan"`
+	FileTypes FileTypeConfig  `json:"fileTypes"`
+	Fetch     FetchConfig     `json:"fetch"`
+}
+
+// ShareConfig 签名分享链接配置
+type ShareConfig struct {
+	Secret     string `json:"secret"`     // HMAC 密钥，留空则自动生成并保存在存储目录中
+	DefaultTTL int    `json:"defaultTTL"` // 分享链接默认有效期（秒）
+	MaxTTL     int    `json:"maxTTL"`     // 分享链接最长有效期（秒）
+}
+
+// RateLimitConfig 限流配置，各项为 0 表示不限制
+type RateLimitConfig struct {
+	Message RateLimitRule `json:"message"` // 创建消息 (每秒条数)
+	Upload  RateLimitRule `json:"upload"`  // 上传带宽 (每秒字节数)
+	Connect RateLimitRule `json:"connect"` // WebSocket 连接 (每秒次数)
+}
+
+// RateLimitRule 分别按 IP、API 令牌和房间计算的令牌桶
+type RateLimitRule struct {
+	PerIP    TokenBucketConfig `json:"perIP"`
+	PerToken TokenBucketConfig `json:"perToken"`
+	PerRoom  TokenBucketConfig `json:"perRoom"`
+}
+
+// AuthGuardConfig 认证暴力破解防护配置
+type AuthGuardConfig struct {
+	MaxFailures int      `json:"maxFailures"` // 触发锁定前允许的连续失败次数，0 表示不锁定
+	LockoutBase int      `json:"lockoutBase"` // 首次锁定时长（秒），之后每次锁定翻倍
+	LockoutMax  int      `json:"lockoutMax"`  // 最长锁定时长（秒）
+	BanList     []string `json:"banList"`     // 禁止访问的 IP 或 CIDR 列表
+}
+
+// TLSConfig HTTPS 证书配置
+type TLSConfig struct {
+	Auto           bool     `json:"auto"`           // 未配置 server.cert/key 时自动生成自签名 CA 和服务器证书
+	Hosts          []string `json:"hosts"`          // 自动证书额外覆盖的主机名或 IP
+	ReloadInterval int      `json:"reloadInterval"` // 检查证书文件变化的间隔（秒）
+}
+
+// MTLSConfig 客户端证书认证配置，需要配置 server.cert/key 或启用 tls.auto
+type MTLSConfig struct {
+	ClientCA  string            `json:"clientCA"`  // 客户端 CA 证书包 (PEM)
+	Mode      string            `json:"mode"`      // "off"、"optional" 或 "required"
+	Listeners map[string]string `json:"listeners"` // 按监听地址 (server.host 中的值) 覆盖 mode
+	Scopes    []string          `json:"scopes"`    // 客户端证书认证的权限范围
+}
+
+// OIDCConfig OpenID Connect 单点登录配置
+type OIDCConfig struct {
+	Enabled       bool     `json:"enabled"`
+	Issuer        string   `json:"issuer"`
+	ClientID      string   `json:"clientId"`
+	ClientSecret  string   `json:"clientSecret"`
+	RedirectURL   string   `json:"redirectUrl"`   // 回调地址，留空则根据请求推断为 <scheme>://<host><prefix>/oidc/callback
+	Scopes        []string `json:"scopes"`        // 请求的 OAuth 范围
+	GroupsClaim   string   `json:"groupsClaim"`   // ID Token 中表示用户组的声明
+	AllowedEmails []string `json:"allowedEmails"` // 允许登录的邮箱，支持通配符，例如 *@example.com
+	AllowedGroups []string `json:"allowedGroups"` // 允许登录的用户组
+	AdminGroups   []string `json:"adminGroups"`   // 拥有 admin 权限的用户组
+	UserScopes    []string `json:"userScopes"`    // 普通用户的权限范围
+	AllowPassword bool     `json:"allowPassword"` // 启用 OIDC 后是否仍接受 server.auth 共享密码
+}
+
+// AccessConfig 按客户端 IP 的访问控制，rooms 中的房间使用各自的规则代替全局规则
+type AccessConfig struct {
+	AccessRule
+	Rooms map[string]AccessRule `json:"rooms"`
+}
+
+// AccessRule 访问规则：deny 优先；配置了 allow 或 privateOnly 时只允许命中其一的地址
+type AccessRule struct {
+	Allow       []string `json:"allow"`       // 允许的 IP 或 CIDR
+	Deny        []string `json:"deny"`        // 拒绝的 IP 或 CIDR
+	PrivateOnly bool     `json:"privateOnly"` // 仅允许私有网络、回环和链路本地地址
+}
+
+// FileTypeRule 按嗅探得到的 MIME 类型限制上传的文件
+// 规则可以是 MIME 通配符 (如 image/*、application/pdf) 或类别 (image、text、audio、video、document、archive、executable、file)
+type FileTypeRule struct {
+	Allow []string `json:"allow"` // 允许的类型，为空表示不限制
+	Deny  []string `json:"deny"`  // 拒绝的类型，优先于 allow
+}
+
+// FileTypeConfig 全局文件类型规则及各房间的覆盖规则
+type FileTypeConfig struct {
+	FileTypeRule
+	Rooms map[string]FileTypeRule `json:"rooms"` // 房间名 -> 覆盖规则
+}
+
+// ScanConfig 上传文件的恶意文件扫描配置 (clamd INSTREAM 协议)
+type ScanConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Address   string `json:"address"`   // clamd 地址，例如 127.0.0.1:3310 或 /run/clamav/clamd.ctl
+	Timeout   int    `json:"timeout"`   // 单个文件的扫描超时（秒）
+	ChunkSize int    `json:"chunkSize"` // INSTREAM 每块发送的字节数
+	MaxSize   int64  `json:"maxSize"`   // 超过此大小的文件无法扫描，默认拒绝，failOpen 时发布且状态为 skipped；0 表示不限制
+	FailOpen  bool   `json:"failOpen"`  // 扫描器不可用或文件超过 maxSize 时是否仍然发布文件
+}
+
+// FetchConfig 服务器从 URL 下载文件 (POST /upload/url) 的配置
+type FetchConfig struct {
+	Enabled         bool     `json:"enabled"`
+	Timeout         int      `json:"timeout"`         // 整个下载的超时（秒）
+	MaxRedirects    int      `json:"maxRedirects"`    // 最多跟随的重定向次数
+	MaxSize         int64    `json:"maxSize"`         // 下载文件的大小限制，0 表示使用 file.limit
+	AllowedNetworks []string `json:"allowedNetworks"` // 允许访问的内网 IP/CIDR，默认禁止访问回环、私有和链路本地地址
+}
+
+// LogConfig 服务器日志配置
+type LogConfig struct {
+	Level      string            `json:"level"`      // debug, info, warn, error
+	Format     string            `json:"format"`     // text 或 json
+	File       string            `json:"file"`       // 日志文件路径，留空则输出到标准输出
+	MaxSize    int64             `json:"maxSize"`    // 单个文件的最大字节数，超过后轮转，0 表示不轮转
+	MaxFiles   int               `json:"maxFiles"`   // 保留的历史文件数量
+	Subsystems map[string]string `json:"subsystems"` // 按子系统覆盖日志级别，例如 {"ws": "debug", "auth": "warn"}
+	Redact     bool              `json:"redact"`     // 不记录消息内容、密码和令牌
+}
+
+// AuditConfig 审计日志配置
+type AuditConfig struct {
+	Enabled  bool   `json:"enabled"`
+	File     string `json:"file"`     // 日志文件路径，留空则为存储目录下的 audit.jsonl
+	MaxSize  int64  `json:"maxSize"`  // 单个文件的最大字节数，超过后轮转，0 表示不轮转
+	MaxFiles int    `json:"maxFiles"` // 保留的历史文件数量
+}
+
+// SessionConfig 登录会话配置
+type SessionConfig struct {
+	TTL int `json:"ttl"` // 会话有效期（秒）
+}
+
+// CORSConfig 跨域策略，同时作用于 HTTP 请求和 WebSocket 连接
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowedOrigins"`   // 允许的来源，支持 "*" 和通配符；未设置时启用认证则只允许同源，否则允许任意来源
+	AllowedMethods   []string `json:"allowedMethods"`   // 预检请求允许的方法
+	AllowedHeaders   []string `json:"allowedHeaders"`   // 预检请求允许的请求头
+	AllowCredentials bool     `json:"allowCredentials"` // 是否允许携带 Cookie 等凭据
+	MaxAge           int      `json:"maxAge"`           // 预检结果缓存时长（秒）
+}
+
+// TokenBucketConfig 令牌桶参数：rate 为每秒补充的令牌数，burst 为桶容量
+type TokenBucketConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
 }
 
 // var config_path = "config.json"
@@ -97,6 +260,9 @@ func defaultConfig() *Config {
 			Key         string      `json:"key"`
 			RoomList    bool        `json:"roomList"`
 			RoomCleanup int         `json:"roomCleanup"`
+
+			TrustedProxies  []string `json:"trustedProxies"`
+			ForwardedHeader string   `json:"forwardedHeader"`
 		}{
 			Host:        []string{"0.0.0.0"},
 			Port:        9501,
@@ -109,6 +275,9 @@ func defaultConfig() *Config {
 			Key:         "",
 			RoomList:    false, // 默认关闭房间列表功能
 			RoomCleanup: 3600,  // 默认1小时清理一次空房间
+
+			TrustedProxies:  []string{"127.0.0.0/8", "::1"}, // 默认只信任本机的反向代理
+			ForwardedHeader: forwardedHeaderXFF,
 		},
 		Text: struct {
 			Limit int `json:"limit"`
@@ -116,13 +285,69 @@ func defaultConfig() *Config {
 			Limit: 4096,
 		},
 		File: struct {
-			Expire int `json:"expire"`
-			Chunk  int `json:"chunk"`
-			Limit  int `json:"limit"`
+			Expire    int `json:"expire"`
+			Chunk     int `json:"chunk"`
+			Limit     int `json:"limit"`
+			MinExpire int `json:"minExpire"`
+			MaxExpire int `json:"maxExpire"`
 		}{
-			Expire: 3600,
-			Chunk:  2 * _MB,
-			Limit:  256 * _MB,
+			Expire:    3600,
+			Chunk:     2 * _MB,
+			Limit:     256 * _MB,
+			MinExpire: 60,
+			MaxExpire: 7 * 24 * 3600,
+		},
+		Share: ShareConfig{
+			DefaultTTL: 3600,
+			MaxTTL:     7 * 24 * 3600,
+		},
+		AuthGuard: AuthGuardConfig{
+			MaxFailures: 5,
+			LockoutBase: 60,
+			LockoutMax:  3600,
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+			AllowedHeaders: []string{"Content-Type", "Authorization", "X-Room-Key", "X-CSRF-Token",
+				"Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "Upload-Checksum", "Digest", "X-HTTP-Method-Override"},
+			MaxAge: 600,
+		},
+		Session: SessionConfig{
+			TTL: 7 * 24 * 3600,
+		},
+		TLS: TLSConfig{
+			ReloadInterval: 30,
+		},
+		MTLS: MTLSConfig{
+			Mode:   mtlsOff,
+			Scopes: []string{scopeRead, scopeWrite, scopeDelete},
+		},
+		OIDC: OIDCConfig{
+			Scopes:      []string{"openid", "profile", "email"},
+			GroupsClaim: "groups",
+			UserScopes:  []string{scopeRead, scopeWrite, scopeDelete},
+		},
+		Audit: AuditConfig{
+			Enabled:  true,
+			MaxSize:  10 * _MB,
+			MaxFiles: 5,
+		},
+		Scan: ScanConfig{
+			Address:   "127.0.0.1:3310",
+			Timeout:   60,
+			ChunkSize: 64 * 1024,
+			MaxSize:   25 * _MB, // 与 clamd 默认的 StreamMaxLength 一致
+		},
+		Fetch: FetchConfig{
+			Timeout:      300,
+			MaxRedirects: 5,
+		},
+		Log: LogConfig{
+			Level:    "info",
+			Format:   "text",
+			MaxSize:  10 * _MB,
+			MaxFiles: 5,
+			Redact:   true,
 		},
 	}
 }
@@ -0,0 +1,131 @@
+package lib
+
+/**
+*** FILE: cors.go
+*** handle cross-origin policy for HTTP requests and WebSocket upgrades
+**/
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// corsPolicy 由 CORSConfig 解析得到的跨域策略
+type corsPolicy struct {
+	allowAll    bool     // 允许任意来源
+	patterns    []string // 允许的来源，支持通配符，例如 https://*.example.com 或 *.lan
+	methods     string
+	headers     string
+	credentials bool
+	maxAge      int
+}
+
+// newCORSPolicy 解析跨域配置。未配置 allowedOrigins 时：启用认证则只允许同源，否则允许任意来源
+// 允许任意来源时不能携带凭据，否则任何网站都可以读取带 Cookie 的响应
+func newCORSPolicy(cfg CORSConfig, authEnabled bool) (*corsPolicy, error) {
+	p := &corsPolicy{
+		methods:     strings.Join(cfg.AllowedMethods, ", "),
+		headers:     strings.Join(cfg.AllowedHeaders, ", "),
+		credentials: cfg.AllowCredentials,
+		maxAge:      cfg.MaxAge,
+	}
+	origins := cfg.AllowedOrigins
+	if origins == nil && !authEnabled {
+		origins = []string{"*"}
+		p.credentials = false // 默认允许任意来源时不发送凭据
+	}
+	for _, origin := range origins {
+		origin = strings.ToLower(strings.TrimRight(strings.TrimSpace(origin), "/"))
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			p.allowAll = true
+			continue
+		}
+		if _, err := path.Match(origin, ""); err != nil {
+			return nil, fmt.Errorf("无效的来源规则 '%s': %w", origin, err)
+		}
+		p.patterns = append(p.patterns, origin)
+	}
+	if p.allowAll && p.credentials {
+		return nil, fmt.Errorf("allowedOrigins 包含 '*' 时不能启用 allowCredentials，请列出允许的来源")
+	}
+	return p, nil
+}
+
+// sameOrigin 判断 Origin 是否与客户端请求的主机一致 (经过受信任代理时为代理转发的原始主机)
+func sameOrigin(origin string, r *http.Request) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return strings.EqualFold(u.Host, getHost(r))
+}
+
+// originAllowed 判断请求来源是否被允许，没有 Origin 头的请求 (非浏览器客户端) 总是允许
+func (p *corsPolicy) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.allowAll || sameOrigin(origin, r) {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	host := origin
+	if u, err := url.Parse(origin); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	for _, pattern := range p.patterns {
+		// 不带协议的规则只匹配主机部分
+		target := origin
+		if !strings.Contains(pattern, "://") {
+			target = host
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMiddleware 在所有处理函数之前校验来源并写入 CORS 头，拒绝不被允许的跨域请求并响应预检请求
+func (s *ClipboardServer) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !s.cors.originAllowed(r) {
+			s.logf(logHTTP, slog.LevelInfo, "跨域请求被拒绝: 来源 %s, IP: %s, 路径: %s", origin, get_remote_ip(r), r.URL.Path)
+			writeJSONError(w, http.StatusForbidden, "Forbidden", "不允许的跨域来源")
+			return
+		}
+
+		if s.cors.allowAll {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if s.cors.credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		// 预检请求
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", s.cors.methods)
+			w.Header().Set("Access-Control-Allow-Headers", s.cors.headers)
+			if s.cors.maxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(s.cors.maxAge))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORSOriginAllowed(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		authEnabled bool
+		origin      string
+		want        bool
+	}{
+		{"no origin", []string{}, true, "", true},
+		{"default without auth allows any", nil, false, "https://other.example", true},
+		{"default with auth only same origin", nil, true, "https://other.example", false},
+		{"same origin", nil, true, "http://clip.lan:9501", true},
+		{"same host other port", nil, true, "http://clip.lan:9502", false},
+		{"exact origin", []string{"https://app.example.com/"}, true, "https://app.example.com", true},
+		{"scheme must match", []string{"https://app.example.com"}, true, "http://app.example.com", false},
+		{"wildcard subdomain", []string{"https://*.example.com"}, true, "https://a.example.com", true},
+		{"wildcard does not match apex", []string{"https://*.example.com"}, true, "https://example.com", false},
+		{"wildcard does not match suffix", []string{"https://*.example.com"}, true, "https://a.example.com.evil", false},
+		{"host pattern any scheme", []string{"*.lan"}, true, "http://nas.lan", true},
+		{"case insensitive", []string{"https://App.Example.com"}, true, "HTTPS://app.example.COM", true},
+		{"invalid origin", []string{"https://app.example.com"}, true, "null", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newCORSPolicy(CORSConfig{AllowedOrigins: tt.origins}, tt.authEnabled)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://clip.lan:9501/", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := p.originAllowed(r); got != tt.want {
+				t.Errorf("originAllowed(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+	if _, err := newCORSPolicy(CORSConfig{AllowedOrigins: []string{"https://[a"}}, true); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
+
+// 允许任意来源时不能携带凭据
+func TestCORSCredentialsWithAllowAll(t *testing.T) {
+	tests := []struct {
+		name            string
+		origins         []string
+		authEnabled     bool
+		wantErr         bool
+		wantCredentials bool
+	}{
+		{"explicit wildcard", []string{"*"}, true, true, false},
+		{"wildcard among origins", []string{"https://app.example.com", "*"}, false, true, false},
+		{"default without auth", nil, false, false, false},
+		{"listed origins", []string{"https://app.example.com"}, true, false, true},
+	}
+	for _, tt := range tests {
+		p, err := newCORSPolicy(CORSConfig{AllowedOrigins: tt.origins, AllowCredentials: true}, tt.authEnabled)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+		if err == nil && p.credentials != tt.wantCredentials {
+			t.Errorf("%s: credentials = %v, want %v", tt.name, p.credentials, tt.wantCredentials)
+		}
+	}
+
+	// 默认允许任意来源时响应不带 Access-Control-Allow-Credentials
+	_, ts := newTestServer(t, func(cfg *Config) { cfg.CORS.AllowCredentials = true })
+	resp, _ := doRequest(t, http.MethodGet, ts.URL+"/server", nil, "Origin", "https://evil.example")
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" || resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("CORS headers = %v", resp.Header)
+	}
+	cfg := defaultConfig()
+	cfg.Server.StorageDir = t.TempDir()
+	cfg.Log.Level = "error"
+	cfg.CORS.AllowedOrigins = []string{"*"}
+	cfg.CORS.AllowCredentials = true
+	if _, err := NewClipboardServer(cfg); err == nil || !strings.Contains(err.Error(), "allowCredentials") {
+		t.Errorf("wildcard origin with credentials: %v", err)
+	}
+}
+
+// 经过受信任的反向代理时，同源判断使用代理转发的原始主机
+func TestCORSSameOriginBehindProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		headers []string
+		want    int
+	}{
+		{"forwarded host", nil, []string{"X-Forwarded-For", "198.51.100.1", "X-Forwarded-Host", "clip.example.com"}, http.StatusOK},
+		{"backend host", nil, nil, http.StatusForbidden},
+		{"untrusted proxy", []string{}, []string{"X-Forwarded-For", "198.51.100.1", "X-Forwarded-Host", "clip.example.com"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ts := newTestServer(t, func(cfg *Config) {
+				cfg.Server.Auth = "pw"
+				if tt.trusted != nil {
+					cfg.Server.TrustedProxies = tt.trusted
+				}
+			})
+			headers := append([]string{"Origin", "https://clip.example.com", "Authorization", "Bearer pw"}, tt.headers...)
+			resp, data := doRequest(t, http.MethodGet, ts.URL+"/server", nil, headers...)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %s %s, want %d", resp.Status, data, tt.want)
+			}
+			if tt.want == http.StatusOK && resp.Header.Get("Access-Control-Allow-Origin") != "https://clip.example.com" {
+				t.Errorf("Access-Control-Allow-Origin = %q", resp.Header.Get("Access-Control-Allow-Origin"))
+			}
+		})
+	}
+}
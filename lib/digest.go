@@ -0,0 +1,166 @@
+package lib
+
+/**
+*** FILE: digest.go
+***   handle end-to-end integrity of uploads: declared digests, streaming hashes and the Digest/ETag of files
+**/
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// 文件摘要保存为 "sha256:<hex>"，下载时作为 Digest 和 ETag 响应头
+const fileDigestPrefix = "sha256:"
+
+// digestAlgorithms 客户端可以声明的摘要算法 (RFC 3230 的名称)
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"blake3":  func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// expectedDigest 客户端声明的文件摘要
+type expectedDigest struct {
+	Algorithm string // sha-256 或 blake3
+	Sum       []byte
+}
+
+// parseDigest 解析 "sha-256=<base64>" 或 "blake3=<hex>" 形式的摘要，值可以是 base64 或十六进制
+// 也接受 "sha256:<hex>"，与 FileReceive.Digest 的格式相同
+func parseDigest(value string) (*expectedDigest, error) {
+	algorithm, encoded, ok := strings.Cut(strings.TrimSpace(value), "=")
+	if !ok {
+		algorithm, encoded, ok = strings.Cut(strings.TrimSpace(value), ":")
+	}
+	if !ok {
+		return nil, fmt.Errorf("无效的摘要 '%s'", value)
+	}
+	algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+	if algorithm == "sha256" {
+		algorithm = "sha-256"
+	}
+	newHash, supported := digestAlgorithms[algorithm]
+	if !supported {
+		return nil, fmt.Errorf("不支持的摘要算法 '%s'", algorithm)
+	}
+	size := newHash().Size()
+	encoded = strings.TrimSpace(encoded)
+	sum, err := hex.DecodeString(encoded)
+	if err != nil || len(sum) != size {
+		sum, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(sum) != size {
+		return nil, fmt.Errorf("无效的 %s 摘要值", algorithm)
+	}
+	return &expectedDigest{Algorithm: algorithm, Sum: sum}, nil
+}
+
+// uploadHasher 在写入文件的同时计算 SHA-256 (保存为文件摘要)，客户端声明了其他算法时同时计算该算法
+type uploadHasher struct {
+	sha256   hash.Hash
+	expected *expectedDigest
+	check    hash.Hash // 与 expected 对应的哈希
+	Size     int64     // 已写入的字节数
+}
+
+func newUploadHasher(expected *expectedDigest) *uploadHasher {
+	h := &uploadHasher{sha256: sha256.New(), expected: expected}
+	switch {
+	case expected == nil:
+	case expected.Algorithm == "sha-256":
+		h.check = h.sha256
+	default:
+		h.check = digestAlgorithms[expected.Algorithm]()
+	}
+	return h
+}
+
+func (h *uploadHasher) Write(p []byte) (int, error) {
+	h.sha256.Write(p)
+	if h.check != nil && h.check != h.sha256 {
+		h.check.Write(p)
+	}
+	h.Size += int64(len(p))
+	return len(p), nil
+}
+
+// digest 返回保存在 FileReceive.Digest 中的文件摘要
+func (h *uploadHasher) digest() string {
+	return fileDigestPrefix + hex.EncodeToString(h.sha256.Sum(nil))
+}
+
+// verify 检查数据是否与声明的摘要一致，未声明摘要时总是通过
+func (h *uploadHasher) verify() error {
+	if h.expected == nil {
+		return nil
+	}
+	if sum := h.check.Sum(nil); string(sum) != string(h.expected.Sum) {
+		return fmt.Errorf("%s 摘要不匹配 (声明 %x, 实际 %x)", h.expected.Algorithm, h.expected.Sum, sum)
+	}
+	return nil
+}
+
+// hashFile 计算已保存文件的摘要，用于没有在上传时计算摘要的文件 (例如 tus 上传)
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := newUploadHasher(nil)
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return h.digest(), nil
+}
+
+// setDigestHeaders 为文件下载设置 Digest (RFC 3230) 和 ETag 响应头
+func setDigestHeaders(w http.ResponseWriter, digest string) {
+	sum, err := hex.DecodeString(strings.TrimPrefix(digest, fileDigestPrefix))
+	if !strings.HasPrefix(digest, fileDigestPrefix) || err != nil {
+		return
+	}
+	w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+	w.Header().Set("Access-Control-Expose-Headers", "Digest, ETag")
+}
+
+// verifyUpload 检查上传的数据与声明的大小和摘要是否一致，不一致时删除文件并写入 422 响应
+func (s *ClipboardServer) verifyUpload(w http.ResponseWriter, r *http.Request, fileInfo File, declaredSize int64, h *uploadHasher) bool {
+	code, err := "DigestMismatch", h.verify()
+	if err == nil && declaredSize >= 0 && h.Size != declaredSize {
+		code, err = "SizeMismatch", fmt.Errorf("大小不匹配 (声明 %d, 实际 %d)", declaredSize, h.Size)
+	}
+	if err == nil {
+		return true
+	}
+	s.logf(logFile, slog.LevelWarn, "警告: 文件 %s (UUID: %s) 校验失败: %v。来自 IP: %s", fileInfo.Name, fileInfo.UUID, err, get_remote_ip(r))
+	s.deleteUploadedFile(fileInfo.UUID)
+	writeJSONError(w, http.StatusUnprocessableEntity, code, fmt.Sprintf("文件校验失败: %v", err))
+	s.abortProgress(fileInfo.UUID, fmt.Sprintf("文件校验失败: %v", err))
+	return false
+}
+
+// ensureFileDigest 返回文件的摘要，上传时没有计算过的文件在这里计算
+func (s *ClipboardServer) ensureFileDigest(fileInfo File) string {
+	if fileInfo.Digest != "" {
+		return fileInfo.Digest
+	}
+	digest, err := hashFile(filepath.Join(s.storageFolder, fileInfo.UUID))
+	if err != nil {
+		s.logf(logFile, slog.LevelWarn, "警告: 计算文件 %s 的摘要失败: %v", fileInfo.UUID, err)
+		return ""
+	}
+	return digest
+}
@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"lukechampine.com/blake3"
+)
+
+func TestParseDigest(t *testing.T) {
+	sha := sha256.Sum256([]byte("hello"))
+	b3 := blake3.Sum256([]byte("hello"))
+	shaHex, shaB64 := hex.EncodeToString(sha[:]), base64.StdEncoding.EncodeToString(sha[:])
+	tests := []struct {
+		value         string
+		wantAlgorithm string
+		wantSum       []byte
+		wantErr       bool
+	}{
+		{"sha-256=" + shaB64, "sha-256", sha[:], false},
+		{"SHA-256=" + shaHex, "sha-256", sha[:], false},
+		{"sha256:" + shaHex, "sha-256", sha[:], false}, // FileReceive.Digest 的格式
+		{" sha-256 = " + shaB64 + " ", "sha-256", sha[:], false},
+		{"blake3=" + hex.EncodeToString(b3[:]), "blake3", b3[:], false},
+		{"blake3=" + base64.StdEncoding.EncodeToString(b3[:]), "blake3", b3[:], false},
+		{"md5=XUFAKrxLKna5cZ2REBfFkg==", "", nil, true},
+		{"sha-256", "", nil, true},
+		{"sha-256=" + shaHex[:62], "", nil, true},
+		{"sha-256=" + base64.StdEncoding.EncodeToString(sha[:16]), "", nil, true},
+		{"sha-256=not-base64!", "", nil, true},
+		{"", "", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDigest(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDigest(%q) error = %v", tt.value, err)
+			continue
+		}
+		if err == nil && (got.Algorithm != tt.wantAlgorithm || string(got.Sum) != string(tt.wantSum)) {
+			t.Errorf("parseDigest(%q) = %s %x", tt.value, got.Algorithm, got.Sum)
+		}
+	}
+}
+
+func TestUploadHasher(t *testing.T) {
+	sha := sha256.Sum256([]byte("hello"))
+	b3 := blake3.Sum256([]byte("hello"))
+	tests := []struct {
+		name     string
+		expected *expectedDigest
+		wantErr  bool
+	}{
+		{"none", nil, false},
+		{"sha-256", &expectedDigest{Algorithm: "sha-256", Sum: sha[:]}, false},
+		{"blake3", &expectedDigest{Algorithm: "blake3", Sum: b3[:]}, false},
+		{"sha-256 mismatch", &expectedDigest{Algorithm: "sha-256", Sum: b3[:]}, true},
+		{"blake3 mismatch", &expectedDigest{Algorithm: "blake3", Sum: sha[:]}, true},
+	}
+	for _, tt := range tests {
+		h := newUploadHasher(tt.expected)
+		h.Write([]byte("hel"))
+		h.Write([]byte("lo"))
+		if err := h.verify(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: verify = %v", tt.name, err)
+		}
+		// 保存的文件摘要总是 SHA-256
+		if h.digest() != fileDigestPrefix+hex.EncodeToString(sha[:]) || h.Size != 5 {
+			t.Errorf("%s: digest %s, size %d", tt.name, h.digest(), h.Size)
+		}
+	}
+}
+
+func TestSetDigestHeaders(t *testing.T) {
+	sha := sha256.Sum256([]byte("hello"))
+	w := httptest.NewRecorder()
+	setDigestHeaders(w, fileDigestPrefix+hex.EncodeToString(sha[:]))
+	if w.Header().Get("Digest") != "sha-256="+base64.StdEncoding.EncodeToString(sha[:]) || w.Header().Get("ETag") != `"`+hex.EncodeToString(sha[:])+`"` {
+		t.Errorf("headers = %v", w.Header())
+	}
+	for _, digest := range []string{"", "md5:abcd", "sha256:zz"} {
+		w := httptest.NewRecorder()
+		setDigestHeaders(w, digest)
+		if len(w.Header()) != 0 {
+			t.Errorf("setDigestHeaders(%q) = %v", digest, w.Header())
+		}
+	}
+}
+
+// 声明的摘要或大小与上传的数据不一致时返回 422 并删除文件
+func TestUploadIntegrity(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	sha := sha256.Sum256([]byte("hello"))
+	digest := "sha-256=" + base64.StdEncoding.EncodeToString(sha[:])
+	tests := []struct {
+		name    string
+		headers []string
+		want    int
+		code    string
+	}{
+		{"matching digest", []string{"Digest", digest}, http.StatusOK, ""},
+		{"matching digest and size", []string{"Digest", digest, "Upload-Length", "5"}, http.StatusOK, ""},
+		{"digest mismatch", []string{"Digest", "sha256:" + strings.Repeat("00", 32)}, http.StatusUnprocessableEntity, "DigestMismatch"},
+		{"size mismatch", []string{"Upload-Length", "6"}, http.StatusUnprocessableEntity, "SizeMismatch"},
+		{"unsupported algorithm", []string{"Digest", "md5=XUFAKrxLKna5cZ2REBfFkg=="}, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		resp, data := postFile(t, ts, "", "a.txt", []byte("hello"), tt.headers...)
+		if resp.StatusCode != tt.want || !strings.Contains(string(data), tt.code) {
+			t.Errorf("%s: %s %s", tt.name, resp.Status, data)
+		}
+	}
+	// 校验失败的文件不会留在存储目录中
+	entries, _ := os.ReadDir(s.storageFolder)
+	files := 0
+	for _, e := range entries {
+		if !e.IsDir() && !strings.Contains(e.Name(), ".") {
+			files++
+		}
+	}
+	if files != 2 {
+		t.Errorf("%d stored files, want 2", files)
+	}
+
+	id := uploadFile(t, ts, "", "b.txt", []byte("hello"))
+	resp, _ := doRequest(t, http.MethodGet, ts.URL+"/file/"+messageFile(s, id), nil)
+	if resp.Header.Get("Digest") != digest {
+		t.Errorf("download Digest = %q, want %q", resp.Header.Get("Digest"), digest)
+	}
+}
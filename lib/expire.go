@@ -0,0 +1,145 @@
+package lib
+
+/**
+*** FILE: expire.go
+***   handle per-upload expiry: requested lifetimes bounded by file.minExpire/maxExpire,
+***   files that never expire, and extending the expiry of published files
+**/
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expireNever 表示永不过期的有效期；文件的 ExpireTime 和消息的 expire 为 0 表示永不过期
+const expireNever = -1
+
+// isExpired 判断过期时间是否已过，0 表示永不过期
+func isExpired(expireTime int64, now int64) bool {
+	return expireTime != 0 && expireTime < now
+}
+
+// expireAfter 返回从现在起经过 ttl 秒的过期时间，ttl 为 expireNever 时返回 0
+func expireAfter(ttl int64) int64 {
+	if ttl == expireNever {
+		return 0
+	}
+	return time.Now().Unix() + ttl
+}
+
+// uploadTTL 解析请求的有效期 (秒数，或 never)，未指定时使用 file.expire
+// 有效期限制在 file.minExpire 和 file.maxExpire 之间；never 需要 admin 权限 (密码认证拥有全部权限)
+// 参数无效或无权时写入错误响应，ok 为 false
+func (s *ClipboardServer) uploadTTL(w http.ResponseWriter, r *http.Request, value string) (ttl int64, ok bool) {
+	if value == "" {
+		return int64(s.config.File.Expire), true
+	}
+	if value == "never" {
+		if info := authFromRequest(r); info != nil && info.hasScope(scopeAdmin) {
+			return expireNever, true
+		}
+		s.logf(logAuth, slog.LevelInfo, "拒绝永不过期的请求: 需要 admin 权限。来自 IP: %s", get_remote_ip(r))
+		writeJSONError(w, http.StatusForbidden, "Forbidden", "只有管理员可以设置永不过期")
+		return 0, false
+	}
+	ttl, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ttl <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "BadRequest", "无效的 expire 参数，应为有效期秒数或 never")
+		return 0, false
+	}
+	if cfg := s.config.File; cfg.MinExpire > 0 && ttl < int64(cfg.MinExpire) {
+		ttl = int64(cfg.MinExpire)
+	} else if cfg.MaxExpire > 0 && ttl > int64(cfg.MaxExpire) {
+		ttl = int64(cfg.MaxExpire)
+	}
+	return ttl, true
+}
+
+// handleExpire 修改已发布的文件或文件夹的有效期 (POST /expire/{id}?expire=秒数|never&room=)
+// 新的过期时间从现在起计算，更新后的消息通过 update 事件广播
+func (s *ClipboardServer) handleExpire(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅允许 POST 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/expire/"))
+	if err != nil {
+		http.Error(w, "无效的消息 ID", http.StatusBadRequest)
+		return
+	}
+	room := r.URL.Query().Get("room")
+	if r.URL.Query().Get("expire") == "" {
+		writeJSONError(w, http.StatusBadRequest, "BadRequest", "缺少 expire 参数")
+		return
+	}
+	ttl, ok := s.uploadTTL(w, r, r.URL.Query().Get("expire"))
+	if !ok {
+		return
+	}
+
+	var found *FileReceive
+	s.messageQueue.Lock()
+	for _, msg := range s.messageQueue.List {
+		if msg.Data.ID() == id && msg.Data.FileReceive != nil && (room == "" || msg.Data.Room() == "" || msg.Data.Room() == room) {
+			fileRec := *msg.Data.FileReceive
+			found = &fileRec
+			break
+		}
+	}
+	s.messageQueue.Unlock()
+	if found == nil {
+		http.Error(w, "文件消息未找到", http.StatusNotFound)
+		return
+	}
+	if !s.checkRoomAccess(w, r, found.Room) {
+		return
+	}
+
+	uuids := []string{found.Cache}
+	if found.Type == "folder" {
+		uuids = uuids[:0]
+		for _, e := range found.Entries {
+			uuids = append(uuids, e.UUID)
+		}
+	}
+	expire := expireAfter(ttl)
+	now := time.Now().Unix()
+	updated := 0
+	s.runMutex.Lock()
+	for _, uuid := range uuids {
+		if fileInfo, ok := s.uploadFileMap[uuid]; ok && !isExpired(fileInfo.ExpireTime, now) {
+			fileInfo.ExpireTime = expire
+			s.uploadFileMap[uuid] = fileInfo
+			updated++
+		}
+	}
+	s.runMutex.Unlock()
+	if updated == 0 {
+		http.Error(w, "文件未找到或已过期", http.StatusNotFound)
+		return
+	}
+
+	// 更新消息队列中的消息，消息可能已被撤销
+	s.messageQueue.Lock()
+	for i, msg := range s.messageQueue.List {
+		if msg.Data.ID() == id && msg.Data.FileReceive != nil {
+			s.messageQueue.List[i].Data.FileReceive.Expire = expire
+			fileRec := *s.messageQueue.List[i].Data.FileReceive
+			found = &fileRec
+			break
+		}
+	}
+	s.messageQueue.Unlock()
+	s.broadcastWebSocketMessage(WebSocketMessage{Event: "update", Data: found}, found.Room)
+	s.saveHistoryData()
+	s.audit(r, auditExpire, found.Room, id, found.Cache, fmt.Sprintf("过期时间 %d", expire))
+	s.logf(logFile, slog.LevelInfo, "已修改 %s (UUID: %s) 的过期时间: %d, 来自: %s", found.Name, found.Cache, expire, get_remote_ip(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": strconv.Itoa(id), "expire": expire})
+}
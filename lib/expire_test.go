@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsExpired(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		expire int64
+		want   bool
+	}{
+		{0, false}, // 永不过期
+		{now - 1, true},
+		{now, false},
+		{now + 60, false},
+	}
+	for _, tt := range tests {
+		if got := isExpired(tt.expire, now); got != tt.want {
+			t.Errorf("isExpired(%d) = %v, want %v", tt.expire, got, tt.want)
+		}
+	}
+	if expireAfter(expireNever) != 0 {
+		t.Error("expireAfter(never) != 0")
+	}
+	if got := expireAfter(60) - time.Now().Unix(); got < 59 || got > 60 {
+		t.Errorf("expireAfter(60) is %d seconds from now", got)
+	}
+}
+
+func TestUploadTTL(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.File.Expire = 3600
+		cfg.File.MinExpire = 60
+		cfg.File.MaxExpire = 7200
+	})
+	admin := &authInfo{Method: "password"}
+	writer := &authInfo{Method: "token", Scopes: []string{scopeRead, scopeWrite}}
+	tests := []struct {
+		value      string
+		auth       *authInfo
+		want       int64
+		wantStatus int
+	}{
+		{"", writer, 3600, 0},
+		{"600", writer, 600, 0},
+		{"5", writer, 60, 0},
+		{"99999", writer, 7200, 0},
+		{"never", admin, expireNever, 0},
+		{"never", writer, 0, http.StatusForbidden},
+		{"never", nil, 0, http.StatusForbidden},
+		{"0", writer, 0, http.StatusBadRequest},
+		{"-5", writer, 0, http.StatusBadRequest},
+		{"1h", writer, 0, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/upload?expire="+tt.value, nil)
+		if tt.auth != nil {
+			r = withAuthInfo(r, tt.auth)
+		}
+		w := httptest.NewRecorder()
+		ttl, ok := s.uploadTTL(w, r, tt.value)
+		if tt.wantStatus != 0 {
+			if ok || w.Code != tt.wantStatus {
+				t.Errorf("uploadTTL(%q) ok=%v status=%d, want status %d", tt.value, ok, w.Code, tt.wantStatus)
+			}
+			continue
+		}
+		if !ok || ttl != tt.want {
+			t.Errorf("uploadTTL(%q) = %d, %v, want %d", tt.value, ttl, ok, tt.want)
+		}
+	}
+}
+
+func TestHandleExpire(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	id := uploadFile(t, ts, "?expire=120", "a.txt", []byte("hello"))
+	uuid := messageFile(s, id)
+
+	resp, data := doRequest(t, http.MethodPost, ts.URL+"/expire/"+id+"?expire=never", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(data), `"expire":0`) {
+		t.Fatalf("expire never: %s %s", resp.Status, data)
+	}
+	s.runMutex.Lock()
+	fileInfo := s.uploadFileMap[uuid]
+	s.runMutex.Unlock()
+	if fileInfo.ExpireTime != 0 {
+		t.Errorf("ExpireTime = %d, want 0", fileInfo.ExpireTime)
+	}
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/expire/"+id, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("missing expire: %s", resp.Status)
+	}
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/expire/999?expire=60", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown id: %s", resp.Status)
+	}
+}
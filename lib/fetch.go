@@ -0,0 +1,306 @@
+package lib
+
+/**
+*** FILE: fetch.go
+***   handle server-side downloads (POST /upload/url) with size, time and redirect limits and SSRF protection
+**/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// fetchBlockedNetworks net.IP 的方法没有覆盖、默认同样禁止访问的网段
+var fetchBlockedNetworks, _ = parseCIDRList([]string{
+	"0.0.0.0/8",     // 本网络
+	"100.64.0.0/10", // 运营商级 NAT
+	"192.0.0.0/24",  // IETF 协议分配
+	"198.18.0.0/15", // 基准测试
+	"240.0.0.0/4",   // 保留
+})
+
+// fetchAddressBlocked 判断服务器下载是否禁止连接该地址：默认禁止回环、私有、链路本地等地址，
+// fetch.allowedNetworks 中的地址除外
+func (s *ClipboardServer) fetchAddressBlocked(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range s.fetchAllowed {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, n := range fetchBlockedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchDialControl 在建立连接前检查 DNS 解析后的实际地址，重定向和 DNS 重绑定都无法绕过
+func (s *ClipboardServer) fetchDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("无效的地址 %s", host)
+	}
+	if s.fetchAddressBlocked(ip) {
+		return fmt.Errorf("禁止访问内网地址 %s", ip)
+	}
+	return nil
+}
+
+// newFetchClient 创建服务器下载使用的 HTTP 客户端
+func (s *ClipboardServer) newFetchClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: s.fetchDialControl}
+	maxRedirects := s.config.Fetch.MaxRedirects
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 nil, // 不使用环境变量中的代理，否则无法检查实际连接的地址
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("重定向次数超过 %d 次", maxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("不支持的重定向地址 %s", req.URL.Redacted())
+			}
+			return nil
+		},
+	}
+}
+
+// fetchMaxSize 返回服务器下载的大小限制，0 表示不限制
+func (s *ClipboardServer) fetchMaxSize() int64 {
+	if s.config.Fetch.MaxSize > 0 {
+		return s.config.Fetch.MaxSize
+	}
+	return int64(s.config.File.Limit)
+}
+
+// fetchFileName 根据 Content-Disposition 或最终 URL 的路径确定文件名
+func fetchFileName(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return filepath.Base(params["filename"])
+	}
+	return urlFileName(resp.Request.URL)
+}
+
+// urlFileName 返回 URL 路径的最后一段，没有时为 download
+func urlFileName(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "" || name == "." || name == "/" {
+		return "download"
+	}
+	return name
+}
+
+// discardResponseWriter 后台任务调用会写入响应的函数时使用，错误通过 upload_abort 事件通知
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (rw *discardResponseWriter) Header() http.Header {
+	if rw.header == nil {
+		rw.header = make(http.Header)
+	}
+	return rw.header
+}
+
+func (rw *discardResponseWriter) WriteHeader(int)             {}
+func (rw *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+// handleUploadURL 由服务器下载 URL 指向的文件并发布到房间 (POST /upload/url)
+// 请求体为 JSON {"url": ..., "name": ..., "room": ...} 或 URL 本身 (text/plain)
+// 下载在后台进行，立即返回 202；进度通过 upload_start、upload_progress、upload_abort 事件广播
+func (s *ClipboardServer) handleUploadURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅允许 POST 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.config.Fetch.Enabled {
+		writeJSONError(w, http.StatusNotFound, "NotFound", "服务器下载未启用")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, "无法读取请求体", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		URL  string `json:"url"`
+		Name string `json:"name"`
+		Room string `json:"room"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "BadRequest", "无效的请求")
+			return
+		}
+	} else {
+		req.URL = strings.TrimSpace(string(body))
+	}
+	target, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		writeJSONError(w, http.StatusBadRequest, "BadRequest", "无效的 URL，仅支持 http 和 https")
+		return
+	}
+
+	room := req.Room
+	if room == "" {
+		room = r.URL.Query().Get("room")
+	}
+	if room == "" {
+		room = "default"
+	}
+	if !s.checkRoomAccess(w, r, room) {
+		return
+	}
+	if !s.checkRateLimit(w, r, limitMessage, room, 1) {
+		return
+	}
+	ttl, ok := s.uploadTTL(w, r, r.URL.Query().Get("expire"))
+	if !ok {
+		return
+	}
+
+	uuid := gen_UUID()
+	name := ""
+	if req.Name != "" {
+		name = filepath.Base(req.Name)
+	}
+	s.logf(logFile, slog.LevelInfo, "开始服务器下载: %s, UUID: %s, 房间: %s, 来自: %s", target.Redacted(), uuid, room, get_remote_ip(r))
+
+	// 后台任务使用请求的副本 (发送者信息、认证身份)，不随请求结束而取消，可以通过 /upload/cancel 取消
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), time.Duration(s.config.Fetch.Timeout)*time.Second)
+	s.fetchTasks.Store(uuid, &fetchTask{room: room, cancel: cancel})
+	go s.fetchURL(r.Clone(ctx), uuid, room, target, name, ttl)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"uuid": uuid})
+}
+
+// fetchURL 下载文件并像普通上传一样检查、扫描和发布，失败时广播 upload_abort
+// r 的 context 带有下载超时，取消时停止下载
+func (s *ClipboardServer) fetchURL(r *http.Request, uuid, room string, target *url.URL, name string, ttl int64) {
+	defer func() {
+		if task, ok := s.fetchTasks.LoadAndDelete(uuid); ok {
+			task.(*fetchTask).cancel()
+		}
+	}()
+	displayName := name
+	if displayName == "" {
+		displayName = urlFileName(target)
+	}
+	progress := s.newProgressReporter(room, uploadProgress{UUID: uuid, Name: displayName, Size: -1, Source: target.Redacted()})
+	fail := func(reason string) {
+		s.logf(logFile, slog.LevelWarn, "警告: 服务器下载 %s 失败: %s", target.Redacted(), reason)
+		progress.abort(reason)
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.String(), nil)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	req.Header.Set("User-Agent", "cloud-clip")
+	resp, err := s.fetchClient.Do(req)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fail(fmt.Sprintf("服务器返回 %s", resp.Status))
+		return
+	}
+	maxSize := s.fetchMaxSize()
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		fail(fmt.Sprintf("文件大小超出限制 (最大 %d 字节)", maxSize))
+		return
+	}
+	if name == "" {
+		name = fetchFileName(resp)
+	}
+	progress.describe(name, resp.ContentLength)
+
+	filePath := filepath.Join(s.storageFolder, uuid)
+	dst, err := os.Create(filePath)
+	if err != nil {
+		s.logf(logFile, slog.LevelError, "错误: 创建文件 %s 失败: %v", filePath, err)
+		fail("无法保存文件")
+		return
+	}
+	var body io.Reader = resp.Body
+	if maxSize > 0 {
+		body = io.LimitReader(resp.Body, maxSize+1)
+	}
+	hasher := newUploadHasher(nil)
+	_, err = io.Copy(io.MultiWriter(dst, hasher, progress), body)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && maxSize > 0 && hasher.Size > maxSize {
+		err = fmt.Errorf("文件大小超出限制 (最大 %d 字节)", maxSize)
+	}
+	if err == nil {
+		err = r.Context().Err() // 下载完成后、发布前被取消
+	}
+	if err != nil {
+		os.Remove(filePath)
+		fail(err.Error())
+		return
+	}
+	// 发布前取走任务，之后的取消请求找不到它；任务已被取消请求取走时不发布
+	task, ok := s.fetchTasks.LoadAndDelete(uuid)
+	if !ok {
+		os.Remove(filePath)
+		fail("上传已取消")
+		return
+	}
+	defer task.(*fetchTask).cancel()
+
+	timestamp := time.Now().Unix()
+	fileInfo := File{
+		Name:       name,
+		UUID:       uuid,
+		Size:       hasher.Size,
+		UploadTime: timestamp,
+		ExpireTime: expireAfter(ttl),
+		Room:       room,
+		Digest:     hasher.digest(),
+	}
+	s.runMutex.Lock()
+	s.uploadFileMap[uuid] = fileInfo
+	s.runMutex.Unlock()
+
+	// 检查未通过时 finalizeUploadedFile 会广播 upload_abort
+	s.finalizeUploadedFile(&discardResponseWriter{}, r, fileInfo)
+}
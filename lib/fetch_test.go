@@ -0,0 +1,202 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFetchAddressBlocked(t *testing.T) {
+	allowed, _ := parseCIDRList([]string{"192.168.1.10", "10.1.0.0/16"})
+	s := &ClipboardServer{fetchAllowed: allowed}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.0.0.1", true},
+		{"172.16.5.4", true},
+		{"192.168.1.11", true},
+		{"169.254.169.254", true}, // 云服务元数据地址
+		{"100.64.1.1", true},
+		{"0.0.0.0", true},
+		{"::ffff:127.0.0.1", true},
+		{"fe80::1", true},
+		{"93.184.216.34", false},
+		{"2606:4700::1111", false},
+		{"192.168.1.10", false}, // allowedNetworks
+		{"10.1.2.3", false},
+	}
+	for _, tt := range tests {
+		if got := s.fetchAddressBlocked(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("fetchAddressBlocked(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+// fetchOrigin 测试用的下载源：/data/{n} 返回 n 字节，/stream/{n} 不带 Content-Length，/redirect/{n} 经过 n 次重定向后返回数据
+func fetchOrigin(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data/", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/data/"))
+		w.Header().Set("Content-Length", strconv.Itoa(n))
+		w.Write([]byte(strings.Repeat("a", n)))
+	})
+	mux.HandleFunc("/stream/", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/stream/"))
+		for i := 0; i < n; i++ {
+			w.Write([]byte("a"))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		if n == 0 {
+			http.Redirect(w, r, "/data/4", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+	})
+	origin := httptest.NewServer(mux)
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// fetch 提交服务器下载并等待结果：发布成功时 reason 为空
+func fetch(t *testing.T, ts *httptest.Server, conn *websocket.Conn, target string) (reason string) {
+	t.Helper()
+	resp, data := doRequest(t, http.MethodPost, ts.URL+"/upload/url", strings.NewReader(target), "Content-Type", "text/plain")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("upload/url: %s %s", resp.Status, data)
+	}
+	var accepted struct{ UUID string }
+	json.Unmarshal(data, &accepted)
+	for {
+		var msg struct {
+			Event string `json:"event"`
+			Data  struct {
+				UUID   string `json:"uuid"`
+				Cache  string `json:"cache"`
+				Reason string `json:"reason"`
+			} `json:"data"`
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case msg.Event == eventUploadAbort && msg.Data.UUID == accepted.UUID:
+			return msg.Data.Reason
+		case msg.Event == "receive" && msg.Data.Cache == accepted.UUID:
+			return ""
+		}
+	}
+}
+
+func TestFetchDisabledByDefault(t *testing.T) {
+	_, ts := newTestServer(t, nil)
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/upload/url", strings.NewReader("https://example.com/a")); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("upload/url: %s", resp.Status)
+	}
+}
+
+func TestFetchBlocksInternalAddress(t *testing.T) {
+	origin := fetchOrigin(t)
+	// 允许访问的地址重定向到禁止访问的地址
+	ln, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	redirect := httptest.NewUnstartedServer(http.RedirectHandler(origin.URL+"/data/4", http.StatusFound))
+	redirect.Listener.Close()
+	redirect.Listener = ln
+	redirect.Start()
+	defer redirect.Close()
+
+	_, ts := newTestServer(t, func(cfg *Config) {
+		cfg.Fetch.Enabled = true
+		cfg.Fetch.AllowedNetworks = []string{"127.0.0.2"}
+	})
+	conn := dialPush(t, ts, "")
+	if reason := fetch(t, ts, conn, origin.URL+"/data/4"); !strings.Contains(reason, "禁止访问内网地址 127.0.0.1") {
+		t.Errorf("loopback fetch: %q", reason)
+	}
+	if reason := fetch(t, ts, conn, redirect.URL); !strings.Contains(reason, "禁止访问内网地址 127.0.0.1") {
+		t.Errorf("redirected fetch: %q", reason)
+	}
+}
+
+func TestFetchLimits(t *testing.T) {
+	origin := fetchOrigin(t)
+	_, ts := newTestServer(t, func(cfg *Config) {
+		cfg.Fetch.Enabled = true
+		cfg.Fetch.AllowedNetworks = []string{"127.0.0.1"}
+		cfg.Fetch.MaxSize = 8
+		cfg.Fetch.MaxRedirects = 2
+	})
+	conn := dialPush(t, ts, "")
+	tests := []struct {
+		path   string
+		reason string
+	}{
+		{"/data/8", ""},
+		{"/data/9", "文件大小超出限制"},
+		{"/stream/8", ""},
+		{"/stream/9", "文件大小超出限制"},
+		{"/redirect/1", ""},
+		{"/redirect/2", "重定向次数超过"},
+	}
+	for _, tt := range tests {
+		reason := fetch(t, ts, conn, origin.URL+tt.path)
+		if (tt.reason == "" && reason != "") || !strings.Contains(reason, tt.reason) {
+			t.Errorf("fetch %s: reason %q, want %q", tt.path, reason, tt.reason)
+		}
+	}
+}
+
+// 取消请求先取走任务时，即使下载已经完成也不会发布
+func TestFetchCancelRace(t *testing.T) {
+	origin := fetchOrigin(t)
+	s, ts := newTestServer(t, func(cfg *Config) {
+		cfg.Fetch.Enabled = true
+		cfg.Fetch.AllowedNetworks = []string{"127.0.0.1"}
+	})
+	target, _ := url.Parse(origin.URL + "/data/4")
+
+	// 取消请求已经取走任务 (但还没有取消下载的 context)
+	s.fetchURL(httptest.NewRequest(http.MethodPost, "/upload/url", nil), "cancelled", "default", target, "a.txt", 0)
+	if _, err := os.Stat(filepath.Join(s.storageFolder, "cancelled")); !os.IsNotExist(err) {
+		t.Errorf("cancelled download kept on disk: %v", err)
+	}
+	s.messageQueue.Lock()
+	published := len(s.messageQueue.List)
+	s.messageQueue.Unlock()
+	if published != 0 {
+		t.Errorf("cancelled download published %d messages", published)
+	}
+
+	// 取消请求取走任务后，下载的 context 被取消，再次取消返回 404
+	cancelled := false
+	s.fetchTasks.Store("running", &fetchTask{room: "default", cancel: func() { cancelled = true }})
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/upload/cancel/running", nil); resp.StatusCode != http.StatusOK || !cancelled {
+		t.Errorf("cancel running download: %s, cancelled %v", resp.Status, cancelled)
+	}
+	if _, ok := s.fetchTasks.Load("running"); ok {
+		t.Error("cancelled task still registered")
+	}
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/upload/cancel/running", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second cancel: %s", resp.Status)
+	}
+}
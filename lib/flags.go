@@ -24,6 +24,7 @@ var (
 	flg_file_limit   = flag.Int("file_limit", 0, "指定文件大小限制，如果设置则覆盖配置文件")
 	flg_cert         = flag.String("cert", "", "指定证书文件，如果设置则覆盖配置文件")
 	flg_key          = flag.String("key", "", "指定密钥文件，如果设置则覆盖配置文件")
+	flg_tls_auto     = flag.Bool("tls-auto", false, "未指定证书时自动生成自签名证书并启用 HTTPS")
 	flg_static_dir   = flag.String("static", "", "Path to external static files (overrides config, used if not in embed mode or useEmbeddedStr=false)")
 	flg_help         = flag.Bool("h", false, "显示帮助信息")
 )
@@ -43,7 +44,8 @@ func printHelp() {
 
 }
 
-func init() {
+// parseCommandLine 解析并检查命令行参数，由 Main 调用 (导入本包的测试不会解析命令行)
+func parseCommandLine() {
 	// 自定义帮助信息
 	flag.Usage = printHelp
 
@@ -167,5 +169,9 @@ func applyCommandLineArgs(cfg *Config) { // 修改参数为 cfg *Config
 		fmt.Printf("使用命令行指定的密钥文件: %s\n", *flg_key)
 		cfg.Server.Key = *flg_key
 	}
+	if *flg_tls_auto {
+		fmt.Println("使用命令行启用自动自签名证书")
+		cfg.TLS.Auto = true
+	}
 
 }
@@ -0,0 +1,447 @@
+package lib
+
+/**
+*** FILE: folder.go
+***   handle folder uploads: files with relative paths published as a single "folder" message,
+***   downloaded as a zip or tar.gz archive built on the fly, or entry by entry
+**/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// folderUpload 进行中的文件夹上传，条目上传后即作为普通文件记录在文件映射中
+type folderUpload struct {
+	sync.Mutex
+	Name    string // 为空时发布时取条目共同的顶层目录名
+	Room    string
+	TTL     int64 // 请求的有效期 (秒)，发布时从发布时间起计算
+	Expire  int64 // 未完成的上传在此之后失效，已上传的条目按文件的过期时间清理
+	Entries []FolderEntry
+}
+
+// size 返回已上传条目的总大小，调用方需持有锁
+func (u *folderUpload) size() int64 {
+	var total int64
+	for _, e := range u.Entries {
+		total += e.Size
+	}
+	return total
+}
+
+// folderEntryPath 检查并规范化条目的相对路径：使用 / 分隔，忽略开头的 /，不能包含 . 或 ..
+func folderEntryPath(raw string) (string, error) {
+	p := strings.Trim(strings.ReplaceAll(raw, "\\", "/"), "/")
+	for _, segment := range strings.Split(p, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("无效的相对路径 '%s'", raw)
+		}
+	}
+	return p, nil
+}
+
+// folderName 返回所有条目共同的顶层目录名，没有时为 folder
+func folderName(entries []FolderEntry) string {
+	top, _, _ := strings.Cut(entries[0].Path, "/")
+	for _, e := range entries {
+		if dir, _, nested := strings.Cut(e.Path, "/"); !nested || dir != top {
+			return "folder"
+		}
+	}
+	return top
+}
+
+// lookupFolderUpload 返回进行中的文件夹上传，已失效时清除
+func (s *ClipboardServer) lookupFolderUpload(uuid string) (*folderUpload, bool) {
+	s.folderMutex.Lock()
+	defer s.folderMutex.Unlock()
+	upload, ok := s.folderUploads[uuid]
+	if ok && isExpired(upload.Expire, time.Now().Unix()) {
+		delete(s.folderUploads, uuid)
+		return nil, false
+	}
+	return upload, ok
+}
+
+// lookupFolder 在消息队列中查找已发布的文件夹
+func (s *ClipboardServer) lookupFolder(uuid string) (FileReceive, bool) {
+	s.messageQueue.Lock()
+	defer s.messageQueue.Unlock()
+	for _, msg := range s.messageQueue.List {
+		if fileRec := msg.Data.FileReceive; fileRec != nil && fileRec.Type == "folder" && fileRec.Cache == uuid {
+			return *fileRec, true
+		}
+	}
+	return FileReceive{}, false
+}
+
+// deleteFolderEntries 删除文件夹的全部条目
+func (s *ClipboardServer) deleteFolderEntries(entries []FolderEntry) {
+	for _, e := range entries {
+		s.deleteUploadedFile(e.UUID)
+	}
+}
+
+// restoreFolderEntries 从历史记录恢复文件夹条目的文件映射，磁盘上不存在的条目跳过
+func (s *ClipboardServer) restoreFolderEntries(fileRec *FileReceive) {
+	for _, e := range fileRec.Entries {
+		if _, err := os.Stat(filepath.Join(s.storageFolder, e.UUID)); err != nil {
+			s.logf(logFile, slog.LevelInfo, "历史记录中的文件夹 %s 的条目 %s (UUID: %s) 在磁盘上未找到，将不加载到文件映射中。", fileRec.Name, e.Path, e.UUID)
+			continue
+		}
+		s.uploadFileMap[e.UUID] = File{
+			Name:       path.Base(e.Path),
+			UUID:       e.UUID,
+			Size:       e.Size,
+			UploadTime: fileRec.Timestamp,
+			ExpireTime: fileRec.Expire,
+			Room:       fileRec.Room,
+			MIME:       e.MIME,
+			Digest:     e.Digest,
+		}
+	}
+}
+
+// folderAvailableLocked 文件夹未过期且至少还有一个条目时保留其消息，调用方需持有 messageQueue 的锁
+func (s *ClipboardServer) folderAvailableLocked(fileRec *FileReceive, now int64) bool {
+	if isExpired(fileRec.Expire, now) {
+		return false
+	}
+	for _, e := range fileRec.Entries {
+		if _, ok := s.uploadFileMap[e.UUID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// folderContentInfo 返回 /content/{id}.json 中文件夹消息的信息
+func folderContentInfo(id int, fileRec *FileReceive) map[string]interface{} {
+	return map[string]interface{}{
+		"type":      "folder",
+		"name":      fileRec.Name,
+		"size":      fileRec.Size,
+		"uuid":      fileRec.Cache,
+		"url":       fileRec.URL,
+		"entries":   fileRec.Entries,
+		"id":        strconv.Itoa(id),
+		"timestamp": fileRec.Timestamp,
+	}
+}
+
+// handleUploadFolder 处理文件夹上传
+//
+//	POST /upload/folder                开始上传，请求体为 JSON {"name": ..., "room": ...}；multipart 请求体则一次上传全部条目并立即发布
+//	POST /upload/folder/{uuid}         上传一个或多个条目 (multipart，文件名为相对路径)
+//	GET  /upload/folder/{uuid}         查询已上传的条目
+//	POST /upload/folder/{uuid}/finish  发布文件夹消息
+func (s *ClipboardServer) handleUploadFolder(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/upload/folder"), "/")
+	uuid, action, _ := strings.Cut(rest, "/")
+	switch {
+	case uuid == "" && r.Method == http.MethodPost:
+		s.startFolderUpload(w, r)
+	case uuid != "" && action == "" && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		upload, ok := s.lookupFolderUpload(uuid)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "NotFound", "上传会话不存在、已完成或已过期")
+			return
+		}
+		if !s.checkRoomAccess(w, r, upload.Room) {
+			return
+		}
+		if r.Method == http.MethodPost && !s.addFolderEntries(w, r, upload) {
+			return
+		}
+		upload.Lock()
+		status := map[string]interface{}{"uuid": uuid, "name": upload.Name, "entries": upload.Entries, "size": upload.size()}
+		upload.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case uuid != "" && action == "finish" && r.Method == http.MethodPost:
+		upload, ok := s.lookupFolderUpload(uuid)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "NotFound", "上传会话不存在、已完成或已过期")
+			return
+		}
+		if !s.checkRoomAccess(w, r, upload.Room) || !s.checkRateLimit(w, r, limitMessage, upload.Room, 1) {
+			return
+		}
+		s.folderMutex.Lock()
+		_, current := s.folderUploads[uuid]
+		delete(s.folderUploads, uuid)
+		s.folderMutex.Unlock()
+		if !current { // 并发的 finish 请求已经发布
+			writeJSONError(w, http.StatusNotFound, "NotFound", "上传会话不存在、已完成或已过期")
+			return
+		}
+		s.publishFolder(w, r, uuid, upload)
+	default:
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+	}
+}
+
+// startFolderUpload 开始文件夹上传 (POST /upload/folder)
+func (s *ClipboardServer) startFolderUpload(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name, room := q.Get("name"), q.Get("room")
+	oneShot := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/")
+	if !oneShot && r.ContentLength != 0 {
+		var init struct {
+			Name string `json:"name"`
+			Room string `json:"room"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&init); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "BadRequest", "无效的初始化请求")
+			return
+		}
+		if init.Name != "" {
+			name = init.Name
+		}
+		if init.Room != "" {
+			room = init.Room
+		}
+	}
+	if room == "" {
+		room = "default"
+	}
+	if !s.checkRoomAccess(w, r, room) {
+		return
+	}
+	if name != "" {
+		name = filepath.Base(name)
+	}
+	ttl, ok := s.uploadTTL(w, r, q.Get("expire"))
+	if !ok {
+		return
+	}
+
+	uuid := gen_UUID()
+	upload := &folderUpload{Name: name, Room: room, TTL: ttl, Expire: expireAfter(ttl)}
+	if oneShot {
+		if !s.checkRateLimit(w, r, limitMessage, room, 1) || !s.addFolderEntries(w, r, upload) {
+			return
+		}
+		s.publishFolder(w, r, uuid, upload)
+		return
+	}
+
+	s.folderMutex.Lock()
+	s.folderUploads[uuid] = upload
+	s.folderMutex.Unlock()
+	s.logf(logFile, slog.LevelInfo, "开始文件夹上传: %s, UUID: %s, 房间: %s, 来自: %s", name, uuid, room, get_remote_ip(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"uuid": uuid})
+}
+
+// addFolderEntries 接收 multipart 请求中的条目，各部分的文件名为相对路径
+// 同一请求中任何一个条目失败时，本次请求的条目全部删除并写入错误响应
+func (s *ClipboardServer) addFolderEntries(w http.ResponseWriter, r *http.Request, upload *folderUpload) bool {
+	if r.ContentLength > 0 && !s.checkRateLimit(w, r, limitUpload, upload.Room, float64(r.ContentLength)) {
+		return false
+	}
+	received, ok := s.receiveMultipartFiles(w, r, upload.Room, upload.Expire, nil, -1)
+	if !ok {
+		return false
+	}
+	discard := func(reason string) {
+		for _, f := range received {
+			s.deleteUploadedFile(f.UUID)
+			s.abortProgress(f.UUID, reason)
+		}
+	}
+
+	entries := make([]FolderEntry, len(received))
+	for i, f := range received {
+		entryPath, err := folderEntryPath(f.path)
+		if err != nil {
+			discard(err.Error())
+			writeJSONError(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return false
+		}
+		entries[i] = FolderEntry{Path: entryPath, UUID: f.UUID}
+	}
+	for i, f := range received {
+		fileInfo, _, ok := s.inspectUploadedFile(w, r, f.File)
+		if !ok {
+			discard("同一请求中的其他文件未通过检查")
+			return false
+		}
+		entries[i].Size, entries[i].MIME, entries[i].Digest = fileInfo.Size, fileInfo.MIME, fileInfo.Digest
+	}
+
+	upload.Lock()
+	defer upload.Unlock()
+	paths := make(map[string]bool, len(upload.Entries)+len(entries))
+	for _, e := range upload.Entries {
+		paths[e.Path] = true
+	}
+	for _, e := range entries {
+		if paths[e.Path] {
+			discard("文件夹中已存在 " + e.Path)
+			writeJSONError(w, http.StatusConflict, "Conflict", fmt.Sprintf("文件夹中已存在 %s", e.Path))
+			return false
+		}
+		paths[e.Path] = true
+	}
+	upload.Entries = append(upload.Entries, entries...)
+	s.logf(logFile, slog.LevelInfo, "文件夹上传收到 %d 个条目, 共 %d 个, 房间: %s", len(entries), len(upload.Entries), upload.Room)
+	return true
+}
+
+// publishFolder 发布文件夹消息，条目的过期时间统一为文件夹的过期时间
+func (s *ClipboardServer) publishFolder(w http.ResponseWriter, r *http.Request, uuid string, upload *folderUpload) {
+	upload.Lock()
+	name, room := upload.Name, upload.Room
+	entries := append([]FolderEntry(nil), upload.Entries...)
+	upload.Unlock()
+
+	expire := expireAfter(upload.TTL)
+	var total int64
+	kept := entries[:0]
+	s.runMutex.Lock()
+	for _, e := range entries {
+		fileInfo, ok := s.uploadFileMap[e.UUID]
+		if !ok { // 上传期间被删除
+			continue
+		}
+		fileInfo.ExpireTime = expire
+		s.uploadFileMap[e.UUID] = fileInfo
+		kept = append(kept, e)
+		total += e.Size
+	}
+	s.runMutex.Unlock()
+	if len(kept) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "BadRequest", "文件夹中没有文件")
+		return
+	}
+	if name == "" {
+		name = folderName(kept)
+	}
+
+	fileReceiveData := &FileReceive{
+		Name:    name,
+		Size:    total,
+		Cache:   uuid,
+		Expire:  expire,
+		URL:     fmt.Sprintf("%s://%s%s/folder/%s", getScheme(r), getHost(r), s.config.Server.Prefix, uuid),
+		Entries: kept,
+	}
+	event := s.addMessageToQueueAndBroadcast("folder", fileReceiveData, room, r)
+	s.audit(r, auditUpload, room, event.Data.ID(), uuid, name)
+	s.logf(logFile, slog.LevelInfo, "文件夹 %s (UUID: %s) 上传完成, %d 个文件, 大小: %d, 房间: %s", name, uuid, len(kept), total, room)
+
+	contentURL := fmt.Sprintf("%s://%s%s/content/%d", getScheme(r), getHost(r), s.config.Server.Prefix, event.Data.ID())
+	if room != "default" {
+		contentURL += fmt.Sprintf("?room=%s", room)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"url":  contentURL,
+		"id":   strconv.Itoa(event.Data.ID()),
+		"type": "folder",
+	})
+}
+
+// handleFolder 下载文件夹 (GET /folder/{uuid}?format=zip|tar.gz) 或其中的一个条目 (GET /folder/{uuid}/{相对路径})
+// 归档边读取条目边写入响应；单个条目与 /file/{uuid} 相同，支持 Range 和 Digest
+func (s *ClipboardServer) handleFolder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "仅允许 GET 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	uuid, entryPath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/folder/"), "/")
+	folder, ok := s.lookupFolder(uuid)
+	if !ok || isExpired(folder.Expire, time.Now().Unix()) {
+		http.Error(w, "文件夹未找到或已过期", http.StatusNotFound)
+		return
+	}
+	if !s.checkRoomAccess(w, r, folder.Room) {
+		return
+	}
+
+	if entryPath != "" {
+		for _, e := range folder.Entries {
+			if e.Path == entryPath {
+				entryReq := r.Clone(r.Context())
+				entryReq.URL.Path = s.config.Server.Prefix + "/file/" + e.UUID
+				s.handle_file(w, entryReq)
+				return
+			}
+		}
+		http.Error(w, "文件夹中没有此文件", http.StatusNotFound)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	contentType, ok := archiveContentTypes[format]
+	if !ok {
+		http.Error(w, "不支持的格式，可选 zip 或 tar.gz", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().Unix()
+	var files []File
+	paths := make(map[string]string) // UUID -> 相对路径
+	s.runMutex.Lock()
+	for _, e := range folder.Entries {
+		if fileInfo, ok := s.uploadFileMap[e.UUID]; ok && !isExpired(fileInfo.ExpireTime, now) {
+			files = append(files, fileInfo)
+			paths[e.UUID] = e.Path
+		}
+	}
+	s.runMutex.Unlock()
+	if len(files) == 0 {
+		http.Error(w, "文件夹中的文件已被删除或已过期", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", folder.Name+"."+format))
+	if r.Method == http.MethodHead {
+		return
+	}
+	s.audit(r, auditDownload, folder.Room, folder.ID, uuid, folder.Name)
+	s.logf(logFile, slog.LevelInfo, "提供文件夹下载: %s (UUID: %s), 格式: %s, %d 个文件", folder.Name, uuid, format, len(files))
+
+	archive, _ := newArchiveWriter(w, format)
+	for _, fileInfo := range files {
+		if err := s.addArchiveFile(archive, paths[fileInfo.UUID], fileInfo); err != nil {
+			// 响应头已经发出，只能中断响应
+			s.logf(logFile, slog.LevelWarn, "警告: 打包文件夹 %s 中断: %v", uuid, err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		s.logf(logFile, slog.LevelWarn, "警告: 打包文件夹 %s 中断: %v", uuid, err)
+	}
+}
+
+// addArchiveFile 将存储目录中的文件写入归档
+func (s *ClipboardServer) addArchiveFile(archive archiveWriter, name string, fileInfo File) error {
+	file, err := os.Open(filepath.Join(s.storageFolder, fileInfo.UUID))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return archive.add(name, stat.Size(), stat.ModTime(), file)
+}
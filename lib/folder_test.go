@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFolderEntryPath(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"photos/a.jpg", "photos/a.jpg", false},
+		{"/photos/a.jpg", "photos/a.jpg", false},
+		{`photos\sub\a.jpg`, "photos/sub/a.jpg", false},
+		{"a.jpg", "a.jpg", false},
+		{"photos/../../etc/passwd", "", true},
+		{"..", "", true},
+		{"photos/./a.jpg", "", true},
+		{"photos//a.jpg", "", true},
+		{"", "", true},
+		{"/", "", true},
+	}
+	for _, tt := range tests {
+		got, err := folderEntryPath(tt.raw)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("folderEntryPath(%q) = %q, %v", tt.raw, got, err)
+		}
+	}
+}
+
+func TestFolderName(t *testing.T) {
+	tests := []struct {
+		paths []string
+		want  string
+	}{
+		{[]string{"photos/a.jpg", "photos/sub/b.jpg"}, "photos"},
+		{[]string{"photos/a.jpg", "docs/b.pdf"}, "folder"},
+		{[]string{"photos/a.jpg", "photos"}, "folder"},
+		{[]string{"a.jpg"}, "folder"},
+	}
+	for _, tt := range tests {
+		var entries []FolderEntry
+		for _, p := range tt.paths {
+			entries = append(entries, FolderEntry{Path: p})
+		}
+		if got := folderName(entries); got != tt.want {
+			t.Errorf("folderName(%v) = %q, want %q", tt.paths, got, tt.want)
+		}
+	}
+}
+
+// folderParts 以相对路径为文件名的 multipart 部分
+func folderParts(files map[string]string) []multipartPart {
+	var parts []multipartPart
+	for name, content := range files {
+		parts = append(parts, multipartPart{field: "file", filename: name, content: content})
+	}
+	return parts
+}
+
+func TestFolderUploadAndDownload(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	resp, data := postMultipart(t, ts.URL+"/upload/folder", folderParts(map[string]string{
+		"photos/a.txt":     "aaa",
+		"photos/sub/b.txt": "bbb",
+	}))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload folder: %s %s", resp.Status, data)
+	}
+	var result struct{ ID string }
+	json.Unmarshal(data, &result)
+	uuid := messageFile(s, result.ID)
+
+	resp, data = doRequest(t, http.MethodGet, ts.URL+"/folder/"+uuid, nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Disposition"), `"photos.zip"`) {
+		t.Fatalf("download folder: %s %s", resp.Status, resp.Header.Get("Content-Disposition"))
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		got[f.Name] = string(content)
+	}
+	if len(got) != 2 || got["photos/a.txt"] != "aaa" || got["photos/sub/b.txt"] != "bbb" {
+		t.Errorf("zip entries = %v", got)
+	}
+
+	if resp, data := doRequest(t, http.MethodGet, ts.URL+"/folder/"+uuid+"/photos/sub/b.txt", nil); resp.StatusCode != http.StatusOK || string(data) != "bbb" {
+		t.Errorf("entry download: %s %q", resp.Status, data)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/folder/"+uuid+"/photos/missing.txt", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing entry: %s", resp.Status)
+	}
+}
+
+func TestFolderUploadRejectsInvalidEntries(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	resp, data := postMultipart(t, ts.URL+"/upload/folder", folderParts(map[string]string{
+		"photos/a.txt":      "aaa",
+		"photos/../../x.sh": "evil",
+	}))
+	if resp.StatusCode != http.StatusBadRequest || storedFiles(t, s) != 0 {
+		t.Errorf("traversal: %s %s, %d stored files", resp.Status, data, storedFiles(t, s))
+	}
+
+	// 分批上传时路径重复的条目被拒绝
+	resp, data = doRequest(t, http.MethodPost, ts.URL+"/upload/folder", strings.NewReader(`{"name":"photos"}`), "Content-Type", "application/json")
+	var started struct{ UUID string }
+	json.Unmarshal(data, &started)
+	if resp.StatusCode != http.StatusOK || started.UUID == "" {
+		t.Fatalf("start: %s %s", resp.Status, data)
+	}
+	entryURL := ts.URL + "/upload/folder/" + started.UUID
+	if resp, data := postMultipart(t, entryURL, folderParts(map[string]string{"a.txt": "1"})); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first batch: %s %s", resp.Status, data)
+	}
+	if resp, _ := postMultipart(t, entryURL, folderParts(map[string]string{"a.txt": "2"})); resp.StatusCode != http.StatusConflict {
+		t.Errorf("duplicate path: %s", resp.Status)
+	}
+	if resp, data := doRequest(t, http.MethodPost, entryURL+"/finish", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("finish: %s %s", resp.Status, data)
+	}
+	if resp, _ := doRequest(t, http.MethodPost, entryURL+"/finish", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second finish: %s", resp.Status)
+	}
+	var names []string
+	s.runMutex.Lock()
+	for _, f := range s.uploadFileMap {
+		names = append(names, f.Name)
+	}
+	s.runMutex.Unlock()
+	sort.Strings(names)
+	if strings.Join(names, ",") != "a.txt" {
+		t.Errorf("stored files = %v", names)
+	}
+}
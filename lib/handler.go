@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"mime"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -17,24 +17,18 @@ import (
 )
 
 func (s *ClipboardServer) handle_server(w http.ResponseWriter, r *http.Request) {
-	s.logger.Printf("处理 /server 请求，来自: %s", get_remote_ip(r))
-	authNeeded := false
-	if authStr, ok := s.config.Server.Auth.(string); ok && authStr != "" {
-		authNeeded = true
-	} else if authBool, ok := s.config.Server.Auth.(bool); ok && authBool {
-		// 如同 authMiddleware 中的注释，如果 auth: true 但没有密码，这是一种不明确状态。
-		// 客户端可能需要知道是否需要认证。
-		authNeeded = true
-	}
+	s.logf(logHTTP, slog.LevelDebug, "处理 /server 请求，来自: %s", get_remote_ip(r))
+	_, authNeeded := s.authPassword()
 
 	wsProtocol := "ws"
-	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+	if getScheme(r) == "https" {
 		wsProtocol = "wss"
 	}
 
 	response := map[string]interface{}{
-		"server": fmt.Sprintf("%s://%s%s/push", wsProtocol, r.Host, s.config.Server.Prefix),
+		"server": fmt.Sprintf("%s://%s%s/push", wsProtocol, getHost(r), s.config.Server.Prefix),
 		"auth":   authNeeded,
+		"oidc":   s.oidc != nil,
 		"config": map[string]interface{}{
 			"server": map[string]interface{}{
 				"roomList": s.config.Server.RoomList,
@@ -43,7 +37,7 @@ func (s *ClipboardServer) handle_server(w http.ResponseWriter, r *http.Request)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		s.logger.Printf("错误: 编码 /server 响应失败: %v", err)
+		s.logf(logHTTP, slog.LevelError, "错误: 编码 /server 响应失败: %v", err)
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 	}
 }
@@ -54,46 +48,71 @@ func (s *ClipboardServer) handle_push(w http.ResponseWriter, r *http.Request) {
 	if room == "" {
 		room = "default" // 默认房间
 	}
-	s.logger.Printf("处理 /push WebSocket 连接请求，来自: %s, 房间: %s", ip, room)
+	s.logf(logWS, slog.LevelInfo, "处理 /push WebSocket 连接请求，来自: %s, 房间: %s", ip, room)
 
-	authNeeded := false
-	var expectedPassword string
-	// 从 s.config.Server.Auth 获取期望的密码（可能是随机生成的或配置的）
-	if authStr, ok := s.config.Server.Auth.(string); ok && authStr != "" {
-		authNeeded = true
-		expectedPassword = authStr
+	_, authNeeded := s.authPassword()
+	if !s.checkAuthGuard(w, r) {
+		return
 	}
-	// 注意：布尔型 true 的情况已在 NewClipboardServer 中处理并转换为字符串密码或空字符串
 
-	if authNeeded {
-		token := r.URL.Query().Get("auth")
-		if expectedPassword == "" { // 这种情况理论上不应发生，因为 NewClipboardServer 会处理
-			s.logger.Printf("WebSocket 认证失败: 服务器端未配置有效密码，但需要认证。来自 IP: %s, 房间: %s", ip, room)
-			http.Error(w, "Unauthorized: Server authentication misconfiguration", http.StatusUnauthorized)
+	// 未携带凭据 (URL 参数、Authorization 头或会话 Cookie) 时先完成升级，再从第一帧读取令牌，
+	// 避免令牌出现在 URL 和代理日志中
+	token, _ := credentialFromRequest(r)
+	firstFrame := authNeeded && token == "" && clientCertIdentity(r) == ""
+	var conn *websocket.Conn
+	if firstFrame {
+		if !s.checkRateLimit(w, r, limitConnect, room, 1) {
 			return
 		}
-		if token == "" {
-			s.logger.Printf("WebSocket 认证失败: 未提供 token。来自 IP: %s, 房间: %s", ip, room)
-			http.Error(w, "Unauthorized: Missing token", http.StatusUnauthorized)
+		var err error
+		if conn, err = s.upgrader.Upgrade(w, r, nil); err != nil {
+			s.logf(logWS, slog.LevelError, "错误: WebSocket 升级失败: %v", err)
 			return
 		}
-		if token != expectedPassword {
-			s.logger.Printf("WebSocket 认证失败: 提供的 token '%s' 与期望的 '%s' 不匹配。来自 IP: %s, 房间: %s", token, expectedPassword, ip, room)
-			http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+		token = readFirstFrameToken(conn)
+	}
+
+	if authNeeded {
+		info, status, message := s.verifyCredential(r, token, scopeRead)
+		if status != 0 {
+			s.logf(logWS, slog.LevelInfo, "WebSocket 认证失败。来自 IP: %s, 房间: %s", ip, room)
+			if conn != nil {
+				closeWebSocket(conn, websocket.ClosePolicyViolation, message)
+			} else {
+				writeCredentialError(w, status, message)
+			}
 			return
 		}
-		s.logger.Printf("WebSocket 认证成功。来自 IP: %s, 房间: %s", ip, room)
+		r = withAuthInfo(r, info)
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		s.logger.Printf("错误: WebSocket 升级失败: %v", err)
-		return
+	if firstFrame {
+		if !s.canAccessRoom(r, room) {
+			s.logf(logWS, slog.LevelInfo, "房间访问被拒绝: WebSocket 无权访问房间 '%s'。来自 IP: %s", room, ip)
+			closeWebSocket(conn, websocket.ClosePolicyViolation, "无权访问该房间")
+			return
+		}
+	} else {
+		if !s.checkRoomAccess(w, r, room) {
+			return
+		}
+		if !s.checkRateLimit(w, r, limitConnect, room, 1) {
+			return
+		}
+		var err error
+		if conn, err = s.upgrader.Upgrade(w, r, nil); err != nil {
+			s.logf(logWS, slog.LevelError, "错误: WebSocket 升级失败: %v", err)
+			return
+		}
 	}
 
-	// 生成设备 ID 和元数据
+	// 生成设备 ID 和元数据，使用客户端证书时以证书身份作为设备标识
 	userAgent := r.Header.Get("User-Agent")
 	deviceID := fmt.Sprintf("%d", hash_murmur3([]byte(fmt.Sprintf("%s %s", r.RemoteAddr, userAgent)), s.deviceHashSeed))
+	certIdentity := clientCertIdentity(r)
+	if certIdentity != "" {
+		deviceID = fmt.Sprintf("%d", hash_murmur3([]byte("cert "+certIdentity), s.deviceHashSeed))
+	}
 
 	clientUA := s.parser.Parse(userAgent)
 	deviceMeta := DeviceMeta{
@@ -103,17 +122,21 @@ func (s *ClipboardServer) handle_push(w http.ResponseWriter, r *http.Request) {
 		OS:      fmt.Sprintf("%s %s", clientUA.Os.Family, clientUA.Os.Major),
 		Browser: fmt.Sprintf("%s %s", clientUA.UserAgent.Family, clientUA.UserAgent.Major),
 	}
+	if certIdentity != "" {
+		deviceMeta.Device = certIdentity
+	}
 
 	// 第一次加锁：注册连接和获取当前房间内的设备列表
 	var devicesInRoom []DeviceMeta
 	s.runMutex.Lock()
 	s.websockets[conn] = true
 	s.room_ws[conn] = room
+	writeLock := s.wsWriteLockLocked(conn)
 	s.deviceConnected[deviceID] = deviceMeta
 	s.connDeviceIDMap[conn] = deviceID
 	s.updateRoomDeviceCount(room, deviceID, true)
 
-	s.logger.Printf("新 WebSocket 客户端连接: %s (ID: %s), 房间: %s. 当前连接数: %d, 设备数: %d",
+	s.logf(logWS, slog.LevelInfo, "新 WebSocket 客户端连接: %s (ID: %s), 房间: %s. 当前连接数: %d, 设备数: %d",
 		conn.RemoteAddr(), deviceID, room, len(s.websockets), len(s.deviceConnected))
 
 	// 获取房间内现有设备列表（排除当前设备）
@@ -130,8 +153,8 @@ func (s *ClipboardServer) handle_push(w http.ResponseWriter, r *http.Request) {
 			Event: "connect",
 			Data:  devMeta,
 		}
-		if err := conn.WriteJSON(wsMsg); err != nil {
-			s.logger.Printf("错误: 发送现有设备 %s 信息到新客户端 %s 失败: %v", devMeta.ID, conn.RemoteAddr(), err)
+		if err := writeWebSocketJSON(conn, writeLock, wsMsg); err != nil {
+			s.logf(logWS, slog.LevelError, "错误: 发送现有设备 %s 信息到新客户端 %s 失败: %v", devMeta.ID, conn.RemoteAddr(), err)
 			// 如果发送失败，清理连接并返回
 			s.cleanupWebSocketConnection(conn, deviceID, room)
 			return
@@ -170,13 +193,13 @@ func (s *ClipboardServer) handle_push(w http.ResponseWriter, r *http.Request) {
 			Event: "receive",
 			Data:  clientPayload,
 		}
-		if err := conn.WriteJSON(wsMsg); err != nil {
-			s.logger.Printf("错误: 发送历史消息到客户端 %s 失败: %v", conn.RemoteAddr(), err)
+		if err := writeWebSocketJSON(conn, writeLock, wsMsg); err != nil {
+			s.logf(logWS, slog.LevelError, "错误: 发送历史消息到客户端 %s 失败: %v", conn.RemoteAddr(), err)
 			s.cleanupWebSocketConnection(conn, deviceID, room)
 			return
 		}
 	}
-	s.logger.Printf("已发送 %d 条历史消息到客户端 %s (房间: %s)", len(historyMessages), conn.RemoteAddr(), room)
+	s.logf(logWS, slog.LevelDebug, "已发送 %d 条历史消息到客户端 %s (房间: %s)", len(historyMessages), conn.RemoteAddr(), room)
 
 	// 发送配置信息给新连接的客户端
 	clientConfigData := struct {
@@ -189,9 +212,11 @@ func (s *ClipboardServer) handle_push(w http.ResponseWriter, r *http.Request) {
 			Limit int `json:"limit"`
 		} `json:"text"`
 		File struct {
-			Expire int `json:"expire"`
-			Chunk  int `json:"chunk"`
-			Limit  int `json:"limit"`
+			Expire    int `json:"expire"`
+			Chunk     int `json:"chunk"`
+			Limit     int `json:"limit"`
+			MinExpire int `json:"minExpire"`
+			MaxExpire int `json:"maxExpire"`
 		} `json:"file"`
 		Auth bool `json:"auth"`
 	}{
@@ -212,10 +237,10 @@ func (s *ClipboardServer) handle_push(w http.ResponseWriter, r *http.Request) {
 		Event: "config",
 		Data:  clientConfigData,
 	}
-	if err := conn.WriteJSON(configWsMsg); err != nil {
-		s.logger.Printf("错误: 发送配置信息到客户端 %s 失败: %v", conn.RemoteAddr(), err)
+	if err := writeWebSocketJSON(conn, writeLock, configWsMsg); err != nil {
+		s.logf(logWS, slog.LevelError, "错误: 发送配置信息到客户端 %s 失败: %v", conn.RemoteAddr(), err)
 	} else {
-		s.logger.Printf("已发送配置信息到客户端 %s", conn.RemoteAddr())
+		s.logf(logWS, slog.LevelDebug, "已发送配置信息到客户端 %s", conn.RemoteAddr())
 	}
 
 	// 启动 WebSocket 消息读取 goroutine
@@ -223,19 +248,15 @@ func (s *ClipboardServer) handle_push(w http.ResponseWriter, r *http.Request) {
 		defer s.cleanupWebSocketConnection(conn, deviceID, room)
 
 		for {
-			messageType, p, err := conn.ReadMessage()
+			_, _, err := conn.ReadMessage()
 			if err != nil {
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					s.logger.Printf("错误: WebSocket 读取错误 (客户端: %s, ID: %s): %v", conn.RemoteAddr(), deviceID, err)
+					s.logf(logWS, slog.LevelError, "错误: WebSocket 读取错误 (客户端: %s, ID: %s): %v", conn.RemoteAddr(), deviceID, err)
 				} else {
-					s.logger.Printf("WebSocket 连接正常关闭 (客户端: %s, ID: %s)", conn.RemoteAddr(), deviceID)
+					s.logf(logWS, slog.LevelInfo, "WebSocket 连接正常关闭 (客户端: %s, ID: %s)", conn.RemoteAddr(), deviceID)
 				}
 				break
 			}
-			if len(p) > 0 {
-				s.logger.Printf("收到来自 %s (ID: %s) 的 WebSocket 心跳消息: 类型 %d, 内容: %s",
-					conn.RemoteAddr(), deviceID, messageType, string(p))
-			}
 		}
 	}()
 }
@@ -246,21 +267,25 @@ func (s *ClipboardServer) handle_file(w http.ResponseWriter, r *http.Request) {
 	pathSegments := strings.SplitN(pathPart, "/", 2) // 最多分割成两部分
 	uuid := pathSegments[0]                          // 第一部分总是 UUID
 
-	s.logger.Printf("处理文件请求: %s, 方法: %s", uuid, r.Method)
+	s.logf(logFile, slog.LevelDebug, "处理文件请求: %s, 方法: %s", uuid, r.Method)
 
 	s.runMutex.Lock() // 保护 uploadFileMap 的读取
 	fileInfo, ok := s.uploadFileMap[uuid]
 	s.runMutex.Unlock()
 
 	if !ok {
-		s.logger.Printf("文件未找到或已过期: %s", uuid)
+		s.logf(logFile, slog.LevelInfo, "文件未找到或已过期: %s", uuid)
 		http.Error(w, "文件未找到或已过期", http.StatusNotFound)
 		return
 	}
 
+	if !s.checkRoomAccess(w, r, fileInfo.Room) {
+		return
+	}
+
 	// 检查文件是否已过期 (双重检查，因为 cleanExpiredFilesLoop 是异步的)
-	if fileInfo.ExpireTime < time.Now().Unix() {
-		s.logger.Printf("尝试访问已过期的文件: %s (UUID: %s)", fileInfo.Name, uuid)
+	if isExpired(fileInfo.ExpireTime, time.Now().Unix()) {
+		s.logf(logFile, slog.LevelInfo, "尝试访问已过期的文件: %s (UUID: %s)", fileInfo.Name, uuid)
 		// 从 map 中移除并尝试删除文件
 		s.runMutex.Lock()
 		delete(s.uploadFileMap, uuid)
@@ -274,11 +299,11 @@ func (s *ClipboardServer) handle_file(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case http.MethodGet:
-		s.logger.Printf("提供文件下载: %s (UUID: %s), 路径: %s", fileInfo.Name, uuid, filePath)
+		s.logf(logFile, slog.LevelInfo, "提供文件下载: %s (UUID: %s), 路径: %s", fileInfo.Name, uuid, filePath)
 
 		file, err := os.Open(filePath) // 打开文件以供 ServeContent 使用
 		if err != nil {
-			s.logger.Printf("错误: 打开文件失败: %v", err)
+			s.logf(logFile, slog.LevelError, "错误: 打开文件失败: %v", err)
 			http.Error(w, "文件在磁盘上未找到", http.StatusNotFound)
 			return
 		}
@@ -286,29 +311,33 @@ func (s *ClipboardServer) handle_file(w http.ResponseWriter, r *http.Request) {
 
 		stat, err := file.Stat()
 		if err != nil {
-			s.logger.Printf("错误: 获取文件状态失败: %v", err)
+			s.logf(logFile, slog.LevelError, "错误: 获取文件状态失败: %v", err)
 			http.Error(w, "无法获取文件状态", http.StatusInternalServerError)
 			return
 		}
 
-		// 设置 Content-Disposition
-		dispositionType := "inline" // 默认为内联显示
-		if r.URL.Query().Get("download") == "true" {
-			dispositionType = "attachment"
+		// 使用上传时嗅探得到的类型，禁止浏览器自行猜测
+		contentType := fileContentType(fileInfo.Name, fileInfo.MIME)
+		w.Header().Set("Content-Disposition", fileDisposition(fileInfo.Name, contentType, r.URL.Query().Get("download") == "true"))
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		setDigestHeaders(w, fileInfo.Digest)
+
+		// 视频等媒体的后续分段请求不重复记录
+		if isDownloadStart(r) {
+			s.audit(r, auditDownload, fileInfo.Room, 0, uuid, fileInfo.Name)
 		}
-		disposition := fmt.Sprintf("%s; filename=%q", dispositionType, fileInfo.Name)
-		w.Header().Set("Content-Disposition", disposition)
 
 		// 使用 http.ServeContent 提供文件内容
 		http.ServeContent(w, r, fileInfo.Name, stat.ModTime(), file)
 
 	case http.MethodDelete:
 		// 需要认证才能删除文件，此处已有 authMiddleware 保护
-		s.logger.Printf("删除文件: %s (UUID: %s)", fileInfo.Name, uuid)
+		s.logf(logFile, slog.LevelInfo, "删除文件: %s (UUID: %s)", fileInfo.Name, uuid)
 
 		err := os.Remove(filePath)
 		if err != nil && !os.IsNotExist(err) {
-			s.logger.Printf("错误: 删除文件失败: %v", err)
+			s.logf(logFile, slog.LevelError, "错误: 删除文件失败: %v", err)
 			http.Error(w, "删除文件失败", http.StatusInternalServerError)
 			return
 		}
@@ -318,6 +347,7 @@ func (s *ClipboardServer) handle_file(w http.ResponseWriter, r *http.Request) {
 		s.runMutex.Unlock()
 
 		s.saveHistoryData()
+		s.audit(r, auditDeleteFile, fileInfo.Room, 0, uuid, fileInfo.Name)
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{"status": "文件删除成功"})
@@ -337,10 +367,16 @@ func (s *ClipboardServer) handle_text(w http.ResponseWriter, r *http.Request) {
 	if room == "" {
 		room = "default"
 	}
+	if !s.checkRoomAccess(w, r, room) {
+		return
+	}
+	if !s.checkRateLimit(w, r, limitMessage, room, 1) {
+		return
+	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		s.logger.Printf("错误: 读取 /text 请求体失败: %v", err)
+		s.logf(logMessage, slog.LevelError, "错误: 读取 /text 请求体失败: %v", err)
 		http.Error(w, "无法读取请求体", http.StatusInternalServerError)
 		return
 	}
@@ -348,7 +384,7 @@ func (s *ClipboardServer) handle_text(w http.ResponseWriter, r *http.Request) {
 
 	text := string(body)
 	if s.config.Text.Limit > 0 && len(text) > s.config.Text.Limit {
-		s.logger.Printf("错误: 文本内容超出限制 (%d > %d)", len(text), s.config.Text.Limit)
+		s.logf(logMessage, slog.LevelError, "错误: 文本内容超出限制 (%d > %d)", len(text), s.config.Text.Limit)
 		http.Error(w, fmt.Sprintf("文本内容超出限制 (最大 %d 字符)", s.config.Text.Limit), http.StatusRequestEntityTooLarge)
 		return
 	}
@@ -359,7 +395,7 @@ func (s *ClipboardServer) handle_text(w http.ResponseWriter, r *http.Request) {
 		// 尝试覆盖现有消息
 		id, err := strconv.Atoi(idStr)
 		if err != nil {
-			s.logger.Printf("无效的 ID 参数: %s", idStr)
+			s.logf(logMessage, slog.LevelInfo, "无效的 ID 参数: %s", idStr)
 			http.Error(w, "无效的 ID 参数", http.StatusBadRequest)
 			return
 		}
@@ -369,7 +405,7 @@ func (s *ClipboardServer) handle_text(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			// 构建内容 URL
 			scheme := getScheme(r)
-			contentURL := fmt.Sprintf("%s://%s%s/content/%s", scheme, r.Host, s.config.Server.Prefix, idStr)
+			contentURL := fmt.Sprintf("%s://%s%s/content/%s", scheme, getHost(r), s.config.Server.Prefix, idStr)
 			if room != "default" {
 				contentURL += fmt.Sprintf("?room=%s", room)
 			}
@@ -380,18 +416,19 @@ func (s *ClipboardServer) handle_text(w http.ResponseWriter, r *http.Request) {
 			})
 			return
 		} else {
-			s.logger.Printf("未找到可更新的文本消息 ID: %d (房间: %s)", id, room)
+			s.logf(logMessage, slog.LevelInfo, "未找到可更新的文本消息 ID: %d (房间: %s)", id, room)
 			http.Error(w, "消息未找到或无法更新", http.StatusNotFound)
 			return
 		}
 	}
 
-	s.logger.Printf("收到文本消息 (房间: %s): %s", room, text)
 	event := s.addMessageToQueueAndBroadcast("text", text, room, r)
+	s.log(logMessage).Info("收到文本消息", "id", event.Data.ID(), "room", room, "length", len(text))
+	s.audit(r, auditSend, room, event.Data.ID(), "", "")
 
 	// 响应 (可以效仿 auth.go 中的 enhanceHandleText 返回内容 URL)
 	scheme := getScheme(r)
-	contentURL := fmt.Sprintf("%s://%s%s/content/%d", scheme, r.Host, s.config.Server.Prefix, event.Data.ID())
+	contentURL := fmt.Sprintf("%s://%s%s/content/%d", scheme, getHost(r), s.config.Server.Prefix, event.Data.ID())
 	if room != "default" {
 		contentURL += fmt.Sprintf("?room=%s", room)
 	}
@@ -414,17 +451,20 @@ func (s *ClipboardServer) updateTextMessage(id int, newContent string, room stri
 			if msg.Data.TextReceive != nil {
 				// 检查更新内容是否与原内容相同
 				if msg.Data.TextReceive.Content == newContent {
-					s.logger.Printf("文本消息 ID %d 内容未改变，无需更新 (房间: %s)", id, room)
+					s.logf(logMessage, slog.LevelInfo, "文本消息 ID %d 内容未改变，无需更新 (房间: %s)", id, room)
 					return true // 内容相同，直接返回，避免频繁触发写入操作
 				}
 
-				// 获取原内容用于日志
-				originalContent := msg.Data.TextReceive.Content
+				// 获取原内容长度用于日志
+				originalLength := len(msg.Data.TextReceive.Content)
 				// 更新内容和时间戳（使用索引 i 修改原数组）
 				s.messageQueue.List[i].Data.TextReceive.Content = newContent
 				s.messageQueue.List[i].Data.TextReceive.Timestamp = time.Now().Unix()
 				s.messageQueue.List[i].Data.TextReceive.SenderIP = get_remote_ip(r)
 				s.messageQueue.List[i].Data.TextReceive.SenderDevice = s.parse_user_agent(r.UserAgent())
+				if info := authFromRequest(r); info != nil {
+					s.messageQueue.List[i].Data.TextReceive.SenderUser = info.User
+				}
 
 				// 广播更新事件
 				wsMsg := WebSocketMessage{
@@ -435,8 +475,9 @@ func (s *ClipboardServer) updateTextMessage(id int, newContent string, room stri
 
 				// 保存历史数据
 				go s.saveHistoryData()
+				s.audit(r, auditUpdate, room, id, "", "")
 
-				s.logger.Printf("文本消息 ID %d 已更新 (房间: %s) - 原内容: '%s', 新内容: '%s'", id, room, originalContent, newContent)
+				s.log(logMessage).Info("文本消息已更新", "id", id, "room", room, "originalLength", originalLength, "length", len(newContent))
 				return true
 			}
 		}
@@ -453,29 +494,81 @@ func (s *ClipboardServer) handle_upload(w http.ResponseWriter, r *http.Request)
 	// 获取请求路径和内容类型
 	path := r.URL.Path
 	contentType := r.Header.Get("Content-Type")
-	s.logger.Printf("处理上传请求，路径: %s, 内容类型: %s, 来自: %s", path, contentType, get_remote_ip(r))
+	s.logf(logFile, slog.LevelInfo, "处理上传请求，路径: %s, 内容类型: %s, 来自: %s", path, contentType, get_remote_ip(r))
 
 	room := r.URL.Query().Get("room")
 	if room == "" {
 		room = "default"
 	}
+	if !s.checkRoomAccess(w, r, room) {
+		return
+	}
+	// 有效期可以通过 expire 参数指定
+	ttl, ok := s.uploadTTL(w, r, r.URL.Query().Get("expire"))
+	if !ok {
+		return
+	}
 
-	// 处理 /upload/chunk 路径（文件名初始化请求）
-	if strings.HasSuffix(path, "/upload/chunk") && contentType == "text/plain" {
-		body, err := io.ReadAll(r.Body)
+	// 客户端可以通过 Digest 请求头声明文件的摘要，上传完成时校验
+	var expected *expectedDigest
+	if value := r.Header.Get("Digest"); value != "" {
+		digest, err := parseDigest(value)
 		if err != nil {
-			s.logger.Printf("错误: 读取文件名失败: %v", err)
+			writeJSONError(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		expected = digest
+	}
+
+	// 处理 /upload/chunk 路径（初始化请求）
+	// 请求体为文件名 (text/plain)，或 JSON {"name": ..., "size": ..., "chunkSize": ..., "digest": ...}
+	// 声明 size 后 /upload/finish 会检查是否收齐，声明 chunkSize 后分块可以使用 index 代替 offset
+	if strings.HasSuffix(path, "/upload/chunk") && (contentType == "text/plain" || strings.HasPrefix(contentType, "application/json")) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+		if err != nil {
+			s.logf(logFile, slog.LevelError, "错误: 读取文件名失败: %v", err)
 			http.Error(w, "无法读取请求体", http.StatusBadRequest)
 			return
 		}
 		defer r.Body.Close()
 
+		session := &chunkUpload{Size: -1}
 		filename := string(body)
+		if contentType != "text/plain" {
+			var init struct {
+				Name      string `json:"name"`
+				Size      *int64 `json:"size"`
+				ChunkSize int64  `json:"chunkSize"`
+				Digest    string `json:"digest"`
+			}
+			if err := json.Unmarshal(body, &init); err != nil || init.Name == "" || init.ChunkSize < 0 || (init.Size != nil && *init.Size < 0) {
+				writeJSONError(w, http.StatusBadRequest, "BadRequest", "无效的初始化请求")
+				return
+			}
+			filename = init.Name
+			session.ChunkSize = init.ChunkSize
+			if init.Size != nil {
+				session.Size = *init.Size
+			}
+			if init.Digest != "" {
+				digest, err := parseDigest(init.Digest)
+				if err != nil {
+					writeJSONError(w, http.StatusBadRequest, "BadRequest", err.Error())
+					return
+				}
+				expected = digest
+			}
+			if s.config.File.Limit > 0 && session.Size > int64(s.config.File.Limit) {
+				http.Error(w, fmt.Sprintf("文件大小超出限制 (最大 %d 字节)", s.config.File.Limit), http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+		session.Hasher = newUploadHasher(expected)
 		uuid := gen_UUID()
-		s.logger.Printf("初始化分块上传: %s, 生成UUID: %s", filename, uuid)
+		s.logf(logFile, slog.LevelInfo, "初始化分块上传: %s, 生成UUID: %s", filename, uuid)
 
 		// 创建文件信息直接记录到 uploadFileMap 中
-		expireTime := time.Now().Unix() + int64(s.config.File.Expire)
+		expireTime := expireAfter(ttl)
 		s.runMutex.Lock()
 		s.uploadFileMap[uuid] = File{
 			Name:       filename,
@@ -483,8 +576,13 @@ func (s *ClipboardServer) handle_upload(w http.ResponseWriter, r *http.Request)
 			Size:       0, // 初始大小为0
 			ExpireTime: expireTime,
 			UploadTime: time.Now().Unix(),
+			Room:       room,
 		}
 		s.runMutex.Unlock()
+		session.Progress = s.newProgressReporter(room, uploadProgress{UUID: uuid, Name: filename, Size: session.Size})
+		s.chunkMutex.Lock()
+		s.chunkUploads[uuid] = session
+		s.chunkMutex.Unlock()
 
 		// 返回UUID响应
 		w.Header().Set("Content-Type", "application/json")
@@ -497,166 +595,172 @@ func (s *ClipboardServer) handle_upload(w http.ResponseWriter, r *http.Request)
 	// 处理常规文件上传 (/upload 路径)
 	// 检查文件大小限制
 	if s.config.File.Limit > 0 && r.ContentLength > int64(s.config.File.Limit) {
-		s.logger.Printf("错误: 文件大小 (%d) 超出限制 (%d)", r.ContentLength, s.config.File.Limit)
+		s.logf(logFile, slog.LevelError, "错误: 文件大小 (%d) 超出限制 (%d)", r.ContentLength, s.config.File.Limit)
 		http.Error(w, fmt.Sprintf("文件大小超出限制 (最大 %d 字节)", s.config.File.Limit), http.StatusRequestEntityTooLarge)
 		return
 	}
-
-	err := r.ParseMultipartForm(int64(s.config.File.Limit)) // 使用文件大小限制作为 maxMemory
-	if err != nil {
-		s.logger.Printf("错误: 解析 multipart form 失败: %v", err)
-		http.Error(w, "无法解析表单数据", http.StatusBadRequest)
-		return
+	// 文件大小可以通过 Upload-Length 请求头声明，与 Digest 一起在保存后校验
+	declaredSize := int64(-1)
+	if value := r.Header.Get("Upload-Length"); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			writeJSONError(w, http.StatusBadRequest, "BadRequest", "无效的 Upload-Length")
+			return
+		}
+		declaredSize = size
 	}
-
-	file, handler, err := r.FormFile("file") // "file" 是表单字段名
-	if err != nil {
-		s.logger.Printf("错误: 获取上传文件失败: %v", err)
-		http.Error(w, "无法获取文件", http.StatusBadRequest)
+	if !s.checkRateLimit(w, r, limitMessage, room, 1) {
 		return
 	}
-	defer file.Close()
-
-	fileName := handler.Filename
-	fileSize := handler.Size
-	s.logger.Printf("收到文件上传: %s, 大小: %d, 房间: %s", fileName, fileSize, room)
-
-	// 生成唯一文件名 (UUID)
-	uuid := gen_UUID()
-	filePath := filepath.Join(s.storageFolder, uuid)
-
-	// 保存文件
-	dst, err := os.Create(filePath)
-	if err != nil {
-		s.logger.Printf("错误: 创建文件 %s 失败: %v", filePath, err)
-		http.Error(w, "无法保存文件", http.StatusInternalServerError)
+	if r.ContentLength > 0 && !s.checkRateLimit(w, r, limitUpload, room, float64(r.ContentLength)) {
 		return
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, file); err != nil {
-		s.logger.Printf("错误: 写入文件 %s 失败: %v", filePath, err)
-		http.Error(w, "无法写入文件", http.StatusInternalServerError)
+	// 各部分直接写入存储目录，不使用 ParseMultipartForm 在内存中缓冲
+	received, ok := s.receiveMultipartFiles(w, r, room, expireAfter(ttl), expected, declaredSize)
+	if !ok {
 		return
 	}
-
-	timestamp := time.Now().Unix()
-	expireTime := timestamp + int64(s.config.File.Expire)
-
-	// 创建文件信息
-	fileInfo := File{
-		Name:       fileName,
-		UUID:       uuid,
-		Size:       fileSize,
-		UploadTime: timestamp,
-		ExpireTime: expireTime,
-	}
-
-	s.runMutex.Lock() // 保护 uploadFileMap
-	s.uploadFileMap[uuid] = fileInfo
-	s.runMutex.Unlock()
-
-	fileReceiveData := &FileReceive{
-		Name:   fileName,
-		Size:   fileSize,
-		Expire: expireTime,
-		Cache:  uuid,
-		URL:    fmt.Sprintf("%s://%s%s/file/%s", getScheme(r), r.Host, s.config.Server.Prefix, uuid),
-	}
-
-	// 如果文件不太大，创建缩略图
-	if fileSize <= 32*1024*1024 { // 32MB
-		thumbnail, err := gen_thumbnail(filePath)
-		if err == nil {
-			s.logger.Printf("已为文件 %s 生成缩略图", fileName)
-			fileReceiveData.Thumbnail = thumbnail
-		} else {
-			s.logger.Printf("生成缩略图失败: %v,文件类型可能不受支持", err)
-		}
-	}
-
-	event := s.addMessageToQueueAndBroadcast("file", fileReceiveData, room, r)
-
-	// 响应
-	scheme := getScheme(r)
-	contentURL := fmt.Sprintf("%s://%s%s/content/%d", scheme, r.Host, s.config.Server.Prefix, event.Data.ID())
-	if room != "default" {
-		contentURL += fmt.Sprintf("?room=%s", room)
+	files := make([]File, len(received))
+	for i, f := range received {
+		files[i] = f.File
 	}
-	responseType := DetermineResponseType(fileInfo.Name)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"url":  contentURL,
-		"id":   strconv.Itoa(event.Data.ID()),
-		"type": responseType,
-	})
+	s.publishUploadedFiles(w, r, files)
 }
 
 func (s *ClipboardServer) handle_chunk(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.handleChunkStatus(w, r)
+		return
+	}
 	if r.Method != http.MethodPost {
-		http.Error(w, "仅允许 POST 请求", http.StatusMethodNotAllowed)
+		http.Error(w, "仅允许 GET 或 POST 请求", http.StatusMethodNotAllowed)
 		return
 	}
 
 	// 从路径中提取 UUID
 	uuid := strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/upload/chunk/")
-	s.logger.Printf("处理分块上传请求, UUID: %s, 来自: %s", uuid, get_remote_ip(r))
-
-	s.runMutex.Lock()
-	fileInfo, ok := s.uploadFileMap[uuid]
-	s.runMutex.Unlock()
+	s.logf(logFile, slog.LevelDebug, "处理分块上传请求, UUID: %s, 来自: %s", uuid, get_remote_ip(r))
 
+	session, fileInfo, ok := s.lookupChunkUpload(uuid)
 	if !ok {
-		s.logger.Printf("错误: 无效的 UUID: %s", uuid)
+		s.logf(logFile, slog.LevelError, "错误: 无效的 UUID: %s", uuid)
 		http.Error(w, "无效的 UUID", http.StatusBadRequest)
 		return
 	}
-
-	// 读取请求体中的数据
-	data, err := io.ReadAll(r.Body)
-	if err != nil {
-		s.logger.Printf("错误: 读取分块数据失败: %v", err)
-		http.Error(w, "无法读取分块数据", http.StatusInternalServerError)
+	if !s.checkRoomAccess(w, r, fileInfo.Room) {
+		return
+	}
+	// 上传带宽限流：已知长度时在读取前检查
+	if r.ContentLength > 0 && !s.checkRateLimit(w, r, limitUpload, fileInfo.Room, float64(r.ContentLength)) {
 		return
 	}
-	defer r.Body.Close()
 
-	// 更新文件大小
-	newSize := fileInfo.Size + int64(len(data))
-	s.logger.Printf("上传分块数据大小: %d, 累计大小: %d", len(data), newSize)
+	// 分块的写入位置：?offset=字节偏移量，或 ?index=分块序号 (需要在初始化时声明 chunkSize)
+	// 两者都没有时追加在已接收数据的末尾 (旧的顺序上传方式)
+	session.Lock()
+	receivedEnd := session.end()
+	chunkSize, declaredSize := session.ChunkSize, session.Size
+	session.Unlock()
+	offset := receivedEnd
+	q := r.URL.Query()
+	if offsetStr := q.Get("offset"); offsetStr != "" {
+		v, err := strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil || v < 0 {
+			http.Error(w, "无效的 offset 参数", http.StatusBadRequest)
+			return
+		}
+		offset = v
+	} else if indexStr := q.Get("index"); indexStr != "" {
+		v, err := strconv.ParseInt(indexStr, 10, 64)
+		if err != nil || v < 0 || chunkSize <= 0 {
+			http.Error(w, "无效的 index 参数 (需要在初始化时声明 chunkSize)", http.StatusBadRequest)
+			return
+		}
+		offset = v * chunkSize
+	}
 
-	// 检查文件大小是否超过限制
-	if s.config.File.Limit > 0 && newSize > int64(s.config.File.Limit) {
-		s.logger.Printf("错误: 文件大小已超过限制 (%d > %d)", newSize, s.config.File.Limit)
-		http.Error(w, fmt.Sprintf("文件大小已超过限制 (最大 %d 字节)", s.config.File.Limit), http.StatusRequestEntityTooLarge)
+	// 分块不能超出声明的大小和文件大小限制
+	maxEnd := int64(-1)
+	if declaredSize >= 0 {
+		maxEnd = declaredSize
+	} else if s.config.File.Limit > 0 {
+		maxEnd = int64(s.config.File.Limit)
+	}
+	if maxEnd >= 0 && (offset > maxEnd || (r.ContentLength > 0 && offset+r.ContentLength > maxEnd)) {
+		s.logf(logFile, slog.LevelError, "错误: 分块超出文件大小 (偏移量 %d, 长度 %d, 最大 %d)", offset, r.ContentLength, maxEnd)
+		http.Error(w, fmt.Sprintf("分块超出文件大小 (最大 %d 字节)", maxEnd), http.StatusRequestEntityTooLarge)
+		return
+	}
+	// 没有声明大小也没有文件大小限制时偏移量没有上限，不允许跳过未接收的数据，避免一个请求创建巨大的稀疏文件
+	if maxEnd < 0 && offset > receivedEnd {
+		s.logf(logFile, slog.LevelError, "错误: 未声明大小的上传不能跳过未接收的数据 (偏移量 %d, 已接收到 %d)", offset, receivedEnd)
+		writeJSONError(w, http.StatusBadRequest, "BadRequest", fmt.Sprintf("未声明文件大小时偏移量不能超过已接收数据的末尾 (%d)，乱序上传需要在初始化时声明 size", receivedEnd))
 		return
 	}
 
-	// 更新文件信息
-	fileInfo.Size = newSize
-	s.runMutex.Lock()
-	s.uploadFileMap[uuid] = fileInfo
-	s.runMutex.Unlock()
-
-	// 追加数据到文件
+	// 使用 WriteAt 写入指定位置，重复或乱序到达的分块都可以安全地写入
 	filePath := filepath.Join(s.storageFolder, uuid)
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		s.logger.Printf("错误: 打开文件 %s 失败: %v", filePath, err)
+		s.logf(logFile, slog.LevelError, "错误: 打开文件 %s 失败: %v", filePath, err)
 		http.Error(w, "无法打开文件", http.StatusInternalServerError)
 		return
 	}
 	defer file.Close()
 
-	if _, err := file.Write(data); err != nil {
-		s.logger.Printf("错误: 写入数据到文件 %s 失败: %v", filePath, err)
-		http.Error(w, "无法写入文件", http.StatusInternalServerError)
+	var body io.Reader = r.Body
+	if maxEnd >= 0 {
+		body = io.LimitReader(r.Body, maxEnd-offset)
+	}
+	written, err := io.Copy(io.NewOffsetWriter(file, offset), body)
+	session.Lock()
+	session.noteWrite(offset, written)
+	session.Unlock()
+	if err != nil {
+		// 不完整的分块不记录为已接收，客户端重传即可
+		s.logf(logFile, slog.LevelError, "错误: 写入数据到文件 %s 失败: %v", filePath, err)
+		http.Error(w, "无法读取分块数据", http.StatusBadRequest)
+		return
+	}
+	// 超出大小的数据不写入磁盘：请求体在限制处仍有剩余时整个分块作废
+	if maxEnd >= 0 {
+		var extra [1]byte
+		if n, _ := io.ReadFull(r.Body, extra[:]); n > 0 {
+			s.logf(logFile, slog.LevelError, "错误: 分块超出文件大小 (偏移量 %d, 最大 %d)", offset, maxEnd)
+			http.Error(w, fmt.Sprintf("分块超出文件大小 (最大 %d 字节)", maxEnd), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+	if r.ContentLength <= 0 && !s.checkRateLimit(w, r, limitUpload, fileInfo.Room, float64(written)) {
 		return
 	}
 
+	session.Lock()
+	session.Received = addRange(session.Received, byteRange{offset, offset + written})
+	received := coveredBytes(session.Received)
+	if err := session.advanceHash(filePath); err != nil {
+		s.logf(logFile, slog.LevelWarn, "警告: 计算文件 %s 的摘要失败: %v", uuid, err)
+	}
+	session.Unlock()
+	s.logf(logFile, slog.LevelDebug, "上传分块数据: 偏移量 %d, 大小: %d, 累计接收: %d", offset, written, received)
+	session.Progress.set(received)
+
+	// 更新文件信息
+	s.runMutex.Lock()
+	if fileInfo, ok := s.uploadFileMap[uuid]; ok {
+		fileInfo.Size = received
+		s.uploadFileMap[uuid] = fileInfo
+	}
+	s.runMutex.Unlock()
+
 	// 返回成功响应
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"offset":   offset,
+		"length":   written,
+		"received": received,
+	})
 }
 
 func (s *ClipboardServer) handle_finish(w http.ResponseWriter, r *http.Request) {
@@ -672,66 +776,206 @@ func (s *ClipboardServer) handle_finish(w http.ResponseWriter, r *http.Request)
 		room = "default"
 	}
 
-	s.logger.Printf("处理上传完成请求, UUID: %s, 房间: %s, 来自: %s", uuid, room, get_remote_ip(r))
+	s.logf(logFile, slog.LevelInfo, "处理上传完成请求, UUID: %s, 房间: %s, 来自: %s", uuid, room, get_remote_ip(r))
 
 	s.runMutex.Lock()
 	fileInfo, ok := s.uploadFileMap[uuid]
 	s.runMutex.Unlock()
 
 	if !ok {
-		s.logger.Printf("错误: 无效的 UUID: %s", uuid)
+		s.logf(logFile, slog.LevelError, "错误: 无效的 UUID: %s", uuid)
 		http.Error(w, "无效的 UUID", http.StatusBadRequest)
 		return
 	}
+	if !s.checkRoomAccess(w, r, fileInfo.Room) || !s.checkRoomAccess(w, r, room) {
+		return
+	}
+	if !s.checkRateLimit(w, r, limitMessage, room, 1) {
+		return
+	}
 
-	// 生成消息相关信息
-	timestamp := time.Now().Unix()
+	// 只能完成进行中的分块上传：tus 上传完成时会自动发布，已发布的文件不能再次发布
+	session, _, ok := s.lookupChunkUpload(uuid)
+	if !ok {
+		s.tusMutex.Lock()
+		_, isTus := s.tusUploads[uuid]
+		s.tusMutex.Unlock()
+		s.logf(logFile, slog.LevelWarn, "警告: %s 不是进行中的分块上传 (tus: %t)，拒绝完成", uuid, isTus)
+		if isTus {
+			writeJSONError(w, http.StatusConflict, "Conflict", "该文件正在通过 tus 上传，完成后会自动发布")
+		} else {
+			writeJSONError(w, http.StatusConflict, "Conflict", "该文件不是进行中的分块上传，可能已经发布")
+		}
+		return
+	}
 
-	filePath := filepath.Join(s.storageFolder, uuid)
+	// 所有分块都已写入后才能完成上传
+	session.Lock()
+	size, missing := session.finalSize()
+	var hashErr error
+	if len(missing) == 0 {
+		hashErr = session.advanceHash(filepath.Join(s.storageFolder, uuid))
+	}
+	session.Unlock()
+	if hashErr != nil {
+		s.logf(logFile, slog.LevelError, "错误: 计算文件 %s 的摘要失败: %v", uuid, hashErr)
+		http.Error(w, "无法读取文件", http.StatusInternalServerError)
+		return
+	}
+	if len(missing) > 0 {
+		s.logf(logFile, slog.LevelWarn, "警告: 上传 %s 尚缺少 %d 个区间，无法完成", uuid, len(missing))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "Incomplete",
+			"message": "上传的数据不完整",
+			"missing": missing,
+		})
+		return
+	}
+	// 并发的完成请求中只有取走会话的那一个发布文件
+	s.chunkMutex.Lock()
+	claimed := s.chunkUploads[uuid] == session
+	if claimed {
+		delete(s.chunkUploads, uuid)
+	}
+	s.chunkMutex.Unlock()
+	if !claimed {
+		writeJSONError(w, http.StatusConflict, "Conflict", "该文件不是进行中的分块上传，可能已经发布")
+		return
+	}
+	// 作废的分块或中断的写入可能在文件末尾之后留下数据，截断到最终大小
+	if err := os.Truncate(filepath.Join(s.storageFolder, uuid), size); err != nil {
+		s.logf(logFile, slog.LevelError, "错误: 截断文件 %s 失败: %v", uuid, err)
+		s.deleteUploadedFile(uuid)
+		s.abortProgress(uuid, "无法写入文件")
+		http.Error(w, "无法写入文件", http.StatusInternalServerError)
+		return
+	}
+	fileInfo.Size = size
+	fileInfo.Digest = session.Hasher.digest()
+	if !s.verifyUpload(w, r, fileInfo, size, session.Hasher) {
+		return
+	}
+
+	fileInfo.Room = room
+	s.runMutex.Lock()
+	s.uploadFileMap[uuid] = fileInfo
+	s.runMutex.Unlock()
+
+	s.publishUploadedFile(w, r, fileInfo)
+}
+
+// publishUploadedFile 在文件完整写入存储目录后调用：发布文件消息并写入上传响应
+func (s *ClipboardServer) publishUploadedFile(w http.ResponseWriter, r *http.Request, fileInfo File) {
+	s.publishUploadedFiles(w, r, []File{fileInfo})
+}
+
+// publishUploadedFiles 依次发布多个文件，每个文件一条消息
+// 响应的 url、id、type 对应第一个文件，多个文件时 files 中列出全部文件
+// 某个文件未通过检查时，之前的文件已经发布，之后的文件被删除
+func (s *ClipboardServer) publishUploadedFiles(w http.ResponseWriter, r *http.Request, files []File) {
+	results := make([]map[string]string, 0, len(files))
+	for i, fileInfo := range files {
+		event, ok := s.finalizeUploadedFile(w, r, fileInfo)
+		if !ok {
+			for _, rest := range files[i+1:] {
+				s.deleteUploadedFile(rest.UUID)
+				s.abortProgress(rest.UUID, "同一请求中的其他文件未通过检查")
+			}
+			return
+		}
+		fileReceive := event.Data.FileReceive
+
+		// 构建响应
+		scheme := getScheme(r)
+		contentURL := fmt.Sprintf("%s://%s%s/content/%d", scheme, getHost(r), s.config.Server.Prefix, event.Data.ID())
+		if fileInfo.Room != "default" {
+			contentURL += fmt.Sprintf("?room=%s", fileInfo.Room)
+		}
+		results = append(results, map[string]string{
+			"url":  contentURL,
+			"id":   strconv.Itoa(event.Data.ID()),
+			"type": fileResponseType(fileReceive.Name, fileReceive.MIME),
+		})
+	}
+
+	response := map[string]interface{}{
+		"url":  results[0]["url"],
+		"id":   results[0]["id"],
+		"type": results[0]["type"],
+	}
+	if len(results) > 1 {
+		response["files"] = results
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// inspectUploadedFile 检查文件类型并扫描文件，通过后在文件映射中记录 MIME 类型和摘要
+// 检查未通过时文件已被删除、已写入错误响应并广播 upload_abort，ok 为 false
+func (s *ClipboardServer) inspectUploadedFile(w http.ResponseWriter, r *http.Request, fileInfo File) (checked File, scanStatus string, ok bool) {
+	uuid := fileInfo.UUID
+	rec := &abortReasonRecorder{ResponseWriter: w}
+	defer func() {
+		if ok {
+			s.finishProgress(uuid)
+		} else {
+			s.abortProgress(uuid, rec.reason())
+		}
+	}()
+
+	mimeType, ok := s.checkFileType(rec, r, fileInfo)
+	if !ok {
+		return File{}, "", false
+	}
+	fileInfo.MIME = mimeType
+	fileInfo.Digest = s.ensureFileDigest(fileInfo)
+	s.runMutex.Lock()
+	s.uploadFileMap[uuid] = fileInfo
+	s.runMutex.Unlock()
+
+	scanStatus, ok = s.scanUploadedFile(rec, r, fileInfo)
+	return fileInfo, scanStatus, ok
+}
+
+// finalizeUploadedFile 检查文件类型、扫描文件、生成缩略图，然后将文件消息加入队列并广播
+// 检查未通过时已写入错误响应并广播 upload_abort，ok 为 false
+func (s *ClipboardServer) finalizeUploadedFile(w http.ResponseWriter, r *http.Request, fileInfo File) (event PostEvent, ok bool) {
+	uuid, room := fileInfo.UUID, fileInfo.Room
+	fileInfo, scanStatus, ok := s.inspectUploadedFile(w, r, fileInfo)
+	if !ok {
+		return PostEvent{}, false
+	}
+	mimeType := fileInfo.MIME
 
 	fileReceiveData := &FileReceive{
-		ReceiveBase: ReceiveBase{
-			Type:         "file",
-			Room:         room,
-			Timestamp:    timestamp,
-			SenderIP:     get_remote_ip(r),
-			SenderDevice: s.parse_user_agent(r.UserAgent()),
-		},
-		Name:   fileInfo.Name,
-		Size:   fileInfo.Size,
-		Cache:  uuid,
-		Expire: fileInfo.ExpireTime,
-		URL:    fmt.Sprintf("%s://%s%s/file/%s", getScheme(r), r.Host, s.config.Server.Prefix, uuid),
+		Name:       fileInfo.Name,
+		Size:       fileInfo.Size,
+		Cache:      uuid,
+		Expire:     fileInfo.ExpireTime,
+		URL:        fmt.Sprintf("%s://%s%s/file/%s", getScheme(r), getHost(r), s.config.Server.Prefix, uuid),
+		ScanStatus: scanStatus,
+		MIME:       mimeType,
+		Digest:     fileInfo.Digest,
 	}
 
 	// 如果文件不太大，创建缩略图
 	if fileInfo.Size <= 32*1024*1024 { // 32MB
-		thumbnail, err := gen_thumbnail(filePath)
+		thumbnail, err := gen_thumbnail(filepath.Join(s.storageFolder, uuid))
 		if err == nil {
-			s.logger.Printf("已为文件 %s 生成缩略图", fileInfo.Name)
+			s.logf(logFile, slog.LevelInfo, "已为文件 %s 生成缩略图", fileInfo.Name)
 			fileReceiveData.Thumbnail = thumbnail
 		} else {
-			s.logger.Printf("生成缩略图失败: %v,文件类型可能不受支持", err)
+			s.logf(logFile, slog.LevelInfo, "生成缩略图失败: %v,文件类型可能不受支持", err)
 		}
 	}
 
 	// 添加消息到队列并广播
-	event := s.addMessageToQueueAndBroadcast("file", fileReceiveData, room, r)
-	s.logger.Printf("文件 %s (UUID: %s) 上传完成, 大小: %d, 房间: %s", fileInfo.Name, uuid, fileInfo.Size, room)
-
-	// 构建响应
-	scheme := getScheme(r)
-	contentURL := fmt.Sprintf("%s://%s%s/content/%d", scheme, r.Host, s.config.Server.Prefix, event.Data.ID())
-	if room != "default" {
-		contentURL += fmt.Sprintf("?room=%s", room)
-	}
-	responseType := DetermineResponseType(fileInfo.Name)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"url":  contentURL,
-		"id":   strconv.Itoa(event.Data.ID()),
-		"type": responseType,
-	})
+	event = s.addMessageToQueueAndBroadcast("file", fileReceiveData, room, r)
+	s.audit(r, auditUpload, room, event.Data.ID(), uuid, fileInfo.Name)
+	s.logf(logFile, slog.LevelInfo, "文件 %s (UUID: %s) 上传完成, 大小: %d, 房间: %s", fileInfo.Name, uuid, fileInfo.Size, room)
+	return event, true
 }
 
 func (s *ClipboardServer) handle_revoke(w http.ResponseWriter, r *http.Request) {
@@ -752,6 +996,7 @@ func (s *ClipboardServer) handle_revoke(w http.ResponseWriter, r *http.Request)
 	s.messageQueue.Lock()
 	var foundMsg *PostEvent // 指向 PostEvent
 	foundIndex := -1
+	deniedRoom := ""
 
 	for i := range s.messageQueue.List { // 使用大写 L
 		// 假设 PostEvent 的 ID 是通过其 Data 字段的 ID() 方法访问的
@@ -764,19 +1009,35 @@ func (s *ClipboardServer) handle_revoke(w http.ResponseWriter, r *http.Request)
 			}
 		}
 	}
-	// ...
-	if foundMsg != nil {
+	// 私有房间中的消息需要房间密钥才能撤销
+	if foundMsg != nil && !s.canAccessRoom(r, foundMsg.Data.Room()) {
+		deniedRoom = normalizeRoomName(foundMsg.Data.Room())
+	}
+	var revoked PostEvent
+	if foundMsg != nil && deniedRoom == "" {
+		revoked = *foundMsg
 		// 从消息队列中移除
 		s.messageQueue.List = append(s.messageQueue.List[:foundIndex], s.messageQueue.List[foundIndex+1:]...) // 使用大写 L
+		foundMsg = &revoked
 	}
 	s.messageQueue.Unlock()
+	if deniedRoom != "" {
+		s.checkRoomAccess(w, r, deniedRoom)
+		return
+	}
 	// ...
 	if foundMsg == nil {
-		s.logger.Printf("尝试撤销未找到的消息 ID: %d (房间: '%s')", id, room)
+		s.logf(logMessage, slog.LevelInfo, "尝试撤销未找到的消息 ID: %d (房间: '%s')", id, room)
 		http.Error(w, "消息未找到", http.StatusNotFound)
 		return
 	}
 
+	revokedFile := ""
+	if foundMsg.Data.FileReceive != nil {
+		revokedFile = foundMsg.Data.FileReceive.Cache
+	}
+	s.audit(r, auditRevoke, foundMsg.Data.Room(), id, revokedFile, "")
+
 	// 如果是文件消息，则删除文件并从 uploadFileMap 中移除
 	if foundMsg.Data.Type() == "file" && foundMsg.Data.FileReceive != nil {
 		uuid := foundMsg.Data.FileReceive.Cache
@@ -787,11 +1048,14 @@ func (s *ClipboardServer) handle_revoke(w http.ResponseWriter, r *http.Request)
 		filePath := filepath.Join(s.storageFolder, uuid)
 		if err := os.Remove(filePath); err != nil {
 			if !os.IsNotExist(err) {
-				s.logger.Printf("警告: 撤销时删除文件 %s (UUID: %s) 失败: %v", filePath, uuid, err)
+				s.logf(logMessage, slog.LevelWarn, "警告: 撤销时删除文件 %s (UUID: %s) 失败: %v", filePath, uuid, err)
 			}
 		} else {
-			s.logger.Printf("已删除与撤销消息关联的文件: %s (UUID: %s)", filePath, uuid)
+			s.logf(logMessage, slog.LevelInfo, "已删除与撤销消息关联的文件: %s (UUID: %s)", filePath, uuid)
 		}
+	} else if foundMsg.Data.Type() == "folder" && foundMsg.Data.FileReceive != nil {
+		s.deleteFolderEntries(foundMsg.Data.FileReceive.Entries)
+		s.logf(logMessage, slog.LevelInfo, "已删除与撤销消息关联的文件夹: %s (UUID: %s)", foundMsg.Data.FileReceive.Name, foundMsg.Data.FileReceive.Cache)
 	}
 
 	// 广播撤销事件
@@ -799,6 +1063,9 @@ func (s *ClipboardServer) handle_revoke(w http.ResponseWriter, r *http.Request)
 		Event: "revoke",
 		Data:  map[string]int{"id": id}, // 前端期望的载荷
 	}
+	if room == "" {
+		room = foundMsg.Data.Room() // 避免将私有房间的撤销事件广播到所有房间
+	}
 	s.broadcastWebSocketMessage(revokeWsMsg, room) // 使用新的广播函数
 	s.saveHistoryData()
 }
@@ -807,59 +1074,46 @@ func (s *ClipboardServer) handleClearAll(w http.ResponseWriter, r *http.Request)
 	room := r.URL.Query().Get("room")
 	normalizedRoom := normalizeRoomName(room) // 应用规范化：空字符串 -> "default"
 
-	s.logger.Printf("处理 /revoke/all 请求 (房间: '%s', 规范化后: '%s')", room, normalizedRoom)
+	s.logf(logMessage, slog.LevelInfo, "处理 /revoke/all 请求 (房间: '%s', 规范化后: '%s')", room, normalizedRoom)
+	if !s.checkRoomAccess(w, r, normalizedRoom) {
+		return
+	}
 
 	s.messageQueue.Lock()
 	var newMsgList []PostEvent
 	var revokedIDs []int
+	var cleared []*FileReceive
 
-	// 始终只清空指定房间（规范化后的房间名），不再支持通过空字符串清空所有
+	// 始终只清空指定房间（规范化后的房间名），不支持通过空字符串清空所有房间
 	for _, msg := range s.messageQueue.List {
 		if normalizeRoomName(msg.Data.Room()) != normalizedRoom {
 			newMsgList = append(newMsgList, msg)
 		} else {
 			revokedIDs = append(revokedIDs, msg.Data.ID())
+			if msg.Data.FileReceive != nil {
+				cleared = append(cleared, msg.Data.FileReceive)
+			}
 		}
 	}
 	s.messageQueue.List = newMsgList
 	s.messageQueue.Unlock()
+	s.audit(r, auditClear, normalizedRoom, 0, "", fmt.Sprintf("清除 %d 条消息", len(revokedIDs)))
 
-	// 删除关联的文件
-	s.runMutex.Lock() // 保护 uploadFileMap
-	var filesToRemove []string
-	if room == "" { // 清空所有文件
-		for uuid := range s.uploadFileMap {
-			filesToRemove = append(filesToRemove, uuid)
-		}
-		s.uploadFileMap = make(map[string]File) // 清空 map
-	} else { // 只清空指定房间的文件 (需要消息中有房间信息来判断)
-		// 这个逻辑比较复杂，因为 uploadFileMap 本身不直接关联房间。
-		// 需要遍历原始消息（在它们被清除之前）来确定哪些文件属于该房间。
-		// 或者，如果 PostEvent 中记录了文件UUID，可以在清除消息时收集这些UUID。
-		// 简单起见，如果按房间清除，我们目前只清除消息，文件由过期机制处理。
-		// 一个更完善的实现会跟踪与房间关联的文件。
-		// 或者，在清除消息时，如果消息是文件类型且属于该房间，则记录其UUID并删除。
-		// 这里我们假设，如果按房间清除，文件暂时不主动删除，依赖过期。
-		// 如果是全局清除，则删除所有文件。
-		if room == "" {
-			for _, uuid := range filesToRemove {
-				filePath := filepath.Join(s.storageFolder, uuid)
-				if err := os.Remove(filePath); err != nil {
-					if !os.IsNotExist(err) {
-						s.logger.Printf("警告: 清除所有时删除文件 %s 失败: %v", filePath, err)
-					}
-				}
-			}
+	// 只删除被清除的消息关联的文件，其他房间的文件不受影响
+	for _, fileRec := range cleared {
+		if fileRec.Type == "folder" {
+			s.deleteFolderEntries(fileRec.Entries)
+		} else {
+			s.deleteUploadedFile(fileRec.Cache)
 		}
 	}
-	s.runMutex.Unlock()
 
-	// 广播 clearAll 事件
+	// 广播 clearAll 事件，只发送到被清空的房间
 	clearWsMsg := WebSocketMessage{
 		Event: "clearAll",
-		Data:  map[string]string{"room": room}, // 前端期望的载荷
+		Data:  map[string]string{"room": normalizedRoom}, // 前端期望的载荷
 	}
-	s.broadcastWebSocketMessage(clearWsMsg, room) // 使用新的广播函数
+	s.broadcastWebSocketMessage(clearWsMsg, normalizedRoom)
 	s.saveHistoryData()
 
 	w.WriteHeader(http.StatusOK)
@@ -896,12 +1150,12 @@ func (s *ClipboardServer) handleContent(w http.ResponseWriter, r *http.Request)
 
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		s.logger.Printf("无效的内容 ID: %s, 错误: %v", idStr, err)
+		s.logf(logHTTP, slog.LevelInfo, "无效的内容 ID: %s, 错误: %v", idStr, err)
 		http.Error(w, "无效的内容 ID", http.StatusBadRequest)
 		return
 	}
 	room := r.URL.Query().Get("room") // 可选的房间参数
-	s.logger.Printf("处理内容请求, ID: %d, 房间: '%s', JSON请求: %t", id, room, isJSONRequest)
+	s.logf(logHTTP, slog.LevelInfo, "处理内容请求, ID: %d, 房间: '%s', JSON请求: %t", id, room, isJSONRequest)
 
 	s.messageQueue.Lock()
 	defer s.messageQueue.Unlock()
@@ -911,7 +1165,7 @@ func (s *ClipboardServer) handleContent(w http.ResponseWriter, r *http.Request)
 		// 检查ID是否匹配
 		if msg.Data.ID() == id {
 			// 检查房间是否匹配（如果指定了房间）
-			if room == "" || msg.Data.Room() == "" || msg.Data.Room() == room {
+			if (room == "" || msg.Data.Room() == "" || msg.Data.Room() == room) && s.canAccessRoom(r, msg.Data.Room()) {
 				// 根据消息类型处理
 				switch msg.Data.Type() {
 				case "file":
@@ -919,7 +1173,7 @@ func (s *ClipboardServer) handleContent(w http.ResponseWriter, r *http.Request)
 						if isJSONRequest {
 							// 返回JSON格式的文件信息
 							fileReceive := msg.Data.FileReceive
-							responseType := DetermineResponseType(fileReceive.Name)
+							responseType := fileResponseType(fileReceive.Name, fileReceive.MIME)
 
 							responseData := map[string]interface{}{
 								"type":      responseType,
@@ -933,7 +1187,7 @@ func (s *ClipboardServer) handleContent(w http.ResponseWriter, r *http.Request)
 
 							w.Header().Set("Content-Type", "application/json")
 							json.NewEncoder(w).Encode(responseData)
-							s.logger.Printf("以JSON格式返回文件信息, ID: %d", id)
+							s.logf(logHTTP, slog.LevelDebug, "以JSON格式返回文件信息, ID: %d", id)
 							return
 						} else {
 							// 文件类型，重定向到文件URL
@@ -944,16 +1198,35 @@ func (s *ClipboardServer) handleContent(w http.ResponseWriter, r *http.Request)
 
 							fileURL := fmt.Sprintf("%s://%s%s/file/%s/%s",
 								scheme,
-								r.Host,
+								getHost(r),
 								s.config.Server.Prefix,
 								cacheUUID,
 								encodedFilename,
 							)
-							s.logger.Printf("找到文件内容, 重定向到: %s", fileURL)
+							// 文件下载同样需要认证：分享链接的参数原样传递，其他认证方式依靠 Cookie 或请求头，不把凭据放进 URL
+							if info := authFromRequest(r); info != nil && info.Method == "share" {
+								fileURL += "?" + shareRedirectQuery(r.URL.Query(), msg.Data.ID()).Encode()
+							}
+							s.logf(logHTTP, slog.LevelDebug, "找到文件内容, 重定向到: %s", fileURL)
 							http.Redirect(w, r, fileURL, http.StatusFound)
 							return
 						}
 					}
+				case "folder":
+					if fileRec := msg.Data.FileReceive; fileRec != nil {
+						if isJSONRequest {
+							w.Header().Set("Content-Type", "application/json")
+							json.NewEncoder(w).Encode(folderContentInfo(msg.Data.ID(), fileRec))
+							return
+						}
+						// 文件夹重定向到 zip 下载
+						folderURL := fmt.Sprintf("%s://%s%s/folder/%s", getScheme(r), getHost(r), s.config.Server.Prefix, fileRec.Cache)
+						if info := authFromRequest(r); info != nil && info.Method == "share" {
+							folderURL += "?" + shareRedirectQuery(r.URL.Query(), msg.Data.ID()).Encode()
+						}
+						http.Redirect(w, r, folderURL, http.StatusFound)
+						return
+					}
 				case "text":
 					if msg.Data.TextReceive != nil {
 						// 返回格式判断优先级：1. isJSONRequest参数 2. Accept头
@@ -968,7 +1241,7 @@ func (s *ClipboardServer) handleContent(w http.ResponseWriter, r *http.Request)
 
 							w.Header().Set("Content-Type", "application/json")
 							json.NewEncoder(w).Encode(responseData)
-							s.logger.Printf("以JSON格式返回文本内容, ID: %d", id)
+							s.logf(logHTTP, slog.LevelDebug, "以JSON格式返回文本内容, ID: %d", id)
 							return
 						} else {
 							// 默认返回纯文本
@@ -978,7 +1251,7 @@ func (s *ClipboardServer) handleContent(w http.ResponseWriter, r *http.Request)
 								content += "\n"
 							}
 							w.Write([]byte(content))
-							s.logger.Printf("以纯文本格式返回文本内容, ID: %d", id)
+							s.logf(logHTTP, slog.LevelDebug, "以纯文本格式返回文本内容, ID: %d", id)
 							return
 						}
 					}
@@ -988,7 +1261,7 @@ func (s *ClipboardServer) handleContent(w http.ResponseWriter, r *http.Request)
 	}
 
 	// 内容未找到时的响应格式也遵循JSON请求参数
-	s.logger.Printf("未找到内容 ID: %d (房间: '%s')", id, room)
+	s.logf(logHTTP, slog.LevelInfo, "未找到内容 ID: %d (房间: '%s')", id, room)
 	if isJSONRequest {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
@@ -1008,14 +1281,14 @@ func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Req
 		isJSONRequest = true
 	}
 
-	s.logger.Printf("处理最新内容请求 (房间: '%s', JSON请求: %t)", room, isJSONRequest)
+	s.logf(logHTTP, slog.LevelInfo, "处理最新内容请求 (房间: '%s', JSON请求: %t)", room, isJSONRequest)
 
 	s.messageQueue.Lock()
 	defer s.messageQueue.Unlock()
 
 	// 检查消息队列是否为空
 	if len(s.messageQueue.List) == 0 {
-		s.logger.Printf("没有可用的内容 (房间: '%s')", room)
+		s.logf(logHTTP, slog.LevelInfo, "没有可用的内容 (房间: '%s')", room)
 		if isJSONRequest {
 			// 如果是JSON请求，返回JSON格式的404响应
 			w.Header().Set("Content-Type", "application/json")
@@ -1029,6 +1302,7 @@ func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Req
 	}
 
 	// 从后向前查找匹配房间的最新消息
+	roomAccess := make(map[string]bool) // 缓存房间密钥校验结果
 	for i := len(s.messageQueue.List) - 1; i >= 0; i-- {
 		msg := s.messageQueue.List[i]
 
@@ -1036,6 +1310,15 @@ func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Req
 		if room != "" && msg.Data.Room() != "" && msg.Data.Room() != room {
 			continue
 		}
+		// 跳过无权访问的私有房间消息
+		allowed, checked := roomAccess[msg.Data.Room()]
+		if !checked {
+			allowed = s.canAccessRoom(r, msg.Data.Room())
+			roomAccess[msg.Data.Room()] = allowed
+		}
+		if !allowed {
+			continue
+		}
 
 		// 如果是JSON请求，始终以JSON格式返回
 		if isJSONRequest {
@@ -1047,7 +1330,7 @@ func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Req
 			if msg.Data.Type() == "file" && msg.Data.FileReceive != nil {
 				// 确定文件类型
 				fileReceive := msg.Data.FileReceive
-				responseType = DetermineResponseType(fileReceive.Name)
+				responseType = fileResponseType(fileReceive.Name, fileReceive.MIME)
 
 				// 构建JSON响应
 				responseData = map[string]interface{}{
@@ -1059,6 +1342,9 @@ func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Req
 					"id":        strconv.Itoa(msg.Data.ID()),
 					"timestamp": fileReceive.Timestamp,
 				}
+			} else if msg.Data.Type() == "folder" && msg.Data.FileReceive != nil {
+				responseType = "folder"
+				responseData = folderContentInfo(msg.Data.ID(), msg.Data.FileReceive)
 			} else if msg.Data.Type() == "text" && msg.Data.TextReceive != nil {
 				responseType = "text"
 				responseData = map[string]interface{}{
@@ -1078,7 +1364,7 @@ func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Req
 			}
 
 			json.NewEncoder(w).Encode(responseData)
-			s.logger.Printf("以JSON格式返回最新内容 (类型: %s, 房间: '%s')", responseType, room)
+			s.logf(logHTTP, slog.LevelDebug, "以JSON格式返回最新内容 (类型: %s, 房间: '%s')", responseType, room)
 			return
 		}
 
@@ -1093,7 +1379,7 @@ func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Req
 
 			file, err := os.Open(filePath)
 			if err != nil {
-				s.logger.Printf("错误: 打开文件失败: %v", err)
+				s.logf(logHTTP, slog.LevelError, "错误: 打开文件失败: %v", err)
 				http.Error(w, "文件在磁盘上未找到", http.StatusNotFound)
 				return
 			}
@@ -1101,28 +1387,21 @@ func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Req
 
 			stat, err := file.Stat()
 			if err != nil {
-				s.logger.Printf("错误: 获取文件状态失败: %v", err)
+				s.logf(logHTTP, slog.LevelError, "错误: 获取文件状态失败: %v", err)
 				http.Error(w, "无法获取文件状态", http.StatusInternalServerError)
 				return
 			}
 
-			// 设置响应头，根据文件类型确定内容类型
-			contentType := mime.TypeByExtension(filepath.Ext(filename))
-			if contentType == "" {
-				contentType = "application/octet-stream"
-			}
+			// 设置响应头，优先使用上传时嗅探得到的类型
+			contentType := fileContentType(filename, msg.Data.FileReceive.MIME)
 			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
 
-			// 根据查询参数决定是否作为附件下载
-			dispositionType := "inline" // 默认内联显示
-			if r.URL.Query().Get("download") == "true" {
-				dispositionType = "attachment"
-			}
-			disposition := fmt.Sprintf("%s; filename=%q", dispositionType, filename)
-			w.Header().Set("Content-Disposition", disposition)
+			// 根据查询参数决定是否作为附件下载，活动内容总是作为附件
+			w.Header().Set("Content-Disposition", fileDisposition(filename, contentType, r.URL.Query().Get("download") == "true"))
 
 			// 提供文件内容
-			s.logger.Printf("直接提供最新文件内容: %s", filename)
+			s.logf(logHTTP, slog.LevelDebug, "直接提供最新文件内容: %s", filename)
 			http.ServeContent(w, r, filename, stat.ModTime(), file)
 			return
 
@@ -1133,7 +1412,7 @@ func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Req
 				// 客户端请求JSON格式
 				w.Header().Set("Content-Type", "application/json")
 				json.NewEncoder(w).Encode(msg)
-				s.logger.Printf("以JSON格式返回最新文本内容")
+				s.logf(logHTTP, slog.LevelDebug, "以JSON格式返回最新文本内容")
 				return
 			} else {
 				// 默认返回纯文本
@@ -1143,13 +1422,13 @@ func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Req
 					content += "\n"
 				}
 				w.Write([]byte(content))
-				s.logger.Printf("以纯文本格式返回最新文本内容")
+				s.logf(logHTTP, slog.LevelDebug, "以纯文本格式返回最新文本内容")
 				return
 			}
 		}
 	}
 
-	s.logger.Printf("未找到匹配的最新内容 (房间: '%s')", room)
+	s.logf(logHTTP, slog.LevelInfo, "未找到匹配的最新内容 (房间: '%s')", room)
 	if isJSONRequest {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
@@ -1161,11 +1440,6 @@ func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Req
 
 // handleRooms 处理房间列表请求
 func (s *ClipboardServer) handleRooms(w http.ResponseWriter, r *http.Request) {
-	// 添加 CORS 头
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
 	// 处理预检请求
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
@@ -1188,9 +1462,25 @@ func (s *ClipboardServer) handleRooms(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.logger.Printf("处理房间列表请求，来自: %s", get_remote_ip(r))
+	s.logf(logHTTP, slog.LevelDebug, "处理房间列表请求，来自: %s", get_remote_ip(r))
 
-	roomList := s.getRoomList()
+	// 只列出调用者有权访问的房间 (房间的 IP 访问策略、私有房间密钥及 API 令牌的房间限制)，
+	// 携带的密钥不匹配任何私有房间时计入认证失败
+	roomKey := roomKeyFromRequest(r)
+	if roomKey != "" && !s.checkAuthGuard(w, r) {
+		return
+	}
+	if roomKey != "" && !s.roomKeyKnown(roomKey) {
+		s.authFailed(r)
+	}
+	roomList := make([]RoomInfo, 0)
+	for _, roomInfo := range s.getRoomList() {
+		if !s.canAccessRoom(r, roomInfo.Name) {
+			continue
+		}
+		roomInfo.Private = s.isPrivateRoom(roomInfo.Name)
+		roomList = append(roomList, roomInfo)
+	}
 
 	response := RoomListResponse{
 		Rooms: roomList,
@@ -1198,10 +1488,10 @@ func (s *ClipboardServer) handleRooms(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		s.logger.Printf("错误: 编码房间列表响应失败: %v", err)
+		s.logf(logHTTP, slog.LevelError, "错误: 编码房间列表响应失败: %v", err)
 		http.Error(w, "编码响应失败", http.StatusInternalServerError)
 		return
 	}
 
-	s.logger.Printf("返回房间列表，包含 %d 个房间", len(roomList))
+	s.logf(logHTTP, slog.LevelDebug, "返回房间列表，包含 %d 个房间", len(roomList))
 }
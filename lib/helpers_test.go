@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer 创建使用临时存储目录的服务器及其 httptest 服务，configure 可以在创建前修改配置
+func newTestServer(t *testing.T, configure func(cfg *Config)) (*ClipboardServer, *httptest.Server) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.Server.StorageDir = dir
+	cfg.Server.HistoryFile = filepath.Join(dir, "history.json")
+	cfg.Server.Auth = ""
+	cfg.Log.Level = "error"
+	if configure != nil {
+		configure(cfg)
+	}
+	s, err := NewClipboardServer(cfg)
+	if err != nil {
+		t.Fatalf("NewClipboardServer: %v", err)
+	}
+	s.setupRoutes()
+	ts := httptest.NewServer(s.httpServer.Handler)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// dialPush 连接 /push 并读取到 config 事件 (握手完成) 为止
+func dialPush(t *testing.T, ts *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/push"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		var msg WebSocketMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Event == "config" {
+			return conn
+		}
+	}
+}
+
+// doRequest 发送请求并读取完整的响应体，headers 为 "名称", "值" 交替排列
+func doRequest(t *testing.T, method, url string, body io.Reader, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+// postFile 通过 /upload 以 multipart 表单上传一个文件
+func postFile(t *testing.T, ts *httptest.Server, query, name string, content []byte, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", name)
+	fw.Write(content)
+	mw.Close()
+	return doRequest(t, http.MethodPost, ts.URL+"/upload"+query, &buf, append([]string{"Content-Type", mw.FormDataContentType()}, headers...)...)
+}
+
+// uploadFile 通过 /upload 上传一个文件，返回响应中的消息 ID
+func uploadFile(t *testing.T, ts *httptest.Server, query, name string, content []byte, headers ...string) string {
+	t.Helper()
+	resp, data := postFile(t, ts, query, name, content, headers...)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload %s: %s %s", name, resp.Status, data)
+	}
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatalf("upload %s: %v %s", name, err, data)
+	}
+	return result.ID
+}
+
+// messageFile 返回消息关联的文件 UUID
+func messageFile(s *ClipboardServer, id string) string {
+	s.messageQueue.Lock()
+	defer s.messageQueue.Unlock()
+	for _, msg := range s.messageQueue.List {
+		if strconv.Itoa(msg.Data.ID()) == id && msg.Data.FileReceive != nil {
+			return msg.Data.FileReceive.Cache
+		}
+	}
+	return ""
+}
@@ -0,0 +1,157 @@
+package lib
+
+/**
+*** FILE: logging.go
+***   handle leveled structured logging (log/slog), per-subsystem verbosity and secret redaction
+**/
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// 日志子系统
+const (
+	logServer  = "server"  // 启动、存储、历史记录等
+	logWS      = "ws"      // WebSocket 连接和广播
+	logHTTP    = "http"    // 一般请求处理
+	logFile    = "file"    // 上传和下载
+	logMessage = "message" // 文本消息和消息队列
+	logAuth    = "auth"    // 认证、会话、令牌和分享链接
+	logTLS     = "tls"     // 证书
+)
+
+const redactedValue = "[REDACTED]"
+
+// redactedLogKeys 启用脱敏时，这些属性的值不会写入日志
+var redactedLogKeys = map[string]bool{
+	"password":      true,
+	"token":         true,
+	"secret":        true,
+	"authorization": true,
+	"cookie":        true,
+	"csrf":          true,
+	"content":       true,
+	"original":      true,
+	"text":          true,
+	"body":          true,
+}
+
+// parseLogLevel 解析日志级别名称: debug, info, warn, error
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("未知的日志级别 '%s'", name)
+	}
+	return level, nil
+}
+
+// subsystemHandler 按 subsystem 属性决定日志级别，未单独配置的子系统使用全局级别
+type subsystemHandler struct {
+	slog.Handler
+	levels map[string]slog.Level
+	level  slog.Level
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	level := h.level
+	for _, attr := range attrs {
+		if attr.Key == "subsystem" {
+			if l, ok := h.levels[attr.Value.String()]; ok {
+				level = l
+			}
+		}
+	}
+	return &subsystemHandler{Handler: h.Handler.WithAttrs(attrs), levels: h.levels, level: level}
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return &subsystemHandler{Handler: h.Handler.WithGroup(name), levels: h.levels, level: h.level}
+}
+
+// newLogger 按配置创建根日志记录器
+func newLogger(cfg LogConfig) (*slog.Logger, error) {
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	levels := make(map[string]slog.Level, len(cfg.Subsystems))
+	for name, levelName := range cfg.Subsystems {
+		l, err := parseLogLevel(levelName)
+		if err != nil {
+			return nil, fmt.Errorf("子系统 '%s': %w", name, err)
+		}
+		levels[name] = l
+	}
+
+	var out io.Writer = os.Stdout
+	if cfg.File != "" {
+		writer, err := newRotatingWriter(cfg.File, cfg.MaxSize, cfg.MaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		out = writer
+	}
+
+	opts := &slog.HandlerOptions{
+		AddSource: true,
+		Level:     slog.LevelDebug, // 级别由 subsystemHandler 过滤
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			switch {
+			case a.Key == slog.SourceKey:
+				// 与原来的 log.Lshortfile 一致，只保留文件名和行号
+				if src, ok := a.Value.Any().(*slog.Source); ok {
+					return slog.String(slog.SourceKey, fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+				}
+			case cfg.Redact && redactedLogKeys[strings.ToLower(a.Key)]:
+				return slog.String(a.Key, redactedValue)
+			}
+			return a
+		},
+	}
+	var handler slog.Handler
+	switch cfg.Format {
+	case "", "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return nil, fmt.Errorf("未知的日志格式 '%s'", cfg.Format)
+	}
+	return slog.New(&subsystemHandler{Handler: handler, levels: levels, level: level}), nil
+}
+
+// log 返回指定子系统的日志记录器
+func (s *ClipboardServer) log(subsystem string) *slog.Logger {
+	if logger, ok := s.subLoggers.Load(subsystem); ok {
+		return logger.(*slog.Logger)
+	}
+	logger, _ := s.subLoggers.LoadOrStore(subsystem, s.slog.With("subsystem", subsystem))
+	return logger.(*slog.Logger)
+}
+
+// logf 以 Printf 风格写入指定子系统和级别的日志
+func (s *ClipboardServer) logf(subsystem string, level slog.Level, format string, args ...interface{}) {
+	handler := s.log(subsystem).Handler()
+	if !handler.Enabled(context.Background(), level) {
+		return
+	}
+	// 跳过 [runtime.Callers, logf]
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+	handler.Handle(context.Background(), slog.NewRecord(time.Now(), level, fmt.Sprintf(format, args...), pcs[0]))
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    slog.Level
+		wantErr bool
+	}{
+		{"", slog.LevelInfo, false},
+		{"debug", slog.LevelDebug, false},
+		{"WARN", slog.LevelWarn, false},
+		{"error", slog.LevelError, false},
+		{"verbose", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseLogLevel(tt.name)
+		if (err != nil) != tt.wantErr || (err == nil && got != tt.want) {
+			t.Errorf("parseLogLevel(%q) = %v, %v", tt.name, got, err)
+		}
+	}
+}
+
+// 服务器各处的日志都经过 logf，按子系统过滤级别并对敏感属性脱敏
+func TestServerLogRedactionAndLevels(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "server.log")
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.Server.Auth = true
+		cfg.Log = LogConfig{
+			Level:      "info",
+			File:       logFile,
+			Subsystems: map[string]string{"ws": "debug", "auth": "warn"},
+			Redact:     true,
+		}
+	})
+	password, _ := s.authPassword()
+	s.logf(logWS, slog.LevelDebug, "ws debug visible")
+	s.logf(logAuth, slog.LevelInfo, "auth info hidden")
+	s.logf(logServer, slog.LevelDebug, "server debug hidden")
+	s.log(logMessage).Info("消息", "content", "secret text")
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	if strings.Contains(out, password) || strings.Contains(out, "secret text") {
+		t.Errorf("log contains redacted values:\n%s", out)
+	}
+	if !strings.Contains(out, "ws debug visible") || strings.Contains(out, "hidden") {
+		t.Errorf("subsystem levels not applied:\n%s", out)
+	}
+	if !strings.Contains(out, "subsystem=server") || !strings.Contains(out, "source=main.go:") {
+		t.Errorf("server startup logs missing subsystem or source:\n%s", out)
+	}
+}
+
+// 关闭脱敏时日志中也不包含消息正文和随机生成的密码
+func TestLogOmitsMessageBodies(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "server.log")
+	s, ts := newTestServer(t, func(cfg *Config) {
+		cfg.Server.Auth = true
+		cfg.Server.History = 1
+		cfg.Log = LogConfig{Level: "debug", File: logFile, Redact: false}
+	})
+	password, _ := s.authPassword()
+	auth := []string{"Authorization", "Bearer " + password}
+	resp, data := doRequest(t, http.MethodPost, ts.URL+"/text", strings.NewReader("first body"), auth...)
+	var created struct{ ID string }
+	json.Unmarshal(data, &created)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("post text: %s %s", resp.Status, data)
+	}
+	if resp, data := doRequest(t, http.MethodPost, ts.URL+"/text?id="+created.ID, strings.NewReader("second body"), auth...); resp.StatusCode != http.StatusOK {
+		t.Fatalf("update text: %s %s", resp.Status, data)
+	}
+	// 队列长度为 1，第二条消息淘汰第一条
+	if resp, data := doRequest(t, http.MethodPost, ts.URL+"/text", strings.NewReader("third body"), auth...); resp.StatusCode != http.StatusOK {
+		t.Fatalf("post text: %s %s", resp.Status, data)
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	for _, secret := range []string{password, "first body", "second body", "third body"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log contains %q:\n%s", secret, out)
+		}
+	}
+	for _, want := range []string{"收到文本消息", "文本消息已更新", "淘汰旧消息"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log missing %q:\n%s", want, out)
+		}
+	}
+}
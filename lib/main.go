@@ -3,11 +3,12 @@ package lib
 import (
 	"context" // 确保导入 embed 包
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"io/fs"
 	"log"
+	"log/slog"
 	"math/big"
 	"net"
 	"net/http"
@@ -24,20 +25,16 @@ import (
 	"github.com/ua-parser/uap-go/uaparser"
 )
 
-var (
-	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-)
-
 var server_version = "go verion by Jonnyan404"
 var build_git_hash = show_bin_info()
 
 // NewClipboardServer 构造函数
 func NewClipboardServer(cfg *Config) (*ClipboardServer, error) {
-	logger := log.New(os.Stdout, "ClipboardServer: ", log.LstdFlags|log.Lshortfile)
+	rootLogger, err := newLogger(cfg.Log)
+	if err != nil {
+		return nil, fmt.Errorf("无效的日志配置: %w", err)
+	}
+	serverLog := rootLogger.With("subsystem", logServer)
 
 	storageFolder := "./uploads"
 	if cfg.Server.StorageDir != "" {
@@ -47,16 +44,16 @@ func NewClipboardServer(cfg *Config) (*ClipboardServer, error) {
 	// 转换为绝对路径用于日志显示
 	absStorageFolder, err := filepath.Abs(storageFolder)
 	if err != nil {
-		logger.Printf("警告: 无法获取存储目录的绝对路径: %v，使用原始路径: %s", err, storageFolder)
+		serverLog.Warn("无法获取存储目录的绝对路径，使用原始路径", "path", storageFolder, "error", err)
 		absStorageFolder = storageFolder
 	}
 
 	if err := os.MkdirAll(storageFolder, 0755); err != nil {
-		logger.Printf("无法创建存储目录 %s: %v", absStorageFolder, err)
+		serverLog.Error("无法创建存储目录", "path", absStorageFolder, "error", err)
 		// 根据需求，这里可以是致命错误
 		// return nil, fmt.Errorf("无法创建存储目录 %s: %w", absStorageFolder, err)
 	} else {
-		logger.Printf("存储目录设置为: %s", absStorageFolder)
+		serverLog.Info("存储目录设置为", "path", absStorageFolder)
 	}
 
 	historyFilePath := filepath.Join(storageFolder, "history.json")
@@ -64,23 +61,23 @@ func NewClipboardServer(cfg *Config) (*ClipboardServer, error) {
 		historyFilePath = cfg.Server.HistoryFile
 	} else {
 		cfg.Server.HistoryFile = historyFilePath // 更新配置对象中的路径
-		logger.Printf("历史文件路径未指定，使用默认: %s", historyFilePath)
+		serverLog.Info("历史文件路径未指定，使用默认路径", "path", historyFilePath)
 	}
 
 	// 转换为绝对路径用于日志显示
 	absHistoryFilePath, err := filepath.Abs(historyFilePath)
 	if err != nil {
-		logger.Printf("警告: 无法获取历史文件的绝对路径: %v，使用原始路径: %s", err, historyFilePath)
+		serverLog.Warn("无法获取历史文件的绝对路径，使用原始路径", "path", historyFilePath, "error", err)
 		absHistoryFilePath = historyFilePath
 	}
-	logger.Printf("历史文件路径设置为: %s", absHistoryFilePath)
+	serverLog.Info("历史文件路径设置为", "path", absHistoryFilePath)
 
 	mqHistoryLen := 100 // 默认历史长度
 	if cfg.Server.History > 0 {
 		mqHistoryLen = cfg.Server.History
 	}
 	// 修改：传入 logger 以便在淘汰消息时打印日志
-	mq := NewMessageQueue(mqHistoryLen, logger)
+	mq := NewMessageQueue(mqHistoryLen, rootLogger.With("subsystem", logMessage))
 
 	uaParser := uaparser.NewFromSaved() // 初始化UA解析器
 
@@ -88,43 +85,48 @@ func NewClipboardServer(cfg *Config) (*ClipboardServer, error) {
 	if authBool, ok := cfg.Server.Auth.(bool); ok && authBool {
 		randomPassword, err := generateRandomString(8)
 		if err != nil {
-			logger.Printf("警告: 生成随机密码失败: %v。认证可能无法正常工作。", err)
+			serverLog.Warn("生成随机密码失败，认证可能无法正常工作", "error", err)
 			// 根据策略，这里可以决定是否继续或返回错误
 			// cfg.Server.Auth = "" // 清空，使其认证失败
 		} else {
 			cfg.Server.Auth = randomPassword // 将随机密码存回配置（内存中）
-			logger.Printf("认证已启用，随机生成的密码为: %s", randomPassword)
+			// 随机密码只打印到控制台一次，不写入日志
+			rootLogger.With("subsystem", logAuth).Info("认证已启用，使用随机生成的密码")
 			fmt.Printf("== \033[07m 认证密码 \033[0m: \033[33m%s\033[0m\n", randomPassword)
 		}
 	} else if authStr, ok := cfg.Server.Auth.(string); ok && authStr != "" {
-		logger.Printf("认证已启用，使用配置的密码。")
+		serverLog.Info("认证已启用，使用配置的密码")
 	} else if authInt, ok := cfg.Server.Auth.(int); ok && authInt != 0 {
 		// 将整数转换为字符串
 		strPassword := strconv.Itoa(authInt)
 		cfg.Server.Auth = strPassword
-		logger.Printf("认证已启用，使用转换为字符串的整数密码: %s", strPassword)
+		serverLog.Info("认证已启用，使用配置的整数密码")
 	} else if authFloat, ok := cfg.Server.Auth.(float64); ok && authFloat != 0 {
 		// JSON解析数字默认使用float64，需要将其转换为字符串
 		strPassword := strconv.FormatFloat(authFloat, 'f', 0, 64)
 		cfg.Server.Auth = strPassword
-		logger.Printf("认证已启用，使用转换为字符串的数字密码: %s", strPassword)
+		serverLog.Info("认证已启用，使用配置的数字密码")
 	} else if authNumber, ok := cfg.Server.Auth.(json.Number); ok {
 		// 处理json.Number类型（在一些JSON解析配置中可能会出现）
 		strPassword := string(authNumber)
 		cfg.Server.Auth = strPassword
-		logger.Printf("认证已启用，使用转换为字符串的JSON数字密码: %s", strPassword)
+		serverLog.Info("认证已启用，使用配置的JSON数字密码")
 	} else {
-		logger.Printf("认证未启用。")
+		serverLog.Info("认证未启用")
 		cfg.Server.Auth = "" // 确保在未配置或配置为false时为空字符串
 	}
 
 	s := &ClipboardServer{
 		config:          cfg,
-		logger:          logger,
+		slog:            rootLogger,
 		messageQueue:    mq,
 		websockets:      make(map[*websocket.Conn]bool),
 		room_ws:         make(map[*websocket.Conn]string),
+		wsWriteLocks:    make(map[*websocket.Conn]*sync.Mutex),
 		uploadFileMap:   make(map[string]File),
+		tusUploads:      make(map[string]*tusUpload),
+		chunkUploads:    make(map[string]*chunkUpload),
+		folderUploads:   make(map[string]*folderUpload),
 		deviceConnected: make(map[string]DeviceMeta),
 		storageFolder:   storageFolder,
 		historyFilePath: historyFilePath,
@@ -135,10 +137,93 @@ func NewClipboardServer(cfg *Config) (*ClipboardServer, error) {
 		// 初始化房间管理相关字段
 		roomStats:      make(map[string]*RoomStat),
 		roomStatsMutex: sync.RWMutex{},
+
+		privateRooms:  make(map[string]PrivateRoom),
+		roomsFilePath: filepath.Join(storageFolder, "rooms.json"),
+
+		apiTokens:      make(map[string]*APIToken),
+		tokensFilePath: filepath.Join(storageFolder, "tokens.json"),
+
+		shareUses: make(map[string]shareUse),
+		sessions:  make(map[string]*Session),
+
+		rateLimiter: newRateLimiter(),
+	}
+
+	guard, err := newAuthGuard(cfg.AuthGuard)
+	if err != nil {
+		return nil, fmt.Errorf("无效的认证防护配置: %w", err)
+	}
+	s.authGuard = guard
+
+	trustedProxies, err := parseCIDRList(cfg.Server.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("无效的受信任代理配置: %w", err)
+	}
+	s.trustedProxies = trustedProxies
+	if s.forwardedHeader, err = parseForwardedHeaderName(cfg.Server.ForwardedHeader); err != nil {
+		return nil, fmt.Errorf("无效的受信任代理配置: %w", err)
+	}
+
+	fetchAllowed, err := parseCIDRList(cfg.Fetch.AllowedNetworks)
+	if err != nil {
+		return nil, fmt.Errorf("无效的服务器下载配置: %w", err)
+	}
+	s.fetchAllowed = fetchAllowed
+	s.fetchClient = s.newFetchClient()
+
+	_, authEnabled := s.authPassword()
+	cors, err := newCORSPolicy(cfg.CORS, authEnabled)
+	if err != nil {
+		return nil, fmt.Errorf("无效的跨域配置: %w", err)
+	}
+	s.cors = cors
+
+	access, err := newAccessControl(cfg.Access)
+	if err != nil {
+		return nil, fmt.Errorf("无效的访问控制配置: %w", err)
+	}
+	s.access = access
+
+	clientCAs, err := loadClientCAs(cfg.MTLS)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 mTLS 配置: %w", err)
+	}
+	s.clientCAs = clientCAs
+
+	if err := s.initTLS(); err != nil {
+		return nil, fmt.Errorf("无效的 TLS 配置: %w", err)
+	}
+	if clientCAs != nil && s.certReloader == nil {
+		return nil, fmt.Errorf("无效的 mTLS 配置: 需要配置 server.cert 和 server.key 或启用 tls.auto")
+	}
+
+	if cfg.OIDC.Enabled {
+		provider, err := newOIDCProvider(cfg.OIDC)
+		if err != nil {
+			return nil, fmt.Errorf("无效的 OIDC 配置: %w", err)
+		}
+		s.oidc = provider
+		s.logf(logAuth, slog.LevelInfo, "已启用 OIDC 单点登录: %s", cfg.OIDC.Issuer)
+	}
+	s.upgrader = websocket.Upgrader{
+		CheckOrigin: s.cors.originAllowed,
 	}
 
 	if err := s.loadHistoryData(); err != nil {
-		s.logger.Printf("警告: 加载历史记录失败: %v. 将以空历史记录启动。", err)
+		s.logf(logServer, slog.LevelWarn, "警告: 加载历史记录失败: %v. 将以空历史记录启动。", err)
+	}
+	if err := s.loadPrivateRooms(); err != nil {
+		s.logf(logServer, slog.LevelWarn, "警告: 加载私有房间失败: %v", err)
+	}
+	if err := s.loadAPITokens(); err != nil {
+		s.logf(logServer, slog.LevelWarn, "警告: 加载 API 令牌失败: %v", err)
+	}
+	s.initShareSecret()
+	s.loadShareUses()
+	s.loadSessions()
+	if err := s.initAuditLog(); err != nil {
+		return nil, fmt.Errorf("无法打开审计日志: %w", err)
 	}
 
 	// 如果启用了房间列表功能，启动房间清理任务
@@ -152,10 +237,10 @@ func NewClipboardServer(cfg *Config) (*ClipboardServer, error) {
 // --- ClipboardServer 方法 ---
 
 func (s *ClipboardServer) loadHistoryData() error {
-	s.logger.Printf("尝试从以下路径加载历史记录: %s", s.historyFilePath)
+	s.logf(logServer, slog.LevelInfo, "尝试从以下路径加载历史记录: %s", s.historyFilePath)
 
 	if !pathExists(s.historyFilePath) { // pathExists 来自 utils.go 或 history.go
-		s.logger.Println("历史文件不存在。将以空历史记录启动。")
+		s.logf(logServer, slog.LevelInfo, "历史文件不存在。将以空历史记录启动。")
 		return nil
 	}
 
@@ -166,7 +251,7 @@ func (s *ClipboardServer) loadHistoryData() error {
 
 	var loadedHist History // History struct from types.go
 	if err := json.Unmarshal(data, &loadedHist); err != nil {
-		s.logger.Printf("无法解析历史数据 %s: %v。将尝试删除损坏的历史文件。", s.historyFilePath, err)
+		s.logf(logServer, slog.LevelWarn, "无法解析历史数据 %s: %v。将尝试删除损坏的历史文件。", s.historyFilePath, err)
 		os.Remove(s.historyFilePath)
 		return fmt.Errorf("无法解析历史数据 %s: %w", s.historyFilePath, err)
 	}
@@ -196,7 +281,9 @@ func (s *ClipboardServer) loadHistoryData() error {
 
 	// 更新 uploadFileMap 的逻辑保持不变
 	for _, rh := range loadedHist.Receive { // 遍历原始的 []ReceiveHolder
-		if fileRec := rh.FileReceive; fileRec != nil && fileRec.Cache != "" {
+		if fileRec := rh.FileReceive; fileRec != nil && fileRec.Type == "folder" {
+			s.restoreFolderEntries(fileRec)
+		} else if fileRec != nil && fileRec.Cache != "" {
 			filePath := filepath.Join(s.storageFolder, fileRec.Cache)
 			if _, statErr := os.Stat(filePath); statErr == nil {
 				s.uploadFileMap[fileRec.Cache] = File{
@@ -205,20 +292,23 @@ func (s *ClipboardServer) loadHistoryData() error {
 					Size:       fileRec.Size,
 					ExpireTime: fileRec.Expire,
 					UploadTime: rh.Timestamp(), // 使用 ReceiveHolder 的 Timestamp 方法
+					Room:       fileRec.Room,
+					MIME:       fileRec.MIME,
+					Digest:     fileRec.Digest,
 				}
 			} else {
-				s.logger.Printf("历史记录中的文件 %s (UUID: %s) 在磁盘上未找到，将不加载到文件映射中。", fileRec.Name, fileRec.Cache)
+				s.logf(logFile, slog.LevelInfo, "历史记录中的文件 %s (UUID: %s) 在磁盘上未找到，将不加载到文件映射中。", fileRec.Name, fileRec.Cache)
 			}
 		}
 	}
 	s.filterHistoryMessages()
 
-	s.logger.Printf("成功从历史记录加载 %d 条消息和 %d 个文件条目。", len(s.messageQueue.List), len(s.uploadFileMap))
+	s.logf(logServer, slog.LevelInfo, "成功从历史记录加载 %d 条消息和 %d 个文件条目。", len(s.messageQueue.List), len(s.uploadFileMap))
 	return nil
 }
 
 func (s *ClipboardServer) saveHistoryData() {
-	s.logger.Printf("尝试将历史记录保存到: %s", s.historyFilePath)
+	s.logf(logServer, slog.LevelDebug, "尝试将历史记录保存到: %s", s.historyFilePath)
 
 	s.messageQueue.Lock()
 	// s.filterHistoryMessagesLocked() // 需要在锁内部调用
@@ -247,14 +337,14 @@ func (s *ClipboardServer) saveHistoryData() {
 
 	data, err := json.MarshalIndent(histToSave, "", "  ")
 	if err != nil {
-		s.logger.Printf("序列化历史记录以进行保存时出错: %v", err)
+		s.logf(logServer, slog.LevelError, "序列化历史记录以进行保存时出错: %v", err)
 		return
 	}
 
 	if err := os.WriteFile(s.historyFilePath, data, 0644); err != nil {
-		s.logger.Printf("写入历史文件 %s 时出错: %v", s.historyFilePath, err)
+		s.logf(logServer, slog.LevelError, "写入历史文件 %s 时出错: %v", s.historyFilePath, err)
 	} else {
-		s.logger.Printf("历史记录已成功保存到 %s", s.historyFilePath)
+		s.logf(logServer, slog.LevelDebug, "历史记录已成功保存到 %s", s.historyFilePath)
 	}
 }
 
@@ -267,12 +357,16 @@ func (s *ClipboardServer) filterHistoryMessagesLocked() {
 	var validMessages []PostEvent
 	now := time.Now().Unix()
 	for _, msg := range s.messageQueue.List { // 确保使用大写 L
-		if msg.Data.FileReceive != nil {
-			fileRec := msg.Data.FileReceive
+		if fileRec := msg.Data.FileReceive; fileRec != nil && fileRec.Type == "folder" {
+			if !s.folderAvailableLocked(fileRec, now) {
+				s.logf(logServer, slog.LevelDebug, "从历史记录中过滤掉文件夹消息: %s (UUID: %s)，原因: 文件夹已过期或其中的文件均已删除。", fileRec.Name, fileRec.Cache)
+				continue
+			}
+		} else if fileRec != nil {
 			fileInfo, existsInMap := s.uploadFileMap[fileRec.Cache]
-			if !existsInMap || fileInfo.ExpireTime < now {
-				s.logger.Printf("从历史记录中过滤掉文件消息: %s (UUID: %s)，原因: 文件不存在或已过期。", fileRec.Name, fileRec.Cache)
-				if existsInMap && fileInfo.ExpireTime < now {
+			if !existsInMap || isExpired(fileInfo.ExpireTime, now) {
+				s.logf(logServer, slog.LevelDebug, "从历史记录中过滤掉文件消息: %s (UUID: %s)，原因: 文件不存在或已过期。", fileRec.Name, fileRec.Cache)
+				if existsInMap && isExpired(fileInfo.ExpireTime, now) {
 					delete(s.uploadFileMap, fileRec.Cache)
 				}
 				continue
@@ -290,6 +384,11 @@ func (s *ClipboardServer) filterHistoryMessages() {
 	s.messageQueue.Unlock()
 }
 
+// storagePath 返回存储目录中的文件路径
+func (s *ClipboardServer) storagePath(name string) string {
+	return filepath.Join(s.storageFolder, name)
+}
+
 func hasEmbeddedStatic() bool {
 	// 尝试打开 static 目录，如果成功说明有嵌入的文件
 	if _, err := embed_static_fs.Open("static"); err == nil {
@@ -299,49 +398,78 @@ func hasEmbeddedStatic() bool {
 }
 
 func (s *ClipboardServer) setupRoutes() {
-	s.logger.Println("正在设置路由...")
+	s.logf(logServer, slog.LevelInfo, "正在设置路由...")
 	prefix := s.config.Server.Prefix
 	mux := http.NewServeMux()
 	if *flg_static_dir != "" { // 检查配置中的外部静态目录
-		s.logger.Printf("从外部目录提供静态文件: %s", *flg_static_dir)
+		s.logf(logServer, slog.LevelInfo, "从外部目录提供静态文件: %s", *flg_static_dir)
 		if _, statErr := os.Stat(*flg_static_dir); os.IsNotExist(statErr) {
-			s.logger.Printf("警告: 配置的外部静态目录 %s 不存在。将不提供前端服务。", *flg_static_dir)
+			s.logf(logServer, slog.LevelWarn, "警告: 配置的外部静态目录 %s 不存在。将不提供前端服务。", *flg_static_dir)
 		} else {
 			mux.Handle(prefix+"/", http.StripPrefix(prefix, compressionMiddleware(http.FileServer(http.Dir(*flg_static_dir)))))
 		}
 	} else if hasEmbeddedStatic() { // 直接检测是否有嵌入的静态文件
-		s.logger.Println("使用嵌入式静态文件。")
+		s.logf(logServer, slog.LevelInfo, "使用嵌入式静态文件。")
 		fsys, err := fs.Sub(embed_static_fs, "static")
 		if err != nil {
-			s.logger.Fatalf("错误: 无法从 embed_static_fs 获取 'static' 子目录: %v", err)
+			s.logf(logServer, slog.LevelError, "错误: 无法从 embed_static_fs 获取 'static' 子目录: %v", err)
+			os.Exit(1)
 		}
 		mux.Handle(prefix+"/", http.StripPrefix(prefix, compressionMiddleware(http.FileServer(http.FS(fsys)))))
 	} else {
-		s.logger.Println("警告: 未使用嵌入式静态文件，也未配置外部静态目录。将不提供前端服务。")
+		s.logf(logServer, slog.LevelWarn, "警告: 未使用嵌入式静态文件，也未配置外部静态目录。将不提供前端服务。")
 	}
 
 	// HTTP 路由
 	mux.HandleFunc(prefix+"/server", s.handle_server)
 	mux.HandleFunc(prefix+"/push", s.handle_push)
-	mux.HandleFunc(prefix+"/rooms", s.handleRooms)
-	mux.HandleFunc(prefix+"/file/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet {
-			s.handle_file(w, r)
-		} else {
-			s.authMiddleware(s.handle_file)(w, r)
+	mux.HandleFunc(prefix+"/login", s.handleLogin)
+	mux.HandleFunc(prefix+"/logout", s.handleLogout)
+	mux.HandleFunc(prefix+"/session", s.authMiddleware(s.handleSession))
+	if s.oidc != nil {
+		mux.HandleFunc(prefix+"/oidc/login", s.handleOIDCLogin)
+		mux.HandleFunc(prefix+"/oidc/callback", s.handleOIDCCallback)
+	}
+	mux.HandleFunc(prefix+"/rooms", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			s.scopedAuthMiddleware(scopeAdmin, s.handleCreateRoom)(w, r)
+		case http.MethodDelete:
+			s.scopedAuthMiddleware(scopeAdmin, s.handleDeleteRoom)(w, r)
+		default:
+			// 启用认证时房间列表同样需要认证，令牌的房间限制才能生效
+			s.scopedAuthMiddleware(scopeRead, s.handleRooms)(w, r)
 		}
 	})
+	// GET /file/ 和 /content/ 可以使用签名分享链接代替认证
+	mux.HandleFunc(prefix+"/file/", s.shareOrAuthMiddleware("file", s.handle_file))
 	mux.HandleFunc(prefix+"/text", s.authMiddleware(s.handle_text))
 	mux.HandleFunc(prefix+"/upload", s.authMiddleware(s.handle_upload))
 	mux.HandleFunc(prefix+"/upload/chunk", s.authMiddleware(s.handle_upload))
 	mux.HandleFunc(prefix+"/upload/chunk/", s.authMiddleware(s.handle_chunk))
 	mux.HandleFunc(prefix+"/upload/finish/", s.authMiddleware(s.handle_finish))
+	mux.HandleFunc(prefix+"/upload/url", s.authMiddleware(s.handleUploadURL))
+	mux.HandleFunc(prefix+"/upload/cancel/", s.authMiddleware(s.handleUploadCancel))
+	mux.HandleFunc(prefix+"/upload/folder", s.authMiddleware(s.handleUploadFolder))
+	mux.HandleFunc(prefix+"/upload/folder/", s.authMiddleware(s.handleUploadFolder))
+	mux.HandleFunc(prefix+"/folder/", s.shareOrAuthMiddleware("folder", s.handleFolder))
+	mux.HandleFunc(prefix+"/bundle", s.authMiddleware(s.handleBundle))
+	mux.HandleFunc(prefix+"/expire/", s.authMiddleware(s.handleExpire))
+	mux.HandleFunc(prefix+"/upload/tus", s.tusRoute())
+	mux.HandleFunc(prefix+"/upload/tus/", s.tusRoute())
 	mux.HandleFunc(prefix+"/revoke/", s.authMiddleware(s.handle_revoke))
 	mux.HandleFunc(prefix+"/revoke/all", s.authMiddleware(s.handleClearAll))
-	mux.HandleFunc(prefix+"/content/", s.authMiddleware(s.handleContent))
+	mux.HandleFunc(prefix+"/content/", s.shareOrAuthMiddleware("content", s.handleContent))
+	mux.HandleFunc(prefix+"/share/", s.scopedAuthMiddleware(scopeWrite, s.handleShare))
+	mux.HandleFunc(prefix+"/admin/tokens", s.scopedAuthMiddleware(scopeAdmin, s.handleTokens))
+	mux.HandleFunc(prefix+"/admin/tokens/", s.scopedAuthMiddleware(scopeAdmin, s.handleTokens))
+	mux.HandleFunc(prefix+"/admin/ratelimit", s.scopedAuthMiddleware(scopeAdmin, s.handleRateLimitState))
+	mux.HandleFunc(prefix+"/admin/lockouts", s.scopedAuthMiddleware(scopeAdmin, s.handleLockouts))
+	mux.HandleFunc(prefix+"/admin/lockouts/", s.scopedAuthMiddleware(scopeAdmin, s.handleLockouts))
+	mux.HandleFunc(prefix+"/admin/audit", s.scopedAuthMiddleware(scopeAdmin, s.handleAudit))
 
 	s.httpServer = &http.Server{
-		Handler: mux,
+		Handler: s.clientInfoMiddleware(s.accessMiddleware(s.corsMiddleware(mux))),
 	}
 }
 
@@ -349,7 +477,7 @@ func (s *ClipboardServer) Start() error {
 	s.runMutex.Lock()
 	if s.isRunning {
 		s.runMutex.Unlock()
-		s.logger.Println("服务器已在运行。")
+		s.logf(logServer, slog.LevelInfo, "服务器已在运行。")
 		return fmt.Errorf("服务器已在运行")
 	}
 
@@ -373,23 +501,23 @@ func (s *ClipboardServer) Start() error {
 		hostList = hostsArray
 	}
 
-	s.logger.Printf("===== Cloud Clipboard Server %s =====", server_version)
+	s.logf(logServer, slog.LevelInfo, "===== Cloud Clipboard Server %s =====", server_version)
 
 	// 显示绝对路径
 	absStorageFolder, err1 := filepath.Abs(s.storageFolder)
 	if err1 != nil {
 		absStorageFolder = s.storageFolder
 	}
-	s.logger.Printf("存储目录: %s", absStorageFolder)
+	s.logf(logServer, slog.LevelInfo, "存储目录: %s", absStorageFolder)
 
 	absHistoryFilePath, err2 := filepath.Abs(s.historyFilePath)
 	if err2 != nil {
 		absHistoryFilePath = s.historyFilePath
 	}
-	s.logger.Printf("历史文件: %s", absHistoryFilePath)
+	s.logf(logServer, slog.LevelInfo, "历史文件: %s", absHistoryFilePath)
 
 	// 显示所有将要监听的地址
-	s.logger.Printf("将监听以下地址: %v", hostList)
+	s.logf(logServer, slog.LevelInfo, "将监听以下地址: %v", hostList)
 
 	if len(hostList) == 0 {
 		s.runMutex.Unlock()
@@ -398,6 +526,7 @@ func (s *ClipboardServer) Start() error {
 
 	// 创建多个监听器
 	listeners := make([]net.Listener, 0, len(hostList))
+	listenerHosts := make([]string, 0, len(hostList))
 	for _, host := range hostList {
 		// 处理IPv6地址
 		formattedHost := host
@@ -408,12 +537,13 @@ func (s *ClipboardServer) Start() error {
 		listenAddr := fmt.Sprintf("%s:%d", formattedHost, s.config.Server.Port)
 		ln, err := net.Listen("tcp", listenAddr)
 		if err != nil {
-			s.logger.Printf("警告: 无法在 %s 上监听: %v", listenAddr, err)
+			s.logf(logServer, slog.LevelWarn, "警告: 无法在 %s 上监听: %v", listenAddr, err)
 			continue
 		}
 
 		listeners = append(listeners, ln)
-		s.logger.Printf("--- 监听地址: %s%s", listenAddr, s.config.Server.Prefix)
+		listenerHosts = append(listenerHosts, host)
+		s.logf(logServer, slog.LevelInfo, "--- 监听地址: %s%s", listenAddr, s.config.Server.Prefix)
 	}
 
 	if len(listeners) == 0 {
@@ -422,6 +552,7 @@ func (s *ClipboardServer) Start() error {
 	}
 
 	s.isRunning = true
+	s.startCertWatcher()
 	s.runMutex.Unlock()
 
 	go s.cleanExpiredFilesLoop()
@@ -435,7 +566,12 @@ func (s *ClipboardServer) Start() error {
 			ReadTimeout:  s.httpServer.ReadTimeout,
 			WriteTimeout: s.httpServer.WriteTimeout,
 			IdleTimeout:  s.httpServer.IdleTimeout,
+			TLSConfig:    &tls.Config{},
+		}
+		if s.certReloader != nil {
+			server.TLSConfig.GetCertificate = s.certReloader.GetCertificate
 		}
+		s.applyClientAuth(server.TLSConfig, listenerHosts[i])
 
 		// 确保至少有一个实例被赋值给s.httpServer以便Stop()方法可以使用
 		if i == 0 {
@@ -446,19 +582,20 @@ func (s *ClipboardServer) Start() error {
 			var err error
 			addr := listener.Addr().String()
 
-			if s.config.Server.Cert != "" && s.config.Server.Key != "" {
-				s.logger.Printf("启动 HTTPS 服务器于 %s", addr)
-				err = srv.ServeTLS(listener, s.config.Server.Cert, s.config.Server.Key)
+			if s.certReloader != nil {
+				s.logf(logServer, slog.LevelInfo, "启动 HTTPS 服务器于 %s (mTLS: %s)", addr, s.mtlsMode(listenerHosts[i]))
+				// 证书由 GetCertificate 提供，更新后无需重启
+				err = srv.ServeTLS(listener, "", "")
 			} else {
-				s.logger.Printf("启动 HTTP 服务器于 %s", addr)
+				s.logf(logServer, slog.LevelInfo, "启动 HTTP 服务器于 %s", addr)
 				err = srv.Serve(listener)
 			}
 
 			if err != nil && err != http.ErrServerClosed {
-				s.logger.Printf("HTTP 服务器在 %s 上的 Serve/ServeTLS 错误: %v", addr, err)
+				s.logf(logServer, slog.LevelError, "HTTP 服务器在 %s 上的 Serve/ServeTLS 错误: %v", addr, err)
 				errChan <- err
 			} else {
-				s.logger.Printf("HTTP 服务器在 %s 上正常关闭", addr)
+				s.logf(logServer, slog.LevelInfo, "HTTP 服务器在 %s 上正常关闭", addr)
 			}
 		}(server, ln)
 	}
@@ -467,7 +604,7 @@ func (s *ClipboardServer) Start() error {
 	var err error
 	select {
 	case err = <-errChan:
-		s.logger.Printf("一个或多个 HTTP 服务器出错: %v", err)
+		s.logf(logServer, slog.LevelError, "一个或多个 HTTP 服务器出错: %v", err)
 		// 尝试优雅关闭所有服务器
 		s.Stop()
 	}
@@ -484,34 +621,35 @@ func (s *ClipboardServer) Stop() error {
 	defer s.runMutex.Unlock()
 
 	if !s.isRunning || s.httpServer == nil {
-		s.logger.Println("服务器未运行或未初始化。")
+		s.logf(logServer, slog.LevelInfo, "服务器未运行或未初始化。")
 		return fmt.Errorf("服务器未运行")
 	}
-	// 停止房间清理任务
+	// 停止房间清理任务和证书监视任务
 	s.stopRoomCleanup()
-	s.logger.Println("正在停止服务器...")
+	s.stopCertWatcher()
+	s.logf(logServer, slog.LevelInfo, "正在停止服务器...")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	err := s.httpServer.Shutdown(ctx)
 	// isRunning 状态由 Start 中的 defer/finally 处理
 	if err != nil {
-		s.logger.Printf("HTTP 服务器关闭错误: %v", err)
+		s.logf(logServer, slog.LevelError, "HTTP 服务器关闭错误: %v", err)
 		return err
 	}
-	s.logger.Println("服务器已成功关闭。")
+	s.logf(logServer, slog.LevelInfo, "服务器已成功关闭。")
 	return nil
 }
 
 func (s *ClipboardServer) cleanExpiredFilesLoop() {
 	// 确保配置中 File.Expire > 0 才启动清理
 	if s.config.File.Expire <= 0 {
-		s.logger.Println("文件过期时间设置为0或负数，不启动过期文件清理任务。")
+		s.logf(logServer, slog.LevelInfo, "文件过期时间设置为0或负数，不启动过期文件清理任务。")
 		return
 	}
 	// 清理间隔可以配置，例如 s.config.File.ExpireCheckInterval，默认为5分钟
 	checkInterval := 5 * time.Minute
-	s.logger.Printf("后台过期文件清理任务已启动，检查间隔: %v", checkInterval)
+	s.logf(logServer, slog.LevelInfo, "后台过期文件清理任务已启动，检查间隔: %v", checkInterval)
 	ticker := time.NewTicker(checkInterval)
 	defer ticker.Stop()
 
@@ -522,30 +660,30 @@ func (s *ClipboardServer) cleanExpiredFilesLoop() {
 }
 
 func (s *ClipboardServer) performCleanExpiredFiles() {
-	s.logger.Println("正在运行过期文件清理任务...")
+	s.logf(logServer, slog.LevelDebug, "正在运行过期文件清理任务...")
 	currentTime := time.Now().Unix()
 	var toRemove []string
 
 	// 注意：并发访问 s.uploadFileMap 需要加锁
 	// s.mapMutex.Lock() // 假设有一个用于保护 map 的锁
 	for uuid, fileInfo := range s.uploadFileMap {
-		if fileInfo.ExpireTime < currentTime {
+		if isExpired(fileInfo.ExpireTime, currentTime) {
 			toRemove = append(toRemove, uuid)
 		}
 	}
 	// s.mapMutex.Unlock()
 
 	if len(toRemove) > 0 {
-		s.logger.Printf("发现 %d 个过期文件需要移除。", len(toRemove))
+		s.logf(logFile, slog.LevelInfo, "发现 %d 个过期文件需要移除。", len(toRemove))
 		removedCount := 0
 		for _, uuid := range toRemove {
 			filePath := filepath.Join(s.storageFolder, uuid)
 			if err := os.Remove(filePath); err != nil {
 				if !os.IsNotExist(err) { // 如果文件不存在，则不是一个错误
-					s.logger.Printf("移除文件 %s 时出错: %v", filePath, err)
+					s.logf(logFile, slog.LevelWarn, "移除文件 %s 时出错: %v", filePath, err)
 				}
 			} else {
-				s.logger.Printf("已移除过期文件: %s (UUID: %s)", filePath, uuid)
+				s.logf(logFile, slog.LevelInfo, "已移除过期文件: %s (UUID: %s)", filePath, uuid)
 			}
 			// s.mapMutex.Lock()
 			delete(s.uploadFileMap, uuid) // 从 map 中移除
@@ -558,17 +696,13 @@ func (s *ClipboardServer) performCleanExpiredFiles() {
 			s.saveHistoryData()
 		}
 	} else {
-		s.logger.Println("没有发现过期文件。")
+		s.logf(logServer, slog.LevelDebug, "没有发现过期文件。")
 	}
 }
 
 // --- main 函数 ---
 func Main() {
-	// 确保标志只解析一次。如果 flags.go 中的 init() 调用了 flag.Parse()，这里可以省略。
-	// 为安全起见，检查一下。
-	if !flag.Parsed() {
-		flag.Parse()
-	}
+	parseCommandLine() // parseCommandLine 来自 flags.go
 
 	initialCfg, err := load_config(*flg_config) // flg_config 来自 flags.go
 	if err != nil {
@@ -587,9 +721,10 @@ func Main() {
 	}
 
 	if err := server.Start(); err != nil {
-		server.logger.Fatalf("服务器启动失败: %v", err)
+		server.logf(logServer, slog.LevelError, "服务器启动失败: %v", err)
+		os.Exit(1)
 	}
-	server.logger.Println("主函数退出。")
+	server.logf(logServer, slog.LevelInfo, "主函数退出。")
 }
 
 // show_bin_info (保持不变)
@@ -637,16 +772,17 @@ func (s *ClipboardServer) cleanupWebSocketConnection(conn *websocket.Conn, devic
 	s.runMutex.Lock()
 	delete(s.websockets, conn)
 	delete(s.room_ws, conn)
+	delete(s.wsWriteLocks, conn)
 	delete(s.connDeviceIDMap, conn)
 
 	if deviceID != "" {
 		delete(s.deviceConnected, deviceID)
 		s.updateRoomDeviceCount(room, deviceID, false)
 		shouldBroadcast = true
-		s.logger.Printf("WebSocket 客户端断开连接: %s (ID: %s), 房间: %s. 当前连接数: %d, 设备数: %d",
+		s.logf(logWS, slog.LevelInfo, "WebSocket 客户端断开连接: %s (ID: %s), 房间: %s. 当前连接数: %d, 设备数: %d",
 			conn.RemoteAddr(), deviceID, room, len(s.websockets), len(s.deviceConnected))
 	} else {
-		s.logger.Printf("WebSocket 客户端断开连接 (无有效DeviceID): %s, 房间: %s. 当前连接数: %d",
+		s.logf(logWS, slog.LevelInfo, "WebSocket 客户端断开连接 (无有效DeviceID): %s, 房间: %s. 当前连接数: %d",
 			conn.RemoteAddr(), room, len(s.websockets))
 	}
 	s.runMutex.Unlock()
@@ -673,115 +809,59 @@ func hash_murmur3(data []byte, seed uint32) uint32 {
 }
 
 func (s *ClipboardServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// 添加 CORS 头，允许跨域请求
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	return s.scopedAuthMiddleware("", next)
+}
 
-		// 处理预检请求
+// scopedAuthMiddleware 要求请求具有指定的权限范围，scope 为空时根据请求方法推断
+func (s *ClipboardServer) scopedAuthMiddleware(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// CORS 头与跨域来源校验由 corsMiddleware 统一处理
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
-		// 快速路径：如果不需要认证，直接调用下一个处理函数
-		authNeeded := false
-		var expectedPassword string
-
-		// 处理所有可能的类型：string、bool、int、float64
-		switch auth := s.config.Server.Auth.(type) {
-		case string:
-			if auth != "" {
-				authNeeded = true
-				expectedPassword = auth
-			}
-		case bool:
-			// bool true 的情况已在 NewClipboardServer 中处理为随机密码
-			if auth {
-				authNeeded = true
-				// expectedPassword 应该已经在 NewClipboardServer 中设置
-				if authStr, ok := s.config.Server.Auth.(string); ok {
-					expectedPassword = authStr
-				}
-			}
-		case int:
-			authNeeded = true
-			expectedPassword = strconv.Itoa(auth)
-		case float64:
-			authNeeded = true
-			expectedPassword = strconv.FormatFloat(auth, 'f', 0, 64)
+		requiredScope := scope
+		if requiredScope == "" {
+			requiredScope = scopeForMethod(r.Method)
 		}
 
-		if !authNeeded {
-			next.ServeHTTP(w, r)
+		// 快速路径：如果不需要认证，直接调用下一个处理函数
+		_, authNeeded := s.authPassword()
+		// 封禁列表和失败锁定在校验凭据之前检查
+		if !s.checkAuthGuard(w, r) {
 			return
 		}
-
-		// 获取认证令牌 - 先检查 Authorization 头，再检查查询参数
-		token := ""
-
-		// 检查 Authorization 头
-		authHeader := r.Header.Get("Authorization")
-		if authHeader != "" {
-			parts := strings.Split(authHeader, " ")
-			if len(parts) == 2 && strings.ToLower(parts[0]) == "bearer" {
-				token = parts[1]
-			} else {
-				// 尝试将整个头部作为令牌（向后兼容）
-				token = authHeader
-			}
-		}
-
-		// 如果头部没有令牌，尝试从查询参数获取
-		if token == "" {
-			token = r.URL.Query().Get("auth")
-		}
-
-		clientIP := get_remote_ip(r)
-
-		// 验证令牌
-		if token == "" {
-			s.logger.Printf("认证失败: 未提供令牌。来自 IP: %s, 路径: %s", clientIP, r.URL.Path)
-
-			// 返回结构化的 JSON 错误响应
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error":   "Unauthorized",
-				"message": "需要认证令牌",
-			})
+		if !authNeeded {
+			// 未启用认证时客户端证书仍用于标识发送者
+			next.ServeHTTP(w, withAuthInfo(r, &authInfo{Method: "none", User: clientCertIdentity(r)}))
 			return
 		}
 
-		if expectedPassword == "" {
-			s.logger.Printf("认证失败: 服务器认证配置错误。来自 IP: %s", clientIP)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error":   "ServerError",
-				"message": "服务器认证配置错误",
-			})
+		token, viaCookie := credentialFromRequest(r)
+		info, status, message := s.verifyCredential(r, token, requiredScope)
+		if status != 0 {
+			writeCredentialError(w, status, message)
 			return
 		}
-
-		if token != expectedPassword {
-			s.logger.Printf("认证失败: 无效令牌。来自 IP: %s, 路径: %s,token:%s,server:%s", clientIP, r.URL.Path, token, expectedPassword)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error":   "Unauthorized",
-				"message": "无效的认证令牌",
-			})
+		// 浏览器会自动携带 Cookie，因此来自 Cookie 的修改类请求必须带上 CSRF 令牌
+		if viaCookie && !s.checkCSRF(w, r, token) {
 			return
 		}
-
-		// 认证成功
-		s.logger.Printf("认证成功: IP: %s, 路径: %s", clientIP, r.URL.Path)
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withAuthInfo(r, info))
 	}
 }
 
+// writeJSONError 返回结构化的 JSON 错误响应
+func writeJSONError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":   code,
+		"message": message,
+	})
+}
+
 // generateRandomString 生成指定长度的随机字符串
 func generateRandomString(length int) (string, error) {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
@@ -975,13 +1055,13 @@ func (s *ClipboardServer) getRoomList() []RoomInfo {
 // startRoomCleanup 启动房间清理任务
 func (s *ClipboardServer) startRoomCleanup() {
 	if s.config.Server.RoomCleanup <= 0 {
-		s.logger.Println("房间清理间隔设置为0或负数，不启动房间清理任务")
+		s.logf(logServer, slog.LevelInfo, "房间清理间隔设置为0或负数，不启动房间清理任务")
 		return
 	}
 
 	interval := time.Duration(s.config.Server.RoomCleanup) * time.Second
 	s.roomCleanupTicker = time.NewTicker(interval)
-	s.logger.Printf("房间清理任务已启动，清理间隔: %v", interval)
+	s.logf(logServer, slog.LevelInfo, "房间清理任务已启动，清理间隔: %v", interval)
 
 	go func() {
 		for range s.roomCleanupTicker.C {
@@ -995,7 +1075,7 @@ func (s *ClipboardServer) stopRoomCleanup() {
 	if s.roomCleanupTicker != nil {
 		s.roomCleanupTicker.Stop()
 		s.roomCleanupTicker = nil
-		s.logger.Println("房间清理任务已停止")
+		s.logf(logServer, slog.LevelInfo, "房间清理任务已停止")
 	}
 }
 
@@ -1005,7 +1085,7 @@ func (s *ClipboardServer) cleanupEmptyRooms() {
 		return
 	}
 
-	s.logger.Println("开始清理空房间...")
+	s.logf(logServer, slog.LevelDebug, "开始清理空房间...")
 
 	// 第一步：快速收集活跃房间信息
 	activeRooms := make(map[string]bool)
@@ -1050,14 +1130,14 @@ func (s *ClipboardServer) cleanupEmptyRooms() {
 	// 第四步：删除房间统计
 	for _, room := range roomsToDelete {
 		delete(s.roomStats, room)
-		s.logger.Printf("已清理空房间统计: %s", room)
+		s.logf(logServer, slog.LevelInfo, "已清理空房间统计: %s", room)
 	}
 	s.roomStatsMutex.Unlock()
 
 	if len(roomsToDelete) > 0 {
-		s.logger.Printf("房间清理完成，共清理 %d 个空房间", len(roomsToDelete))
+		s.logf(logServer, slog.LevelInfo, "房间清理完成，共清理 %d 个空房间", len(roomsToDelete))
 	} else {
-		s.logger.Println("房间清理完成，没有发现需要清理的空房间")
+		s.logf(logServer, slog.LevelDebug, "房间清理完成，没有发现需要清理的空房间")
 	}
 }
 
@@ -0,0 +1,262 @@
+package lib
+
+/**
+*** FILE: mimetype.go
+***   handle content sniffing of uploaded files and the per-room file type policy
+**/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const sniffLen = 512 // 与 http.DetectContentType 读取的长度一致
+
+// magicSignature http.DetectContentType 不识别的格式
+type magicSignature struct {
+	match func(data []byte) bool
+	mime  string
+}
+
+func hasMagic(offset int, magic string) func([]byte) bool {
+	return func(data []byte) bool {
+		return len(data) >= offset+len(magic) && string(data[offset:offset+len(magic)]) == magic
+	}
+}
+
+// isPE 判断是否为 Windows 可执行文件：MZ 头，且 e_lfanew 指向 "PE\0\0" (超出嗅探范围时只看 MZ 头)
+func isPE(data []byte) bool {
+	if len(data) < 64 || data[0] != 'M' || data[1] != 'Z' {
+		return false
+	}
+	// 先以无符号数比较，e_lfanew 很大时转换为 int 在 32 位平台上会变成负数
+	offset := binary.LittleEndian.Uint32(data[0x3c:0x40])
+	if uint64(offset)+4 > uint64(len(data)) {
+		return true
+	}
+	return string(data[offset:offset+4]) == "PE\x00\x00"
+}
+
+// ftypBrand 返回 ISO 媒体文件 (MP4/HEIF/QuickTime) 的主品牌
+func ftypBrand(data []byte) string {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return ""
+	}
+	return string(data[8:12])
+}
+
+func hasBrand(brands ...string) func([]byte) bool {
+	return func(data []byte) bool {
+		brand := ftypBrand(data)
+		for _, b := range brands {
+			if brand == b {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+var extraMagic = []magicSignature{
+	{isPE, "application/vnd.microsoft.portable-executable"},
+	{hasMagic(0, "\x7fELF"), "application/x-elf"},
+	{hasMagic(0, "\xfe\xed\xfa\xce"), "application/x-mach-binary"},
+	{hasMagic(0, "\xfe\xed\xfa\xcf"), "application/x-mach-binary"},
+	{hasMagic(0, "\xce\xfa\xed\xfe"), "application/x-mach-binary"},
+	{hasMagic(0, "\xcf\xfa\xed\xfe"), "application/x-mach-binary"},
+	{hasMagic(0, "dex\n"), "application/vnd.android.dex"},
+	{hasMagic(0, "#!"), "text/x-shellscript"},
+	{hasMagic(0, "7z\xbc\xaf\x27\x1c"), "application/x-7z-compressed"},
+	{hasMagic(0, "BZh"), "application/x-bzip2"},
+	{hasMagic(0, "\xfd7zXZ\x00"), "application/x-xz"},
+	{hasMagic(0, "\x28\xb5\x2f\xfd"), "application/zstd"},
+	{hasMagic(257, "ustar"), "application/x-tar"},
+	{hasMagic(0, "SQLite format 3\x00"), "application/vnd.sqlite3"},
+	{hasMagic(0, "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), "application/x-ole-storage"},
+	{hasBrand("heic", "heix", "hevc", "mif1", "msf1"), "image/heic"},
+	{hasBrand("avif", "avis"), "image/avif"},
+	{hasBrand("qt  "), "video/quicktime"},
+	{hasBrand("3gp4", "3gp5", "3gp6", "3g2a"), "video/3gpp"},
+	{hasBrand("M4A ", "M4B "), "audio/mp4"},
+}
+
+// zipContainers 以 ZIP 为容器的格式，嗅探结果为 application/zip 时按扩展名细分
+var zipContainers = map[string]string{
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".epub": "application/epub+zip",
+	".jar":  "application/java-archive",
+	".apk":  "application/vnd.android.package-archive",
+}
+
+// executableMIMEs 属于 executable 类别的类型
+var executableMIMEs = map[string]bool{
+	"application/vnd.microsoft.portable-executable": true,
+	"application/x-msdownload":                      true,
+	"application/x-dosexec":                         true,
+	"application/x-elf":                             true,
+	"application/x-executable":                      true,
+	"application/x-mach-binary":                     true,
+	"application/vnd.android.dex":                   true,
+	"application/vnd.android.package-archive":       true,
+	"application/java-archive":                      true,
+	"application/x-sh":                              true,
+	"text/x-shellscript":                            true,
+}
+
+// activeMIMEs 浏览器内联打开时可以执行脚本的类型，总是作为附件下载，防止存储型 XSS
+var activeMIMEs = map[string]bool{
+	"text/html":                 true,
+	"application/xhtml+xml":     true,
+	"image/svg+xml":             true,
+	"text/xml":                  true,
+	"application/xml":           true,
+	"text/xsl":                  true,
+	"text/javascript":           true,
+	"application/javascript":    true,
+	"application/x-javascript":  true,
+	"application/ecmascript":    true,
+	"multipart/x-mixed-replace": true,
+}
+
+// fileDisposition 返回提供文件下载时使用的 Content-Disposition，活动内容即使请求内联显示也作为附件
+func fileDisposition(name string, contentType string, download bool) string {
+	dispositionType := "inline" // 默认为内联显示
+	if download || activeMIMEs[mimeBase(contentType)] {
+		dispositionType = "attachment"
+	}
+	return fmt.Sprintf("%s; filename=%q", dispositionType, name)
+}
+
+// sniffBytes 根据文件头判断 MIME 类型
+func sniffBytes(data []byte) string {
+	for _, sig := range extraMagic {
+		if sig.match(data) {
+			return sig.mime
+		}
+	}
+	return http.DetectContentType(data)
+}
+
+// detectMIME 读取文件头判断文件的真实类型，ZIP 容器格式参考文件名的扩展名
+func detectMIME(filePath string, name string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	sniffed := sniffBytes(buf[:n])
+	if sniffed == "application/zip" {
+		if container, ok := zipContainers[strings.ToLower(filepath.Ext(name))]; ok && bytes.HasPrefix(buf, []byte("PK\x03\x04")) {
+			return container, nil
+		}
+	}
+	return sniffed, nil
+}
+
+// mimeBase 去掉 MIME 类型中的参数，例如 "text/plain; charset=utf-8" -> "text/plain"
+func mimeBase(mimeType string) string {
+	base, _, _ := strings.Cut(mimeType, ";")
+	return strings.ToLower(strings.TrimSpace(base))
+}
+
+// fileResponseType 返回文件的类别，优先使用嗅探得到的类型
+func fileResponseType(name string, mimeType string) string {
+	if mimeType == "" {
+		return DetermineResponseType(name)
+	}
+	if executableMIMEs[mimeBase(mimeType)] {
+		return "file"
+	}
+	return responseTypeForMIME(mimeBase(mimeType))
+}
+
+// fileContentType 返回提供文件下载时使用的 Content-Type
+func fileContentType(name string, mimeType string) string {
+	if mimeType != "" {
+		return mimeType
+	}
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// matchFileType 判断 MIME 类型是否匹配规则：带 / 的规则按通配符匹配 MIME 类型 (如 image/*)，
+// 否则按类别匹配 (image、text、audio、video、document、archive、executable、file)
+func matchFileType(pattern string, mimeType string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	base := mimeBase(mimeType)
+	if strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, base)
+		return ok
+	}
+	if pattern == "executable" {
+		return executableMIMEs[base]
+	}
+	return fileResponseType("", base) == pattern
+}
+
+// permits 判断类型是否被规则允许：拒绝列表优先，配置了允许列表时只允许命中的类型
+func (rule FileTypeRule) permits(mimeType string) bool {
+	for _, pattern := range rule.Deny {
+		if matchFileType(pattern, mimeType) {
+			return false
+		}
+	}
+	if len(rule.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range rule.Allow {
+		if matchFileType(pattern, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileTypeRule 返回房间使用的文件类型规则，房间的覆盖规则优先
+func (s *ClipboardServer) fileTypeRule(room string) FileTypeRule {
+	for name, rule := range s.config.FileTypes.Rooms {
+		if normalizeRoomName(name) == normalizeRoomName(room) {
+			return rule
+		}
+	}
+	return s.config.FileTypes.FileTypeRule
+}
+
+// checkFileType 嗅探上传文件的类型并按房间的规则检查，不允许时删除文件并写入 415 响应
+func (s *ClipboardServer) checkFileType(w http.ResponseWriter, r *http.Request, fileInfo File) (mimeType string, ok bool) {
+	mimeType, err := detectMIME(filepath.Join(s.storageFolder, fileInfo.UUID), fileInfo.Name)
+	if err != nil {
+		s.logf(logFile, slog.LevelError, "错误: 读取文件 %s 的类型失败: %v", fileInfo.UUID, err)
+		http.Error(w, "无法读取文件", http.StatusInternalServerError)
+		return "", false
+	}
+	if s.fileTypeRule(fileInfo.Room).permits(mimeType) {
+		return mimeType, true
+	}
+	s.logf(logFile, slog.LevelWarn, "警告: 拒绝上传文件 %s (UUID: %s)，类型 %s 在房间 '%s' 中不被允许。来自 IP: %s",
+		fileInfo.Name, fileInfo.UUID, mimeType, fileInfo.Room, get_remote_ip(r))
+	s.deleteUploadedFile(fileInfo.UUID)
+	writeJSONError(w, http.StatusUnsupportedMediaType, "UnsupportedMediaType", fmt.Sprintf("不允许上传此类型的文件 (%s)", mimeBase(mimeType)))
+	return "", false
+}
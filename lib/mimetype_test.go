@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"encoding/binary"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// peHeader 构造 e_lfanew 为 offset 的 MZ 头，在 peAt 处写入 PE 签名
+func peHeader(offset uint32, peAt int) []byte {
+	data := make([]byte, 256)
+	copy(data, "MZ")
+	binary.LittleEndian.PutUint32(data[0x3c:], offset)
+	if peAt >= 0 {
+		copy(data[peAt:], "PE\x00\x00")
+	}
+	return data
+}
+
+func TestIsPE(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"valid", peHeader(0x80, 0x80), true},
+		{"wrong signature", peHeader(0x80, -1), false},
+		{"offset beyond sniffed data", peHeader(0x1000, -1), true},
+		{"offset overflows int32", peHeader(0x80000000, -1), true},
+		{"max offset", peHeader(0xffffffff, -1), true},
+		{"offset at end", peHeader(254, -1), true},
+		{"too short", []byte("MZ"), false},
+		{"no MZ", make([]byte, 256), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPE(tt.data); got != tt.want {
+				t.Errorf("isPE = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSniffBytes(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"\x7fELF\x02\x01\x01", "application/x-elf"},
+		{"#!/bin/sh\necho hi\n", "text/x-shellscript"},
+		{"\x00\x00\x00\x18ftypheic\x00\x00\x00\x00", "image/heic"},
+		{"<!DOCTYPE html><html></html>", "text/html; charset=utf-8"},
+		{"plain text", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		if got := sniffBytes([]byte(tt.data)); got != tt.want {
+			t.Errorf("sniffBytes(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestFileDisposition(t *testing.T) {
+	tests := []struct {
+		contentType string
+		download    bool
+		want        string
+	}{
+		{"image/png", false, "inline"},
+		{"image/png", true, "attachment"},
+		{"text/plain; charset=utf-8", false, "inline"},
+		{"text/html; charset=utf-8", false, "attachment"},
+		{"image/svg+xml", false, "attachment"},
+		{"application/xhtml+xml", false, "attachment"},
+		{"text/xml; charset=utf-8", false, "attachment"},
+		{"Application/JavaScript", false, "attachment"},
+	}
+	for _, tt := range tests {
+		got := fileDisposition("a b", tt.contentType, tt.download)
+		if want := tt.want + `; filename="a b"`; got != want {
+			t.Errorf("fileDisposition(%q, %v) = %q, want %q", tt.contentType, tt.download, got, want)
+		}
+	}
+}
+
+func TestFileTypeRulePermits(t *testing.T) {
+	rule := FileTypeRule{Allow: []string{"image/*", "document"}, Deny: []string{"image/svg+xml", "executable"}}
+	tests := []struct {
+		mimeType string
+		want     bool
+	}{
+		{"image/png", true},
+		{"image/svg+xml", false},
+		{"application/pdf", true},
+		{"application/x-elf", false},
+		{"text/plain; charset=utf-8", false},
+	}
+	for _, tt := range tests {
+		if got := rule.permits(tt.mimeType); got != tt.want {
+			t.Errorf("permits(%q) = %v, want %v", tt.mimeType, got, tt.want)
+		}
+	}
+	if !(FileTypeRule{}).permits("application/x-elf") {
+		t.Error("empty rule should permit everything")
+	}
+}
+
+// 上传的 HTML 和 SVG 文件即使不带 download 参数也作为附件下载
+func TestActiveContentServedAsAttachment(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	tests := []struct {
+		name    string
+		content string
+		noMIME  bool // 没有嗅探结果的历史文件，按扩展名确定类型
+		want    string
+	}{
+		{"page.html", "<html><script>alert(1)</script></html>", false, "attachment"},
+		{"image.svg", `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`, true, "attachment"},
+		{"notes.txt", "hello", false, "inline"},
+	}
+	for _, tt := range tests {
+		id := uploadFile(t, ts, "", tt.name, []byte(tt.content))
+		uuid := messageFile(s, id)
+		if tt.noMIME {
+			s.runMutex.Lock()
+			fileInfo := s.uploadFileMap[uuid]
+			fileInfo.MIME = ""
+			s.uploadFileMap[uuid] = fileInfo
+			s.runMutex.Unlock()
+		}
+		resp, _ := doRequest(t, http.MethodGet, ts.URL+"/file/"+uuid, nil)
+		if disposition := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(disposition, tt.want+";") {
+			t.Errorf("%s: Content-Disposition = %q, Content-Type = %q", tt.name, disposition, resp.Header.Get("Content-Type"))
+		}
+	}
+}
@@ -1,6 +1,6 @@
 package lib
 
-import "log" // 新增：导入 log 包
+import "log/slog"
 
 /**
 *** FILE: msg.go
@@ -8,7 +8,7 @@ import "log" // 新增：导入 log 包
 **/
 
 // 修改：增加 logger 参数
-func NewMessageQueue(historyLen int, logger *log.Logger) *PostList {
+func NewMessageQueue(historyLen int, logger *slog.Logger) *PostList {
 	return &PostList{
 		nextid:      1, // Start IDs from 1
 		history_len: historyLen,
@@ -31,22 +31,16 @@ func (m *PostList) Append(item *PostEvent) {
 		if m.logger != nil {
 			evicted := m.List[0]
 
-			var content string
-			// 提取内容预览
+			// 只记录消息长度，不记录内容
+			var length int64
 			if evicted.Data.TextReceive != nil {
-				content = evicted.Data.TextReceive.Content
+				length = int64(len(evicted.Data.TextReceive.Content))
 			} else if evicted.Data.FileReceive != nil {
-				content = "[文件] " + evicted.Data.FileReceive.Name
+				length = evicted.Data.FileReceive.Size
 			}
 
-			// 截断内容 (支持中文)，超过30个字符则截断
-			runes := []rune(content)
-			if len(runes) > 30 {
-				content = string(runes[:30]) + "..."
-			}
-
-			m.logger.Printf("消息队列已满(%d)，淘汰旧消息: ID=%d, 房间=[%s], 类型=%s, 内容=[%s]",
-				m.history_len, evicted.Data.ID(), evicted.Data.Room(), evicted.Event, content)
+			m.logger.Info("消息队列已满，淘汰旧消息", "limit", m.history_len, "id", evicted.Data.ID(),
+				"room", evicted.Data.Room(), "type", evicted.Event, "length", length)
 		}
 
 		m.List = m.List[1:]
@@ -0,0 +1,110 @@
+package lib
+
+/**
+*** FILE: mtls.go
+***   handle client certificate (mTLS) authentication
+**/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// mTLS 模式
+const (
+	mtlsOff      = "off"
+	mtlsOptional = "optional"
+	mtlsRequired = "required"
+)
+
+// loadClientCAs 读取客户端 CA 证书包，未配置时返回 nil
+func loadClientCAs(cfg MTLSConfig) (*x509.CertPool, error) {
+	modes := []string{cfg.Mode}
+	for _, mode := range cfg.Listeners {
+		modes = append(modes, mode)
+	}
+	needed := false
+	for _, mode := range modes {
+		switch mode {
+		case "", mtlsOff:
+		case mtlsOptional, mtlsRequired:
+			needed = true
+		default:
+			return nil, fmt.Errorf("未知的 mTLS 模式 '%s'", mode)
+		}
+	}
+	if !needed {
+		return nil, nil
+	}
+	if cfg.ClientCA == "" {
+		return nil, fmt.Errorf("启用 mTLS 时需要配置 clientCA")
+	}
+	data, err := os.ReadFile(cfg.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取客户端 CA 文件: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("客户端 CA 文件 %s 中没有有效的证书", cfg.ClientCA)
+	}
+	return pool, nil
+}
+
+// mtlsMode 返回监听地址使用的 mTLS 模式，listeners 中的配置优先
+func (s *ClipboardServer) mtlsMode(host string) string {
+	if mode, ok := s.config.MTLS.Listeners[host]; ok && mode != "" {
+		return mode
+	}
+	if s.config.MTLS.Mode == "" {
+		return mtlsOff
+	}
+	return s.config.MTLS.Mode
+}
+
+// applyClientAuth 按监听地址的 mTLS 模式设置 tls.Config 的客户端证书校验
+func (s *ClipboardServer) applyClientAuth(tlsConfig *tls.Config, host string) {
+	switch s.mtlsMode(host) {
+	case mtlsOptional:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = s.clientCAs
+	case mtlsRequired:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = s.clientCAs
+	default:
+		tlsConfig.ClientAuth = tls.NoClientCert
+	}
+}
+
+// clientCertIdentity 返回已通过校验的客户端证书身份：CN，没有时依次使用第一个 DNS 或邮箱 SAN
+func clientCertIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// clientCertAuth 使用客户端证书认证，没有有效证书时返回 nil
+func (s *ClipboardServer) clientCertAuth(r *http.Request) *authInfo {
+	identity := clientCertIdentity(r)
+	if identity == "" {
+		return nil
+	}
+	return &authInfo{
+		Method: "cert",
+		Name:   identity,
+		User:   identity,
+		Scopes: s.config.MTLS.Scopes,
+	}
+}
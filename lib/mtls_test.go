@@ -0,0 +1,186 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientCertIdentity(t *testing.T) {
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want string
+	}{
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "laptop"}, DNSNames: []string{"laptop.lan"}}, "laptop"},
+		{"dns name", &x509.Certificate{DNSNames: []string{"laptop.lan"}, EmailAddresses: []string{"a@example.com"}}, "laptop.lan"},
+		{"email", &x509.Certificate{EmailAddresses: []string{"a@example.com"}}, "a@example.com"},
+		{"no identity", &x509.Certificate{}, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert}}}
+		if got := clientCertIdentity(r); got != tt.want {
+			t.Errorf("%s: clientCertIdentity = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// 未经校验的证书 (没有 VerifiedChains) 不作为身份
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "laptop"}}}}
+	if got := clientCertIdentity(r); got != "" {
+		t.Errorf("unverified certificate: %q", got)
+	}
+	if got := clientCertIdentity(httptest.NewRequest(http.MethodGet, "/", nil)); got != "" {
+		t.Errorf("plain HTTP: %q", got)
+	}
+}
+
+func TestLoadClientCAs(t *testing.T) {
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.pem")
+	if _, _, err := loadOrCreateCA(caPath, filepath.Join(dir, "ca.key")); err != nil {
+		t.Fatal(err)
+	}
+	invalidPath := filepath.Join(dir, "invalid.pem")
+	os.WriteFile(invalidPath, []byte("not a certificate"), 0600)
+
+	tests := []struct {
+		name     string
+		cfg      MTLSConfig
+		wantPool bool
+		wantErr  bool
+	}{
+		{"disabled", MTLSConfig{}, false, false},
+		{"off without CA", MTLSConfig{Mode: mtlsOff}, false, false},
+		{"optional", MTLSConfig{Mode: mtlsOptional, ClientCA: caPath}, true, false},
+		{"listener only", MTLSConfig{Listeners: map[string]string{"0.0.0.0": mtlsRequired}, ClientCA: caPath}, true, false},
+		{"missing CA", MTLSConfig{Mode: mtlsRequired}, false, true},
+		{"unreadable CA", MTLSConfig{Mode: mtlsRequired, ClientCA: filepath.Join(dir, "missing.pem")}, false, true},
+		{"invalid CA", MTLSConfig{Mode: mtlsRequired, ClientCA: invalidPath}, false, true},
+		{"unknown mode", MTLSConfig{Mode: "sometimes", ClientCA: caPath}, false, true},
+		{"unknown listener mode", MTLSConfig{Listeners: map[string]string{"::": "yes"}}, false, true},
+	}
+	for _, tt := range tests {
+		pool, err := loadClientCAs(tt.cfg)
+		if (err != nil) != tt.wantErr || (pool != nil) != tt.wantPool {
+			t.Errorf("%s: loadClientCAs = %v, %v", tt.name, pool != nil, err)
+		}
+	}
+}
+
+func TestApplyClientAuth(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	s.config.MTLS = MTLSConfig{Mode: mtlsOptional, Listeners: map[string]string{"192.0.2.1": mtlsRequired, "192.0.2.2": mtlsOff}}
+	tests := []struct {
+		host string
+		want tls.ClientAuthType
+	}{
+		{"0.0.0.0", tls.VerifyClientCertIfGiven},
+		{"192.0.2.1", tls.RequireAndVerifyClientCert},
+		{"192.0.2.2", tls.NoClientCert},
+	}
+	for _, tt := range tests {
+		tlsConfig := &tls.Config{}
+		s.applyClientAuth(tlsConfig, tt.host)
+		if tlsConfig.ClientAuth != tt.want {
+			t.Errorf("%s: ClientAuth = %v, want %v", tt.host, tlsConfig.ClientAuth, tt.want)
+		}
+	}
+}
+
+// issueClientCert 使用 CA 签发客户端证书
+func issueClientCert(t *testing.T, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, commonName string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := randomSerial()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// 启用密码认证时，持有受信任客户端证书的请求无需密码
+func TestClientCertAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey, err := loadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.Server.Auth = "pw"
+		cfg.MTLS.Scopes = []string{scopeRead}
+	})
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	ts := httptest.NewUnstartedServer(s.httpServer.Handler)
+	ts.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0) // 握手失败是预期的
+	ts.StartTLS()
+	defer ts.Close()
+
+	// 其他 CA 签发的证书不被接受
+	otherCA, otherKey, err := loadOrCreateCA(filepath.Join(dir, "other.pem"), filepath.Join(dir, "other.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		certs []tls.Certificate
+		want  int
+	}{
+		{"trusted certificate", []tls.Certificate{issueClientCert(t, caCert, caKey, "laptop")}, http.StatusOK},
+		{"no certificate", nil, http.StatusUnauthorized},
+		{"untrusted certificate", []tls.Certificate{issueClientCert(t, otherCA, otherKey, "laptop")}, 0},
+	}
+	for _, tt := range tests {
+		transport := ts.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = tt.certs
+		client := &http.Client{Transport: transport}
+		resp, err := client.Get(ts.URL + "/session")
+		if tt.want == 0 {
+			// 服务器拒绝握手
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s: %s", tt.name, resp.Status)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var session map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&session)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: %s, want %d", tt.name, resp.Status, tt.want)
+		}
+		if tt.want == http.StatusOK && (session["method"] != "cert" || session["user"] != "laptop") {
+			t.Errorf("%s: session %v", tt.name, session)
+		}
+	}
+}
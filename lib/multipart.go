@@ -0,0 +1,193 @@
+package lib
+
+/**
+*** FILE: multipart.go
+***   handle streaming multipart uploads: parts are written to storage as they arrive, never buffered in memory
+**/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// countingReadCloser 统计已读取的请求体字节数，用于估计各部分的大小
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// multipartFile 已写入存储目录、尚未发布的文件
+type multipartFile struct {
+	File
+	path         string // 部分的原始文件名，文件夹上传时为相对路径 (File.Name 只保留最后一段)
+	hasher       *uploadHasher
+	declaredSize int64 // -1 表示未声明
+}
+
+// receiveMultipartFiles 逐个读取请求中名为 file 的部分并直接写入存储目录，每个部分对应一个文件
+// 请求体超过文件大小限制时立即停止读取。任何一个文件失败时删除本次请求已保存的全部文件并写入错误响应
+// Digest 和 Upload-Length 请求头只能用于单个文件，多个文件时可以在各部分的头中声明 Digest
+func (s *ClipboardServer) receiveMultipartFiles(w http.ResponseWriter, r *http.Request, room string, expire int64, expected *expectedDigest, declaredSize int64) ([]multipartFile, bool) {
+	if s.config.File.Limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(s.config.File.Limit))
+	}
+	body := &countingReadCloser{ReadCloser: r.Body}
+	r.Body = body
+	reader, err := r.MultipartReader()
+	if err != nil {
+		s.logf(logFile, slog.LevelError, "错误: 解析 multipart form 失败: %v", err)
+		http.Error(w, "无法解析表单数据", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var received []multipartFile
+	fail := func(status int, message string) ([]multipartFile, bool) {
+		for _, f := range received {
+			s.deleteUploadedFile(f.UUID)
+			s.abortProgress(f.UUID, message)
+		}
+		http.Error(w, message, status)
+		return nil, false
+	}
+
+	var total int64
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(s.multipartErrorStatus(err))
+		}
+		// 其他表单字段不需要，跳过
+		if part.FormName() != "file" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		if len(received) > 0 && (expected != nil || declaredSize >= 0) {
+			part.Close()
+			return fail(http.StatusBadRequest, "Digest 和 Upload-Length 请求头只能用于单个文件")
+		}
+		partExpected := expected
+		if value := part.Header.Get("Digest"); value != "" {
+			if partExpected, err = parseDigest(value); err != nil {
+				part.Close()
+				return fail(http.StatusBadRequest, err.Error())
+			}
+		}
+
+		// 进度事件中的大小：声明的 Upload-Length，否则按请求体剩余的长度估计，都没有时为 -1
+		sizeHint := declaredSize
+		if sizeHint < 0 && r.ContentLength > 0 {
+			sizeHint = r.ContentLength - body.n
+		}
+		f, err := s.saveMultipartPart(part, room, expire, partExpected, sizeHint)
+		part.Close()
+		if err != nil {
+			status, message := s.multipartErrorStatus(err)
+			s.abortProgress(f.UUID, message)
+			return fail(status, message)
+		}
+		f.declaredSize = declaredSize
+		received = append(received, f)
+		total += f.Size
+		s.logf(logFile, slog.LevelInfo, "收到文件上传: %s, 大小: %d, 房间: %s", f.Name, f.Size, room)
+	}
+	if len(received) == 0 {
+		s.logf(logFile, slog.LevelError, "错误: 请求中没有上传文件")
+		http.Error(w, "无法获取文件", http.StatusBadRequest)
+		return nil, false
+	}
+
+	// 未声明长度的请求在读取后计入上传带宽
+	rec := &abortReasonRecorder{ResponseWriter: w}
+	if r.ContentLength <= 0 && !s.checkRateLimit(rec, r, limitUpload, room, float64(total)) {
+		for _, f := range received {
+			s.deleteUploadedFile(f.UUID)
+			s.abortProgress(f.UUID, rec.reason())
+		}
+		return nil, false
+	}
+
+	for _, f := range received {
+		if !s.verifyUpload(w, r, f.File, f.declaredSize, f.hasher) {
+			for _, other := range received {
+				s.deleteUploadedFile(other.UUID)
+				s.abortProgress(other.UUID, "同一请求中的其他文件未通过校验")
+			}
+			return nil, false
+		}
+	}
+	return received, true
+}
+
+// saveMultipartPart 将一个部分写入存储目录并记录到文件映射中，失败时删除不完整的文件
+// 写入期间广播上传进度；失败时返回的 multipartFile 只有 UUID，由调用方广播 upload_abort
+func (s *ClipboardServer) saveMultipartPart(part *multipart.Part, room string, expire int64, expected *expectedDigest, sizeHint int64) (multipartFile, error) {
+	uuid := gen_UUID()
+	filePath := filepath.Join(s.storageFolder, uuid)
+	dst, err := os.Create(filePath)
+	if err != nil {
+		s.logf(logFile, slog.LevelError, "错误: 创建文件 %s 失败: %v", filePath, err)
+		return multipartFile{}, err
+	}
+	hasher := newUploadHasher(expected)
+	progress := s.newProgressReporter(room, uploadProgress{UUID: uuid, Name: part.FileName(), Size: sizeHint})
+	_, err = io.Copy(io.MultiWriter(dst, hasher, progress), part)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.logf(logFile, slog.LevelError, "错误: 写入文件 %s 失败: %v", filePath, err)
+		os.Remove(filePath)
+		return multipartFile{File: File{UUID: uuid}}, err
+	}
+
+	timestamp := time.Now().Unix()
+	fileInfo := File{
+		Name:       part.FileName(),
+		UUID:       uuid,
+		Size:       hasher.Size,
+		UploadTime: timestamp,
+		ExpireTime: expire,
+		Room:       room,
+		Digest:     hasher.digest(),
+	}
+	s.runMutex.Lock() // 保护 uploadFileMap
+	s.uploadFileMap[uuid] = fileInfo
+	s.runMutex.Unlock()
+	filename := part.FileName()
+	if _, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		filename = params["filename"]
+	}
+	return multipartFile{File: fileInfo, path: filename, hasher: hasher, declaredSize: -1}, nil
+}
+
+// multipartErrorStatus 返回读取 multipart 请求出错时的状态码和提示
+func (s *ClipboardServer) multipartErrorStatus(err error) (int, string) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		s.logf(logFile, slog.LevelError, "错误: 文件大小超出限制 (%d)", maxBytesErr.Limit)
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("文件大小超出限制 (最大 %d 字节)", maxBytesErr.Limit)
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return http.StatusInternalServerError, "无法保存文件"
+	}
+	s.logf(logFile, slog.LevelError, "错误: 读取 multipart 数据失败: %v", err)
+	return http.StatusBadRequest, "无法读取文件数据"
+}
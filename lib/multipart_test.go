@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMultipartErrorStatus(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"size limit", fmt.Errorf("read: %w", &http.MaxBytesError{Limit: 10}), http.StatusRequestEntityTooLarge},
+		{"storage", &os.PathError{Op: "write", Path: "x", Err: errors.New("no space left on device")}, http.StatusInternalServerError},
+		{"truncated body", io.ErrUnexpectedEOF, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if status, message := s.multipartErrorStatus(tt.err); status != tt.want || message == "" {
+			t.Errorf("%s: multipartErrorStatus = %d %q, want %d", tt.name, status, message, tt.want)
+		}
+	}
+}
+
+// multipartPart 测试请求中的一个表单部分，digest 非空时写入该部分的 Digest 头
+type multipartPart struct {
+	field, filename, content, digest string
+}
+
+// postMultipart 上传多个部分；不声明 Content-Length，服务器只能在读取时检查大小
+func postMultipart(t *testing.T, url string, parts []multipartPart) (*http.Response, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		header := textproto.MIMEHeader{}
+		disposition := fmt.Sprintf(`form-data; name=%q`, p.field)
+		if p.filename != "" {
+			disposition += fmt.Sprintf(`; filename=%q`, p.filename)
+		}
+		header.Set("Content-Disposition", disposition)
+		if p.digest != "" {
+			header.Set("Digest", p.digest)
+		}
+		w, _ := mw.CreatePart(header)
+		w.Write([]byte(p.content))
+	}
+	mw.Close()
+	return doRequest(t, http.MethodPost, url, io.MultiReader(&buf), "Content-Type", mw.FormDataContentType())
+}
+
+// storedFiles 返回文件映射中已保存的上传文件数
+func storedFiles(t *testing.T, s *ClipboardServer) int {
+	t.Helper()
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+	return len(s.uploadFileMap)
+}
+
+func TestMultipartUpload(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	digest := "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+	tests := []struct {
+		name      string
+		parts     []multipartPart
+		want      int
+		wantFiles int
+	}{
+		{"multiple files and other fields", []multipartPart{
+			{field: "note", content: "ignored"},
+			{field: "file", filename: "a.txt", content: "hello", digest: digest},
+			{field: "file", filename: "b.txt", content: "world"},
+		}, http.StatusOK, 2},
+		{"no file", []multipartPart{{field: "note", content: "x"}}, http.StatusBadRequest, 0},
+		{"part digest mismatch", []multipartPart{
+			{field: "file", filename: "a.txt", content: "hello"},
+			{field: "file", filename: "b.txt", content: "world", digest: digest},
+		}, http.StatusUnprocessableEntity, 0},
+		{"invalid part digest", []multipartPart{
+			{field: "file", filename: "a.txt", content: "hello"},
+			{field: "file", filename: "b.txt", content: "world", digest: "md5=x"},
+		}, http.StatusBadRequest, 0},
+		{"body over limit", []multipartPart{
+			{field: "file", filename: "a.txt", content: "hello"},
+			{field: "file", filename: "big.bin", content: strings.Repeat("a", 2048)},
+		}, http.StatusRequestEntityTooLarge, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t, func(cfg *Config) { cfg.File.Limit = 1024 })
+			resp, data := postMultipart(t, ts.URL+"/upload", tt.parts)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %s %s, want %d", resp.Status, data, tt.want)
+			}
+			// 任何一个文件失败时本次请求的文件全部删除
+			if n := storedFiles(t, s); n != tt.wantFiles {
+				t.Errorf("%d stored files, want %d", n, tt.wantFiles)
+			}
+			if tt.wantFiles > 1 {
+				var result struct {
+					Files []map[string]string `json:"files"`
+				}
+				json.Unmarshal(data, &result)
+				if len(result.Files) != tt.wantFiles {
+					t.Errorf("response files: %s", data)
+				}
+			}
+		})
+	}
+}
+
+// 请求级的 Digest 和 Upload-Length 只能用于单个文件
+func TestMultipartRequestDigestSingleFile(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		w, _ := mw.CreateFormFile("file", name)
+		w.Write([]byte("hello"))
+	}
+	mw.Close()
+	resp, _ := doRequest(t, http.MethodPost, ts.URL+"/upload", &buf, "Content-Type", mw.FormDataContentType(), "Upload-Length", "5")
+	if resp.StatusCode != http.StatusBadRequest || storedFiles(t, s) != 0 {
+		t.Errorf("status %s, %d stored files", resp.Status, storedFiles(t, s))
+	}
+}
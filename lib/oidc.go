@@ -0,0 +1,623 @@
+package lib
+
+/**
+*** FILE: oidc.go
+***   handle OpenID Connect authorization-code login (discovery, PKCE, ID token verification)
+**/
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcPendingTTL 登录请求 (state) 的有效期
+const oidcPendingTTL = 10 * time.Minute
+
+// oidcStateCookieName 保存 state 哈希的 Cookie，把回调绑定到发起登录的浏览器
+const oidcStateCookieName = "cc_oidc_state"
+
+// oidcDiscovery OpenID Provider 元数据中用到的字段
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcPending 已发起但尚未回调的登录请求
+type oidcPending struct {
+	nonce       string
+	verifier    string // PKCE code_verifier
+	redirectURI string
+	returnTo    string
+	expires     time.Time
+}
+
+// oidcIdentity 从 ID Token 中提取的用户身份
+type oidcIdentity struct {
+	Subject string
+	Email   string
+	Name    string
+	Groups  []string
+}
+
+// oidcProvider OIDC 客户端，元数据和签名密钥在首次使用时获取并缓存
+type oidcProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+	pending     map[string]oidcPending
+}
+
+func newOIDCProvider(cfg OIDCConfig) (*oidcProvider, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, errors.New("需要配置 issuer 和 clientId")
+	}
+	for _, pattern := range cfg.AllowedEmails {
+		if _, err := path.Match(strings.ToLower(pattern), ""); err != nil {
+			return nil, fmt.Errorf("无效的邮箱规则 '%s': %w", pattern, err)
+		}
+	}
+	return &oidcProvider{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		keys:    make(map[string]crypto.PublicKey),
+		pending: make(map[string]oidcPending),
+	}, nil
+}
+
+func (p *oidcProvider) getJSON(rawURL string, v interface{}) error {
+	resp, err := p.client.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s 返回状态码 %d", rawURL, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// metadata 获取并缓存 Provider 元数据
+func (p *oidcProvider) metadata() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := p.getJSON(strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("获取 OIDC 元数据失败: %w", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != strings.TrimSuffix(p.cfg.Issuer, "/") {
+		return nil, fmt.Errorf("OIDC 元数据中的 issuer '%s' 与配置不一致", d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("OIDC 元数据缺少必要的端点")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// jwk JSON Web Key 中用到的字段 (RSA 与 EC)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("无效的 RSA 指数")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("不支持的曲线 %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC 公钥不在曲线上")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("不支持的密钥类型 %s", k.Kty)
+}
+
+// publicKey 按 kid 查找签名公钥，未找到时重新获取 JWKS (最多每分钟一次，用于密钥轮换)
+func (p *oidcProvider) publicKey(kid string) (crypto.PublicKey, error) {
+	d, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < time.Minute {
+		return nil, fmt.Errorf("未知的签名密钥 '%s'", kid)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("获取 JWKS 失败: %w", err)
+	}
+	p.keysFetched = time.Now()
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			p.keys[k.Kid] = key
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	// 只有一个密钥且 ID Token 未指定 kid 时直接使用
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("未知的签名密钥 '%s'", kid)
+}
+
+// verifySignature 校验 JWS 签名，支持 RS256/384/512 和 ES256/384/512
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("不支持的签名算法 %s", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("签名算法与密钥类型不匹配")
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, hash, digest, sig)
+	case strings.HasPrefix(alg, "ES"):
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("签名算法与密钥类型不匹配")
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("无效的 ECDSA 签名长度")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errors.New("ECDSA 签名校验失败")
+		}
+		return nil
+	}
+	return fmt.Errorf("不支持的签名算法 %s", alg)
+}
+
+// verifyIDToken 校验 ID Token 的签名、issuer、audience、有效期和 nonce，返回其中的声明
+func (p *oidcProvider) verifyIDToken(raw string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("ID Token 格式无效")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("ID Token 头部无效")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.New("ID Token 头部无效")
+	}
+	if len(header.Alg) != 5 {
+		return nil, fmt.Errorf("不支持的签名算法 %s", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("ID Token 签名无效")
+	}
+	key, err := p.publicKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, fmt.Errorf("ID Token 签名校验失败: %w", err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("ID Token 内容无效")
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("ID Token 内容无效")
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != strings.TrimSuffix(p.cfg.Issuer, "/") {
+		return nil, fmt.Errorf("ID Token 的 issuer '%s' 不匹配", iss)
+	}
+	audiences := claimStrings(claims["aud"])
+	audOK := false
+	for _, aud := range audiences {
+		if aud == p.cfg.ClientID {
+			audOK = true
+		}
+	}
+	if !audOK {
+		return nil, errors.New("ID Token 的 audience 不匹配")
+	}
+	if azp, ok := claims["azp"].(string); ok && len(audiences) > 1 && azp != p.cfg.ClientID {
+		return nil, errors.New("ID Token 的 azp 不匹配")
+	}
+	now := float64(time.Now().Unix())
+	const skew = 60
+	if exp, ok := claims["exp"].(float64); !ok || exp+skew < now {
+		return nil, errors.New("ID Token 已过期")
+	}
+	if iat, ok := claims["iat"].(float64); ok && iat-skew > now {
+		return nil, errors.New("ID Token 的签发时间无效")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("ID Token 的 nonce 不匹配")
+	}
+	return claims, nil
+}
+
+// claimStrings 将字符串或字符串数组形式的声明转换为 []string
+func claimStrings(v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		return []string{val}
+	case []interface{}:
+		list := make([]string, 0, len(val))
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func (p *oidcProvider) identity(claims map[string]interface{}) oidcIdentity {
+	id := oidcIdentity{Groups: claimStrings(claims[p.cfg.GroupsClaim])}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		id.Email = ""
+	}
+	for _, key := range []string{"name", "preferred_username", "email", "sub"} {
+		if name, _ := claims[key].(string); name != "" {
+			id.Name = name
+			break
+		}
+	}
+	return id
+}
+
+func (id oidcIdentity) inGroups(groups []string) bool {
+	for _, want := range groups {
+		for _, g := range id.Groups {
+			if g == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowed 判断用户是否允许登录：未配置 allowedEmails 和 allowedGroups 时允许所有用户
+func (p *oidcProvider) allowed(id oidcIdentity) bool {
+	if len(p.cfg.AllowedEmails) == 0 && len(p.cfg.AllowedGroups) == 0 {
+		return true
+	}
+	if id.inGroups(p.cfg.AllowedGroups) {
+		return true
+	}
+	email := strings.ToLower(id.Email)
+	for _, pattern := range p.cfg.AllowedEmails {
+		if ok, _ := path.Match(strings.ToLower(pattern), email); ok && email != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeCode 使用授权码和 PKCE verifier 换取 ID Token
+func (p *oidcProvider) exchangeCode(code string, pending oidcPending) (string, error) {
+	d, err := p.metadata()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", pending.redirectURI)
+	form.Set("code_verifier", pending.verifier)
+	form.Set("client_id", p.cfg.ClientID)
+
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return "", fmt.Errorf("无法解析令牌响应 (状态码 %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || result.Error != "" {
+		return "", fmt.Errorf("令牌端点返回错误: %s %s", result.Error, result.ErrorDescription)
+	}
+	if result.IDToken == "" {
+		return "", errors.New("令牌响应中没有 id_token")
+	}
+	return result.IDToken, nil
+}
+
+func (p *oidcProvider) addPending(state string, pending oidcPending) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for k, v := range p.pending {
+		if v.expires.Before(now) {
+			delete(p.pending, k)
+		}
+	}
+	p.pending[state] = pending
+}
+
+// takePending 取出并删除 state 对应的登录请求，每个 state 只能使用一次
+func (p *oidcProvider) takePending(state string) (oidcPending, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, ok := p.pending[state]
+	delete(p.pending, state)
+	if !ok || pending.expires.Before(time.Now()) {
+		return oidcPending{}, false
+	}
+	return pending, true
+}
+
+// oidcRedirectURI 返回回调地址：优先使用配置，否则根据请求推断
+func (s *ClipboardServer) oidcRedirectURI(r *http.Request) string {
+	if s.config.OIDC.RedirectURL != "" {
+		return s.config.OIDC.RedirectURL
+	}
+	return fmt.Sprintf("%s://%s%s/oidc/callback", getScheme(r), getHost(r), s.config.Server.Prefix)
+}
+
+// safeReturnPath 只允许站内的相对路径作为登录后的跳转目标，防止开放重定向
+func (s *ClipboardServer) safeReturnPath(target string) string {
+	if strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") && !strings.Contains(target, "\\") {
+		return target
+	}
+	return s.config.Server.Prefix + "/"
+}
+
+func oidcStateHash(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// setOIDCStateCookie 写入 (或在 state 为空时清除) 保存 state 哈希的短期 Cookie
+// 回调是从身份提供方跳转回来的顶层 GET 请求，SameSite=Lax 时浏览器会携带该 Cookie
+func (s *ClipboardServer) setOIDCStateCookie(w http.ResponseWriter, r *http.Request, state string) {
+	cookie := &http.Cookie{
+		Name:     oidcStateCookieName,
+		Path:     s.config.Server.Prefix + "/oidc/",
+		HttpOnly: true,
+		Secure:   getScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+	if state == "" {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Value = oidcStateHash(state)
+		cookie.MaxAge = int(oidcPendingTTL / time.Second)
+	}
+	http.SetCookie(w, cookie)
+}
+
+// oidcStateCookieMatches 判断回调的 state 是否由当前浏览器发起，防止攻击者把自己的回调链接发给受害者 (登录 CSRF)
+func oidcStateCookieMatches(r *http.Request, state string) bool {
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || state == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(oidcStateHash(state))) == 1
+}
+
+// handleOIDCLogin 发起授权码登录 (GET /oidc/login?redirect=/path)
+func (s *ClipboardServer) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAuthGuard(w, r) {
+		return
+	}
+	d, err := s.oidc.metadata()
+	if err != nil {
+		s.logf(logAuth, slog.LevelInfo, "OIDC 登录失败: %v", err)
+		writeJSONError(w, http.StatusBadGateway, "BadGateway", "无法连接身份提供方")
+		return
+	}
+
+	state := base64.RawURLEncoding.EncodeToString(random_bytes(24))
+	pending := oidcPending{
+		nonce:       base64.RawURLEncoding.EncodeToString(random_bytes(24)),
+		verifier:    base64.RawURLEncoding.EncodeToString(random_bytes(32)),
+		redirectURI: s.oidcRedirectURI(r),
+		returnTo:    s.safeReturnPath(r.URL.Query().Get("redirect")),
+		expires:     time.Now().Add(oidcPendingTTL),
+	}
+	s.oidc.addPending(state, pending)
+	s.setOIDCStateCookie(w, r, state)
+
+	challenge := sha256.Sum256([]byte(pending.verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", s.config.OIDC.ClientID)
+	q.Set("redirect_uri", pending.redirectURI)
+	q.Set("scope", strings.Join(s.config.OIDC.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", pending.nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// handleOIDCCallback 处理身份提供方的回调 (GET /oidc/callback?code=&state=)，登录成功后创建会话
+func (s *ClipboardServer) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAuthGuard(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	if !oidcStateCookieMatches(r, q.Get("state")) {
+		s.logf(logAuth, slog.LevelInfo, "OIDC 回调失败: state 与发起登录的浏览器不匹配。来自 IP: %s", get_remote_ip(r))
+		writeJSONError(w, http.StatusBadRequest, "BadRequest", "登录请求无效或已过期，请重新登录")
+		return
+	}
+	s.setOIDCStateCookie(w, r, "")
+	pending, ok := s.oidc.takePending(q.Get("state"))
+	if !ok {
+		s.logf(logAuth, slog.LevelInfo, "OIDC 回调失败: 无效或已过期的 state。来自 IP: %s", get_remote_ip(r))
+		writeJSONError(w, http.StatusBadRequest, "BadRequest", "登录请求无效或已过期，请重新登录")
+		return
+	}
+	if errCode := q.Get("error"); errCode != "" {
+		s.logf(logAuth, slog.LevelInfo, "OIDC 回调失败: 身份提供方返回错误 %s。来自 IP: %s", errCode, get_remote_ip(r))
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized", "身份提供方拒绝了登录请求")
+		return
+	}
+
+	idToken, err := s.oidc.exchangeCode(q.Get("code"), pending)
+	if err != nil {
+		s.logf(logAuth, slog.LevelInfo, "OIDC 回调失败: %v。来自 IP: %s", err, get_remote_ip(r))
+		writeJSONError(w, http.StatusBadGateway, "BadGateway", "无法完成登录")
+		return
+	}
+	claims, err := s.oidc.verifyIDToken(idToken, pending.nonce)
+	if err != nil {
+		s.logf(logAuth, slog.LevelInfo, "OIDC 回调失败: %v。来自 IP: %s", err, get_remote_ip(r))
+		s.authFailed(r)
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized", "无效的身份令牌")
+		return
+	}
+
+	identity := s.oidc.identity(claims)
+	if !s.oidc.allowed(identity) {
+		s.logf(logAuth, slog.LevelInfo, "OIDC 登录被拒绝: 用户 %s (%s) 不在允许的邮箱或组中。来自 IP: %s", identity.Name, identity.Subject, get_remote_ip(r))
+		s.audit(r, auditAuthFailure, "", 0, "", "oidc: "+identity.Subject)
+		writeJSONError(w, http.StatusForbidden, "Forbidden", "该用户无权访问")
+		return
+	}
+
+	scopes := s.config.OIDC.UserScopes
+	if identity.inGroups(s.config.OIDC.AdminGroups) {
+		scopes = []string{scopeAdmin}
+	}
+	user := identity.Email
+	if user == "" {
+		user = identity.Subject
+	}
+	token, sess := s.createSession(r, &authInfo{
+		Method: "oidc",
+		Name:   identity.Name,
+		User:   user,
+		Scopes: scopes,
+	})
+	s.authSucceeded(r)
+	s.setSessionCookie(w, r, token, sess.ExpiresAt)
+	s.logf(logAuth, slog.LevelInfo, "OIDC 登录成功: 用户 %s, 会话 %s, 来自 IP: %s", user, sess.hash[:8], get_remote_ip(r))
+	http.Redirect(w, r, pending.returnTo, http.StatusFound)
+}
@@ -0,0 +1,275 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer 测试用的身份提供方，提供元数据、JWKS 和令牌端点
+type testIssuer struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+
+	mu        sync.Mutex
+	claims    map[string]interface{} // 下一次令牌请求签发的 ID Token 声明
+	challenge string                 // 授权请求中的 PKCE code_challenge
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIssuer{key: key}
+	b64 := base64.RawURLEncoding.EncodeToString
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			JWKSURI:               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+			Kty: "EC", Kid: "k1", Use: "sig", Crv: "P-256",
+			X: b64(key.X.FillBytes(make([]byte, 32))), Y: b64(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("grant_type") != "authorization_code" || r.FormValue("code") != "good-code" || b64(sum[:]) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, idp.claims)})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// sign 使用 ES256 签发 ID Token
+func (idp *testIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "k1"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, idp.key, digest[:])
+	if err != nil {
+		t.Error(err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newOIDCTestServer(t *testing.T, configure func(cfg *OIDCConfig)) (*testIssuer, *httptest.Server) {
+	idp := newTestIssuer(t)
+	_, ts := newTestServer(t, func(cfg *Config) {
+		cfg.OIDC.Enabled = true
+		cfg.OIDC.Issuer = idp.URL
+		cfg.OIDC.ClientID = "cloud-clip"
+		cfg.AuthGuard.MaxFailures = 100
+		if configure != nil {
+			configure(&cfg.OIDC)
+		}
+	})
+	return idp, ts
+}
+
+// oidcLogin 一次已发起的登录：授权请求中的 state 和发起登录的浏览器收到的 state Cookie
+type oidcLogin struct {
+	state  string
+	cookie *http.Cookie
+}
+
+// startLogin 发起登录，返回 state 和 Cookie 并记录授权请求中的 PKCE challenge，claims 中的 nonce 使用授权请求的值
+func startLogin(t *testing.T, idp *testIssuer, ts *httptest.Server, claims map[string]interface{}) oidcLogin {
+	t.Helper()
+	resp, err := noRedirect.Get(ts.URL + "/oidc/login?redirect=/after")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || err != nil || !strings.HasPrefix(location.String(), idp.URL+"/authorize") {
+		t.Fatalf("login: %s %s", resp.Status, resp.Header.Get("Location"))
+	}
+	q := location.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "cloud-clip" {
+		t.Errorf("authorization request = %v", q)
+	}
+	base := map[string]interface{}{
+		"iss":   idp.URL,
+		"aud":   "cloud-clip",
+		"sub":   "user-1",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": q.Get("nonce"),
+	}
+	for k, v := range claims {
+		base[k] = v
+	}
+	idp.mu.Lock()
+	idp.claims = base
+	idp.challenge = q.Get("code_challenge")
+	idp.mu.Unlock()
+	login := oidcLogin{state: q.Get("state")}
+	for _, c := range resp.Cookies() {
+		if c.Name == oidcStateCookieName {
+			login.cookie = c
+		}
+	}
+	if login.cookie == nil || !login.cookie.HttpOnly || login.cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("state cookie = %v", login.cookie)
+	}
+	return login
+}
+
+// callback 以 login 的 state 请求回调地址，login 的 Cookie 非空时一并发送
+func callback(t *testing.T, ts *httptest.Server, code string, login oidcLogin) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/oidc/callback?"+url.Values{"code": {code}, "state": {login.state}}.Encode(), nil)
+	if login.cookie != nil {
+		req.AddCookie(login.cookie)
+	}
+	resp, err := noRedirect.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp, ts := newOIDCTestServer(t, nil)
+
+	login := startLogin(t, idp, ts, map[string]interface{}{"email": "alice@example.com", "email_verified": true})
+	resp := callback(t, ts, "good-code", login)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/after" {
+		t.Fatalf("callback: %s %s", resp.Status, resp.Header.Get("Location"))
+	}
+	var session *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookieName {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("no session cookie")
+	}
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/content/latest.json", nil)
+	req.AddCookie(session)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode == http.StatusUnauthorized {
+		t.Errorf("request with session: %v %v", resp, err)
+	}
+
+	// state 只能使用一次
+	if resp := callback(t, ts, "good-code", login); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("reused state: %s", resp.Status)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	idp, ts := newOIDCTestServer(t, nil)
+
+	if resp := callback(t, ts, "good-code", oidcLogin{state: "unknown"}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown state: %s", resp.Status)
+	}
+	login := startLogin(t, idp, ts, nil)
+	if resp := callback(t, ts, "bad-code", login); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("rejected code: %s", resp.Status)
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+	}{
+		{"nonce mismatch", map[string]interface{}{"nonce": "other"}},
+		{"wrong audience", map[string]interface{}{"aud": "other-client"}},
+		{"wrong issuer", map[string]interface{}{"iss": "https://evil.example"}},
+		{"expired", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login := startLogin(t, idp, ts, tt.claims)
+			if resp := callback(t, ts, "good-code", login); resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("callback: %s", resp.Status)
+			}
+		})
+	}
+}
+
+func TestOIDCAllowList(t *testing.T) {
+	idp, ts := newOIDCTestServer(t, func(cfg *OIDCConfig) {
+		cfg.AllowedEmails = []string{"*@example.com"}
+		cfg.AllowedGroups = []string{"clip-users"}
+	})
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   int
+	}{
+		{"allowed email", map[string]interface{}{"email": "bob@EXAMPLE.com"}, http.StatusFound},
+		{"unverified email", map[string]interface{}{"email": "bob@example.com", "email_verified": false}, http.StatusForbidden},
+		{"other domain", map[string]interface{}{"email": "eve@example.org"}, http.StatusForbidden},
+		{"allowed group", map[string]interface{}{"email": "eve@example.org", "groups": []string{"staff", "clip-users"}}, http.StatusFound},
+		{"other group", map[string]interface{}{"groups": "staff"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login := startLogin(t, idp, ts, tt.claims)
+			if resp := callback(t, ts, "good-code", login); resp.StatusCode != tt.want {
+				t.Errorf("callback: %s, want %d", resp.Status, tt.want)
+			}
+		})
+	}
+}
+
+// 回调的 state 必须来自同一浏览器发起的登录，攻击者不能让受害者使用攻击者的回调链接登录
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	idp, ts := newOIDCTestServer(t, nil)
+	// 测试身份提供方只记录最后一次授权请求的 PKCE challenge，所以攻击者最后发起登录
+	victim := startLogin(t, idp, ts, nil)
+	attacker := startLogin(t, idp, ts, map[string]interface{}{"sub": "attacker"})
+
+	tests := []struct {
+		name  string
+		login oidcLogin
+	}{
+		{"no cookie", oidcLogin{state: attacker.state}},
+		{"cookie of another login", oidcLogin{state: attacker.state, cookie: victim.cookie}},
+		{"forged cookie", oidcLogin{state: attacker.state, cookie: &http.Cookie{Name: oidcStateCookieName, Value: attacker.state}}},
+	}
+	for _, tt := range tests {
+		resp := callback(t, ts, "good-code", tt.login)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: %s", tt.name, resp.Status)
+		}
+		for _, c := range resp.Cookies() {
+			if c.Name == sessionCookieName {
+				t.Errorf("%s: session created", tt.name)
+			}
+		}
+	}
+	// 发起登录的浏览器仍然可以完成登录
+	if resp := callback(t, ts, "good-code", attacker); resp.StatusCode != http.StatusFound {
+		t.Errorf("matching cookie: %s", resp.Status)
+	}
+}
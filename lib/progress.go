@@ -0,0 +1,219 @@
+package lib
+
+/**
+*** FILE: progress.go
+***   handle upload progress events (upload_start, upload_progress, upload_abort) broadcast to the room,
+***   and cancellation of uploads in progress
+**/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 上传进度事件，上传完成时仍然广播 receive 事件
+const (
+	eventUploadStart    = "upload_start"
+	eventUploadProgress = "upload_progress"
+	eventUploadAbort    = "upload_abort"
+)
+
+// uploadProgressInterval 两次 upload_progress 事件之间的最短间隔
+const uploadProgressInterval = 500 * time.Millisecond
+
+// uploadProgress 上传进度事件的载荷
+type uploadProgress struct {
+	UUID     string `json:"uuid"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"` // 总大小，未知时为 -1
+	Received int64  `json:"received"`
+	Source   string `json:"source,omitempty"` // 服务器下载的来源 URL
+	Reason   string `json:"reason,omitempty"` // upload_abort 的原因
+}
+
+// progressReporter 跟踪一个上传的进度并按间隔广播到房间
+type progressReporter struct {
+	sync.Mutex
+	s        *ClipboardServer
+	room     string
+	progress uploadProgress
+	last     time.Time
+	done     bool
+}
+
+// newProgressReporter 广播 upload_start 并返回进度跟踪，上传完成或中止前可以通过 UUID 找到
+func (s *ClipboardServer) newProgressReporter(room string, progress uploadProgress) *progressReporter {
+	p := &progressReporter{s: s, room: room, progress: progress, last: time.Now()}
+	s.uploadReporters.Store(progress.UUID, p)
+	s.broadcastWebSocketMessage(WebSocketMessage{Event: eventUploadStart, Data: progress}, room)
+	return p
+}
+
+// finishProgress 上传已发布，停止广播进度；没有进度跟踪的上传 (如 tus) 忽略
+func (s *ClipboardServer) finishProgress(uuid string) {
+	if p, ok := s.uploadReporters.Load(uuid); ok {
+		p.(*progressReporter).finish()
+	}
+}
+
+// abortProgress 广播上传的 upload_abort 事件；没有进度跟踪的上传忽略
+func (s *ClipboardServer) abortProgress(uuid string, reason string) {
+	if p, ok := s.uploadReporters.Load(uuid); ok {
+		p.(*progressReporter).abort(reason)
+	}
+}
+
+// Write 累计收到的字节数，可以作为 io.MultiWriter 的一部分
+func (p *progressReporter) Write(data []byte) (int, error) {
+	p.add(int64(len(data)))
+	return len(data), nil
+}
+
+// add 累计收到的字节数，距离上次广播超过间隔时广播 upload_progress
+func (p *progressReporter) add(n int64) {
+	p.Lock()
+	p.progress.Received += n
+	progress, due := p.due()
+	p.Unlock()
+	if due {
+		p.s.broadcastWebSocketMessage(WebSocketMessage{Event: eventUploadProgress, Data: progress}, p.room)
+	}
+}
+
+// set 更新已收到的字节数 (乱序的分块上传为已覆盖的字节数)
+func (p *progressReporter) set(received int64) {
+	p.Lock()
+	p.progress.Received = received
+	progress, due := p.due()
+	p.Unlock()
+	if due {
+		p.s.broadcastWebSocketMessage(WebSocketMessage{Event: eventUploadProgress, Data: progress}, p.room)
+	}
+}
+
+// due 判断是否需要广播进度，调用方需持有锁；收齐全部数据时不受间隔限制
+func (p *progressReporter) due() (uploadProgress, bool) {
+	if p.done || (time.Since(p.last) < uploadProgressInterval && p.progress.Received != p.progress.Size) {
+		return uploadProgress{}, false
+	}
+	p.last = time.Now()
+	return p.progress, true
+}
+
+// describe 更新文件名和总大小 (例如服务器下载收到响应头之后)
+func (p *progressReporter) describe(name string, size int64) {
+	p.Lock()
+	p.progress.Name = name
+	p.progress.Size = size
+	p.Unlock()
+}
+
+// finish 上传已完成 (之后由 receive 事件通知)，不再广播进度
+func (p *progressReporter) finish() {
+	p.Lock()
+	p.done = true
+	p.Unlock()
+	p.s.uploadReporters.Delete(p.progress.UUID)
+}
+
+// abort 广播 upload_abort，之后不再广播进度
+func (p *progressReporter) abort(reason string) {
+	p.Lock()
+	if p.done {
+		p.Unlock()
+		return
+	}
+	p.done = true
+	progress := p.progress
+	progress.Reason = reason
+	p.Unlock()
+	p.s.uploadReporters.Delete(progress.UUID)
+	p.s.broadcastWebSocketMessage(WebSocketMessage{Event: eventUploadAbort, Data: progress}, p.room)
+}
+
+// abortReasonRecorder 在写入响应的同时记录错误信息，用作 upload_abort 的原因
+type abortReasonRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (rw *abortReasonRecorder) Write(p []byte) (int, error) {
+	if rw.body.Len() < 4096 {
+		rw.body.Write(p)
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+// reason 返回写入的错误信息，JSON 错误取其中的 message
+func (rw *abortReasonRecorder) reason() string {
+	var jsonErr struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(rw.body.Bytes(), &jsonErr) == nil && jsonErr.Message != "" {
+		return jsonErr.Message
+	}
+	return strings.TrimSpace(rw.body.String())
+}
+
+// fetchTask 进行中的服务器下载，可以通过 /upload/cancel 取消
+type fetchTask struct {
+	room   string
+	cancel context.CancelFunc
+}
+
+// handleUploadCancel 取消进行中的分块上传、服务器下载或文件夹上传 (POST /upload/cancel/{uuid})
+// 删除已写入的部分文件 (文件夹为已上传的条目) 和文件映射中的记录，并在房间内广播 upload_abort
+func (s *ClipboardServer) handleUploadCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅允许 POST 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	uuid := strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/upload/cancel/")
+
+	if task, ok := s.fetchTasks.Load(uuid); ok {
+		if !s.checkRoomAccess(w, r, task.(*fetchTask).room) {
+			return
+		}
+		// fetchURL 在发布前取走任务，先取走任务的一方生效，取消不会发生在发布之后
+		if !s.fetchTasks.CompareAndDelete(uuid, task) {
+			writeJSONError(w, http.StatusConflict, "Conflict", "下载已完成，文件正在发布")
+			return
+		}
+		s.abortProgress(uuid, "上传已取消")
+		task.(*fetchTask).cancel() // fetchURL 会删除已下载的部分
+	} else if upload, ok := s.lookupFolderUpload(uuid); ok {
+		if !s.checkRoomAccess(w, r, upload.Room) {
+			return
+		}
+		s.folderMutex.Lock()
+		delete(s.folderUploads, uuid)
+		s.folderMutex.Unlock()
+		upload.Lock()
+		s.deleteFolderEntries(upload.Entries)
+		upload.Unlock()
+	} else {
+		_, fileInfo, ok := s.lookupChunkUpload(uuid)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "NotFound", "上传会话不存在、已完成或已过期")
+			return
+		}
+		if !s.checkRoomAccess(w, r, fileInfo.Room) {
+			return
+		}
+		s.chunkMutex.Lock()
+		delete(s.chunkUploads, uuid)
+		s.chunkMutex.Unlock()
+		s.deleteUploadedFile(uuid)
+		s.abortProgress(uuid, "上传已取消")
+	}
+	s.logf(logFile, slog.LevelInfo, "上传已取消, UUID: %s, 来自: %s", uuid, get_remote_ip(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "上传已取消"})
+}
@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProgressReporterDue(t *testing.T) {
+	tests := []struct {
+		name     string
+		received int64
+		size     int64
+		since    time.Duration
+		done     bool
+		want     bool
+	}{
+		{"within interval", 10, 100, 0, false, false},
+		{"interval elapsed", 10, 100, uploadProgressInterval, false, true},
+		{"complete within interval", 100, 100, 0, false, true},
+		{"unknown size within interval", 10, -1, 0, false, false},
+		{"done", 100, 100, time.Hour, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &progressReporter{
+				progress: uploadProgress{Received: tt.received, Size: tt.size},
+				last:     time.Now().Add(-tt.since),
+				done:     tt.done,
+			}
+			if _, got := p.due(); got != tt.want {
+				t.Errorf("due() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 并发写入的分块各自广播进度，与处理函数的广播写入同一个 WebSocket 连接
+func TestConcurrentChunkProgress(t *testing.T) {
+	_, ts := newTestServer(t, nil)
+	conn := dialPush(t, ts, "")
+
+	const chunks, chunkSize = 8, 1024
+	body, _ := json.Marshal(map[string]interface{}{"name": "a.bin", "size": chunks * chunkSize, "chunkSize": chunkSize})
+	resp, err := http.Post(ts.URL+"/upload/chunk", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var init struct {
+		Result struct{ UUID string } `json:"result"`
+	}
+	json.NewDecoder(resp.Body).Decode(&init)
+	resp.Body.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < chunks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			url := fmt.Sprintf("%s/upload/chunk/%s?index=%d", ts.URL, init.Result.UUID, i)
+			resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(make([]byte, chunkSize)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("chunk %d: %s", i, resp.Status)
+			}
+		}(i)
+	}
+
+	// 收齐全部数据时立即广播，不受间隔限制
+	for {
+		var msg struct {
+			Event string         `json:"event"`
+			Data  uploadProgress `json:"data"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Event == eventUploadProgress && msg.Data.Received == chunks*chunkSize {
+			break
+		}
+	}
+	wg.Wait()
+}
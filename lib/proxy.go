@@ -0,0 +1,167 @@
+package lib
+
+/**
+*** FILE: proxy.go
+***   handle trusted proxies and client IP / scheme resolution
+**/
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientInfo 经过受信任代理解析后的客户端信息
+type clientInfo struct {
+	IP     string
+	Scheme string
+	Host   string // 客户端请求的主机 (含端口)
+}
+
+type clientInfoContextKey struct{}
+
+// forwardedHop 转发链中的一跳
+type forwardedHop struct {
+	addr  string // 客户端地址 (可能不是合法 IP，例如 "unknown" 或混淆标识)
+	proto string
+	host  string
+}
+
+// stripHostPort 去掉地址中的端口和 IPv6 方括号
+func stripHostPort(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// parseForwardedHeader 解析 RFC 7239 Forwarded 头，按出现顺序返回各跳
+func parseForwardedHeader(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			var hop forwardedHop
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				val = strings.Trim(strings.TrimSpace(val), `"`)
+				switch strings.ToLower(key) {
+				case "for":
+					hop.addr = stripHostPort(val)
+				case "proto":
+					hop.proto = strings.ToLower(val)
+				case "host":
+					hop.host = val
+				}
+			}
+			if hop.addr != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// parseXForwardedFor 解析 X-Forwarded-For (及 X-Forwarded-Proto、X-Forwarded-Host) 头
+func parseXForwardedFor(h http.Header) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = stripHostPort(addr); addr != "" {
+				hops = append(hops, forwardedHop{addr: addr})
+			}
+		}
+	}
+	if len(hops) > 0 {
+		hops[len(hops)-1].proto = lastForwardedProto(h)
+		hops[len(hops)-1].host = lastForwardedHost(h)
+	}
+	return hops
+}
+
+// lastForwardedProto 返回 X-Forwarded-Proto 最右侧 (离我们最近的代理设置) 的值
+func lastForwardedProto(h http.Header) string {
+	protos := strings.Split(h.Get("X-Forwarded-Proto"), ",")
+	return strings.ToLower(strings.TrimSpace(protos[len(protos)-1]))
+}
+
+// lastForwardedHost 返回 X-Forwarded-Host 最右侧的值
+func lastForwardedHost(h http.Header) string {
+	hosts := strings.Split(h.Get("X-Forwarded-Host"), ",")
+	return strings.TrimSpace(hosts[len(hosts)-1])
+}
+
+// 可以采用的转发头 (server.forwardedHeader)，只采用反向代理实际设置的那一个，
+// 其他转发头可能是客户端自己发送、被代理原样转发的
+const (
+	forwardedHeaderXFF      = "x-forwarded-for" // X-Forwarded-For、X-Forwarded-Proto 与 X-Forwarded-Host (nginx、大多数代理的默认做法)
+	forwardedHeaderStandard = "forwarded"       // RFC 7239 Forwarded
+	forwardedHeaderRealIP   = "x-real-ip"       // X-Real-IP、X-Forwarded-Proto 与 X-Forwarded-Host
+)
+
+// parseForwardedHeaderName 校验 server.forwardedHeader，留空时为 x-forwarded-for
+func parseForwardedHeaderName(name string) (string, error) {
+	switch name = strings.ToLower(strings.TrimSpace(name)); name {
+	case "":
+		return forwardedHeaderXFF, nil
+	case forwardedHeaderXFF, forwardedHeaderStandard, forwardedHeaderRealIP:
+		return name, nil
+	}
+	return "", fmt.Errorf("不支持的转发头 '%s'，可选 x-forwarded-for、forwarded 或 x-real-ip", name)
+}
+
+// resolveClientInfo 解析客户端 IP、协议与主机：只有直连对端是受信任代理时才采用 header 指定的转发头，
+// 并从右向左遍历转发链，跳过受信任的代理，取第一个不受信任的地址
+func resolveClientInfo(r *http.Request, trusted []*net.IPNet, header string) clientInfo {
+	info := clientInfo{IP: stripHostPort(r.RemoteAddr), Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		info.Scheme = "https"
+	}
+	if !ipInNets(info.IP, trusted) {
+		return info
+	}
+
+	var hops []forwardedHop
+	switch header {
+	case forwardedHeaderStandard:
+		hops = parseForwardedHeader(r.Header.Values("Forwarded"))
+	case forwardedHeaderRealIP:
+		if realIP := stripHostPort(r.Header.Get("X-Real-IP")); realIP != "" {
+			hops = []forwardedHop{{addr: realIP, proto: lastForwardedProto(r.Header), host: lastForwardedHost(r.Header)}}
+		}
+	default:
+		hops = parseXForwardedFor(r.Header)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hops[i]
+		if hop.proto == "https" || hop.proto == "http" {
+			info.Scheme = hop.proto
+		}
+		if hop.host != "" {
+			info.Host = hop.host
+		}
+		if net.ParseIP(hop.addr) == nil {
+			// 非 IP 标识 ("unknown" 等)，停止在最后一个受信任的地址
+			break
+		}
+		info.IP = hop.addr
+		if !ipInNets(hop.addr, trusted) {
+			break
+		}
+	}
+	return info
+}
+
+// clientInfoMiddleware 在所有处理函数之前解析客户端信息并写入请求上下文
+func (s *ClipboardServer) clientInfoMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := resolveClientInfo(r, s.trustedProxies, s.forwardedHeader)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientInfoContextKey{}, info)))
+	})
+}
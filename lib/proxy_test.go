@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveClientInfo(t *testing.T) {
+	trusted, err := parseCIDRList([]string{"127.0.0.0/8", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remote     string
+		header     string
+		headers    map[string]string
+		tls        bool
+		wantIP     string
+		wantScheme string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.9:1234", forwardedHeaderXFF,
+			map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Proto": "https"}, false, "203.0.113.9", "http"},
+		{"direct tls", "203.0.113.9:1234", forwardedHeaderXFF, nil, true, "203.0.113.9", "https"},
+		{"xff single hop", "127.0.0.1:1234", forwardedHeaderXFF,
+			map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Proto": "https"}, false, "198.51.100.1", "https"},
+		{"xff skips trusted hops from the right", "127.0.0.1:1234", forwardedHeaderXFF,
+			map[string]string{"X-Forwarded-For": "6.6.6.6, 198.51.100.1, 10.1.2.3"}, false, "198.51.100.1", "http"},
+		{"xff client spoofed Forwarded is ignored", "127.0.0.1:1234", forwardedHeaderXFF,
+			map[string]string{"X-Forwarded-For": "198.51.100.1", "Forwarded": "for=10.9.9.9;proto=https"}, false, "198.51.100.1", "http"},
+		{"xff client spoofed X-Real-IP is ignored", "127.0.0.1:1234", forwardedHeaderXFF,
+			map[string]string{"X-Real-IP": "10.9.9.9"}, false, "127.0.0.1", "http"},
+		{"xff unknown hop stops at last trusted", "127.0.0.1:1234", forwardedHeaderXFF,
+			map[string]string{"X-Forwarded-For": "unknown, 10.1.2.3"}, false, "10.1.2.3", "http"},
+		{"forwarded header", "127.0.0.1:1234", forwardedHeaderStandard,
+			map[string]string{"Forwarded": `for="[2001:db8::1]:4711";proto=https, for=10.1.2.3`}, false, "2001:db8::1", "https"},
+		{"forwarded ignores xff", "127.0.0.1:1234", forwardedHeaderStandard,
+			map[string]string{"X-Forwarded-For": "198.51.100.1"}, false, "127.0.0.1", "http"},
+		{"x-real-ip", "127.0.0.1:1234", forwardedHeaderRealIP,
+			map[string]string{"X-Real-IP": "198.51.100.7", "X-Forwarded-For": "6.6.6.6", "X-Forwarded-Proto": "https"}, false, "198.51.100.7", "https"},
+		{"x-real-ip invalid", "127.0.0.1:1234", forwardedHeaderRealIP,
+			map[string]string{"X-Real-IP": "not-an-ip"}, false, "127.0.0.1", "http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			info := resolveClientInfo(r, trusted, tt.header)
+			if info.IP != tt.wantIP || info.Scheme != tt.wantScheme {
+				t.Errorf("got %s %s, want %s %s", info.IP, info.Scheme, tt.wantIP, tt.wantScheme)
+			}
+		})
+	}
+}
+
+func TestParseForwardedHeaderName(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"", forwardedHeaderXFF, false},
+		{"X-Forwarded-For", forwardedHeaderXFF, false},
+		{" forwarded ", forwardedHeaderStandard, false},
+		{"x-real-ip", forwardedHeaderRealIP, false},
+		{"cf-connecting-ip", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseForwardedHeaderName(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseForwardedHeaderName(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestResolveClientHost(t *testing.T) {
+	trusted, _ := parseCIDRList([]string{"127.0.0.0/8", "10.0.0.0/8"})
+	tests := []struct {
+		name    string
+		remote  string
+		header  string
+		headers map[string]string
+		want    string
+	}{
+		{"no proxy headers", "127.0.0.1:1234", forwardedHeaderXFF, nil, "backend:8080"},
+		{"untrusted peer ignores X-Forwarded-Host", "203.0.113.9:1234", forwardedHeaderXFF,
+			map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Host": "evil.example"}, "backend:8080"},
+		{"xff", "127.0.0.1:1234", forwardedHeaderXFF,
+			map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Host": "clip.example.com"}, "clip.example.com"},
+		{"xff uses rightmost host", "127.0.0.1:1234", forwardedHeaderXFF,
+			map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Host": "evil.example, clip.example.com"}, "clip.example.com"},
+		{"xff without X-Forwarded-For", "127.0.0.1:1234", forwardedHeaderXFF,
+			map[string]string{"X-Forwarded-Host": "clip.example.com"}, "backend:8080"},
+		{"x-real-ip", "127.0.0.1:1234", forwardedHeaderRealIP,
+			map[string]string{"X-Real-IP": "198.51.100.7", "X-Forwarded-Host": "clip.example.com:8443"}, "clip.example.com:8443"},
+		{"forwarded host of client-facing proxy", "127.0.0.1:1234", forwardedHeaderStandard,
+			map[string]string{"Forwarded": `for=198.51.100.1;host="clip.example.com", for=10.1.2.3;host=internal`}, "clip.example.com"},
+		{"forwarded stops at untrusted hop", "127.0.0.1:1234", forwardedHeaderStandard,
+			map[string]string{"Forwarded": `for=198.51.100.1;host=evil.example, for=198.51.100.2;host=clip.example.com`}, "clip.example.com"},
+		{"forwarded ignores X-Forwarded-Host", "127.0.0.1:1234", forwardedHeaderStandard,
+			map[string]string{"Forwarded": "for=198.51.100.1", "X-Forwarded-Host": "evil.example"}, "backend:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://backend:8080/", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := resolveClientInfo(r, trusted, tt.header).Host; got != tt.want {
+				t.Errorf("host = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package lib
+
+/**
+*** FILE: ratelimit.go
+***   handle token-bucket rate limiting per IP, API token and room
+**/
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 限流类别
+const (
+	limitMessage = "message"
+	limitUpload  = "upload"
+	limitConnect = "connect"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	cfg    TokenBucketConfig
+}
+
+// refill 按流逝的时间补充令牌
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(b.cfg.Burst, b.tokens+elapsed*b.cfg.Rate)
+		b.last = now
+	}
+}
+
+// rateLimiter 令牌桶集合，键为 "类别|维度|值"
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets:   make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// limitKey 限流维度与对应的桶参数
+type limitKey struct {
+	key string
+	cfg TokenBucketConfig
+}
+
+// allow 同时检查多个令牌桶，全部满足时才扣除 n 个令牌
+// 当 n 大于桶容量时，只要求桶是满的并允许透支，透支部分由后续请求等待偿还 (用于上传带宽)
+func (l *rateLimiter) allow(keys []limitKey, n float64, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pruneLocked(now)
+
+	var retryAfter time.Duration
+	buckets := make([]*tokenBucket, 0, len(keys))
+	for _, k := range keys {
+		bucket, ok := l.buckets[k.key]
+		if !ok {
+			bucket = &tokenBucket{tokens: k.cfg.Burst, last: now}
+			l.buckets[k.key] = bucket
+		}
+		bucket.cfg = k.cfg
+		bucket.refill(now)
+		buckets = append(buckets, bucket)
+
+		need := math.Min(n, k.cfg.Burst)
+		if bucket.tokens < need {
+			wait := time.Duration((need - bucket.tokens) / k.cfg.Rate * float64(time.Second))
+			if wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	if retryAfter > 0 {
+		return false, retryAfter
+	}
+	for _, bucket := range buckets {
+		bucket.tokens -= n
+	}
+	return true, 0
+}
+
+// pruneLocked 每分钟清理一次已补满的空闲令牌桶
+func (l *rateLimiter) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for key, bucket := range l.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.cfg.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// bucketState 令牌桶状态，用于管理接口
+type bucketState struct {
+	Key    string  `json:"key"`
+	Tokens float64 `json:"tokens"`
+	Rate   float64 `json:"rate"`
+	Burst  float64 `json:"burst"`
+}
+
+func (l *rateLimiter) snapshot(now time.Time) []bucketState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	states := make([]bucketState, 0, len(l.buckets))
+	for key, bucket := range l.buckets {
+		bucket.refill(now)
+		states = append(states, bucketState{
+			Key:    key,
+			Tokens: math.Round(bucket.tokens*100) / 100,
+			Rate:   bucket.cfg.Rate,
+			Burst:  bucket.cfg.Burst,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Key < states[j].Key })
+	return states
+}
+
+// rateLimitKeys 根据配置生成请求在某个类别下需要检查的令牌桶
+func (s *ClipboardServer) rateLimitKeys(kind string, r *http.Request, room string) []limitKey {
+	var rule RateLimitRule
+	switch kind {
+	case limitMessage:
+		rule = s.config.RateLimit.Message
+	case limitUpload:
+		rule = s.config.RateLimit.Upload
+	case limitConnect:
+		rule = s.config.RateLimit.Connect
+	}
+
+	var keys []limitKey
+	add := func(dimension, value string, cfg TokenBucketConfig) {
+		if cfg.Rate <= 0 {
+			return
+		}
+		if cfg.Burst < 1 {
+			cfg.Burst = math.Max(1, cfg.Rate)
+		}
+		keys = append(keys, limitKey{key: kind + "|" + dimension + "|" + value, cfg: cfg})
+	}
+	add("ip", get_remote_ip(r), rule.PerIP)
+	if info := authFromRequest(r); info != nil && info.TokenID != "" {
+		add("token", info.TokenID, rule.PerToken)
+	}
+	if room != "" {
+		add("room", normalizeRoomName(room), rule.PerRoom)
+	}
+	return keys
+}
+
+// checkRateLimit 检查限流，超限时写入 429 响应 (带 Retry-After) 并返回 false
+func (s *ClipboardServer) checkRateLimit(w http.ResponseWriter, r *http.Request, kind string, room string, n float64) bool {
+	keys := s.rateLimitKeys(kind, r, room)
+	if len(keys) == 0 {
+		return true
+	}
+	ok, retryAfter := s.rateLimiter.allow(keys, n, time.Now())
+	if ok {
+		return true
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	s.logf(logHTTP, slog.LevelInfo, "限流: %s 请求过于频繁 (房间: '%s')，来自 IP: %s, 路径: %s, %d 秒后重试", kind, room, get_remote_ip(r), r.URL.Path, seconds)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeJSONError(w, http.StatusTooManyRequests, "TooManyRequests", "请求过于频繁，请稍后重试")
+	return false
+}
+
+// handleRateLimitState 查看限流配置与当前令牌桶状态 (GET /admin/ratelimit)，需要 admin 权限
+func (s *ClipboardServer) handleRateLimitState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "仅允许 GET 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"config":  s.config.RateLimit,
+		"buckets": s.rateLimiter.snapshot(time.Now()),
+	})
+}
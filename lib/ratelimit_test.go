@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	start := time.Now()
+	cfg := TokenBucketConfig{Rate: 1, Burst: 2}
+	keys := []limitKey{{key: "message|ip|a", cfg: cfg}}
+	tests := []struct {
+		name      string
+		at        time.Duration
+		n         float64
+		want      bool
+		wantRetry time.Duration
+	}{
+		{"burst 1", 0, 1, true, 0},
+		{"burst 2", 0, 1, true, 0},
+		{"empty", 0, 1, false, time.Second},
+		{"partially refilled", 500 * time.Millisecond, 1, false, 500 * time.Millisecond},
+		{"refilled", time.Second, 1, true, 0},
+		{"refill capped at burst", time.Hour, 2, true, 0},
+	}
+	l := newRateLimiter()
+	for _, tt := range tests {
+		ok, retry := l.allow(keys, tt.n, start.Add(tt.at))
+		if ok != tt.want || retry != tt.wantRetry {
+			t.Errorf("%s: allow = %v, %v, want %v, %v", tt.name, ok, retry, tt.want, tt.wantRetry)
+		}
+	}
+}
+
+// 任一令牌桶不足时整个请求被拒绝，其他桶不扣除令牌
+func TestRateLimiterAllOrNothing(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter()
+	ip := limitKey{key: "message|ip|a", cfg: TokenBucketConfig{Rate: 1, Burst: 5}}
+	room := limitKey{key: "message|room|r", cfg: TokenBucketConfig{Rate: 1, Burst: 1}}
+	if ok, _ := l.allow([]limitKey{ip, room}, 1, now); !ok {
+		t.Fatal("first request rejected")
+	}
+	if ok, _ := l.allow([]limitKey{ip, room}, 1, now); ok {
+		t.Fatal("room bucket should be empty")
+	}
+	if tokens := l.buckets[ip.key].tokens; tokens != 4 {
+		t.Errorf("ip bucket tokens = %v, want 4", tokens)
+	}
+}
+
+// 超过桶容量的请求 (上传带宽) 在桶满时允许透支，之后需要等待偿还
+func TestRateLimiterOverdraft(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter()
+	keys := []limitKey{{key: "upload|ip|a", cfg: TokenBucketConfig{Rate: 100, Burst: 100}}}
+	if ok, _ := l.allow(keys, 300, now); !ok {
+		t.Fatal("overdraft from full bucket rejected")
+	}
+	// 透支 200 个令牌，1 秒后仍欠 100 个
+	if ok, retry := l.allow(keys, 1, now.Add(time.Second)); ok || retry != 1010*time.Millisecond {
+		t.Errorf("after overdraft: %v, %v", ok, retry)
+	}
+	if ok, retry := l.allow(keys, 300, now.Add(2*time.Second)); ok || retry != time.Second {
+		t.Errorf("overdraft from partially filled bucket: %v, %v", ok, retry)
+	}
+	if ok, _ := l.allow(keys, 300, now.Add(3*time.Second)); !ok {
+		t.Error("overdraft after repayment rejected")
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter()
+	cfg := TokenBucketConfig{Rate: 1, Burst: 1}
+	l.allow([]limitKey{{key: "idle", cfg: cfg}}, 1, now)
+	l.allow([]limitKey{{key: "busy", cfg: TokenBucketConfig{Rate: 0.001, Burst: 1}}}, 1, now)
+	l.allow(nil, 0, now.Add(2*time.Minute))
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("refilled bucket not pruned")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("bucket still refilling was pruned")
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.RateLimit.Message = RateLimitRule{
+			PerIP:    TokenBucketConfig{Rate: 2},
+			PerToken: TokenBucketConfig{Rate: 5, Burst: 10},
+			PerRoom:  TokenBucketConfig{Rate: 0}, // 未启用
+		}
+	})
+	r := httptest.NewRequest(http.MethodPost, "/text", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r = withAuthInfo(r, &authInfo{Method: "token", TokenID: "t1"})
+	want := []limitKey{
+		{key: "message|ip|192.0.2.1", cfg: TokenBucketConfig{Rate: 2, Burst: 2}}, // burst 默认等于 rate
+		{key: "message|token|t1", cfg: TokenBucketConfig{Rate: 5, Burst: 10}},
+	}
+	if got := s.rateLimitKeys(limitMessage, r, "Room"); !reflect.DeepEqual(got, want) {
+		t.Errorf("rateLimitKeys = %+v, want %+v", got, want)
+	}
+	if got := s.rateLimitKeys(limitConnect, r, "Room"); len(got) != 0 {
+		t.Errorf("unconfigured kind keys = %+v", got)
+	}
+}
+
+func TestRateLimitResponse(t *testing.T) {
+	_, ts := newTestServer(t, func(cfg *Config) {
+		cfg.RateLimit.Message.PerIP = TokenBucketConfig{Rate: 0.1, Burst: 2}
+	})
+	for i := 0; i < 2; i++ {
+		if resp, data := doRequest(t, http.MethodPost, ts.URL+"/text", strings.NewReader("hi")); resp.StatusCode != http.StatusOK {
+			t.Fatalf("message %d: %s %s", i, resp.Status, data)
+		}
+	}
+	resp, _ := doRequest(t, http.MethodPost, ts.URL+"/text", strings.NewReader("hi"))
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "10" {
+		t.Errorf("limited message: %s, Retry-After %q", resp.Status, resp.Header.Get("Retry-After"))
+	}
+}
@@ -0,0 +1,265 @@
+package lib
+
+/**
+*** FILE: rooms.go
+***   handle password-protected private rooms
+**/
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// roomKeyIterations 房间密钥哈希的迭代次数 (PBKDF2-HMAC-SHA256)
+const roomKeyIterations = 10000
+
+// PrivateRoom 私有房间信息，只保存密钥的加盐哈希
+type PrivateRoom struct {
+	Name      string `json:"name"`
+	Salt      string `json:"salt"`
+	Hash      string `json:"hash"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// pbkdf2SHA256 计算单块 PBKDF2-HMAC-SHA256 (输出 32 字节)
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	var blockIndex [4]byte
+	binary.BigEndian.PutUint32(blockIndex[:], 1)
+	prf.Write(blockIndex[:])
+	u := prf.Sum(nil)
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func hashRoomKey(key string, salt []byte) string {
+	return base64.StdEncoding.EncodeToString(pbkdf2SHA256([]byte(key), salt, roomKeyIterations))
+}
+
+// verify 校验房间密钥
+func (p PrivateRoom) verify(key string) bool {
+	if key == "" {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(p.Salt)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashRoomKey(key, salt)), []byte(p.Hash)) == 1
+}
+
+// roomKeyFromRequest 从请求中获取房间密钥：先检查 X-Room-Key 头，再检查 room_key 查询参数
+// (浏览器的 WebSocket 无法设置自定义头，因此 /push 需要使用查询参数)
+func roomKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-Room-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("room_key")
+}
+
+func (s *ClipboardServer) loadPrivateRooms() error {
+	if !pathExists(s.roomsFilePath) {
+		return nil
+	}
+	data, err := os.ReadFile(s.roomsFilePath)
+	if err != nil {
+		return fmt.Errorf("无法读取私有房间文件 %s: %w", s.roomsFilePath, err)
+	}
+	var rooms []PrivateRoom
+	if err := json.Unmarshal(data, &rooms); err != nil {
+		return fmt.Errorf("无法解析私有房间文件 %s: %w", s.roomsFilePath, err)
+	}
+
+	s.privateRoomsMutex.Lock()
+	for _, room := range rooms {
+		s.privateRooms[normalizeRoomName(room.Name)] = room
+	}
+	s.privateRoomsMutex.Unlock()
+
+	s.logf(logServer, slog.LevelInfo, "已加载 %d 个私有房间", len(rooms))
+	return nil
+}
+
+// savePrivateRoomsLocked 将私有房间写入磁盘，必须在 privateRoomsMutex 锁定时调用
+func (s *ClipboardServer) savePrivateRoomsLocked() error {
+	rooms := make([]PrivateRoom, 0, len(s.privateRooms))
+	for _, room := range s.privateRooms {
+		rooms = append(rooms, room)
+	}
+	data, err := json.MarshalIndent(rooms, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.roomsFilePath, data, 0600)
+}
+
+// isPrivateRoom 判断房间是否为私有房间
+func (s *ClipboardServer) isPrivateRoom(room string) bool {
+	s.privateRoomsMutex.RLock()
+	defer s.privateRoomsMutex.RUnlock()
+	_, ok := s.privateRooms[normalizeRoomName(room)]
+	return ok
+}
+
+// roomKeyValid 判断给定密钥是否可以访问房间，公共房间总是返回 true
+func (s *ClipboardServer) roomKeyValid(room string, key string) bool {
+	s.privateRoomsMutex.RLock()
+	privateRoom, ok := s.privateRooms[normalizeRoomName(room)]
+	s.privateRoomsMutex.RUnlock()
+	if !ok {
+		return true
+	}
+	return privateRoom.verify(key)
+}
+
+// roomKeyKnown 判断密钥是否属于任一私有房间
+func (s *ClipboardServer) roomKeyKnown(key string) bool {
+	s.privateRoomsMutex.RLock()
+	defer s.privateRoomsMutex.RUnlock()
+	for _, room := range s.privateRooms {
+		if room.verify(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessRoom 判断请求是否有权访问指定房间 (房间的 IP 访问策略、私有房间密钥及 API 令牌的房间限制)
+func (s *ClipboardServer) canAccessRoom(r *http.Request, room string) bool {
+	if !s.ipPermitsRoom(r, room) {
+		return false
+	}
+	// 分享链接的签名已绑定到单个文件或消息
+	if info := authFromRequest(r); info != nil && info.Method == "share" {
+		return true
+	}
+	if info := authFromRequest(r); info != nil && info.Room != "" && info.Room != normalizeRoomName(room) {
+		return false
+	}
+	return s.roomKeyValid(room, roomKeyFromRequest(r))
+}
+
+// checkRoomAccess 检查房间访问权限，无权访问时写入 403 响应并返回 false
+func (s *ClipboardServer) checkRoomAccess(w http.ResponseWriter, r *http.Request, room string) bool {
+	// 房间密钥与密码一样受认证防护：锁定期间不再校验密钥，错误的密钥计入失败次数
+	keyAttempt := roomKeyFromRequest(r) != "" && s.isPrivateRoom(room)
+	if keyAttempt && !s.checkAuthGuard(w, r) {
+		return false
+	}
+	if s.canAccessRoom(r, room) {
+		return true
+	}
+	if !s.ipPermitsRoom(r, room) {
+		s.logf(logHTTP, slog.LevelInfo, "访问被拒绝: IP %s 不在房间 '%s' 允许的网络范围内, 路径: %s", get_remote_ip(r), room, r.URL.Path)
+		writeJSONError(w, http.StatusForbidden, "Forbidden", "该地址不允许访问")
+		return false
+	}
+	if info := authFromRequest(r); info != nil && info.Room != "" && info.Room != normalizeRoomName(room) {
+		s.logf(logAuth, slog.LevelInfo, "房间访问被拒绝: API 令牌 %s 仅限房间 '%s'，请求房间 '%s'。来自 IP: %s", info.Name, info.Room, room, get_remote_ip(r))
+		writeJSONError(w, http.StatusForbidden, "Forbidden", "令牌无权访问该房间")
+		return false
+	}
+	s.logf(logAuth, slog.LevelInfo, "房间访问被拒绝: 房间 '%s' 需要有效的房间密钥。来自 IP: %s, 路径: %s", room, get_remote_ip(r), r.URL.Path)
+	if keyAttempt {
+		s.authFailed(r)
+	}
+	writeJSONError(w, http.StatusForbidden, "Forbidden", "需要有效的房间密钥")
+	return false
+}
+
+// handleCreateRoom 创建私有房间 (POST /rooms)
+func (s *ClipboardServer) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+		Key  string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "无效的请求体", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || normalizeRoomName(name) == "default" {
+		http.Error(w, "默认房间不能设置为私有房间", http.StatusBadRequest)
+		return
+	}
+	if len(req.Key) < 4 {
+		http.Error(w, "房间密钥至少需要 4 个字符", http.StatusBadRequest)
+		return
+	}
+
+	salt := random_bytes(16)
+	privateRoom := PrivateRoom{
+		Name:      name,
+		Salt:      base64.StdEncoding.EncodeToString(salt),
+		Hash:      hashRoomKey(req.Key, salt),
+		CreatedAt: time.Now().Unix(),
+	}
+
+	s.privateRoomsMutex.Lock()
+	if _, exists := s.privateRooms[name]; exists {
+		s.privateRoomsMutex.Unlock()
+		http.Error(w, "私有房间已存在", http.StatusConflict)
+		return
+	}
+	s.privateRooms[name] = privateRoom
+	err := s.savePrivateRoomsLocked()
+	s.privateRoomsMutex.Unlock()
+	if err != nil {
+		s.logf(logServer, slog.LevelError, "错误: 保存私有房间文件失败: %v", err)
+	}
+
+	s.logf(logServer, slog.LevelInfo, "已创建私有房间: %s, 来自: %s", name, get_remote_ip(r))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":    name,
+		"private": true,
+	})
+}
+
+// handleDeleteRoom 取消房间的私有状态 (DELETE /rooms?room=xxx)，需要提供房间密钥
+func (s *ClipboardServer) handleDeleteRoom(w http.ResponseWriter, r *http.Request) {
+	room := normalizeRoomName(r.URL.Query().Get("room"))
+	if !s.isPrivateRoom(room) {
+		http.Error(w, "私有房间不存在", http.StatusNotFound)
+		return
+	}
+	if !s.checkRoomAccess(w, r, room) {
+		return
+	}
+
+	s.privateRoomsMutex.Lock()
+	delete(s.privateRooms, room)
+	err := s.savePrivateRoomsLocked()
+	s.privateRoomsMutex.Unlock()
+	if err != nil {
+		s.logf(logServer, slog.LevelError, "错误: 保存私有房间文件失败: %v", err)
+	}
+
+	s.logf(logServer, slog.LevelInfo, "已删除私有房间: %s, 来自: %s", room, get_remote_ip(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":    room,
+		"private": false,
+	})
+}
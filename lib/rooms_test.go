@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// RFC 7914 第 11 节的测试向量 (取前 32 字节)
+	got := hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1))
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"
+	if got != want {
+		t.Errorf("pbkdf2SHA256 = %s, want %s", got, want)
+	}
+}
+
+func TestPrivateRoomVerify(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	room := PrivateRoom{Name: "secret", Salt: "MDEyMzQ1Njc4OWFiY2RlZg==", Hash: hashRoomKey("right-key", salt)}
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"right-key", true},
+		{"wrong-key", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := room.verify(tt.key); got != tt.want {
+			t.Errorf("verify(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+// 不带 room 的 /revoke/all 只清空默认房间，私有房间的消息和文件不受影响
+func TestClearAllOnlyClearsRequestedRoom(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	resp, data := doRequest(t, http.MethodPost, ts.URL+"/rooms", strings.NewReader(`{"name":"secret","key":"room-key"}`))
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create room: %s %s", resp.Status, data)
+	}
+	secretID := uploadFile(t, ts, "?room=secret", "secret.txt", []byte("secret"), "X-Room-Key", "room-key")
+	defaultID := uploadFile(t, ts, "", "public.txt", []byte("public"))
+	secretFile, defaultFile := messageFile(s, secretID), messageFile(s, defaultID)
+
+	if resp, data := doRequest(t, http.MethodDelete, ts.URL+"/revoke/all", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("clear: %s %s", resp.Status, data)
+	}
+	if messageFile(s, secretID) == "" {
+		t.Error("private room message was cleared")
+	}
+	if _, err := os.Stat(filepath.Join(s.storageFolder, secretFile)); err != nil {
+		t.Errorf("private room file was deleted: %v", err)
+	}
+	if messageFile(s, defaultID) != "" {
+		t.Error("default room message was not cleared")
+	}
+	if _, err := os.Stat(filepath.Join(s.storageFolder, defaultFile)); !os.IsNotExist(err) {
+		t.Errorf("default room file still exists: %v", err)
+	}
+
+	// 私有房间需要房间密钥才能清空
+	if resp, _ := doRequest(t, http.MethodDelete, ts.URL+"/revoke/all?room=secret", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("clear private room without key: %s", resp.Status)
+	}
+}
+
+// 房间列表只包含调用者有权访问的房间
+func TestRoomListFiltersInaccessibleRooms(t *testing.T) {
+	_, ts := newTestServer(t, func(cfg *Config) {
+		cfg.Server.Auth = "pw"
+		cfg.Server.RoomList = true
+	})
+	for _, room := range []string{"a", "b"} {
+		if resp, data := doRequest(t, http.MethodPost, ts.URL+"/text?room="+room, strings.NewReader("hi"), "Authorization", "Bearer pw"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("post to %s: %s %s", room, resp.Status, data)
+		}
+	}
+	resp, data := doRequest(t, http.MethodPost, ts.URL+"/admin/tokens", strings.NewReader(`{"name":"ci","scopes":["read"],"room":"a"}`), "Authorization", "Bearer pw")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create token: %s %s", resp.Status, data)
+	}
+	var created struct{ Token string }
+	json.Unmarshal(data, &created)
+
+	listRooms := func(headers ...string) (int, []string) {
+		resp, data := doRequest(t, http.MethodGet, ts.URL+"/rooms", nil, headers...)
+		var list RoomListResponse
+		json.Unmarshal(data, &list)
+		var names []string
+		for _, room := range list.Rooms {
+			names = append(names, room.Name)
+		}
+		sort.Strings(names)
+		return resp.StatusCode, names
+	}
+	if status, _ := listRooms(); status != http.StatusUnauthorized {
+		t.Errorf("unauthenticated room list: %d", status)
+	}
+	if status, names := listRooms("Authorization", "Bearer pw"); status != http.StatusOK || strings.Join(names, ",") != "a,b" {
+		t.Errorf("password room list: %d %v", status, names)
+	}
+	if status, names := listRooms("Authorization", "Bearer "+created.Token); status != http.StatusOK || strings.Join(names, ",") != "a" {
+		t.Errorf("room token list: %d %v", status, names)
+	}
+}
@@ -0,0 +1,97 @@
+package lib
+
+/**
+*** FILE: rotate.go
+***   handle append-only log files with size-based rotation
+**/
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingWriter 追加写入的日志文件，超过 maxSize 时轮转为 path.1 ... path.N
+type rotatingWriter struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64 // 0 表示不轮转
+	maxFiles int   // 保留的历史文件数量
+	file     *os.File
+	size     int64
+}
+
+func newRotatingWriter(path string, maxSize int64, maxFiles int) (*rotatingWriter, error) {
+	w := &rotatingWriter{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = stat.Size()
+	return nil
+}
+
+// rotatedPath 返回第 n 个历史文件的路径，n 为 0 时返回当前文件
+func (w *rotatingWriter) rotatedPath(n int) string {
+	if n == 0 {
+		return w.path
+	}
+	return fmt.Sprintf("%s.%d", w.path, n)
+}
+
+// rotateLocked 关闭当前文件并依次重命名历史文件，必须在 mu 锁定时调用
+func (w *rotatingWriter) rotateLocked() error {
+	w.file.Close()
+	if w.maxFiles > 0 {
+		os.Remove(w.rotatedPath(w.maxFiles))
+		for i := w.maxFiles - 1; i >= 0; i-- {
+			os.Rename(w.rotatedPath(i), w.rotatedPath(i+1))
+		}
+	} else {
+		os.Remove(w.path)
+	}
+	return w.open()
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// files 返回当前文件及仍存在的历史文件，按从新到旧排列
+func (w *rotatingWriter) files() []string {
+	paths := []string{w.path}
+	for i := 1; i <= w.maxFiles; i++ {
+		if pathExists(w.rotatedPath(i)) {
+			paths = append(paths, w.rotatedPath(i))
+		}
+	}
+	return paths
+}
+
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
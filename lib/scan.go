@@ -0,0 +1,227 @@
+package lib
+
+/**
+*** FILE: scan.go
+***   handle malware scanning of uploaded files through the clamd INSTREAM protocol
+**/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 扫描状态，保存在 FileReceive.ScanStatus 中
+const (
+	scanClean   = "clean"   // 扫描通过
+	scanSkipped = "skipped" // 文件超过 maxSize，failOpen 时未经扫描发布
+	scanError   = "error"   // 扫描器不可用，failOpen 时仍然发布
+)
+
+// scanResult clamd 的扫描结果
+type scanResult struct {
+	Infected  bool
+	Signature string // 命中的病毒特征名称
+}
+
+// clamdNetwork 根据地址判断连接方式：以 / 开头或以 unix: 开头为 Unix 套接字，否则为 TCP
+func clamdNetwork(address string) (network, addr string) {
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		return "unix", strings.TrimPrefix(address, "unix:")
+	case strings.HasPrefix(address, "/"):
+		return "unix", address
+	}
+	return "tcp", strings.TrimPrefix(address, "tcp:")
+}
+
+// clamdScan 通过 INSTREAM 命令将数据流发送给 clamd 并解析结果
+func clamdScan(cfg ScanConfig, data io.Reader) (*scanResult, error) {
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	network, addr := clamdNetwork(cfg.Address)
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("无法连接 clamd: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	writer := bufio.NewWriter(conn)
+	if _, err := writer.WriteString("zINSTREAM\x00"); err != nil {
+		return nil, err
+	}
+	chunkSize := cfg.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 64 * 1024
+	}
+	buf := make([]byte, chunkSize)
+	var header [4]byte
+	for {
+		n, readErr := data.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(header[:], uint32(n))
+			if _, err := writer.Write(header[:]); err != nil {
+				return nil, err
+			}
+			if _, err := writer.Write(buf[:n]); err != nil {
+				return nil, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+	// 长度为 0 的块表示数据结束
+	binary.BigEndian.PutUint32(header[:], 0)
+	if _, err := writer.Write(header[:]); err != nil {
+		return nil, err
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return nil, fmt.Errorf("读取 clamd 响应失败: %w", err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply 解析 "stream: OK"、"stream: <签名> FOUND" 或 "... ERROR" 格式的响应
+func parseClamdReply(reply string) (*scanResult, error) {
+	result := strings.TrimSpace(reply)
+	if idx := strings.Index(result, ": "); idx >= 0 {
+		result = result[idx+2:]
+	}
+	switch {
+	case result == "OK":
+		return &scanResult{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return &scanResult{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	}
+	return nil, fmt.Errorf("clamd 返回错误: %s", reply)
+}
+
+// quarantineRecord 隔离文件旁边保存的说明
+type quarantineRecord struct {
+	Name      string `json:"name"`
+	UUID      string `json:"uuid"`
+	Size      int64  `json:"size"`
+	Room      string `json:"room"`
+	Signature string `json:"signature"`
+	IP        string `json:"ip"`
+	Time      int64  `json:"time"`
+}
+
+// quarantineFile 将感染的文件移动到存储目录的 quarantine/ 下，并从文件映射中移除
+func (s *ClipboardServer) quarantineFile(r *http.Request, fileInfo File, signature string) error {
+	dir := s.storagePath("quarantine")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	s.runMutex.Lock()
+	delete(s.uploadFileMap, fileInfo.UUID)
+	s.runMutex.Unlock()
+
+	dst := filepath.Join(dir, fileInfo.UUID)
+	if err := os.Rename(filepath.Join(s.storageFolder, fileInfo.UUID), dst); err != nil {
+		return err
+	}
+	os.Chmod(dst, 0600)
+	record, _ := json.MarshalIndent(quarantineRecord{
+		Name:      fileInfo.Name,
+		UUID:      fileInfo.UUID,
+		Size:      fileInfo.Size,
+		Room:      fileInfo.Room,
+		Signature: signature,
+		IP:        get_remote_ip(r),
+		Time:      time.Now().Unix(),
+	}, "", "  ")
+	return os.WriteFile(dst+".json", record, 0600)
+}
+
+// scanUploadedFile 扫描已保存的上传文件，返回扫描状态
+// 文件被感染时隔离文件、广播 error 事件并写入错误响应，此时 ok 为 false
+func (s *ClipboardServer) scanUploadedFile(w http.ResponseWriter, r *http.Request, fileInfo File) (status string, ok bool) {
+	cfg := s.config.Scan
+	if !cfg.Enabled {
+		return "", true
+	}
+	// 超过扫描大小限制的文件无法扫描，与扫描器不可用同样处理：默认拒绝，failOpen 时不经扫描发布
+	if cfg.MaxSize > 0 && fileInfo.Size > cfg.MaxSize {
+		if cfg.FailOpen {
+			s.logf(logFile, slog.LevelWarn, "警告: 文件 %s (UUID: %s) 超过扫描大小限制，未经扫描发布", fileInfo.Name, fileInfo.UUID)
+			return scanSkipped, true
+		}
+		s.logf(logFile, slog.LevelInfo, "文件 %s (UUID: %s) 超过扫描大小限制 %d 字节，已拒绝", fileInfo.Name, fileInfo.UUID, cfg.MaxSize)
+		s.deleteUploadedFile(fileInfo.UUID)
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "ScanTooLarge", "文件超过安全扫描的大小限制")
+		return "", false
+	}
+
+	file, err := os.Open(filepath.Join(s.storageFolder, fileInfo.UUID))
+	if err != nil {
+		s.logf(logFile, slog.LevelError, "错误: 打开待扫描文件失败: %v", err)
+		http.Error(w, "无法读取文件", http.StatusInternalServerError)
+		return "", false
+	}
+	result, err := clamdScan(cfg, file)
+	file.Close()
+	if err != nil {
+		s.logf(logFile, slog.LevelWarn, "警告: 扫描文件 %s (UUID: %s) 失败: %v", fileInfo.Name, fileInfo.UUID, err)
+		if cfg.FailOpen {
+			return scanError, true
+		}
+		s.deleteUploadedFile(fileInfo.UUID)
+		writeJSONError(w, http.StatusServiceUnavailable, "ScanUnavailable", "文件扫描服务不可用，请稍后重试")
+		return "", false
+	}
+	if !result.Infected {
+		return scanClean, true
+	}
+
+	s.logf(logFile, slog.LevelWarn, "警告: 文件 %s (UUID: %s) 被检测为 %s，已隔离。来自 IP: %s",
+		fileInfo.Name, fileInfo.UUID, result.Signature, get_remote_ip(r))
+	if err := s.quarantineFile(r, fileInfo, result.Signature); err != nil {
+		s.logf(logFile, slog.LevelError, "错误: 隔离文件 %s 失败: %v", fileInfo.UUID, err)
+		s.deleteUploadedFile(fileInfo.UUID)
+	}
+	s.audit(r, auditQuarantine, fileInfo.Room, 0, fileInfo.UUID, result.Signature)
+	s.broadcastWebSocketMessage(WebSocketMessage{
+		Event: "error",
+		Data: map[string]string{
+			"code":      "infected",
+			"name":      fileInfo.Name,
+			"uuid":      fileInfo.UUID,
+			"signature": result.Signature,
+			"message":   fmt.Sprintf("文件 %s 未通过安全扫描，已被拒绝", fileInfo.Name),
+		},
+	}, fileInfo.Room)
+	writeJSONError(w, http.StatusUnprocessableEntity, "Infected", fmt.Sprintf("文件未通过安全扫描: %s", result.Signature))
+	return "", false
+}
+
+// deleteUploadedFile 删除上传的文件并从文件映射中移除
+func (s *ClipboardServer) deleteUploadedFile(uuid string) {
+	s.runMutex.Lock()
+	delete(s.uploadFileMap, uuid)
+	s.runMutex.Unlock()
+	if err := os.Remove(filepath.Join(s.storageFolder, uuid)); err != nil && !os.IsNotExist(err) {
+		s.logf(logFile, slog.LevelWarn, "警告: 删除文件 %s 失败: %v", uuid, err)
+	}
+}
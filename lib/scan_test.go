@@ -0,0 +1,234 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply     string
+		infected  bool
+		signature string
+		wantErr   bool
+	}{
+		{"stream: OK", false, "", false},
+		{"stream: Eicar-Test-Signature FOUND", true, "Eicar-Test-Signature", false},
+		{"stream: INSTREAM size limit exceeded. ERROR", false, "", true},
+		{"", false, "", true},
+	}
+	for _, tt := range tests {
+		result, err := parseClamdReply(tt.reply)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseClamdReply(%q) error = %v", tt.reply, err)
+			continue
+		}
+		if err == nil && (result.Infected != tt.infected || result.Signature != tt.signature) {
+			t.Errorf("parseClamdReply(%q) = %+v", tt.reply, result)
+		}
+	}
+}
+
+func TestClamdNetwork(t *testing.T) {
+	tests := []struct{ address, network, addr string }{
+		{"127.0.0.1:3310", "tcp", "127.0.0.1:3310"},
+		{"tcp:clamd:3310", "tcp", "clamd:3310"},
+		{"/run/clamav/clamd.ctl", "unix", "/run/clamav/clamd.ctl"},
+		{"unix:/tmp/clamd.sock", "unix", "/tmp/clamd.sock"},
+	}
+	for _, tt := range tests {
+		if network, addr := clamdNetwork(tt.address); network != tt.network || addr != tt.addr {
+			t.Errorf("clamdNetwork(%q) = %s %s", tt.address, network, addr)
+		}
+	}
+}
+
+// fakeClamd 按 INSTREAM 协议接收数据流，并对每个连接返回 reply
+func fakeClamd(t *testing.T, reply string) (address string, received chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received = make(chan []byte, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				if cmd, err := reader.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					t.Errorf("clamd command = %q, %v", cmd, err)
+					return
+				}
+				var data []byte
+				for {
+					var size uint32
+					if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+						t.Error(err)
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(reader, chunk); err != nil {
+						t.Error(err)
+						return
+					}
+					data = append(data, chunk...)
+				}
+				received <- data
+				conn.Write([]byte(reply + "\x00"))
+			}(conn)
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+// unavailableAddress 返回没有程序监听的地址
+func unavailableAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+	return address
+}
+
+// messageScanStatus 返回文件消息的扫描状态
+func messageScanStatus(s *ClipboardServer, id string) string {
+	s.messageQueue.Lock()
+	defer s.messageQueue.Unlock()
+	for _, msg := range s.messageQueue.List {
+		if strconv.Itoa(msg.Data.ID()) == id && msg.Data.FileReceive != nil {
+			return msg.Data.FileReceive.ScanStatus
+		}
+	}
+	return ""
+}
+
+func TestScanClean(t *testing.T) {
+	address, received := fakeClamd(t, "stream: OK")
+	s, ts := newTestServer(t, func(cfg *Config) {
+		cfg.Scan.Enabled = true
+		cfg.Scan.Address = address
+		cfg.Scan.ChunkSize = 4
+	})
+	content := []byte("harmless content")
+	id := uploadFile(t, ts, "", "a.txt", content)
+	if data := <-received; string(data) != string(content) {
+		t.Errorf("clamd received %q", data)
+	}
+	if status := messageScanStatus(s, id); status != scanClean {
+		t.Errorf("scanStatus = %q", status)
+	}
+}
+
+func TestScanInfected(t *testing.T) {
+	address, _ := fakeClamd(t, "stream: Eicar-Test-Signature FOUND")
+	s, ts := newTestServer(t, func(cfg *Config) {
+		cfg.Scan.Enabled = true
+		cfg.Scan.Address = address
+	})
+	conn := dialPush(t, ts, "")
+
+	resp, data := postFile(t, ts, "", "eicar.com", []byte("X5O!P%@AP"))
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("upload: %s %s", resp.Status, data)
+	}
+	for {
+		var msg struct {
+			Event string          `json:"event"`
+			Data  json.RawMessage `json:"data"`
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Event != "error" {
+			continue
+		}
+		var event map[string]string
+		json.Unmarshal(msg.Data, &event)
+		if event["code"] != "infected" || event["signature"] != "Eicar-Test-Signature" {
+			t.Errorf("error event = %s", msg.Data)
+		}
+		uuid := event["uuid"]
+		if _, err := os.Stat(filepath.Join(s.storagePath("quarantine"), uuid)); err != nil {
+			t.Errorf("quarantined file: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(s.storageFolder, uuid)); !os.IsNotExist(err) {
+			t.Errorf("infected file still in storage: %v", err)
+		}
+		break
+	}
+	s.messageQueue.Lock()
+	n := len(s.messageQueue.List)
+	s.messageQueue.Unlock()
+	if n != 0 {
+		t.Errorf("%d messages published", n)
+	}
+}
+
+func TestScanUnavailableOrTooLarge(t *testing.T) {
+	cleanAddress, _ := fakeClamd(t, "stream: OK")
+	tests := []struct {
+		name       string
+		address    string
+		maxSize    int64
+		failOpen   bool
+		wantStatus int
+		wantScan   string
+	}{
+		{"unavailable", unavailableAddress(t), 0, false, http.StatusServiceUnavailable, ""},
+		{"unavailable fail open", unavailableAddress(t), 0, true, http.StatusOK, scanError},
+		{"too large", cleanAddress, 4, false, http.StatusRequestEntityTooLarge, ""},
+		{"too large fail open", cleanAddress, 4, true, http.StatusOK, scanSkipped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t, func(cfg *Config) {
+				cfg.Scan.Enabled = true
+				cfg.Scan.Address = tt.address
+				cfg.Scan.Timeout = 5
+				cfg.Scan.MaxSize = tt.maxSize
+				cfg.Scan.FailOpen = tt.failOpen
+			})
+			resp, data := postFile(t, ts, "", "a.txt", []byte("some content"))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("upload: %s %s", resp.Status, data)
+			}
+			if tt.wantStatus != http.StatusOK {
+				s.runMutex.Lock()
+				n := len(s.uploadFileMap)
+				s.runMutex.Unlock()
+				if n != 0 {
+					t.Errorf("rejected file left in file map")
+				}
+				return
+			}
+			var result struct {
+				ID string `json:"id"`
+			}
+			json.Unmarshal(data, &result)
+			if status := messageScanStatus(s, result.ID); status != tt.wantScan {
+				t.Errorf("scanStatus = %q, want %q", status, tt.wantScan)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package lib
+
+/**
+*** FILE: session.go
+***   handle login sessions: signed expiring session tokens, cookies and CSRF protection
+**/
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// sessionTokenPrefix 会话令牌的固定前缀，格式为 ccs_<id>.<过期时间>.<签名>
+	sessionTokenPrefix = "ccs_"
+	sessionCookieName  = "cc_session"
+	csrfHeaderName     = "X-CSRF-Token"
+)
+
+// Session 登录会话，以会话 ID 的 SHA-256 哈希为键保存
+type Session struct {
+	CSRF      string   `json:"csrf"`
+	Method    string   `json:"method"` // 登录方式: "password"、"token" 或 "oidc"
+	TokenID   string   `json:"tokenId,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	User      string   `json:"user,omitempty"` // 单点登录用户 (邮箱或 subject)
+	Scopes    []string `json:"scopes"`
+	Room      string   `json:"room,omitempty"`
+	IP        string   `json:"ip"`
+	UserAgent string   `json:"userAgent"`
+	CreatedAt int64    `json:"createdAt"`
+	ExpiresAt int64    `json:"expiresAt"`
+
+	hash string
+}
+
+func (sess *Session) authInfo() *authInfo {
+	return &authInfo{
+		Method:    "session",
+		TokenID:   sess.TokenID,
+		Name:      sess.Name,
+		Scopes:    sess.Scopes,
+		Room:      sess.Room,
+		SessionID: sess.hash,
+		User:      sess.User,
+	}
+}
+
+func (s *ClipboardServer) loadSessions() {
+	data, err := os.ReadFile(s.storagePath("sessions.json"))
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &s.sessions); err != nil {
+		s.logf(logAuth, slog.LevelWarn, "警告: 无法解析会话文件: %v", err)
+		return
+	}
+	for hash, sess := range s.sessions {
+		sess.hash = hash
+	}
+}
+
+// saveSessionsLocked 保存会话并清理已过期的会话，必须在 sessionsMutex 锁定时调用
+func (s *ClipboardServer) saveSessionsLocked() {
+	now := time.Now().Unix()
+	for hash, sess := range s.sessions {
+		if sess.ExpiresAt < now {
+			delete(s.sessions, hash)
+		}
+	}
+	data, err := json.Marshal(s.sessions)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(s.storagePath("sessions.json"), data, 0600); err != nil {
+		s.logf(logAuth, slog.LevelInfo, "写入会话文件时出错: %v", err)
+	}
+}
+
+// parseSessionToken 校验会话令牌的签名与有效期，返回会话 ID；签名不匹配时 forged 为 true
+func (s *ClipboardServer) parseSessionToken(token string) (id string, forged bool) {
+	parts := strings.Split(strings.TrimPrefix(token, sessionTokenPrefix), ".")
+	if len(parts) != 3 {
+		return "", true
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", true
+	}
+	expected := s.signShare("session", parts[0], expires, 0, "")
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return "", true
+	}
+	if expires < time.Now().Unix() {
+		return "", false
+	}
+	return parts[0], false
+}
+
+// lookupSession 查找有效的会话；由 API 令牌登录的会话在令牌被撤销或过期后一并失效
+func (s *ClipboardServer) lookupSession(token string) (sess *Session, forged bool) {
+	id, forged := s.parseSessionToken(token)
+	if id == "" {
+		return nil, forged
+	}
+	hash := hashAPIToken(id)
+
+	s.sessionsMutex.Lock()
+	sess, ok := s.sessions[hash]
+	s.sessionsMutex.Unlock()
+	if !ok || sess.ExpiresAt < time.Now().Unix() {
+		return nil, false
+	}
+	if sess.TokenID != "" && !s.apiTokenActive(sess.TokenID) {
+		return nil, false
+	}
+	return sess, false
+}
+
+// apiTokenActive 判断指定 ID 的 API 令牌是否仍然存在且未过期
+func (s *ClipboardServer) apiTokenActive(id string) bool {
+	now := time.Now().Unix()
+	s.apiTokensMutex.Lock()
+	defer s.apiTokensMutex.Unlock()
+	for _, token := range s.apiTokens {
+		if token.ID == id {
+			return !token.expired(now)
+		}
+	}
+	return false
+}
+
+// createSession 为已认证的身份创建会话，返回会话令牌
+func (s *ClipboardServer) createSession(r *http.Request, info *authInfo) (string, *Session) {
+	now := time.Now()
+	sess := &Session{
+		CSRF:      gen_UUID(),
+		Method:    info.Method,
+		TokenID:   info.TokenID,
+		Name:      info.Name,
+		User:      info.User,
+		Scopes:    info.Scopes,
+		Room:      info.Room,
+		IP:        get_remote_ip(r),
+		UserAgent: r.Header.Get("User-Agent"),
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Unix() + int64(s.config.Session.TTL),
+	}
+	if info.Method == "password" {
+		sess.Scopes = []string{scopeAdmin}
+	}
+
+	id := strings.ReplaceAll(gen_UUID(), "-", "") + strings.ReplaceAll(gen_UUID(), "-", "")
+	sess.hash = hashAPIToken(id)
+	token := sessionTokenPrefix + id + "." + strconv.FormatInt(sess.ExpiresAt, 10) + "." +
+		s.signShare("session", id, sess.ExpiresAt, 0, "")
+
+	s.sessionsMutex.Lock()
+	s.sessions[sess.hash] = sess
+	s.saveSessionsLocked()
+	s.sessionsMutex.Unlock()
+	return token, sess
+}
+
+// csrfValid 校验 Cookie 认证的修改类请求携带的 CSRF 令牌
+func csrfValid(r *http.Request, sess *Session) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	token := r.Header.Get(csrfHeaderName)
+	return sess != nil && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(sess.CSRF)) == 1
+}
+
+// checkCSRF 对来自会话 Cookie 的修改类请求进行 CSRF 校验，失败时写入 403 响应并返回 false
+func (s *ClipboardServer) checkCSRF(w http.ResponseWriter, r *http.Request, token string) bool {
+	sess, _ := s.lookupSession(token)
+	if csrfValid(r, sess) {
+		return true
+	}
+	s.logf(logAuth, slog.LevelInfo, "CSRF 校验失败: 来自 IP: %s, 方法: %s, 路径: %s", get_remote_ip(r), r.Method, r.URL.Path)
+	writeJSONError(w, http.StatusForbidden, "Forbidden", "CSRF 校验失败")
+	return false
+}
+
+func (s *ClipboardServer) setSessionCookie(w http.ResponseWriter, r *http.Request, value string, expires int64) {
+	path := s.config.Server.Prefix + "/"
+	cookie := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     path,
+		HttpOnly: true,
+		Secure:   getScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Expires = time.Unix(expires, 0)
+	}
+	http.SetCookie(w, cookie)
+}
+
+// handleLogin 使用密码或 API 令牌换取会话 (POST /login)
+// 请求体为 {"password": "..."} 或 {"token": "..."}，也可以使用 Authorization 头
+func (s *ClipboardServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅允许 POST 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, authNeeded := s.authPassword(); !authNeeded {
+		writeJSONError(w, http.StatusBadRequest, "BadRequest", "服务器未启用认证")
+		return
+	}
+	if !s.checkAuthGuard(w, r) {
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+		Token    string `json:"token"`
+	}
+	if r.Body != nil {
+		json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req)
+	}
+	credential := req.Password
+	if credential == "" {
+		credential = req.Token
+	}
+	if credential == "" {
+		credential = tokenFromRequest(r)
+	}
+	if strings.HasPrefix(credential, sessionTokenPrefix) {
+		writeJSONError(w, http.StatusBadRequest, "BadRequest", "不能使用会话令牌登录")
+		return
+	}
+
+	info, status, message := s.verifyCredential(r, credential, scopeRead)
+	if status != 0 {
+		writeCredentialError(w, status, message)
+		return
+	}
+
+	token, sess := s.createSession(r, info)
+	s.setSessionCookie(w, r, token, sess.ExpiresAt)
+	s.logf(logAuth, slog.LevelInfo, "已创建会话 %s, 有效期至 %d, 来自 IP: %s", sess.hash[:8], sess.ExpiresAt, sess.IP)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":     token,
+		"csrfToken": sess.CSRF,
+		"expiresAt": sess.ExpiresAt,
+		"scopes":    sess.Scopes,
+		"room":      sess.Room,
+	})
+}
+
+// handleLogout 注销当前会话 (POST /logout)，会话令牌可以来自 Cookie 或 Authorization 头
+func (s *ClipboardServer) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅允许 POST 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	token, viaCookie := credentialFromRequest(r)
+	if !strings.HasPrefix(token, sessionTokenPrefix) {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized", "未登录")
+		return
+	}
+	sess, _ := s.lookupSession(token)
+	if viaCookie && !s.checkCSRF(w, r, token) {
+		return
+	}
+
+	if sess != nil {
+		s.sessionsMutex.Lock()
+		delete(s.sessions, sess.hash)
+		s.saveSessionsLocked()
+		s.sessionsMutex.Unlock()
+		s.logf(logAuth, slog.LevelInfo, "已注销会话 %s, 来自 IP: %s", sess.hash[:8], get_remote_ip(r))
+	}
+	s.setSessionCookie(w, r, "", 0)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "已注销"})
+}
+
+// firstFrameTimeout 等待 WebSocket 第一帧认证消息的时间
+const firstFrameTimeout = 10 * time.Second
+
+// readFirstFrameToken 读取 WebSocket 的第一帧认证消息 {"type": "auth", "token": "..."}，失败时返回空字符串
+func readFirstFrameToken(conn *websocket.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(firstFrameTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	_, p, err := conn.ReadMessage()
+	if err != nil {
+		return ""
+	}
+	var frame struct {
+		Type  string `json:"type"`
+		Token string `json:"token"`
+	}
+	if json.Unmarshal(p, &frame) != nil || frame.Type != "auth" {
+		return ""
+	}
+	return frame.Token
+}
+
+// closeWebSocket 发送关闭帧并关闭连接
+func closeWebSocket(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	conn.Close()
+}
+
+// handleSession 返回当前请求的身份 (GET /session)，会话认证时同时返回 CSRF 令牌
+func (s *ClipboardServer) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "仅允许 GET 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	info := authFromRequest(r)
+	response := map[string]interface{}{
+		"method": info.Method,
+		"name":   info.Name,
+		"user":   info.User,
+		"scopes": info.Scopes,
+		"room":   info.Room,
+	}
+	if token, _ := credentialFromRequest(r); info.SessionID != "" {
+		if sess, _ := s.lookupSession(token); sess != nil {
+			response["csrfToken"] = sess.CSRF
+			response["expiresAt"] = sess.ExpiresAt
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
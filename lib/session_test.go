@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSRFValid(t *testing.T) {
+	sess := &Session{CSRF: "csrf-token"}
+	tests := []struct {
+		method string
+		token  string
+		sess   *Session
+		want   bool
+	}{
+		{http.MethodGet, "", sess, true},
+		{http.MethodHead, "", sess, true},
+		{http.MethodOptions, "", nil, true},
+		{http.MethodPost, "csrf-token", sess, true},
+		{http.MethodDelete, "csrf-token", sess, true},
+		{http.MethodPost, "", sess, false},
+		{http.MethodPut, "wrong", sess, false},
+		{http.MethodPatch, "csrf-token-", sess, false},
+		{http.MethodPost, "csrf-token", nil, false},
+		{http.MethodPost, "x", &Session{}, false}, // 会话没有 CSRF 令牌时总是失败
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/", nil)
+		if tt.token != "" {
+			r.Header.Set(csrfHeaderName, tt.token)
+		}
+		if got := csrfValid(r, tt.sess); got != tt.want {
+			t.Errorf("csrfValid(%s, %q) = %v, want %v", tt.method, tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestParseSessionToken(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	token := func(id string, expires int64) string {
+		return sessionTokenPrefix + id + "." + strconv.FormatInt(expires, 10) + "." + s.signShare("session", id, expires, 0, "")
+	}
+	future := time.Now().Unix() + 60
+	valid := token("abc", future)
+	tests := []struct {
+		name       string
+		token      string
+		wantID     string
+		wantForged bool
+	}{
+		{"valid", valid, "abc", false},
+		{"expired", token("abc", time.Now().Unix()-1), "", false},
+		{"other id", strings.Replace(valid, "abc", "abd", 1), "", true},
+		{"extended expiry", sessionTokenPrefix + "abc." + strconv.FormatInt(future+3600, 10) + "." + s.signShare("session", "abc", future, 0, ""), "", true},
+		{"malformed", sessionTokenPrefix + "abc", "", true},
+		{"invalid expiry", sessionTokenPrefix + "abc.soon." + s.signShare("session", "abc", future, 0, ""), "", true},
+	}
+	for _, tt := range tests {
+		if id, forged := s.parseSessionToken(tt.token); id != tt.wantID || forged != tt.wantForged {
+			t.Errorf("%s: parseSessionToken = %q, %v", tt.name, id, forged)
+		}
+	}
+}
+
+// 来自会话 Cookie 的修改类请求必须带上 CSRF 令牌，Authorization 头携带的会话令牌不需要
+func TestSessionCSRF(t *testing.T) {
+	_, ts := newTestServer(t, func(cfg *Config) { cfg.Server.Auth = "pw" })
+	resp, data := doRequest(t, http.MethodPost, ts.URL+"/login", strings.NewReader(`{"password":"pw"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: %s %s", resp.Status, data)
+	}
+	var login struct {
+		Token     string `json:"token"`
+		CSRFToken string `json:"csrfToken"`
+	}
+	json.Unmarshal(data, &login)
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != login.Token || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("session cookie: %+v", cookie)
+	}
+	withCookie := "cc_session=" + login.Token
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers []string
+		want    int
+	}{
+		{"cookie read", http.MethodGet, "/session", []string{"Cookie", withCookie}, http.StatusOK},
+		{"cookie write without token", http.MethodPost, "/text", []string{"Cookie", withCookie}, http.StatusForbidden},
+		{"cookie write with wrong token", http.MethodPost, "/text", []string{"Cookie", withCookie, csrfHeaderName, "wrong"}, http.StatusForbidden},
+		{"cookie write with token", http.MethodPost, "/text", []string{"Cookie", withCookie, csrfHeaderName, login.CSRFToken}, http.StatusOK},
+		{"bearer session write", http.MethodPost, "/text", []string{"Authorization", "Bearer " + login.Token}, http.StatusOK},
+		{"cookie logout without token", http.MethodPost, "/logout", []string{"Cookie", withCookie}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if resp, data := doRequest(t, tt.method, ts.URL+tt.path, strings.NewReader("hi"), tt.headers...); resp.StatusCode != tt.want {
+			t.Errorf("%s: %s %s, want %d", tt.name, resp.Status, data, tt.want)
+		}
+	}
+
+	// GET /session 返回同一个 CSRF 令牌，供页面刷新后使用
+	_, data = doRequest(t, http.MethodGet, ts.URL+"/session", nil, "Cookie", withCookie)
+	var session map[string]interface{}
+	json.Unmarshal(data, &session)
+	if session["method"] != "session" || session["csrfToken"] != login.CSRFToken {
+		t.Errorf("session: %s", data)
+	}
+
+	if resp, data := doRequest(t, http.MethodPost, ts.URL+"/logout", nil, "Cookie", withCookie, csrfHeaderName, login.CSRFToken); resp.StatusCode != http.StatusOK {
+		t.Fatalf("logout: %s %s", resp.Status, data)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/session", nil, "Cookie", withCookie); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("session after logout: %s", resp.Status)
+	}
+}
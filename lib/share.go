@@ -0,0 +1,303 @@
+package lib
+
+/**
+*** FILE: share.go
+***   handle HMAC-signed, expiring share links for /file and /content
+**/
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shareUse 记录限制下载次数的分享链接的使用情况
+type shareUse struct {
+	Count   int   `json:"count"`
+	Expires int64 `json:"expires"`
+}
+
+// initShareSecret 初始化分享链接的签名密钥：优先使用配置，否则从存储目录读取或生成
+func (s *ClipboardServer) initShareSecret() {
+	if s.config.Share.Secret != "" {
+		s.shareSecret = []byte(s.config.Share.Secret)
+		return
+	}
+	keyPath := s.storagePath("share.key")
+	if data, err := os.ReadFile(keyPath); err == nil && len(data) > 0 {
+		if secret, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+			s.shareSecret = secret
+			return
+		}
+	}
+	s.shareSecret = random_bytes(32)
+	if err := os.WriteFile(keyPath, []byte(hex.EncodeToString(s.shareSecret)), 0600); err != nil {
+		s.logf(logAuth, slog.LevelWarn, "警告: 无法保存分享链接密钥 %s: %v，重启后已签发的链接将失效", keyPath, err)
+	}
+}
+
+func (s *ClipboardServer) loadShareUses() {
+	data, err := os.ReadFile(s.storagePath("shares.json"))
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &s.shareUses); err != nil {
+		s.logf(logAuth, slog.LevelWarn, "警告: 无法解析分享链接使用记录: %v", err)
+	}
+}
+
+// saveShareUsesLocked 保存分享链接使用记录并清理已过期的条目，必须在 shareMutex 锁定时调用
+func (s *ClipboardServer) saveShareUsesLocked() {
+	now := time.Now().Unix()
+	for id, use := range s.shareUses {
+		if use.Expires < now {
+			delete(s.shareUses, id)
+		}
+	}
+	data, err := json.Marshal(s.shareUses)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(s.storagePath("shares.json"), data, 0600); err != nil {
+		s.logf(logAuth, slog.LevelInfo, "写入分享链接使用记录时出错: %v", err)
+	}
+}
+
+func (s *ClipboardServer) signShare(kind, target string, expires int64, max int, linkID string) string {
+	mac := hmac.New(sha256.New, s.shareSecret)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%d\n%s", kind, target, expires, max, linkID)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareQuery 生成分享链接的查询参数
+func (s *ClipboardServer) shareQuery(kind, target string, expires int64, max int) url.Values {
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(expires, 10))
+	linkID := ""
+	if max > 0 {
+		linkID = gen_UUID()
+		q.Set("max", strconv.Itoa(max))
+		q.Set("lid", linkID)
+	}
+	q.Set("sig", s.signShare(kind, target, expires, max, linkID))
+	return q
+}
+
+// consumeShareLink 校验分享链接的签名、有效期和下载次数，count 为 true 时计入一次下载
+// 校验通过返回 0，否则返回对应的 HTTP 状态码和错误信息
+func (s *ClipboardServer) consumeShareLink(kind, target string, q url.Values, count bool) (int, string) {
+	expires, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil {
+		return http.StatusForbidden, "无效的分享链接"
+	}
+	max := 0
+	if maxStr := q.Get("max"); maxStr != "" {
+		if max, err = strconv.Atoi(maxStr); err != nil || max <= 0 {
+			return http.StatusForbidden, "无效的分享链接"
+		}
+	}
+	linkID := q.Get("lid")
+	expected := s.signShare(kind, target, expires, max, linkID)
+	if !hmac.Equal([]byte(expected), []byte(q.Get("sig"))) {
+		return http.StatusForbidden, "分享链接签名无效"
+	}
+	if expires < time.Now().Unix() {
+		return http.StatusGone, "分享链接已过期"
+	}
+	if max == 0 || !count {
+		return 0, ""
+	}
+
+	s.shareMutex.Lock()
+	defer s.shareMutex.Unlock()
+	use := s.shareUses[linkID]
+	if use.Count >= max {
+		return http.StatusGone, "分享链接下载次数已用完"
+	}
+	use.Count++
+	use.Expires = expires
+	s.shareUses[linkID] = use
+	s.saveShareUsesLocked()
+	return 0, ""
+}
+
+// isDownloadStart 判断请求是否为一次下载的开始：没有 Range 头，或者包含从第 0 字节开始的范围或后缀范围 (bytes=-N)，
+// 视频等媒体的后续分段请求和断点续传不算作新的下载
+func isDownloadStart(r *http.Request) bool {
+	rangeHeader := r.Header.Get("Range")
+	specs, ok := strings.CutPrefix(rangeHeader, "bytes=")
+	if !ok {
+		return true // 没有或无法识别的 Range 头，返回完整文件
+	}
+	for _, spec := range strings.Split(specs, ",") {
+		start, _, _ := strings.Cut(strings.TrimSpace(spec), "-")
+		if start == "" {
+			return true
+		}
+		if n, err := strconv.ParseInt(start, 10, 64); err == nil && n == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// messageFileCache 返回文件或文件夹消息的缓存 UUID，其他消息返回空字符串
+func (s *ClipboardServer) messageFileCache(id int) string {
+	s.messageQueue.Lock()
+	defer s.messageQueue.Unlock()
+	for _, msg := range s.messageQueue.List {
+		if msg.Data.ID() == id && msg.Data.FileReceive != nil {
+			return msg.Data.FileReceive.Cache
+		}
+	}
+	return ""
+}
+
+// shareRedirectQuery 原样传递消息分享链接的参数，供重定向到 /file 或 /folder 时使用，
+// 下载次数限制和有效期仍按原链接计算
+func shareRedirectQuery(q url.Values, id int) url.Values {
+	out := url.Values{}
+	for _, key := range []string{"exp", "max", "lid", "sig"} {
+		if v := q.Get(key); v != "" {
+			out.Set(key, v)
+		}
+	}
+	out.Set("cid", strconv.Itoa(id))
+	return out
+}
+
+// shareTarget 从请求路径中提取分享目标：file 和 folder 为 UUID，content 为消息 ID
+func (s *ClipboardServer) shareTarget(kind string, path string) string {
+	rest := strings.TrimPrefix(path, s.config.Server.Prefix+"/"+kind+"/")
+	if kind == "file" || kind == "folder" {
+		return strings.SplitN(rest, "/", 2)[0]
+	}
+	return strings.TrimSuffix(rest, ".json")
+}
+
+// shareOrAuthMiddleware 携带签名参数的 GET/HEAD 请求按分享链接校验，其他请求走常规认证
+func (s *ClipboardServer) shareOrAuthMiddleware(kind string, next http.HandlerFunc) http.HandlerFunc {
+	authed := s.authMiddleware(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("sig") == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			authed(w, r)
+			return
+		}
+		target := s.shareTarget(kind, r.URL.Path)
+		signedKind, signedTarget := kind, target
+		count := r.Method == http.MethodGet && isDownloadStart(r)
+		if cid := q.Get("cid"); cid != "" && kind != "content" {
+			// 由 /content 分享链接重定向而来：校验原链接的签名，且消息必须指向所请求的文件或文件夹
+			if id, err := strconv.Atoi(cid); err != nil || s.messageFileCache(id) != target {
+				writeJSONError(w, http.StatusForbidden, "Forbidden", "无效的分享链接")
+				return
+			}
+			signedKind, signedTarget = "content", cid
+		} else if kind == "content" {
+			// 文件和文件夹消息会重定向到下载地址，由下载请求计入次数
+			if id, err := strconv.Atoi(target); err == nil && s.messageFileCache(id) != "" {
+				count = false
+			}
+		}
+		if status, message := s.consumeShareLink(signedKind, signedTarget, q, count); status != 0 {
+			s.logf(logAuth, slog.LevelInfo, "分享链接校验失败: %s (%s/%s)。来自 IP: %s", message, kind, target, get_remote_ip(r))
+			writeJSONError(w, status, "Forbidden", message)
+			return
+		}
+		s.logf(logAuth, slog.LevelInfo, "通过分享链接访问: %s/%s, IP: %s", kind, target, get_remote_ip(r))
+		next(w, withAuthInfo(r, &authInfo{Method: "share", Scopes: []string{scopeRead}}))
+	}
+}
+
+// handleShare 为消息生成签名分享链接 (POST /share/{id}?room=&ttl=&max=)
+func (s *ClipboardServer) handleShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅允许 POST 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	idStr := strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/share/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "无效的消息 ID", http.StatusBadRequest)
+		return
+	}
+	room := r.URL.Query().Get("room")
+
+	ttl := int64(s.config.Share.DefaultTTL)
+	if ttlStr := r.URL.Query().Get("ttl"); ttlStr != "" {
+		if ttl, err = strconv.ParseInt(ttlStr, 10, 64); err != nil || ttl <= 0 {
+			http.Error(w, "无效的有效期", http.StatusBadRequest)
+			return
+		}
+	}
+	if s.config.Share.MaxTTL > 0 && ttl > int64(s.config.Share.MaxTTL) {
+		ttl = int64(s.config.Share.MaxTTL)
+	}
+	max := 0
+	if maxStr := r.URL.Query().Get("max"); maxStr != "" {
+		if max, err = strconv.Atoi(maxStr); err != nil || max < 0 {
+			http.Error(w, "无效的下载次数", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var found *ReceiveHolder
+	s.messageQueue.Lock()
+	for _, msg := range s.messageQueue.List {
+		if msg.Data.ID() == id && (room == "" || msg.Data.Room() == "" || msg.Data.Room() == room) {
+			holder := msg.Data
+			found = &holder
+			break
+		}
+	}
+	s.messageQueue.Unlock()
+
+	if found == nil {
+		http.Error(w, "消息未找到", http.StatusNotFound)
+		return
+	}
+	if !s.checkRoomAccess(w, r, found.Room()) {
+		return
+	}
+
+	expires := time.Now().Unix() + ttl
+	var shareURL string
+	if found.FileReceive != nil && found.FileReceive.Type == "folder" {
+		if found.FileReceive.Expire != 0 && expires > found.FileReceive.Expire {
+			expires = found.FileReceive.Expire
+		}
+		q := s.shareQuery("folder", found.FileReceive.Cache, expires, max)
+		shareURL = fmt.Sprintf("%s://%s%s/folder/%s?%s", getScheme(r), getHost(r), s.config.Server.Prefix, found.FileReceive.Cache, q.Encode())
+	} else if found.FileReceive != nil {
+		// 文件过期后链接也随之失效
+		if found.FileReceive.Expire != 0 && expires > found.FileReceive.Expire {
+			expires = found.FileReceive.Expire
+		}
+		uuid := found.FileReceive.Cache
+		q := s.shareQuery("file", uuid, expires, max)
+		shareURL = fmt.Sprintf("%s://%s%s/file/%s/%s?%s", getScheme(r), getHost(r), s.config.Server.Prefix,
+			uuid, url.PathEscape(found.FileReceive.Name), q.Encode())
+	} else {
+		q := s.shareQuery("content", strconv.Itoa(id), expires, max)
+		shareURL = fmt.Sprintf("%s://%s%s/content/%d?%s", getScheme(r), getHost(r), s.config.Server.Prefix, id, q.Encode())
+	}
+
+	s.logf(logAuth, slog.LevelInfo, "已生成分享链接: 消息 ID %d, 有效期至 %d, 最大下载次数 %d, 来自: %s", id, expires, max, get_remote_ip(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":          shareURL,
+		"expires":      expires,
+		"maxDownloads": max,
+	})
+}
@@ -0,0 +1,178 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// noRedirect 返回第一个响应，不跟随重定向
+var noRedirect = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+// 通过消息分享链接访问文件时，重定向沿用原链接的参数，下载次数限制不会被绕过
+func TestContentShareRedirectKeepsLimit(t *testing.T) {
+	s, ts := newTestServer(t, func(cfg *Config) { cfg.Server.Auth = "pw" })
+	id := uploadFile(t, ts, "", "a.txt", []byte("hello"), "Authorization", "Bearer pw")
+	other := uploadFile(t, ts, "", "b.txt", []byte("other"), "Authorization", "Bearer pw")
+
+	q := s.shareQuery("content", id, time.Now().Unix()+60, 2)
+	resp, err := noRedirect.Get(ts.URL + "/content/" + id + "?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || location == nil {
+		t.Fatalf("content: %s", resp.Status)
+	}
+	got := location.Query()
+	for _, key := range []string{"exp", "max", "lid", "sig"} {
+		if got.Get(key) != q.Get(key) {
+			t.Errorf("redirect %s = %q, want %q", key, got.Get(key), q.Get(key))
+		}
+	}
+
+	// 原链接的签名不能用于其他文件
+	otherURL := ts.URL + "/file/" + messageFile(s, other) + "?" + got.Encode()
+	if resp, _ := doRequest(t, http.MethodGet, otherURL, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("other file with redirected link: %s", resp.Status)
+	}
+
+	// 访问 /content 本身不计数，每次下载计数一次
+	for i := 0; i < 2; i++ {
+		if resp, data := doRequest(t, http.MethodGet, ts.URL+"/content/"+id+"?"+q.Encode(), nil); resp.StatusCode != http.StatusOK || string(data) != "hello" {
+			t.Fatalf("download %d: %s %s", i, resp.Status, data)
+		}
+	}
+	if resp, _ := doRequest(t, http.MethodGet, location.String(), nil); resp.StatusCode != http.StatusGone {
+		t.Errorf("download beyond limit: %s", resp.Status)
+	}
+}
+
+// 使用令牌访问 /content 时，重定向地址不包含凭据
+func TestContentRedirectOmitsCredentials(t *testing.T) {
+	_, ts := newTestServer(t, func(cfg *Config) { cfg.Server.Auth = "pw" })
+	id := uploadFile(t, ts, "", "a.txt", []byte("hello"), "Authorization", "Bearer pw")
+
+	resp, err := noRedirect.Get(ts.URL + "/content/" + id + "?auth=pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("content: %s", resp.Status)
+	}
+	if location := resp.Header.Get("Location"); strings.Contains(location, "pw") || strings.Contains(location, "auth=") {
+		t.Errorf("redirect leaks credentials: %s", location)
+	}
+}
+
+func TestIsDownloadStart(t *testing.T) {
+	tests := []struct {
+		rangeHeader string
+		want        bool
+	}{
+		{"", true},
+		{"bytes=0-", true},
+		{"bytes=0-1023", true},
+		{"bytes=00-", true},
+		{"bytes=-500", true}, // 后缀范围可以取得整个文件
+		{"bytes=100-200, 0-10", true},
+		{"items=5-", true}, // 无法识别的单位，返回完整文件
+		{"bytes=1024-", false},
+		{"bytes=1-", false},
+		{"bytes=100-200,300-400", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/file/x", nil)
+		if tt.rangeHeader != "" {
+			r.Header.Set("Range", tt.rangeHeader)
+		}
+		if got := isDownloadStart(r); got != tt.want {
+			t.Errorf("isDownloadStart(%q) = %v, want %v", tt.rangeHeader, got, tt.want)
+		}
+	}
+}
+
+func TestConsumeShareLink(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	now := time.Now().Unix()
+	valid := s.shareQuery("file", "uuid-1", now+60, 0)
+	limited := s.shareQuery("file", "uuid-1", now+60, 2)
+	with := func(q url.Values, key, value string) url.Values {
+		out := url.Values{}
+		for k, v := range q {
+			out[k] = v
+		}
+		out.Set(key, value)
+		return out
+	}
+	tests := []struct {
+		name   string
+		kind   string
+		target string
+		q      url.Values
+		want   int
+	}{
+		{"valid", "file", "uuid-1", valid, 0},
+		{"other target", "file", "uuid-2", valid, http.StatusForbidden},
+		{"other kind", "folder", "uuid-1", valid, http.StatusForbidden},
+		{"tampered signature", "file", "uuid-1", with(valid, "sig", "AAAA"), http.StatusForbidden},
+		{"extended expiry", "file", "uuid-1", with(valid, "exp", strconv.FormatInt(now+3600, 10)), http.StatusForbidden},
+		{"invalid expiry", "file", "uuid-1", with(valid, "exp", "soon"), http.StatusForbidden},
+		{"expired", "file", "uuid-1", s.shareQuery("file", "uuid-1", now-1, 0), http.StatusGone},
+		{"raised limit", "file", "uuid-1", with(limited, "max", "5"), http.StatusForbidden},
+		{"removed limit", "file", "uuid-1", with(limited, "max", ""), http.StatusForbidden},
+		{"negative limit", "file", "uuid-1", with(limited, "max", "-1"), http.StatusForbidden},
+		{"other link id", "file", "uuid-1", with(limited, "lid", "other"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, _ := s.consumeShareLink(tt.kind, tt.target, tt.q, true); status != tt.want {
+				t.Errorf("consumeShareLink = %d, want %d", status, tt.want)
+			}
+		})
+	}
+
+	// 不计数的请求不消耗次数
+	for i := 0; i < 5; i++ {
+		if status, _ := s.consumeShareLink("file", "uuid-1", limited, false); status != 0 {
+			t.Fatalf("uncounted request %d: %d", i, status)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if status, _ := s.consumeShareLink("file", "uuid-1", limited, true); status != 0 {
+			t.Fatalf("download %d: %d", i, status)
+		}
+	}
+	if status, _ := s.consumeShareLink("file", "uuid-1", limited, true); status != http.StatusGone {
+		t.Errorf("download beyond limit: %d", status)
+	}
+}
+
+// 分段请求 (视频拖动、断点续传) 不计入分享链接的下载次数
+func TestShareLinkRangeRequestsNotCounted(t *testing.T) {
+	s, ts := newTestServer(t, func(cfg *Config) { cfg.Server.Auth = "pw" })
+	id := uploadFile(t, ts, "", "a.txt", []byte("0123456789"), "Authorization", "Bearer pw")
+	uuid := messageFile(s, id)
+	link := ts.URL + "/file/" + uuid + "?" + s.shareQuery("file", uuid, time.Now().Unix()+60, 1).Encode()
+
+	if resp, data := doRequest(t, http.MethodGet, link, nil, "Range", "bytes=0-3"); resp.StatusCode != http.StatusPartialContent || string(data) != "0123" {
+		t.Fatalf("first range: %s %q", resp.Status, data)
+	}
+	for i := 0; i < 3; i++ {
+		if resp, data := doRequest(t, http.MethodGet, link, nil, "Range", "bytes=4-"); resp.StatusCode != http.StatusPartialContent || string(data) != "456789" {
+			t.Fatalf("continuation %d: %s %q", i, resp.Status, data)
+		}
+	}
+	if resp, _ := doRequest(t, http.MethodGet, link, nil); resp.StatusCode != http.StatusGone {
+		t.Errorf("second download: %s", resp.Status)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, link, nil, "Range", "bytes=-10"); resp.StatusCode != http.StatusGone {
+		t.Errorf("suffix range after limit: %s", resp.Status)
+	}
+}
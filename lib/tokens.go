@@ -0,0 +1,252 @@
+package lib
+
+/**
+*** FILE: tokens.go
+***   handle scoped API tokens and their management endpoints
+**/
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiTokenPrefix API 令牌的固定前缀，便于在日志和配置中识别
+const apiTokenPrefix = "cct_"
+
+// APIToken 命名的 API 令牌，只保存令牌的 SHA-256 哈希
+type APIToken struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Hash      string   `json:"hash,omitempty"`
+	Scopes    []string `json:"scopes"`
+	Room      string   `json:"room,omitempty"`      // 房间限制，空表示不限制
+	CreatedAt int64    `json:"createdAt"`           // Unix 时间戳
+	ExpiresAt int64    `json:"expiresAt,omitempty"` // 0 表示永不过期
+	LastUsed  int64    `json:"lastUsed,omitempty"`
+}
+
+func (t *APIToken) expired(now int64) bool {
+	return t.ExpiresAt > 0 && t.ExpiresAt < now
+}
+
+func (t *APIToken) authInfo() *authInfo {
+	return &authInfo{
+		Method:  "token",
+		TokenID: t.ID,
+		Name:    t.Name,
+		Scopes:  t.Scopes,
+		Room:    t.Room,
+	}
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *ClipboardServer) loadAPITokens() error {
+	if !pathExists(s.tokensFilePath) {
+		return nil
+	}
+	data, err := os.ReadFile(s.tokensFilePath)
+	if err != nil {
+		return fmt.Errorf("无法读取令牌文件 %s: %w", s.tokensFilePath, err)
+	}
+	var tokens []*APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("无法解析令牌文件 %s: %w", s.tokensFilePath, err)
+	}
+
+	s.apiTokensMutex.Lock()
+	for _, token := range tokens {
+		s.apiTokens[token.Hash] = token
+	}
+	s.apiTokensMutex.Unlock()
+
+	s.logf(logAuth, slog.LevelInfo, "已加载 %d 个 API 令牌", len(tokens))
+	return nil
+}
+
+// saveAPITokensLocked 将令牌写入磁盘，必须在 apiTokensMutex 锁定时调用
+func (s *ClipboardServer) saveAPITokensLocked() {
+	tokens := make([]*APIToken, 0, len(s.apiTokens))
+	for _, token := range s.apiTokens {
+		tokens = append(tokens, token)
+	}
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		s.logf(logAuth, slog.LevelInfo, "序列化 API 令牌时出错: %v", err)
+		return
+	}
+	if err := os.WriteFile(s.tokensFilePath, data, 0600); err != nil {
+		s.logf(logAuth, slog.LevelInfo, "写入令牌文件 %s 时出错: %v", s.tokensFilePath, err)
+	}
+}
+
+// lookupAPIToken 根据明文令牌查找 API 令牌，并记录最后使用时间
+// 返回值 found 表示令牌存在 (即使已过期)
+func (s *ClipboardServer) lookupAPIToken(token string) (info *authInfo, found bool, expired bool) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, false, false
+	}
+	hash := hashAPIToken(token)
+	now := time.Now().Unix()
+
+	s.apiTokensMutex.Lock()
+	defer s.apiTokensMutex.Unlock()
+	apiToken, ok := s.apiTokens[hash]
+	if !ok {
+		return nil, false, false
+	}
+	if apiToken.expired(now) {
+		return nil, true, true
+	}
+	// 最后使用时间最多每分钟写盘一次
+	persist := now-apiToken.LastUsed >= 60
+	apiToken.LastUsed = now
+	if persist {
+		s.saveAPITokensLocked()
+	}
+	return apiToken.authInfo(), true, false
+}
+
+// handleTokens 令牌管理 (GET/POST /admin/tokens, DELETE /admin/tokens/{id})，需要 admin 权限
+func (s *ClipboardServer) handleTokens(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/admin/tokens"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		s.apiTokensMutex.Lock()
+		tokens := make([]APIToken, 0, len(s.apiTokens))
+		for _, token := range s.apiTokens {
+			t := *token
+			t.Hash = "" // 不返回哈希
+			tokens = append(tokens, t)
+		}
+		s.apiTokensMutex.Unlock()
+		sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt < tokens[j].CreatedAt })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"tokens": tokens})
+
+	case r.Method == http.MethodPost && id == "":
+		s.handleCreateToken(w, r)
+
+	case r.Method == http.MethodDelete && id != "":
+		s.apiTokensMutex.Lock()
+		var removed *APIToken
+		for hash, token := range s.apiTokens {
+			if token.ID == id {
+				removed = token
+				delete(s.apiTokens, hash)
+				break
+			}
+		}
+		if removed != nil {
+			s.saveAPITokensLocked()
+		}
+		s.apiTokensMutex.Unlock()
+
+		if removed == nil {
+			http.Error(w, "令牌不存在", http.StatusNotFound)
+			return
+		}
+		s.logf(logAuth, slog.LevelInfo, "已撤销 API 令牌: %s (ID: %s), 来自: %s", removed.Name, removed.ID, get_remote_ip(r))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "令牌已撤销", "id": removed.ID})
+
+	default:
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *ClipboardServer) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		Room      string   `json:"room"`
+		ExpiresIn int64    `json:"expiresIn"` // 有效期 (秒)，0 表示永不过期
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "无效的请求体", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "令牌名称不能为空", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "至少需要一个权限范围", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validScopes[scope] {
+			http.Error(w, fmt.Sprintf("无效的权限范围: %s", scope), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.ExpiresIn < 0 {
+		http.Error(w, "无效的有效期", http.StatusBadRequest)
+		return
+	}
+	if req.Room != "" {
+		req.Room = normalizeRoomName(req.Room)
+	}
+
+	// 新令牌的权限不能超过调用者: 受房间限制的调用者只能为同一房间创建令牌，且不能授予自己没有的权限
+	if caller := authFromRequest(r); caller != nil {
+		if caller.Room != "" && req.Room != caller.Room {
+			s.logf(logAuth, slog.LevelInfo, "拒绝创建 API 令牌: %s 只能为房间 '%s' 创建令牌, 请求的房间: '%s'", caller.describe(), caller.Room, req.Room)
+			http.Error(w, "只能为自己所属的房间创建令牌", http.StatusForbidden)
+			return
+		}
+		for _, scope := range req.Scopes {
+			if !caller.hasScope(scope) {
+				s.logf(logAuth, slog.LevelInfo, "拒绝创建 API 令牌: %s 没有权限 %s", caller.describe(), scope)
+				http.Error(w, fmt.Sprintf("不能授予自己没有的权限范围: %s", scope), http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	plain := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(random_bytes(32))
+	now := time.Now().Unix()
+	apiToken := &APIToken{
+		ID:        gen_UUID(),
+		Name:      req.Name,
+		Hash:      hashAPIToken(plain),
+		Scopes:    req.Scopes,
+		Room:      req.Room,
+		CreatedAt: now,
+	}
+	if req.ExpiresIn > 0 {
+		apiToken.ExpiresAt = now + req.ExpiresIn
+	}
+
+	s.apiTokensMutex.Lock()
+	s.apiTokens[apiToken.Hash] = apiToken
+	s.saveAPITokensLocked()
+	s.apiTokensMutex.Unlock()
+
+	s.logf(logAuth, slog.LevelInfo, "已创建 API 令牌: %s (ID: %s, 权限: %v, 房间: '%s'), 来自: %s",
+		apiToken.Name, apiToken.ID, apiToken.Scopes, apiToken.Room, get_remote_ip(r))
+
+	response := *apiToken
+	response.Hash = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token": plain, // 明文令牌只返回这一次
+		"info":  response,
+	})
+}
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 受房间限制的管理令牌只能为同一房间创建令牌
+func TestCreateTokenRoomRestricted(t *testing.T) {
+	_, ts := newTestServer(t, func(cfg *Config) { cfg.Server.Auth = "pw" })
+	createToken := func(body, bearer string) (int, string) {
+		resp, data := doRequest(t, http.MethodPost, ts.URL+"/admin/tokens", strings.NewReader(body), "Authorization", "Bearer "+bearer)
+		var created struct{ Token string }
+		json.Unmarshal(data, &created)
+		return resp.StatusCode, created.Token
+	}
+	status, roomAdmin := createToken(`{"name":"room-admin","scopes":["admin"],"room":"a"}`, "pw")
+	if status != http.StatusCreated {
+		t.Fatalf("create room admin token: %d", status)
+	}
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"name":"same room","scopes":["read"],"room":"a"}`, http.StatusCreated},
+		{`{"name":"same room admin","scopes":["admin"],"room":"a"}`, http.StatusCreated},
+		{`{"name":"other room","scopes":["read"],"room":"b"}`, http.StatusForbidden},
+		{`{"name":"all rooms","scopes":["read"]}`, http.StatusForbidden},
+		{`{"name":"all rooms admin","scopes":["admin"],"room":""}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if status, _ := createToken(tt.body, roomAdmin); status != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.body, status, tt.want)
+		}
+	}
+}
+
+// 新令牌不能包含调用者没有的权限范围
+func TestCreateTokenScopesLimitedToCaller(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	caller := &authInfo{Method: "token", TokenID: "t1", Name: "writer", Scopes: []string{"read", "write"}}
+	tests := []struct {
+		scopes string
+		want   int
+	}{
+		{`["read"]`, http.StatusCreated},
+		{`["read","write"]`, http.StatusCreated},
+		{`["delete"]`, http.StatusForbidden},
+		{`["read","admin"]`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/admin/tokens", strings.NewReader(`{"name":"new","scopes":`+tt.scopes+`}`))
+		w := httptest.NewRecorder()
+		s.handleCreateToken(w, withAuthInfo(r, caller))
+		if w.Code != tt.want {
+			t.Errorf("scopes %s: status %d, want %d", tt.scopes, w.Code, tt.want)
+		}
+	}
+	s.apiTokensMutex.Lock()
+	defer s.apiTokensMutex.Unlock()
+	for _, token := range s.apiTokens {
+		for _, scope := range token.Scopes {
+			if !caller.hasScope(scope) {
+				t.Errorf("token %s created with scope %s", token.Name, scope)
+			}
+		}
+	}
+}
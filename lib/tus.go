@@ -0,0 +1,404 @@
+package lib
+
+/**
+*** FILE: tus.go
+***   handle the tus 1.0 resumable upload protocol (creation, termination and checksum extensions)
+**/
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tusVersion            = "1.0.0"
+	tusExtensions         = "creation,creation-with-upload,termination,checksum"
+	tusChecksumAlgorithms = "sha1,md5,sha256,sha512"
+	tusContentType        = "application/offset+octet-stream"
+	tusExposeHeaders      = "Location, Upload-Offset, Upload-Length, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Tus-Checksum-Algorithm"
+
+	statusChecksumMismatch = 460 // tus checksum 扩展定义的状态码
+)
+
+// tusUpload 进行中的 tus 上传，完成后移除
+type tusUpload struct {
+	sync.Mutex
+	Length int64 // 声明的总长度
+	Offset int64 // 已接收的字节数
+}
+
+// newTusHasher 按 Upload-Checksum 的算法名称创建哈希
+func newTusHasher(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha1":
+		return sha1.New()
+	case "md5":
+		return md5.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// parseTusMetadata 解析 Upload-Metadata 头: "key base64value,key2 base64value2"，值可以省略
+func parseTusMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		meta[key] = string(decoded)
+	}
+	return meta
+}
+
+// tusRoute 返回 tus 路由：OPTIONS 用于能力发现，无需认证；其余请求需要 write 权限
+func (s *ClipboardServer) tusRoute() http.HandlerFunc {
+	authed := s.scopedAuthMiddleware(scopeWrite, s.handleTus)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		w.Header().Set("Access-Control-Expose-Headers", tusExposeHeaders)
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.Header().Set("Tus-Extension", tusExtensions)
+			w.Header().Set("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+			if s.config.File.Limit > 0 {
+				w.Header().Set("Tus-Max-Size", strconv.Itoa(s.config.File.Limit))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		authed(w, r)
+	}
+}
+
+// handleTus 处理 tus 请求: POST /upload/tus 创建上传，HEAD/PATCH/DELETE /upload/tus/{uuid}
+func (s *ClipboardServer) handleTus(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "不支持的 tus 协议版本", http.StatusPreconditionFailed)
+		return
+	}
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && method == http.MethodPost {
+		method = strings.ToUpper(override)
+	}
+
+	uuid := strings.Trim(strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/upload/tus"), "/")
+	switch {
+	case uuid == "" && method == http.MethodPost:
+		s.handleTusCreate(w, r)
+	case uuid != "" && method == http.MethodHead:
+		s.handleTusHead(w, r, uuid)
+	case uuid != "" && method == http.MethodPatch:
+		s.handleTusPatch(w, r, uuid)
+	case uuid != "" && method == http.MethodDelete:
+		s.handleTusTerminate(w, r, uuid)
+	default:
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+	}
+}
+
+// lookupTusUpload 返回进行中的上传及其文件信息；文件已过期或被删除时清除上传状态
+func (s *ClipboardServer) lookupTusUpload(uuid string) (*tusUpload, File, bool) {
+	s.runMutex.Lock()
+	fileInfo, exists := s.uploadFileMap[uuid]
+	s.runMutex.Unlock()
+
+	s.tusMutex.Lock()
+	defer s.tusMutex.Unlock()
+	upload, ok := s.tusUploads[uuid]
+	if ok && !exists {
+		delete(s.tusUploads, uuid)
+		return nil, File{}, false
+	}
+	return upload, fileInfo, ok
+}
+
+func (s *ClipboardServer) handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "不支持 Upload-Defer-Length", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "无效的 Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if s.config.File.Limit > 0 && length > int64(s.config.File.Limit) {
+		http.Error(w, fmt.Sprintf("文件大小超出限制 (最大 %d 字节)", s.config.File.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	meta := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+	if name == "" {
+		name = "file"
+	}
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		room = meta["room"]
+	}
+	if room == "" {
+		room = "default"
+	}
+	if !s.checkRoomAccess(w, r, room) || !s.checkRateLimit(w, r, limitMessage, room, 1) {
+		return
+	}
+	expire := r.URL.Query().Get("expire")
+	if expire == "" {
+		expire = meta["expire"]
+	}
+	ttl, ok := s.uploadTTL(w, r, expire)
+	if !ok {
+		return
+	}
+
+	uuid := gen_UUID()
+	file, err := os.OpenFile(filepath.Join(s.storageFolder, uuid), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		s.logf(logFile, slog.LevelError, "错误: 创建 tus 上传文件失败: %v", err)
+		http.Error(w, "无法创建文件", http.StatusInternalServerError)
+		return
+	}
+	file.Close()
+
+	now := time.Now().Unix()
+	s.runMutex.Lock()
+	s.uploadFileMap[uuid] = File{
+		Name:       name,
+		UUID:       uuid,
+		Size:       0,
+		UploadTime: now,
+		ExpireTime: expireAfter(ttl),
+		Room:       room,
+	}
+	s.runMutex.Unlock()
+	upload := &tusUpload{Length: length}
+	s.tusMutex.Lock()
+	s.tusUploads[uuid] = upload
+	s.tusMutex.Unlock()
+	s.logf(logFile, slog.LevelInfo, "创建 tus 上传: %s, 长度: %d, UUID: %s, 房间: %s", name, length, uuid, room)
+
+	w.Header().Set("Location", fmt.Sprintf("%s://%s%s/upload/tus/%s", getScheme(r), getHost(r), s.config.Server.Prefix, uuid))
+
+	// creation-with-upload: 创建请求中可以直接携带第一段数据
+	if r.Header.Get("Content-Type") == tusContentType && r.ContentLength != 0 {
+		upload.Lock()
+		defer upload.Unlock()
+		if !s.writeTusData(w, r, uuid, upload) {
+			return
+		}
+	}
+	if upload.Offset == upload.Length {
+		if _, ok := s.completeTusUpload(w, r, uuid, upload); !ok {
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *ClipboardServer) handleTusHead(w http.ResponseWriter, r *http.Request, uuid string) {
+	w.Header().Set("Cache-Control", "no-store")
+	upload, fileInfo, ok := s.lookupTusUpload(uuid)
+	if !ok {
+		// 已完成的上传：偏移量等于文件大小
+		s.runMutex.Lock()
+		fileInfo, ok = s.uploadFileMap[uuid]
+		s.runMutex.Unlock()
+		if !ok {
+			http.Error(w, "上传不存在或已过期", http.StatusNotFound)
+			return
+		}
+		if !s.checkRoomAccess(w, r, fileInfo.Room) {
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(fileInfo.Size, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(fileInfo.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !s.checkRoomAccess(w, r, fileInfo.Room) {
+		return
+	}
+	upload.Lock()
+	offset, length := upload.Offset, upload.Length
+	upload.Unlock()
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *ClipboardServer) handleTusPatch(w http.ResponseWriter, r *http.Request, uuid string) {
+	upload, fileInfo, ok := s.lookupTusUpload(uuid)
+	if !ok {
+		http.Error(w, "上传不存在或已完成", http.StatusNotFound)
+		return
+	}
+	if !s.checkRoomAccess(w, r, fileInfo.Room) {
+		return
+	}
+	if r.Header.Get("Content-Type") != tusContentType {
+		http.Error(w, "Content-Type 必须为 "+tusContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	if !upload.TryLock() {
+		http.Error(w, "该上传正在被另一个请求写入", http.StatusLocked)
+		return
+	}
+	defer upload.Unlock()
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "无效的 Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, "Upload-Offset 与服务器上的偏移量不一致", http.StatusConflict)
+		return
+	}
+	if !s.writeTusData(w, r, uuid, upload) {
+		return
+	}
+	if upload.Offset == upload.Length {
+		if _, ok := s.completeTusUpload(w, r, uuid, upload); !ok {
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeTusData 将请求体写入上传文件的当前偏移量处，调用方需持有 upload 的锁
+// 携带 Upload-Checksum 时，校验失败或数据不完整都会丢弃本次写入的数据
+func (s *ClipboardServer) writeTusData(w http.ResponseWriter, r *http.Request, uuid string, upload *tusUpload) bool {
+	var hasher hash.Hash
+	var expected []byte
+	if checksum := r.Header.Get("Upload-Checksum"); checksum != "" {
+		algorithm, value, _ := strings.Cut(checksum, " ")
+		hasher = newTusHasher(strings.ToLower(algorithm))
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if hasher == nil || err != nil {
+			http.Error(w, "不支持的校验算法或无效的 Upload-Checksum", http.StatusBadRequest)
+			return false
+		}
+		expected = decoded
+	}
+
+	remaining := upload.Length - upload.Offset
+	if r.ContentLength > remaining {
+		http.Error(w, "数据超出声明的 Upload-Length", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	s.runMutex.Lock()
+	room := s.uploadFileMap[uuid].Room
+	s.runMutex.Unlock()
+	if r.ContentLength > 0 && !s.checkRateLimit(w, r, limitUpload, room, float64(r.ContentLength)) {
+		return false
+	}
+
+	filePath := filepath.Join(s.storageFolder, uuid)
+	file, err := os.OpenFile(filePath, os.O_WRONLY, 0644)
+	if err != nil {
+		s.logf(logFile, slog.LevelError, "错误: 打开文件 %s 失败: %v", filePath, err)
+		http.Error(w, "无法打开文件", http.StatusInternalServerError)
+		return false
+	}
+	defer file.Close()
+
+	var body io.Reader = io.LimitReader(r.Body, remaining)
+	if hasher != nil {
+		body = io.TeeReader(body, hasher)
+	}
+	written, copyErr := io.Copy(io.NewOffsetWriter(file, upload.Offset), body)
+
+	if hasher != nil && (copyErr != nil || string(hasher.Sum(nil)) != string(expected)) {
+		file.Truncate(upload.Offset)
+		if copyErr != nil {
+			s.logf(logFile, slog.LevelWarn, "警告: tus 上传 %s 的数据不完整，已丢弃: %v", uuid, copyErr)
+			http.Error(w, "读取数据失败", http.StatusBadRequest)
+		} else {
+			s.logf(logFile, slog.LevelWarn, "警告: tus 上传 %s 的校验和不一致，已丢弃 %d 字节", uuid, written)
+			http.Error(w, "校验和不一致", statusChecksumMismatch)
+		}
+		return false
+	}
+
+	// 没有校验和时保留已收到的部分，客户端可以从新的偏移量继续
+	upload.Offset += written
+	s.runMutex.Lock()
+	if fileInfo, ok := s.uploadFileMap[uuid]; ok {
+		fileInfo.Size = upload.Offset
+		s.uploadFileMap[uuid] = fileInfo
+	}
+	s.runMutex.Unlock()
+	if copyErr != nil {
+		s.logf(logFile, slog.LevelWarn, "警告: tus 上传 %s 中断于偏移量 %d: %v", uuid, upload.Offset, copyErr)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, "读取数据失败", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// completeTusUpload 上传完成后移除 tus 状态并发布文件消息
+func (s *ClipboardServer) completeTusUpload(w http.ResponseWriter, r *http.Request, uuid string, upload *tusUpload) (PostEvent, bool) {
+	s.tusMutex.Lock()
+	delete(s.tusUploads, uuid)
+	s.tusMutex.Unlock()
+
+	s.runMutex.Lock()
+	fileInfo, ok := s.uploadFileMap[uuid]
+	s.runMutex.Unlock()
+	if !ok {
+		http.Error(w, "上传不存在或已过期", http.StatusNotFound)
+		return PostEvent{}, false
+	}
+	fileInfo.Size = upload.Length
+	return s.finalizeUploadedFile(w, r, fileInfo)
+}
+
+func (s *ClipboardServer) handleTusTerminate(w http.ResponseWriter, r *http.Request, uuid string) {
+	upload, fileInfo, ok := s.lookupTusUpload(uuid)
+	if !ok {
+		http.Error(w, "上传不存在或已完成", http.StatusNotFound)
+		return
+	}
+	if !s.checkRoomAccess(w, r, fileInfo.Room) {
+		return
+	}
+	upload.Lock()
+	defer upload.Unlock()
+	s.tusMutex.Lock()
+	delete(s.tusUploads, uuid)
+	s.tusMutex.Unlock()
+	s.deleteUploadedFile(uuid)
+	s.logf(logFile, slog.LevelInfo, "已终止 tus 上传: %s (UUID: %s)", fileInfo.Name, uuid)
+	w.WriteHeader(http.StatusNoContent)
+}
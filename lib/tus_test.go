@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		header string
+		want   map[string]string
+	}{
+		{"", map[string]string{}},
+		{"filename " + b64("a b.txt") + ",room " + b64("r1"), map[string]string{"filename": "a b.txt", "room": "r1"}},
+		{"is_confidential", map[string]string{"is_confidential": ""}},
+		{"filename !!!,room " + b64("r1"), map[string]string{"room": "r1"}},
+	}
+	for _, tt := range tests {
+		if got := parseTusMetadata(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTusMetadata(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+// tusRequest 发送带 Tus-Resumable 头的请求
+func tusRequest(t *testing.T, method, url string, body []byte, headers ...string) *http.Response {
+	t.Helper()
+	resp, _ := doRequest(t, method, url, bytes.NewReader(body), append([]string{"Tus-Resumable", tusVersion}, headers...)...)
+	return resp
+}
+
+func countFileMessages(s *ClipboardServer, uuid string) int {
+	s.messageQueue.Lock()
+	defer s.messageQueue.Unlock()
+	n := 0
+	for _, msg := range s.messageQueue.List {
+		if msg.Data.FileReceive != nil && msg.Data.FileReceive.Cache == uuid {
+			n++
+		}
+	}
+	return n
+}
+
+func TestTusUpload(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	data := []byte("hello, resumable world")
+
+	resp := tusRequest(t, http.MethodPost, ts.URL+"/upload/tus", nil,
+		"Upload-Length", strconv.Itoa(len(data)), "Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("hello.txt")))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: %s", resp.Status)
+	}
+	location := resp.Header.Get("Location")
+	uuid := path.Base(location)
+
+	// 未完成的 tus 上传不能通过 /upload/finish 发布
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/upload/finish/"+uuid, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("finish during tus upload: %s", resp.Status)
+	}
+
+	// 偏移量不一致
+	if resp := tusRequest(t, http.MethodPatch, location, data[:5], "Content-Type", tusContentType, "Upload-Offset", "3"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("patch with wrong offset: %s", resp.Status)
+	}
+	// 校验和不一致的数据被丢弃
+	sum := sha1.Sum([]byte("other"))
+	resp = tusRequest(t, http.MethodPatch, location, data[:5], "Content-Type", tusContentType, "Upload-Offset", "0",
+		"Upload-Checksum", "sha1 "+base64.StdEncoding.EncodeToString(sum[:]))
+	if resp.StatusCode != statusChecksumMismatch {
+		t.Errorf("patch with bad checksum: %s", resp.Status)
+	}
+
+	sum = sha1.Sum(data[:5])
+	resp = tusRequest(t, http.MethodPatch, location, data[:5], "Content-Type", tusContentType, "Upload-Offset", "0",
+		"Upload-Checksum", "sha1 "+base64.StdEncoding.EncodeToString(sum[:]))
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != "5" {
+		t.Fatalf("first patch: %s offset %s", resp.Status, resp.Header.Get("Upload-Offset"))
+	}
+	if resp := tusRequest(t, http.MethodHead, location, nil); resp.Header.Get("Upload-Offset") != "5" {
+		t.Errorf("head offset = %s", resp.Header.Get("Upload-Offset"))
+	}
+	// 超出声明长度的数据
+	if resp := tusRequest(t, http.MethodPatch, location, append(data[5:], 'x'), "Content-Type", tusContentType, "Upload-Offset", "5"); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("patch beyond length: %s", resp.Status)
+	}
+	resp = tusRequest(t, http.MethodPatch, location, data[5:], "Content-Type", tusContentType, "Upload-Offset", "5")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != strconv.Itoa(len(data)) {
+		t.Fatalf("final patch: %s offset %s", resp.Status, resp.Header.Get("Upload-Offset"))
+	}
+	if n := countFileMessages(s, uuid); n != 1 {
+		t.Fatalf("published %d messages, want 1", n)
+	}
+
+	// 已发布的文件不能再次发布
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/upload/finish/"+uuid, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("finish after tus completion: %s", resp.Status)
+	}
+	if n := countFileMessages(s, uuid); n != 1 {
+		t.Errorf("published %d messages after finish, want 1", n)
+	}
+	if _, body := doRequest(t, http.MethodGet, ts.URL+"/file/"+uuid, nil); !bytes.Equal(body, data) {
+		t.Errorf("file content = %q", body)
+	}
+}
+
+func TestTusTerminate(t *testing.T) {
+	s, ts := newTestServer(t, nil)
+	resp := tusRequest(t, http.MethodPost, ts.URL+"/upload/tus", nil, "Upload-Length", "10")
+	location := resp.Header.Get("Location")
+	if resp := tusRequest(t, http.MethodDelete, location, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("terminate: %s", resp.Status)
+	}
+	s.runMutex.Lock()
+	_, exists := s.uploadFileMap[path.Base(location)]
+	s.runMutex.Unlock()
+	if exists {
+		t.Error("terminated upload still in file map")
+	}
+	if resp := tusRequest(t, http.MethodHead, location, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("head after terminate: %s", resp.Status)
+	}
+}
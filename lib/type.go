@@ -1,7 +1,9 @@
 package lib
 
 import (
-	"log"
+	"crypto/x509"
+	"log/slog"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -29,7 +31,7 @@ type PostList struct {
 	sync.Mutex
 	nextid      int
 	history_len int
-	logger      *log.Logger // 新增：用于记录日志
+	logger      *slog.Logger // 用于记录淘汰消息的日志
 
 	List []PostEvent `json:"receive"`
 }
@@ -60,12 +62,14 @@ type DeviceMeta struct {
 type ClipboardServer struct {
 	config          *Config
 	httpServer      *http.Server
-	logger          *log.Logger
+	slog            *slog.Logger // 根日志记录器
+	subLoggers      sync.Map     // 子系统名称 -> *slog.Logger
 	messageQueue    *PostList
 	websockets      map[*websocket.Conn]bool
 	room_ws         map[*websocket.Conn]string
-	uploadFileMap   map[string]File       // 从 history.go 的全局变量迁移过来
-	deviceConnected map[string]DeviceMeta // 更改为将 deviceID 映射到 DeviceMeta
+	wsWriteLocks    map[*websocket.Conn]*sync.Mutex // 每个连接的写入锁，gorilla/websocket 同一连接只允许一个写入者
+	uploadFileMap   map[string]File                 // 从 history.go 的全局变量迁移过来
+	deviceConnected map[string]DeviceMeta           // 更改为将 deviceID 映射到 DeviceMeta
 	storageFolder   string
 	historyFilePath string
 	isRunning       bool
@@ -78,6 +82,56 @@ type ClipboardServer struct {
 	roomStats         map[string]*RoomStat `json:"-"` // 房间统计信息，不序列化
 	roomStatsMutex    sync.RWMutex         `json:"-"` // 房间统计读写锁
 	roomCleanupTicker *time.Ticker         `json:"-"` // 房间清理定时器
+
+	// 私有房间
+	privateRooms      map[string]PrivateRoom // 房间名 -> 私有房间信息
+	privateRoomsMutex sync.RWMutex
+	roomsFilePath     string
+
+	// API 令牌
+	apiTokens      map[string]*APIToken // 令牌哈希 -> 令牌信息
+	apiTokensMutex sync.Mutex
+	tokensFilePath string
+
+	// 签名分享链接
+	shareSecret []byte
+	shareUses   map[string]shareUse // 链接 ID -> 使用情况
+	shareMutex  sync.Mutex
+
+	sessions      map[string]*Session // 登录会话，键为会话 ID 的哈希
+	sessionsMutex sync.Mutex
+
+	auditLog  *rotatingWriter // 审计日志，未启用时为 nil
+	access    *accessControl  // 按 IP 的访问控制
+	oidc      *oidcProvider   // 单点登录，未启用时为 nil
+	clientCAs *x509.CertPool  // mTLS 客户端 CA，未启用时为 nil
+
+	certReloader  *certReloader // 服务器证书，未启用 HTTPS 时为 nil
+	autoCert      bool          // 是否使用自动生成的自签名证书
+	certWatchStop chan struct{} // 关闭后证书监视任务退出，未运行时为 nil
+
+	tusUploads map[string]*tusUpload // 进行中的 tus 上传: UUID -> 状态
+	tusMutex   sync.Mutex
+
+	chunkUploads map[string]*chunkUpload // 进行中的分块上传: UUID -> 已接收的区间
+	chunkMutex   sync.Mutex
+
+	folderUploads map[string]*folderUpload // 进行中的文件夹上传: UUID -> 已上传的条目
+	folderMutex   sync.Mutex
+
+	fetchClient  *http.Client // 服务器下载 (POST /upload/url) 使用的客户端
+	fetchAllowed []*net.IPNet // 服务器下载允许访问的内网地址
+	fetchTasks   sync.Map     // 进行中的服务器下载: UUID -> *fetchTask
+
+	uploadReporters sync.Map // 进行中的上传的进度跟踪: UUID -> *progressReporter
+
+	rateLimiter *rateLimiter // 限流令牌桶
+	authGuard   *authGuard   // 认证失败跟踪与锁定
+
+	trustedProxies  []*net.IPNet // 受信任的反向代理
+	forwardedHeader string       // 采用的转发头，见 proxy.go
+	cors            *corsPolicy  // 跨域策略
+	upgrader        websocket.Upgrader
 }
 
 // file item in File[]
@@ -87,6 +141,9 @@ type File struct {
 	Size       int64  `json:"size"`
 	UploadTime int64  `json:"uploadTime"`
 	ExpireTime int64  `json:"expireTime"`
+	Room       string `json:"room,omitempty"`   // 文件所属房间，用于私有房间的访问控制
+	MIME       string `json:"mime,omitempty"`   // 根据文件内容嗅探得到的 MIME 类型
+	Digest     string `json:"digest,omitempty"` // 文件摘要 "sha256:<hex>"
 }
 
 // History represents the entire JSON structure
@@ -101,9 +158,10 @@ type ReceiveBase struct {
 	ID           int               `json:"id"`
 	Type         string            `json:"type"`
 	Room         string            `json:"room"`
-	Timestamp    int64             `json:"timestamp"`    // Unix timestamp (seconds)
-	SenderIP     string            `json:"senderIP"`     // 发送者 IP 地址
-	SenderDevice map[string]string `json:"senderDevice"` // 发送者设备信息 (来自 User-Agent 解析)
+	Timestamp    int64             `json:"timestamp"`            // Unix timestamp (seconds)
+	SenderIP     string            `json:"senderIP"`             // 发送者 IP 地址
+	SenderDevice map[string]string `json:"senderDevice"`         // 发送者设备信息 (来自 User-Agent 解析)
+	SenderUser   string            `json:"senderUser,omitempty"` // 发送者的单点登录身份
 }
 
 // "text" type item in Receive[]
@@ -123,12 +181,26 @@ type FileReceive struct {
 	Cache       string `json:"cache"` // Cache 通常就是 UUID
 	Expire      int64  `json:"expire"`
 	Thumbnail   string `json:"thumbnail"`
-	URL         string `json:"url,omitempty"` // 新增 URL 字段
+	URL         string `json:"url,omitempty"`        // 新增 URL 字段
+	ScanStatus  string `json:"scanStatus,omitempty"` // 恶意文件扫描结果: clean, skipped, error；未启用扫描时为空
+	MIME        string `json:"mime,omitempty"`       // 根据文件内容嗅探得到的 MIME 类型
+	Digest      string `json:"digest,omitempty"`     // 文件摘要 "sha256:<hex>"，下载时作为 Digest 和 ETag 响应头
+	// "folder" 类型的消息：Name 为文件夹名，Size 为总大小，Cache 为文件夹的 UUID
+	Entries []FolderEntry `json:"entries,omitempty"`
 	// 也可以在这里为设备事件添加字段以保持对称性，如果需要的话
 	// DeviceConnection *DeviceMeta `json:"deviceConnection,omitempty"`
 	// DeviceID         string      `json:"deviceID,omitempty"`
 }
 
+// FolderEntry 文件夹中的一个文件，文件本身与普通上传一样记录在 uploadFileMap 中
+type FolderEntry struct {
+	Path   string `json:"path"` // 相对于文件夹的路径，使用 / 分隔
+	UUID   string `json:"uuid"`
+	Size   int64  `json:"size"`
+	MIME   string `json:"mime,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
 // holds either a TextReceive or a FileReceive
 type ReceiveHolder struct {
 	TextReceive *TextReceive
@@ -143,6 +215,7 @@ type RoomInfo struct {
 	DeviceCount  int    `json:"deviceCount"`  // 设备数量
 	LastActive   int64  `json:"lastActive"`   // 最后活跃时间（Unix时间戳）
 	IsActive     bool   `json:"isActive"`     // 是否活跃（有设备连接）
+	Private      bool   `json:"private"`      // 是否为私有房间
 }
 
 // RoomListResponse 房间列表响应结构体
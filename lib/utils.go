@@ -145,9 +145,12 @@ func pathExists(path string) bool {
 }
 
 func DetermineResponseType(filename string) string {
+	return responseTypeForMIME(mime.TypeByExtension(filepath.Ext(filename)))
+}
+
+// responseTypeForMIME 将 MIME 类型归类为 image、text、audio、video、document、archive 或 file
+func responseTypeForMIME(mimeType string) string {
 	responseType := "file" // Default type
-	fileExtension := filepath.Ext(filename)
-	mimeType := mime.TypeByExtension(fileExtension)
 
 	if mimeType != "" {
 		if strings.HasPrefix(mimeType, "image/") {
@@ -164,7 +167,12 @@ func DetermineResponseType(filename string) string {
 			strings.HasPrefix(mimeType, "application/x-rar-compressed") ||
 			strings.HasPrefix(mimeType, "application/x-tar") ||
 			strings.HasPrefix(mimeType, "application/x-7z-compressed") ||
-			strings.HasPrefix(mimeType, "application/gzip") {
+			strings.HasPrefix(mimeType, "application/gzip") ||
+			strings.HasPrefix(mimeType, "application/x-gzip") ||
+			strings.HasPrefix(mimeType, "application/vnd.rar") ||
+			strings.HasPrefix(mimeType, "application/x-bzip2") ||
+			strings.HasPrefix(mimeType, "application/x-xz") ||
+			strings.HasPrefix(mimeType, "application/zstd") {
 			responseType = "archive"
 		} else if strings.Contains(mimeType, "word") || // application/msword, application/vnd.openxmlformats-officedocument.wordprocessingml.document
 			strings.Contains(mimeType, "excel") || // application/vnd.ms-excel, application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
@@ -195,7 +203,7 @@ func (r *ReceiveHolder) UnmarshalJSON(data []byte) error {
 			return err
 		}
 		r.TextReceive = &textReceive
-	case "file":
+	case "file", "folder":
 		var fileReceive FileReceive
 		if err := json.Unmarshal(data, &fileReceive); err != nil {
 			return err
@@ -307,32 +315,71 @@ func (s *ClipboardServer) parse_user_agent(uaString string) map[string]string {
 	}
 }
 
-// get_remote_ip(r *http.Request) (保持不变)
+// get_remote_ip 返回客户端 IP，转发头只在来自受信任代理时才会被采用 (见 proxy.go)
 func get_remote_ip(r *http.Request) string {
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		ip = r.Header.Get("X-Real-IP")
-	}
-	if ip == "" {
-		remoteAddr := r.RemoteAddr
-		host, _, err := net.SplitHostPort(remoteAddr)
-		if err == nil {
-			ip = host
-		} else {
-			ip = remoteAddr
-		}
-	}
-	ips := strings.Split(ip, ",")
-	if len(ips) > 0 {
-		ip = strings.TrimSpace(ips[0])
+	if info, ok := r.Context().Value(clientInfoContextKey{}).(clientInfo); ok {
+		return info.IP
 	}
-	return ip
+	return stripHostPort(r.RemoteAddr)
 }
 
-// getScheme (保持不变)
+// getScheme 返回客户端使用的协议，X-Forwarded-Proto/Forwarded 只在来自受信任代理时才会被采用
 func getScheme(r *http.Request) string {
-	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+	if info, ok := r.Context().Value(clientInfoContextKey{}).(clientInfo); ok {
+		return info.Scheme
+	}
+	if r.TLS != nil {
 		return "https"
 	}
 	return "http"
 }
+
+// getHost 返回客户端请求的主机，X-Forwarded-Host/Forwarded 只在来自受信任代理时才会被采用
+func getHost(r *http.Request) string {
+	if info, ok := r.Context().Value(clientInfoContextKey{}).(clientInfo); ok {
+		return info.Host
+	}
+	return r.Host
+}
+
+// parseCIDRList 解析 IP/CIDR 列表，单个 IP 视为 /32 (IPv4) 或 /128 (IPv6)
+func parseCIDRList(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("无效的 IP 地址: %s", item)
+			}
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("无效的 CIDR: %s", item)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// ipInNets 判断 IP 是否属于任一网段
+func ipInNets(ipStr string, nets []*net.IPNet) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}